@@ -0,0 +1,168 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// afpacketPollTimeout bounds how long a reader waits for a packet before checking whether it was closed.
+const afpacketPollTimeout = 100 * time.Millisecond
+
+// afpacketSource reads TPACKET_V3 rings of AF_PACKET sockets. With more than one socket they join a fanout
+// group hashing on the flow, so the kernel hands every packet of a connection to the same socket. Each socket
+// has its own reader and the packets of a connection keep their order.
+type afpacketSource struct {
+	sockets []*afpacket.TPacket
+	frames  chan capturedFrame
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+type capturedFrame struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	err  error
+}
+
+// openAFPacket opens the AF_PACKET sockets on the device, or on every interface when it is empty.
+func openAFPacket(device string) (packetSource, error) {
+	filter, err := compileFilter(layers.LinkTypeEthernet)
+	if err != nil {
+		return nil, err
+	}
+	fanout := afpacketFanout
+	if fanout < 1 {
+		fanout = 1
+	}
+	s := &afpacketSource{frames: make(chan capturedFrame, 1024), stop: make(chan struct{})}
+	for i := 0; i < fanout; i++ {
+		opts := []interface{}{
+			afpacket.OptFrameSize(afpacketFrameSize),
+			afpacket.OptBlockSize(afpacketBlockSize),
+			afpacket.OptNumBlocks(afpacketBlocks),
+			afpacket.OptPollTimeout(afpacketPollTimeout),
+			afpacket.TPacketVersion3,
+		}
+		if device != "" {
+			opts = append(opts, afpacket.OptInterface(device))
+		}
+		socket, err := afpacket.NewTPacket(opts...)
+		if err != nil {
+			s.closeSockets()
+			return nil, fmt.Errorf("failed to open AF_PACKET socket: %v", err)
+		}
+		s.sockets = append(s.sockets, socket)
+		if err := socket.SetBPF(filter); err != nil {
+			s.closeSockets()
+			return nil, fmt.Errorf("failed to set the capture filter: %v", err)
+		}
+		if fanout > 1 {
+			// The group is per process so two zkpackets on the same host don't share their traffic
+			if err := socket.SetFanout(afpacket.FanoutHash, uint16(os.Getpid())); err != nil {
+				s.closeSockets()
+				return nil, fmt.Errorf("failed to join the fanout group: %v", err)
+			}
+		}
+	}
+	for _, socket := range s.sockets {
+		s.wg.Add(1)
+		go s.read(socket)
+	}
+	go func() {
+		s.wg.Wait()
+		close(s.frames)
+	}()
+	return s, nil
+}
+
+// compileFilter compiles the capture filter for sockets of the link type. The filter also cuts packets to
+// the snapshot length.
+func compileFilter(linkType layers.LinkType) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(linkType, int(snapshotLen), captureFilter())
+	if err != nil {
+		return nil, err
+	}
+	filter := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		filter[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return filter, nil
+}
+
+func (s *afpacketSource) read(socket *afpacket.TPacket) {
+	defer s.wg.Done()
+	for {
+		// The ring is reused once the next packet is read so the data is copied
+		data, ci, err := socket.ReadPacketData()
+		if err == afpacket.ErrTimeout {
+			select {
+			case <-s.stop:
+				return
+			default:
+				continue
+			}
+		}
+		select {
+		case s.frames <- capturedFrame{data: data, ci: ci, err: err}:
+		case <-s.stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadPacketData returns the next packet of any socket.
+func (s *afpacketSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	f, ok := <-s.frames
+	if !ok {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	return f.data, f.ci, f.err
+}
+
+func (s *afpacketSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// Stats adds up the counters of the sockets. AF_PACKET does not count interface drops.
+func (s *afpacketSource) Stats() (captureStats, error) {
+	var total captureStats
+	for _, socket := range s.sockets {
+		_, stats, err := socket.SocketStats()
+		if err != nil {
+			return captureStats{}, err
+		}
+		total.received += uint64(stats.Packets())
+		total.dropped += uint64(stats.Drops())
+	}
+	return total, nil
+}
+
+// Close stops the readers and closes the sockets once none of them reads its ring any more.
+func (s *afpacketSource) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+		s.wg.Wait()
+		s.closeSockets()
+	})
+}
+
+func (s *afpacketSource) closeSockets() {
+	for _, socket := range s.sockets {
+		socket.Close()
+	}
+}
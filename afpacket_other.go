@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+func openAFPacket(device string) (packetSource, error) {
+	return nil, errors.New("the afpacket backend is only available on Linux")
+}
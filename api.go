@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"go.uber.org/zap"
+)
+
+const defaultTopPaths = 20
+
+type sessionJSON struct {
+	Client         string    `json:"client"`
+	Session        string    `json:"session"`
+	TimeoutSeconds float64   `json:"timeout_seconds"`
+	Connected      time.Time `json:"connected"`
+	LastSeen       time.Time `json:"last_seen"`
+	LastHeartbeat  time.Time `json:"last_heartbeat"`
+	// HeartbeatAgeSeconds is how long the client has been silent, NearExpiry is set past 2/3 of the timeout
+	HeartbeatAgeSeconds float64 `json:"heartbeat_age_seconds"`
+	NearExpiry          bool    `json:"near_expiry"`
+	Ops                 int     `json:"ops"`
+	Watches             int     `json:"watches"`
+	// RequestedTimeoutSeconds and the client fingerprint are only known when the connect request was captured
+	RequestedTimeoutSeconds float64 `json:"requested_timeout_seconds,omitempty"`
+	ReadOnlyFlag            string  `json:"read_only_flag"`
+	ReadOnly                string  `json:"read_only,omitempty"`
+	FirstOp                 string  `json:"first_op,omitempty"`
+	SetWatches              bool    `json:"set_watches"`
+}
+
+type pendingJSON struct {
+	Client     string  `json:"client"`
+	Xid        string  `json:"xid"`
+	Op         string  `json:"op"`
+	Path       string  `json:"path,omitempty"`
+	Watch      bool    `json:"watch"`
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+type watcherJSON struct {
+	Client string `json:"client"`
+	Kind   string `json:"kind"`
+}
+
+type watchJSON struct {
+	Path     string        `json:"path"`
+	Watchers []watcherJSON `json:"watchers"`
+}
+
+type statsJSON struct {
+	Ops                   int     `json:"ops"`
+	Errors                int     `json:"errors"`
+	Bytes                 int     `json:"bytes"`
+	AverageLatencySeconds float64 `json:"avg_latency_seconds"`
+}
+
+func newStatsJSON(s *opStats) statsJSON {
+	j := statsJSON{Ops: s.ops, Errors: s.errors, Bytes: s.bytes}
+	if s.ops > 0 {
+		j.AverageLatencySeconds = (s.latency / time.Duration(s.ops)).Seconds()
+	}
+	return j
+}
+
+type pathJSON struct {
+	Path string `json:"path"`
+	statsJSON
+}
+
+type clientJSON struct {
+	Client   string `json:"client"`
+	Label    string `json:"label,omitempty"`
+	Sessions int    `json:"sessions"`
+	statsJSON
+}
+
+// registerDebugAPI adds the JSON debug endpoints and the live event stream to the mux.
+func registerDebugAPI(mux *http.ServeMux, pool *sniffer.Pool, stream *eventStream) {
+	mux.HandleFunc("/api/sessions", handleSessions)
+	mux.HandleFunc("/api/pending", func(w http.ResponseWriter, r *http.Request) { handlePending(w, r, pool) })
+	mux.HandleFunc("/api/watches", handleWatches)
+	mux.HandleFunc("/api/paths/top", handleTopPaths)
+	mux.HandleFunc("/api/clients", handleClients)
+	mux.HandleFunc("/api/stream", func(w http.ResponseWriter, r *http.Request) { handleStream(w, r, stream) })
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("failed to write api response", zap.Error(err))
+	}
+}
+
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	stateMu.Lock()
+	watchCount := map[string]int{}
+	for _, watchers := range watches {
+		for wt := range watchers {
+			watchCount[wt.conn]++
+		}
+	}
+	now := captureNow()
+	expireSessions(now)
+	sessions := make([]sessionJSON, 0, len(connSessions))
+	for conn, s := range connSessions {
+		sessions = append(sessions, sessionJSON{
+			Client:                  conn,
+			Session:                 sessionString(s.id),
+			TimeoutSeconds:          s.timeout.Seconds(),
+			Connected:               s.connected,
+			LastSeen:                s.lastSeen,
+			LastHeartbeat:           s.heartbeat,
+			HeartbeatAgeSeconds:     s.heartbeatAge(now).Seconds(),
+			NearExpiry:              s.nearExpiry(now),
+			Ops:                     s.ops,
+			Watches:                 watchCount[conn],
+			RequestedTimeoutSeconds: s.requested.Seconds(),
+			ReadOnlyFlag:            s.fingerprint.readOnlyFlag(),
+			ReadOnly:                s.fingerprint.readOnly,
+			FirstOp:                 s.fingerprint.firstOp,
+			SetWatches:              s.fingerprint.setWatches,
+		})
+	}
+	stateMu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Client < sessions[j].Client })
+	writeJSON(w, sessions)
+}
+
+func handlePending(w http.ResponseWriter, r *http.Request, pool *sniffer.Pool) {
+	// The workers lock stateMu while they hold their own lock, so the pool is read first
+	requests := pool.Pending()
+	now := clock.now()
+	stateMu.Lock()
+	pending := make([]pendingJSON, 0, len(requests))
+	for _, req := range requests {
+		pending = append(pending, pendingJSON{
+			Client:     req.Client.String(),
+			Xid:        strconv.Itoa(int(req.Xid)),
+			Op:         req.Op.String(),
+			Path:       req.Path,
+			Watch:      req.Watch,
+			AgeSeconds: now.Sub(req.Time).Seconds(),
+		})
+	}
+	stateMu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].AgeSeconds > pending[j].AgeSeconds })
+	writeJSON(w, pending)
+}
+
+func handleWatches(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("path")
+	stateMu.Lock()
+	list := make([]watchJSON, 0, len(watches))
+	for path, watchers := range watches {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		wj := watchJSON{Path: path}
+		for wt := range watchers {
+			wj.Watchers = append(wj.Watchers, watcherJSON{Client: wt.conn, Kind: string(wt.kind)})
+		}
+		sort.Slice(wj.Watchers, func(i, j int) bool {
+			if wj.Watchers[i].Client != wj.Watchers[j].Client {
+				return wj.Watchers[i].Client < wj.Watchers[j].Client
+			}
+			return wj.Watchers[i].Kind < wj.Watchers[j].Kind
+		})
+		list = append(list, wj)
+	}
+	stateMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	writeJSON(w, list)
+}
+
+// handleTopPaths lists the busiest paths. The n parameter limits the result and sort picks
+// ops (the default), errors, bytes or latency.
+func handleTopPaths(w http.ResponseWriter, r *http.Request) {
+	n := defaultTopPaths
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid n %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	less, ok := statsOrder[r.URL.Query().Get("sort")]
+	if !ok {
+		http.Error(w, fmt.Sprintf("invalid sort %q", r.URL.Query().Get("sort")), http.StatusBadRequest)
+		return
+	}
+
+	stateMu.Lock()
+	paths := make([]pathJSON, 0, len(pathStats))
+	for path, s := range pathStats {
+		paths = append(paths, pathJSON{Path: path, statsJSON: newStatsJSON(s)})
+	}
+	stateMu.Unlock()
+
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Path < paths[j].Path })
+	sort.SliceStable(paths, func(i, j int) bool { return less(paths[j].statsJSON, paths[i].statsJSON) })
+	if len(paths) > n {
+		paths = paths[:n]
+	}
+	writeJSON(w, paths)
+}
+
+// statsOrder are the orderings the top endpoints can sort by, descending.
+var statsOrder = map[string]func(a, b statsJSON) bool{
+	"":        func(a, b statsJSON) bool { return a.Ops < b.Ops },
+	"ops":     func(a, b statsJSON) bool { return a.Ops < b.Ops },
+	"errors":  func(a, b statsJSON) bool { return a.Errors < b.Errors },
+	"bytes":   func(a, b statsJSON) bool { return a.Bytes < b.Bytes },
+	"latency": func(a, b statsJSON) bool { return a.AverageLatencySeconds < b.AverageLatencySeconds },
+}
+
+func handleClients(w http.ResponseWriter, r *http.Request) {
+	stateMu.Lock()
+	expireSessions(captureNow())
+	sessionCount := map[string]int{}
+	for conn := range connSessions {
+		// The connections are keyed by host and port, the client stats by host alone
+		if host, _, err := net.SplitHostPort(conn); err == nil {
+			sessionCount[host]++
+		}
+	}
+	clients := make([]clientJSON, 0, len(clientStats))
+	for host, s := range clientStats {
+		clients = append(clients, clientJSON{Client: host, Label: labelFor(net.ParseIP(host)), Sessions: sessionCount[host], statsJSON: newStatsJSON(s)})
+	}
+	stateMu.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Ops != clients[j].Ops {
+			return clients[i].Ops > clients[j].Ops
+		}
+		return clients[i].Client < clients[j].Client
+	})
+	writeJSON(w, clients)
+}
+
+// handleStream sends completed operations as Server-Sent Events until the client goes away.
+// Operations are filtered by the -filter flag and the query parameters, see streamFilterExpr.
+func handleStream(w http.ResponseWriter, r *http.Request, stream *eventStream) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	expr := streamFilterExpr(r.URL.Query())
+	f, err := filter.Parse(expr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid filter %q: %v", expr, err), http.StatusBadRequest)
+		return
+	}
+
+	sub := stream.subscribe(f)
+	defer stream.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-sub.events:
+			if !writeStreamEvent(w, "operation", ev) {
+				return
+			}
+		case ev := <-sub.epochs:
+			if !writeStreamEvent(w, "epoch", ev) {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeStreamEvent writes a server-sent event and tells if the subscriber is still there.
+func writeStreamEvent(w io.Writer, name string, ev interface{}) bool {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		logger.Warn("failed to encode stream event", zap.Error(err))
+		return true
+	}
+	_, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n", name, data)
+	return err == nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func resetTrackingState() {
+	connSessions = map[string]*session{}
+	watches = watchTable{}
+	pathStats = map[string]*opStats{}
+	clientStats = map[string]*opStats{}
+	sessionsSwept = time.Time{}
+}
+
+// requestPacket builds the packet of a client request to the default server port.
+func requestPacket(t *testing.T, c sniffer.Client, ts time.Time, xid int32, op proto.OpType, body interface{}) gopacket.Packet {
+	buf := make([]byte, 256)
+	n, err := zk.EncodePacket(buf[4:], &proto.RequestHeader{Xid: xid, Opcode: op})
+	require.NoError(t, err)
+	m, err := zk.EncodePacket(buf[4+n:], body)
+	require.NoError(t, err)
+	binary.BigEndian.PutUint32(buf, uint32(n+m))
+
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: c.Host.To4(), DstIP: net.IPv4(10, 0, 0, 100).To4()}
+	tcp := &layers.TCP{SrcPort: c.Port, DstPort: sniffer.DefaultPort, PSH: true, ACK: true}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+	out := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(out, opts, ip, tcp, gopacket.Payload(buf[:4+n+m])))
+
+	packet := gopacket.NewPacket(out.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	packet.Metadata().Timestamp = ts
+	return packet
+}
+
+func getJSON(t *testing.T, mux *http.ServeMux, url string, v interface{}) {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+}
+
+func TestDebugAPI(t *testing.T) {
+	resetTrackingState()
+	defer resetTrackingState()
+
+	start := time.Unix(1500000000, 0)
+	c := sniffer.Client{Host: net.ParseIP("10.0.0.1"), Port: 5000}
+	connSessions[c.String()] = &session{id: 0x1234, timeout: 10 * time.Second, connected: start, heartbeat: start}
+	r := &sniffer.Response{Request: &sniffer.Request{Client: c, Time: start, Op: proto.OpGetData, Watch: true, Path: "/a"}, Time: start}
+	trackOperation(r, &filter.Message{Op: proto.OpGetData, Path: "/a", Watch: true, Latency: time.Millisecond})
+	trackOperation(r, &filter.Message{Op: proto.OpGetData, Path: "/a", Latency: 3 * time.Millisecond})
+	trackOperation(r, &filter.Message{Op: proto.OpDelete, Path: "/b", Err: errNoNode})
+
+	// An unanswered GetData leaves a pending request in the pool
+	pool := sniffer.NewPool(1, nil)
+	pool.HandlePacket(requestPacket(t, c, start, 7, proto.OpGetData, &proto.GetDataRequest{Path: "/c"}))
+	pool.Close()
+	defer func() { clock = &captureClock{} }()
+	clock = &captureClock{offline: true}
+	clock.tick(start.Add(2 * time.Second))
+	mux := http.NewServeMux()
+	registerDebugAPI(mux, pool, newEventStream())
+
+	var sessions []sessionJSON
+	getJSON(t, mux, "/api/sessions", &sessions)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "0x1234", sessions[0].Session)
+	assert.Equal(t, 3, sessions[0].Ops)
+	assert.Equal(t, 1, sessions[0].Watches)
+
+	var pending []pendingJSON
+	getJSON(t, mux, "/api/pending", &pending)
+	assert.Equal(t, []pendingJSON{{Client: "10.0.0.1:5000", Xid: "7", Op: "OpGetData", Path: "/c", AgeSeconds: 2}}, pending)
+
+	var watchList []watchJSON
+	getJSON(t, mux, "/api/watches", &watchList)
+	assert.Equal(t, []watchJSON{{Path: "/a", Watchers: []watcherJSON{{Client: "10.0.0.1:5000", Kind: "data"}}}}, watchList)
+
+	var paths []pathJSON
+	getJSON(t, mux, "/api/paths/top?n=1", &paths)
+	require.Len(t, paths, 1)
+	assert.Equal(t, "/a", paths[0].Path)
+	assert.Equal(t, 0.002, paths[0].AverageLatencySeconds)
+	getJSON(t, mux, "/api/paths/top?sort=errors", &paths)
+	assert.Equal(t, "/b", paths[0].Path)
+
+	var clients []clientJSON
+	getJSON(t, mux, "/api/clients", &clients)
+	require.Len(t, clients, 1)
+	assert.Equal(t, clientJSON{Client: "10.0.0.1", Sessions: 1, statsJSON: statsJSON{Ops: 3, Errors: 1, AverageLatencySeconds: 0.001333333}}, clients[0])
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/paths/top?sort=bogus", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestReadSessions(t *testing.T) {
+	resetTrackingState()
+	defer resetTrackingState()
+	defer func(a string, out io.Writer, l *zap.Logger) { addr, output, logger, clock = a, out, l, &captureClock{} }(addr, output, logger)
+	addr, output, logger = "", ioutil.Discard, zap.NewNop()
+
+	// The session of the capture is still open at its end, years before the wall clock
+	require.NoError(t, runRead([]string{"testdata/errors.pcap"}))
+	pool := sniffer.NewPool(1, nil)
+	defer pool.Close()
+	mux := http.NewServeMux()
+	registerDebugAPI(mux, pool, newEventStream())
+
+	var sessions []sessionJSON
+	getJSON(t, mux, "/api/sessions", &sessions)
+	require.Len(t, sessions, 1)
+	assert.False(t, sessions[0].NearExpiry)
+	var clients []clientJSON
+	getJSON(t, mux, "/api/clients", &clients)
+	require.Len(t, clients, 1)
+	assert.Equal(t, 1, clients[0].Sessions)
+}
+
+func TestClientsIPv6(t *testing.T) {
+	resetTrackingState()
+	defer resetTrackingState()
+
+	c := sniffer.Client{Host: net.ParseIP("::1"), Port: 5000}
+	connSessions[c.String()] = &session{id: 0x1234, timeout: 10 * time.Second, heartbeat: time.Now()}
+	r := &sniffer.Response{Request: &sniffer.Request{Client: c, Op: proto.OpGetData, Path: "/a"}}
+	trackOperation(r, &filter.Message{Op: proto.OpGetData, Path: "/a"})
+	pool := sniffer.NewPool(1, nil)
+	defer pool.Close()
+	mux := http.NewServeMux()
+	registerDebugAPI(mux, pool, newEventStream())
+
+	var clients []clientJSON
+	getJSON(t, mux, "/api/clients", &clients)
+	require.Len(t, clients, 1)
+	assert.Equal(t, "::1", clients[0].Client)
+	assert.Equal(t, 1, clients[0].Sessions)
+}
+
+func TestWatchesFire(t *testing.T) {
+	w := watchTable{}
+	w.register("a", &filter.Message{Op: proto.OpGetData, Path: "/n", Watch: true})
+	w.register("a", &filter.Message{Op: proto.OpGetChildren2, Path: "/n", Watch: true})
+	w.register("b", &filter.Message{Op: proto.OpExists, Path: "/n", Watch: true, Err: errNoNode})
+	w.register("c", &filter.Message{Op: proto.OpGetData, Path: "/n", Watch: true, Err: errNoNode})
+	assert.Len(t, w["/n"], 3)
+
+	w.fire("a", &sniffer.WatchEvent{Type: zk.EventNodeDataChanged, Path: "/n"})
+	assert.Equal(t, map[watcher]bool{{"a", childWatch}: true, {"b", dataWatch}: true}, w["/n"])
+
+	w.forget("b")
+	w.fire("a", &sniffer.WatchEvent{Type: zk.EventNodeDeleted, Path: "/n"})
+	assert.Empty(t, w)
+}
+
+func TestEventStreamFilters(t *testing.T) {
+	query := url.Values{"op": {"GetData,SetData"}, "path": {"/kafka"}, "min_latency": {"10ms"}}
+	expr := streamFilterExpr(query)
+	f, err := filter.Parse(expr)
+	require.NoError(t, err, expr)
+
+	s := newEventStream()
+	sub := s.subscribe(f)
+	r := &sniffer.Response{Request: &sniffer.Request{Client: sniffer.Client{Host: net.ParseIP("10.0.0.1"), Port: 5000}, Op: proto.OpGetData}}
+	s.publish(r, &filter.Message{Op: proto.OpGetData, Path: "/kafka/a", Latency: 20 * time.Millisecond}, "")
+	s.publish(r, &filter.Message{Op: proto.OpGetData, Path: "/other", Latency: 20 * time.Millisecond}, "")
+	s.unsubscribe(sub)
+	s.publish(r, &filter.Message{Op: proto.OpGetData, Path: "/kafka/b", Latency: 20 * time.Millisecond}, "")
+
+	require.Len(t, sub.events, 1)
+	ev := <-sub.events
+	assert.Equal(t, "/kafka/a", ev.Path)
+	assert.Equal(t, "10.0.0.1:5000", ev.Client)
+}
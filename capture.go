@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	backendPcap     = "pcap"
+	backendAFPacket = "afpacket"
+)
+
+var (
+	// captureBackend is how live traffic is captured, libpcap or AF_PACKET memory mapped rings
+	captureBackend = backendPcap
+	// afpacketFanout is the number of AF_PACKET sockets sharing the traffic, each read by its own goroutine
+	afpacketFanout = 1
+	// afpacketFrameSize, afpacketBlockSize and afpacketBlocks size the ring of each AF_PACKET socket. The
+	// block size must be a multiple of the page and frame sizes.
+	afpacketFrameSize = 4096
+	afpacketBlockSize = 4096 * 128
+	afpacketBlocks    = 128
+)
+
+// captureStats are the packet counts the kernel reports for a live capture.
+type captureStats struct {
+	received  uint64
+	dropped   uint64
+	ifDropped uint64
+}
+
+// packetSource is a capture, either a pcap handle or AF_PACKET sockets.
+type packetSource interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	// Stats fails for sources the kernel keeps no statistics for, like files.
+	Stats() (captureStats, error)
+	Close()
+}
+
+// openSource opens the pcap file when one is given and otherwise starts a live capture on the device with
+// the configured backend. Either way the source only sees ZooKeeper traffic. A file sets the capture clock
+// offline, sessions and requests age by the time of its packets.
+func openSource(device, file string) (packetSource, error) {
+	clock.setOffline(file != "")
+	if file == "" {
+		switch captureBackend {
+		case backendPcap:
+		case backendAFPacket:
+			return openAFPacket(device)
+		default:
+			return nil, fmt.Errorf("unknown capture backend %q", captureBackend)
+		}
+	}
+	var handle *pcap.Handle
+	var err error
+	if file != "" {
+		handle, err = pcap.OpenOffline(file)
+	} else {
+		handle, err = pcap.OpenLive(device, snapshotLen, false /* promiscuous */, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter(captureFilter()); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return pcapSource{handle}, nil
+}
+
+// pcapSource is a libpcap capture.
+type pcapSource struct {
+	*pcap.Handle
+}
+
+func (s pcapSource) Stats() (captureStats, error) {
+	stats, err := s.Handle.Stats()
+	if err != nil {
+		return captureStats{}, err
+	}
+	return captureStats{
+		received:  uint64(stats.PacketsReceived),
+		dropped:   uint64(stats.PacketsDropped),
+		ifDropped: uint64(stats.PacketsIfDropped),
+	}, nil
+}
+
+// capturePackets hands every packet from the source to the pool until the source is exhausted or stop is
+// closed, then waits for the pool to finish. A positive speed paces packets from a file by their capture
+// timestamps, 2 replays twice as fast.
+func capturePackets(handle packetSource, pool *sniffer.Pool, speed float64, stop <-chan struct{}) {
+	health.watch(handle, pool)
+	// The source is closed by the caller once we return
+	defer health.watch(nil, nil)
+	defer pool.Close()
+	var first time.Time
+	var started time.Time
+
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+	// Only the layers needed to pick a worker are decoded here, the workers decode the rest
+	source.DecodeOptions.Lazy = true
+	packets := source.Packets()
+	for {
+		var packet gopacket.Packet
+		select {
+		case <-stop:
+			return
+		case p, ok := <-packets:
+			if !ok {
+				return
+			}
+			packet = p
+		}
+		ts := packet.Metadata().Timestamp
+		if speed > 0 {
+			if first.IsZero() {
+				first, started = ts, time.Now()
+			}
+			due := started.Add(time.Duration(float64(ts.Sub(first)) / speed))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-stop:
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+		clock.tick(ts)
+		pool.HandlePacket(packet)
+	}
+}
@@ -0,0 +1,83 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// loopbackTraffic sends small TCP writes over the loopback interface until stop is closed and returns the
+// server port.
+func loopbackTraffic(b *testing.B, stop chan struct{}) layers.TCPPort {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4096)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		defer conn.Close()
+		msg := make([]byte, 64)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := conn.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+	return layers.TCPPort(l.Addr().(*net.TCPAddr).Port)
+}
+
+// BenchmarkCapture reads packets of a busy loopback connection with each backend. It needs the privileges
+// to capture and is skipped without them.
+func BenchmarkCapture(b *testing.B) {
+	for _, backend := range []struct {
+		name   string
+		fanout int
+	}{{backendPcap, 1}, {backendAFPacket, 1}, {backendAFPacket, 4}} {
+		b.Run(fmt.Sprintf("%v/fanout=%d", backend.name, backend.fanout), func(b *testing.B) {
+			stop := make(chan struct{})
+			defer close(stop)
+			defer func(ports portList) { serverPorts = ports }(serverPorts)
+			serverPorts = portList{loopbackTraffic(b, stop)}
+			captureBackend, afpacketFanout = backend.name, backend.fanout
+			defer func() { captureBackend, afpacketFanout = backendPcap, 1 }()
+
+			source, err := openSource("lo", "")
+			if err != nil {
+				b.Skipf("cannot capture on lo: %v", err)
+			}
+			defer source.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := source.ReadPacketData(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jeffbean/zkpacket/loadgen"
+)
+
+// manifestFile is the zkload manifest the check command compares the capture with
+var manifestFile string
+
+func checkFlags(fs *flag.FlagSet) {
+	durationFlags(fs)
+	fs.StringVar(&manifestFile, "manifest", "", "The manifest zkload -manifest wrote.")
+}
+
+// checkRow is an operation of the manifest or the capture with how often each had it.
+type checkRow struct {
+	op                    string
+	want, got             int
+	wantErrors, gotErrors int
+}
+
+func (r checkRow) ok() bool {
+	return r.want == r.got && r.wantErrors == r.gotErrors
+}
+
+// runCheck decodes the capture like report and fails when its operations differ from the manifest.
+func runCheck(args []string) error {
+	if manifestFile == "" {
+		return errors.New("-manifest is required")
+	}
+	m, err := loadgen.LoadManifest(manifestFile)
+	if err != nil {
+		return err
+	}
+	if err := setupFilter(); err != nil {
+		return err
+	}
+	handle, err := openSource(device, readFile)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	output = ioutil.Discard
+	topStats = newTopAggregator(time.Time{})
+	capturePackets(handle, newPool(), 0, stopAfter(duration))
+
+	rows := checkManifest(m, topStats.ops)
+	if bad := writeCheck(os.Stdout, rows); bad > 0 {
+		return fmt.Errorf("%v operations don't match the manifest", bad)
+	}
+	return nil
+}
+
+// checkManifest lines up the counts and errors of each operation in the manifest with the ones seen.
+func checkManifest(m *loadgen.Manifest, seen map[string]*opWindow) []checkRow {
+	rows := make(map[string]*checkRow)
+	row := func(op string) *checkRow {
+		r, ok := rows[op]
+		if !ok {
+			r = &checkRow{op: op}
+			rows[op] = r
+		}
+		return r
+	}
+	for op, n := range m.Counts {
+		row(op).want = n
+	}
+	for op, n := range m.Errors {
+		row(op).wantErrors = n
+	}
+	for op, w := range seen {
+		r := row(op)
+		r.got, r.gotErrors = w.count, w.errors
+	}
+
+	out := make([]checkRow, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, *r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].op < out[j].op })
+	return out
+}
+
+// writeCheck prints the rows and returns how many don't match.
+func writeCheck(w io.Writer, rows []checkRow) int {
+	var bad int
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPERATION\tMANIFEST\tSEEN\tMANIFEST ERRORS\tSEEN ERRORS\t")
+	for _, r := range rows {
+		status := ""
+		if !r.ok() {
+			bad++
+			status = "MISMATCH"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", r.op, r.want, r.got, r.wantErrors, r.gotErrors, status)
+	}
+	tw.Flush()
+	return bad
+}
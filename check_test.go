@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jeffbean/zkpacket/loadgen"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckManifest(t *testing.T) {
+	m := &loadgen.Manifest{
+		Counts: map[string]int{"OpCreate": 3, "OpGetData": 2, "OpMulti": 1},
+		Errors: map[string]int{"OpMulti": 1},
+	}
+	seen := map[string]*opWindow{
+		"OpCreate":  {count: 3},
+		"OpGetData": {count: 1},
+		"OpMulti":   {count: 1, errors: 1},
+		"OpPing":    {count: 4},
+	}
+	rows := checkManifest(m, seen)
+	assert.Equal(t, []checkRow{
+		{op: "OpCreate", want: 3, got: 3},
+		{op: "OpGetData", want: 2, got: 1},
+		{op: "OpMulti", want: 1, got: 1, wantErrors: 1, gotErrors: 1},
+		{op: "OpPing", got: 4},
+	}, rows)
+
+	var out bytes.Buffer
+	assert.Equal(t, 2, writeCheck(&out, rows))
+	assert.Equal(t, `OPERATION  MANIFEST  SEEN  MANIFEST ERRORS  SEEN ERRORS  
+OpCreate   3         3     0                0            
+OpGetData  2         1     0                0            MISMATCH
+OpMulti    1         1     1                1            
+OpPing     0         4     0                0            MISMATCH
+`, out.String())
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/loadgen"
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// command is a zkpacket subcommand. Flag groups are shared between commands so the same flag means
+// the same thing everywhere.
+type command struct {
+	name    string
+	args    string
+	summary string
+	help    string
+	flags   []func(*flag.FlagSet)
+	run     func(args []string) error
+}
+
+var commands = []*command{
+	{
+		name:    "sniff",
+		summary: "capture live traffic and export metrics, the debug API and traces",
+		help: `Captures ZooKeeper traffic on -interface and decodes every request and response. Metrics and the
+debug API are served on -listen-address and completed operations are traced to stdout. This is the
+default when no command is given.`,
+		flags: []func(*flag.FlagSet){logFlags, captureFlags, pipelineFlags, httpFlags, workerFlags},
+		run:   runSniff,
+	},
+	{
+		name:    "read",
+		args:    "<file.pcap>",
+		summary: "decode a pcap file as fast as possible",
+		help: `Runs a pcap file through the same pipeline as sniff, as fast as it can be read, and exits at the end
+of the file.`,
+		flags: []func(*flag.FlagSet){logFlags, pipelineFlags, httpFlags, workerFlags},
+		run:   runRead,
+	},
+	{
+		name:    "replay",
+		args:    "<file.pcap>",
+		summary: "replay a pcap file at its original pace",
+		help: `Runs a pcap file through the same pipeline as sniff, pacing packets by their capture timestamps so
+dashboards see the traffic as it happened. -speed 2 replays twice as fast.`,
+		flags: []func(*flag.FlagSet){logFlags, pipelineFlags, httpFlags, speedFlags, workerFlags},
+		run:   runReplay,
+	},
+	{
+		name:    "trace",
+		summary: "print completed operations, without metrics or the debug API",
+		help: `Prints every completed operation matching -filter to stdout, one line each, from a live capture or
+a pcap file given with -read.`,
+		flags: []func(*flag.FlagSet){logFlags, captureFlags, readFlags, pipelineFlags, workerFlags},
+		run:   runTrace,
+	},
+	{
+		name:    "top",
+		summary: "full-screen live view of ops/s, latency, clients and paths",
+		help: `Shows a terminal view refreshed every second with ops/s, error rate and p50/p99 latency per
+operation, client and path. Works on a live capture or replays a pcap file given with -read.`,
+		flags: []func(*flag.FlagSet){logFlags, captureFlags, readFlags, filterFlags, speedFlags, workerFlags},
+		run:   runTop,
+	},
+	{
+		name:    "report",
+		summary: "summarise the traffic of a pcap file or a timed live capture",
+		help: `Decodes a pcap file given with -read, or captures live for -duration or until interrupted, and prints
+a summary of the operations, clients and paths seen.`,
+		flags: []func(*flag.FlagSet){logFlags, captureFlags, readFlags, filterFlags, reportFlags, workerFlags},
+		run:   runReport,
+	},
+	{
+		name:    "record",
+		summary: "write ZooKeeper traffic to a pcap or workload file",
+		help: `Writes the captured ZooKeeper traffic to the -o pcap file. With -filter only the request and
+response packets of matching operations are kept. Live captures run for -duration or until interrupted.
+With -format workload it writes the operations of each session instead, for zkload -replay.`,
+		flags: []func(*flag.FlagSet){logFlags, captureFlags, readFlags, filterFlags, recordFlags, workerFlags},
+		run:   runRecord,
+	},
+	{
+		name:    "proxy",
+		summary: "forward clients to a ZooKeeper server and decode the traffic, without pcap",
+		help: `Accepts ZooKeeper clients on -listen and forwards each connection byte for byte to -upstream. The
+frames are decoded straight from the stream into the same metrics, debug API and traces as sniff, so it
+needs neither libpcap nor CAP_NET_RAW. Triggered dumps are not available.`,
+		flags: []func(*flag.FlagSet){logFlags, slowLogFlags, httpFlags, workerFlags, proxyFlags},
+		run:   runProxy,
+	},
+	{
+		name:    "check",
+		summary: "check a capture saw the operations of a zkload manifest",
+		help: `Decodes a pcap file given with -read, or captures live for -duration or until interrupted, and compares
+the count and errors of each operation with the -manifest zkload wrote. It fails when any differ, the capture
+must hold nothing but the zkload run.`,
+		flags: []func(*flag.FlagSet){logFlags, captureFlags, readFlags, checkFlags, workerFlags},
+		run:   runCheck,
+	},
+	{
+		name:    "compare",
+		args:    "<requests> <events>",
+		summary: "compare zkload's client latencies with the latencies on the wire",
+		help: `Matches the requests of a zkload -request-log with the operations of a saved /api/stream by session and
+xid, and prints the client and wire latencies of each operation and how far apart they are. zkpacket must
+see the connects of zkload's sessions to know their ids.`,
+		flags: []func(*flag.FlagSet){logFlags},
+		run:   runCompare,
+	},
+	{
+		name:    "load",
+		args:    "[clean]",
+		summary: "generate ZooKeeper load, the same as zkload",
+		help:    loadgen.Usage,
+		flags:   []func(*flag.FlagSet){logFlags, loadgen.RegisterFlags},
+		run:     runLoad,
+	},
+}
+
+func main() {
+	name, args := "sniff", os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			usage(os.Stdout)
+			return
+		}
+		if !strings.HasPrefix(args[0], "-") {
+			name, args = args[0], args[1:]
+		}
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("zkpacket "+cmd.name, flag.ExitOnError)
+	fs.Usage = func() { commandUsage(fs, cmd) }
+	for _, register := range cmd.flags {
+		register(fs)
+	}
+	fs.StringVar(&configPath, "config", "", "YAML config file. Flags given on the command line override it and SIGHUP reloads everything but the capture settings.")
+	fs.Parse(args)
+	setupLogging()
+	if configPath != "" {
+		set := setFlags(fs)
+		cfg, err := loadConfig(configPath)
+		if err == nil {
+			err = cfg.applyStartup(set)
+		}
+		if err != nil {
+			logger.Fatal("failed to load config", zap.Error(err))
+		}
+		reloadOnHangup(configPath, set)
+	}
+
+	if err := cmd.run(fs.Args()); err != nil {
+		logger.Fatal(cmd.name+" failed", zap.Error(err))
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "zkpacket decodes ZooKeeper traffic into metrics, logs and traces.\n\n")
+	fmt.Fprintf(w, "Usage:\n  zkpacket <command> [flags]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %v\t%v\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun 'zkpacket <command> -help' for the flags of a command.\n")
+}
+
+func commandUsage(fs *flag.FlagSet, cmd *command) {
+	w := os.Stderr
+	fmt.Fprintf(w, "Usage:\n  zkpacket %v [flags] %v\n\n%v\n\nFlags:\n", cmd.name, cmd.args, cmd.help)
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// levelFlag sets the shared atomic log level from the command line.
+type levelFlag struct{ level zap.AtomicLevel }
+
+func (f levelFlag) String() string     { return f.level.String() }
+func (f levelFlag) Set(s string) error { return f.level.UnmarshalText([]byte(s)) }
+
+func logFlags(fs *flag.FlagSet) {
+	fs.Var(levelFlag{dl}, "log-level", "Log level: debug, info, warn or error.")
+}
+
+func captureFlags(fs *flag.FlagSet) {
+	fs.StringVar(&device, "interface", device, "interface to listen on")
+	fs.Var(&serverPorts, "port", "Comma separated ZooKeeper server ports.")
+	fs.StringVar(&captureBackend, "backend", captureBackend, "Live capture backend, pcap or afpacket (Linux only).")
+	fs.IntVar(&afpacketFanout, "afpacket-fanout", afpacketFanout, "Number of AF_PACKET sockets sharing the traffic.")
+	fs.IntVar(&afpacketFrameSize, "afpacket-frame-size", afpacketFrameSize, "AF_PACKET ring frame size in bytes.")
+	fs.IntVar(&afpacketBlockSize, "afpacket-block-size", afpacketBlockSize, "AF_PACKET ring block size in bytes, a multiple of the frame size.")
+	fs.IntVar(&afpacketBlocks, "afpacket-blocks", afpacketBlocks, "Number of blocks in each AF_PACKET ring.")
+}
+
+func readFlags(fs *flag.FlagSet) {
+	fs.StringVar(&readFile, "read", readFile, "Read packets from this pcap file instead of capturing live.")
+}
+
+func speedFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&speed, "speed", 1, "Replay speed for pcap files, 2 is twice as fast and 0 as fast as possible.")
+}
+
+func filterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&filterExpr, "filter", filterExpr, `Only use operations matching the expression, e.g. 'op in (SetData, Create) and latency > 50ms'`)
+}
+
+func pipelineFlags(fs *flag.FlagSet) {
+	slowLogFlags(fs)
+	triggerFlags(fs)
+}
+
+func slowLogFlags(fs *flag.FlagSet) {
+	filterFlags(fs)
+	fs.StringVar(&slowLogPath, "slow-log", slowLogPath, "File to write operations slower than their -slow-threshold to.")
+	fs.Var(&thresholds, "slow-threshold", "Log operations slower than this. Either a duration for all operations or [op][:path-template]=duration, e.g. SetData:/kafka/*=100ms. The most specific rule wins. Repeatable.")
+}
+
+func triggerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&triggerDir, "trigger-dir", triggerDir, "Directory to write pcap dumps of a connection's recent packets to when a -trigger fires. Disabled when empty.")
+	fs.IntVar(&triggerRingSize, "trigger-ring-size", triggerRingSize, "Number of recent packets kept per connection for triggered dumps.")
+	fs.DurationVar(&triggerCooldown, "trigger-cooldown", triggerCooldown, "Minimum time between triggered dumps of the same connection.")
+	fs.Var(&triggers, "trigger", "Condition that dumps a connection's recent packets: latency (uses -slow-threshold), latency=<duration>, err=<code or name>, decode-error or session-expired. Repeatable.")
+}
+
+func workerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&workers, "workers", workers, "Number of goroutines decoding packets. Each connection is always decoded by the same one.")
+}
+
+func httpFlags(fs *flag.FlagSet) {
+	fs.StringVar(&addr, "listen-address", addr, "The address to listen on for HTTP requests. Disabled when empty.")
+}
+
+// setupLogging builds the logger every command shares. Its level follows dl so it can change at runtime.
+func setupLogging() {
+	loggerConfig := zap.NewDevelopmentConfig()
+	loggerConfig.Level = dl
+	var err error
+	if logger, err = loggerConfig.Build(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setupFilter compiles -filter, a bad expression stops the command before anything is captured.
+func setupFilter() error {
+	var err error
+	if opFilter, err = filter.Parse(filterExpr); err != nil {
+		return fmt.Errorf("invalid filter %q: %v", filterExpr, err)
+	}
+	return nil
+}
+
+// setupPipeline prepares the outputs completed operations are handed to and returns a function to flush them.
+func setupPipeline() (func(), error) {
+	if err := setupFilter(); err != nil {
+		return nil, err
+	}
+	// Thresholds from a config file can appear on reload, the log is opened then
+	slowLogOnReload = configPath != ""
+	if err := openSlowLog(); err != nil {
+		return nil, err
+	}
+	return func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		slowLogger.Sync()
+	}, nil
+}
+
+func setupDumper(handle packetSource) error {
+	if triggerDir == "" {
+		return nil
+	}
+	var err error
+	dumper, err = newPacketDumper(triggerDir, triggerRingSize, triggerCooldown, &triggers, handle.LinkType(), uint32(snapshotLen))
+	return err
+}
+
+func serveHTTP(pool *sniffer.Pool) {
+	if addr == "" {
+		return
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	registerDebugAPI(http.DefaultServeMux, pool, events)
+	go func() {
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			logger.Error("http server stopped", zap.Error(err))
+		}
+	}()
+}
+
+// interrupted is closed on SIGINT or SIGTERM so captures can stop cleanly and flush their output.
+func interrupted() <-chan struct{} {
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		signal.Stop(c)
+		close(stop)
+	}()
+	return stop
+}
+
+// fileArg takes the pcap file from the only argument.
+func fileArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("expected a single pcap file, got %v arguments", len(args))
+	}
+	return args[0], nil
+}
+
+// runPipeline decodes the source through every output and blocks until it is exhausted or interrupted.
+func runPipeline(source string, serve bool, pace float64) error {
+	flush, err := setupPipeline()
+	if err != nil {
+		return err
+	}
+	defer flush()
+
+	pool := newPool()
+	if serve {
+		serveHTTP(pool)
+	}
+	handle, err := openSource(device, source)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if err := setupDumper(handle); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Filter: %v\n", captureFilter())
+	if opFilter.String() != "" {
+		fmt.Fprintf(output, "Operation filter: %v\n", opFilter)
+	}
+	capturePackets(handle, pool, pace, interrupted())
+	dumper.wait()
+	return nil
+}
+
+func runSniff(args []string) error {
+	return runPipeline("", true, 0)
+}
+
+func runRead(args []string) error {
+	file, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	return runPipeline(file, true, 0)
+}
+
+func runReplay(args []string) error {
+	file, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	return runPipeline(file, true, speed)
+}
+
+func runTrace(args []string) error {
+	return runPipeline(readFile, false, 0)
+}
+
+func runLoad(args []string) error {
+	switch {
+	case len(args) == 0:
+		return loadgen.Run(logger)
+	case len(args) == 1 && args[0] == "clean":
+		return loadgen.Clean(logger)
+	}
+	return errors.New("load takes no arguments but clean")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jeffbean/zkpacket/loadgen"
+)
+
+// maxEventLine is the longest event stream line compare reads.
+const maxEventLine = 1 << 20
+
+// latencyKey is how a request of the zkload request log is found in the event stream.
+type latencyKey struct {
+	session int64
+	xid     int32
+}
+
+// opComparison holds the latencies of the matched requests of an operation.
+type opComparison struct {
+	client, wire, diff []time.Duration
+}
+
+// comparison lines up the latencies zkload measured with the ones zkpacket saw on the wire.
+type comparison struct {
+	requests, events int
+	ops              map[string]*opComparison
+	// clientOnly are requests zkpacket didn't see, wireOnly are operations not in the request log
+	clientOnly, wireOnly int
+}
+
+func runCompare(args []string) error {
+	if len(args) != 2 {
+		return errors.New("compare takes the zkload request log and the saved event stream")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	requests, err := loadgen.ReadRequestLog(f)
+	if err != nil {
+		return err
+	}
+
+	e, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	events, err := readEvents(e)
+	if err != nil {
+		return err
+	}
+	writeComparison(os.Stdout, compareLatencies(requests, events))
+	return nil
+}
+
+// readEvents reads operation events saved from /api/stream, or written one JSON object a line.
+func readEvents(r io.Reader) ([]operationEvent, error) {
+	var events []operationEvent
+	// name is the name of the server-sent event being read, the stream has other events than operations
+	var name string
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxEventLine)
+	for n := 1; s.Scan(); n++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			name = ""
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("event:")) {
+			name = string(bytes.TrimSpace(line[len("event:"):]))
+			continue
+		}
+		line = bytes.TrimPrefix(line, []byte("data:"))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] != '{' || (name != "" && name != "operation") {
+			continue
+		}
+		var ev operationEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return nil, fmt.Errorf("invalid event on line %d: %v", n, err)
+		}
+		events = append(events, ev)
+	}
+	return events, s.Err()
+}
+
+func compareLatencies(requests []loadgen.RequestRecord, events []operationEvent) *comparison {
+	c := &comparison{requests: len(requests), events: len(events), ops: make(map[string]*opComparison)}
+	wire := make(map[latencyKey]operationEvent, len(events))
+	for _, ev := range events {
+		session, err := strconv.ParseInt(ev.Session, 0, 64)
+		if err != nil || session == 0 {
+			// The session is unknown when the capture missed the connect
+			c.wireOnly++
+			continue
+		}
+		wire[latencyKey{session, ev.Xid}] = ev
+	}
+
+	for _, r := range requests {
+		key := latencyKey{r.Session, r.Xid}
+		ev, ok := wire[key]
+		if r.Xid == 0 || !ok {
+			c.clientOnly++
+			continue
+		}
+		delete(wire, key)
+		op, ok := c.ops[r.Op]
+		if !ok {
+			op = &opComparison{}
+			c.ops[r.Op] = op
+		}
+		w := time.Duration(ev.LatencySeconds * float64(time.Second))
+		op.client = append(op.client, r.Latency)
+		op.wire = append(op.wire, w)
+		op.diff = append(op.diff, r.Latency-w)
+	}
+	c.wireOnly += len(wire)
+	return c
+}
+
+func writeComparison(w io.Writer, c *comparison) {
+	var matched int
+	names := make([]string, 0, len(c.ops))
+	for name, op := range c.ops {
+		names = append(names, name)
+		matched += len(op.diff)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "%v requests in the log, %v operations in the stream, %v matched\n", c.requests, c.events, matched)
+	fmt.Fprintf(w, "%v requests not seen on the wire, %v operations on the wire not in the log\n\n", c.clientOnly, c.wireOnly)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "OPERATION\tOPS\tCLIENT P50\tWIRE P50\tDIFF P50\tDIFF P99\tDIFF MAX\t\n")
+	for _, name := range names {
+		op := c.ops[name]
+		for _, l := range [][]time.Duration{op.client, op.wire, op.diff} {
+			sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", name, len(op.diff), percentile(op.client, 0.5),
+			percentile(op.wire, 0.5), percentile(op.diff, 0.5), percentile(op.diff, 0.99), op.diff[len(op.diff)-1])
+	}
+	tw.Flush()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/loadgen"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadEvents(t *testing.T) {
+	stream := `event: operation
+data: {"time":"2017-06-01T10:00:00Z","client":"10.0.0.1:5000","session":"0x15c","xid":1,"op":"OpCreate","path":"/a","watch":false,"size":10,"err":0,"latency_seconds":0.002}
+
+event: epoch
+data: {"time":"2017-06-01T10:00:00Z","zxid":"0x200000000","epoch":2,"previous_epoch":1}
+
+event: operation
+data: {"time":"2017-06-01T10:00:01Z","client":"10.0.0.1:5000","session":"0x15c","xid":2,"op":"OpGetData","path":"/a","watch":true,"size":20,"err":-101,"latency_seconds":0.001}
+
+`
+	events, err := readEvents(strings.NewReader(stream))
+	require.NoError(t, err)
+	require.Len(t, events, 2, "only operations")
+	assert.Equal(t, int32(2), events[1].Xid)
+	assert.Equal(t, int32(-101), events[1].Err)
+
+	lines, err := readEvents(strings.NewReader(`{"session":"0x15c","xid":1,"op":"OpCreate","latency_seconds":0.002}`))
+	require.NoError(t, err)
+	assert.Len(t, lines, 1, "plain JSON lines")
+
+	empty, err := readEvents(strings.NewReader("event: operation\ndata:\n\n"))
+	require.NoError(t, err)
+	assert.Empty(t, empty, "data without a payload")
+
+	_, err = readEvents(strings.NewReader("data: {\"xid\": \"one\"}\n"))
+	assert.Error(t, err)
+}
+
+func TestCompareLatencies(t *testing.T) {
+	requests := []loadgen.RequestRecord{
+		{Session: 0x15c, Xid: 1, Op: "OpCreate", Latency: 3 * time.Millisecond},
+		{Session: 0x15c, Xid: 2, Op: "OpGetData", Latency: 5 * time.Millisecond},
+		{Session: 0x15c, Xid: 3, Op: "OpGetData", Latency: 4 * time.Millisecond},
+		// Not seen on the wire
+		{Session: 0x15c, Xid: 4, Op: "OpGetData", Latency: time.Millisecond},
+		// Failed before it was sent
+		{Session: 0x15c, Op: "OpExists"},
+	}
+	events := []operationEvent{
+		{Session: "0x15c", Xid: 1, Op: "OpCreate", LatencySeconds: 0.002},
+		{Session: "0x15c", Xid: 2, Op: "OpGetData", LatencySeconds: 0.001},
+		{Session: "0x15c", Xid: 3, Op: "OpGetData", LatencySeconds: 0.003},
+		// Another client
+		{Session: "0x2", Xid: 1, Op: "OpGetData", LatencySeconds: 0.001},
+		// A session whose connect was not captured
+		{Session: "0x0", Xid: 5, Op: "OpGetData", LatencySeconds: 0.001},
+	}
+	c := compareLatencies(requests, events)
+	assert.Equal(t, 2, c.clientOnly)
+	assert.Equal(t, 2, c.wireOnly)
+	require.Len(t, c.ops, 2)
+	assert.Equal(t, []time.Duration{time.Millisecond}, c.ops["OpCreate"].diff)
+	assert.Equal(t, []time.Duration{4 * time.Millisecond, time.Millisecond}, c.ops["OpGetData"].diff)
+
+	var buf bytes.Buffer
+	writeComparison(&buf, c)
+	assert.Equal(t, `5 requests in the log, 5 operations in the stream, 3 matched
+2 requests not seen on the wire, 2 operations on the wire not in the log
+
+  OPERATION  OPS  CLIENT P50  WIRE P50  DIFF P50  DIFF P99  DIFF MAX
+   OpCreate    1         3ms       2ms       1ms       1ms       1ms
+  OpGetData    2         4ms       1ms       1ms       4ms       4ms
+`, buf.String())
+}
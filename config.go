@@ -0,0 +1,310 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// configPath is the YAML configuration file, none when empty
+var configPath string
+
+var (
+	// serverPorts are the TCP ports ZooKeeper servers listen on, a packet from one of them is a response
+	serverPorts = portList{zkDefaultPort}
+	// pathTemplates collapse znode paths into one entry of the per path statistics, e.g. /kafka/brokers/ids/*
+	pathTemplates []string
+	// clientLabels name the clients of known address ranges
+	clientLabels []clientLabel
+)
+
+// fileConfig is the configuration file. Every setting is optional and a flag given on the command line
+// wins over the file. Everything outside of capture is reloaded on SIGHUP.
+type fileConfig struct {
+	Capture struct {
+		Interface      string `yaml:"interface"`
+		Ports          []int  `yaml:"ports"`
+		SnapshotLength int32  `yaml:"snapshot_length"`
+		Backend        string `yaml:"backend"`
+		AFPacket       struct {
+			Fanout    int `yaml:"fanout"`
+			FrameSize int `yaml:"frame_size"`
+			BlockSize int `yaml:"block_size"`
+			Blocks    int `yaml:"blocks"`
+		} `yaml:"afpacket"`
+	} `yaml:"capture"`
+	LogLevel      string `yaml:"log_level"`
+	ListenAddress string `yaml:"listen_address"`
+	Filter        string `yaml:"filter"`
+	// Labels maps a label to the client address ranges it names, in CIDR notation or single addresses
+	Labels        map[string][]string `yaml:"labels"`
+	PathTemplates []string            `yaml:"path_templates"`
+	Outputs       struct {
+		SlowLog         string        `yaml:"slow_log"`
+		TriggerDir      string        `yaml:"trigger_dir"`
+		TriggerRingSize int           `yaml:"trigger_ring_size"`
+		TriggerCooldown time.Duration `yaml:"trigger_cooldown"`
+	} `yaml:"outputs"`
+	Thresholds struct {
+		Slow     []string `yaml:"slow"`
+		Triggers []string `yaml:"triggers"`
+	} `yaml:"thresholds"`
+}
+
+func loadConfig(fileName string) (*fileConfig, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &fileConfig{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config %v: %v", fileName, err)
+	}
+	return cfg, nil
+}
+
+// applyStartup sets what can only change before the capture starts: the capture itself, the HTTP address
+// and the outputs. Settings whose flag is in set were given on the command line and are kept.
+func (cfg *fileConfig) applyStartup(set map[string]bool) error {
+	if cfg.Capture.Interface != "" && !set["interface"] {
+		device = cfg.Capture.Interface
+	}
+	if len(cfg.Capture.Ports) > 0 && !set["port"] {
+		var ports portList
+		for _, p := range cfg.Capture.Ports {
+			if p <= 0 || p > 65535 {
+				return fmt.Errorf("invalid port %v", p)
+			}
+			ports = append(ports, layers.TCPPort(p))
+		}
+		serverPorts = ports
+	}
+	if cfg.Capture.SnapshotLength > 0 {
+		snapshotLen = cfg.Capture.SnapshotLength
+	}
+	if cfg.Capture.Backend != "" && !set["backend"] {
+		captureBackend = cfg.Capture.Backend
+	}
+	ring := cfg.Capture.AFPacket
+	if ring.Fanout > 0 && !set["afpacket-fanout"] {
+		afpacketFanout = ring.Fanout
+	}
+	if ring.FrameSize > 0 && !set["afpacket-frame-size"] {
+		afpacketFrameSize = ring.FrameSize
+	}
+	if ring.BlockSize > 0 && !set["afpacket-block-size"] {
+		afpacketBlockSize = ring.BlockSize
+	}
+	if ring.Blocks > 0 && !set["afpacket-blocks"] {
+		afpacketBlocks = ring.Blocks
+	}
+	if cfg.ListenAddress != "" && !set["listen-address"] {
+		addr = cfg.ListenAddress
+	}
+	if cfg.Outputs.SlowLog != "" && !set["slow-log"] {
+		slowLogPath = cfg.Outputs.SlowLog
+	}
+	if cfg.Outputs.TriggerDir != "" && !set["trigger-dir"] {
+		triggerDir = cfg.Outputs.TriggerDir
+	}
+	if cfg.Outputs.TriggerRingSize > 0 && !set["trigger-ring-size"] {
+		triggerRingSize = cfg.Outputs.TriggerRingSize
+	}
+	if cfg.Outputs.TriggerCooldown > 0 && !set["trigger-cooldown"] {
+		triggerCooldown = cfg.Outputs.TriggerCooldown
+	}
+	return cfg.applyRuntime(set)
+}
+
+// applyRuntime sets the filter, thresholds, labels, path templates and log level. Everything is validated
+// before anything changes so a bad file leaves the running settings alone.
+func (cfg *fileConfig) applyRuntime(set map[string]bool) error {
+	level := dl.Level()
+	if cfg.LogLevel != "" && !set["log-level"] {
+		if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			return err
+		}
+	}
+
+	expr := filterExpr
+	if !set["filter"] {
+		expr = cfg.Filter
+	}
+	f, err := filter.Parse(expr)
+	if err != nil {
+		return fmt.Errorf("invalid filter %q: %v", expr, err)
+	}
+
+	slow := thresholds
+	if !set["slow-threshold"] {
+		slow = nil
+		for _, rule := range cfg.Thresholds.Slow {
+			if err := slow.Set(rule); err != nil {
+				return err
+			}
+		}
+	}
+	rules := triggers
+	if !set["trigger"] {
+		rules = triggerRules{}
+		for _, rule := range cfg.Thresholds.Triggers {
+			if err := rules.Set(rule); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, template := range cfg.PathTemplates {
+		if _, err := path.Match(template, ""); err != nil {
+			return fmt.Errorf("invalid path template %q: %v", template, err)
+		}
+	}
+	labels, err := parseClientLabels(cfg.Labels)
+	if err != nil {
+		return err
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	dl.SetLevel(level)
+	filterExpr, opFilter = expr, f
+	thresholds, triggers = slow, rules
+	pathTemplates = cfg.PathTemplates
+	clientLabels = labels
+	return nil
+}
+
+// setFlags is the names of the flags given on the command line.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// reloadOnHangup reloads the runtime settings from the config file on every SIGHUP. A file that fails to
+// load or validate is logged and the previous settings stay.
+func reloadOnHangup(fileName string, set map[string]bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			cfg, err := loadConfig(fileName)
+			if err == nil {
+				err = cfg.applyRuntime(set)
+			}
+			if err == nil && slowLogOnReload {
+				stateMu.Lock()
+				err = openSlowLog()
+				stateMu.Unlock()
+			}
+			if err != nil {
+				logger.Error("failed to reload config", zap.String("file", fileName), zap.Error(err))
+				continue
+			}
+			logger.Info("reloaded config", zap.String("file", fileName), zap.Stringer("level", dl.Level()))
+		}
+	}()
+}
+
+// portList is a comma separated list of TCP ports. It implements flag.Value.
+type portList []layers.TCPPort
+
+func (p *portList) String() string {
+	ports := make([]string, len(*p))
+	for i, port := range *p {
+		ports[i] = strconv.Itoa(int(port))
+	}
+	return strings.Join(ports, ",")
+}
+
+func (p *portList) Set(value string) error {
+	var ports portList
+	for _, s := range strings.Split(value, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+		if err != nil || port == 0 {
+			return fmt.Errorf("invalid port %q", s)
+		}
+		ports = append(ports, layers.TCPPort(port))
+	}
+	*p = ports
+	return nil
+}
+
+// captureFilter limits the capture to the ZooKeeper server ports.
+func captureFilter() string {
+	ports := make([]string, len(serverPorts))
+	for i, p := range serverPorts {
+		ports[i] = fmt.Sprintf("port %d", p)
+	}
+	return "tcp and (" + strings.Join(ports, " or ") + ")"
+}
+
+// templatePath returns the first path template matching the path, or the path itself.
+func templatePath(p string) string {
+	for _, template := range pathTemplates {
+		if ok, _ := path.Match(template, p); ok {
+			return template
+		}
+	}
+	return p
+}
+
+type clientLabel struct {
+	name    string
+	network *net.IPNet
+}
+
+// parseClientLabels orders the labels from the most to the least specific network so the narrowest range wins.
+func parseClientLabels(config map[string][]string) ([]clientLabel, error) {
+	var labels []clientLabel
+	for name, networks := range config {
+		for _, network := range networks {
+			if !strings.Contains(network, "/") {
+				if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+					network += "/32"
+				} else {
+					network += "/128"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q for label %q: %v", network, name, err)
+			}
+			labels = append(labels, clientLabel{name: name, network: ipNet})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, _ := labels[i].network.Mask.Size()
+		b, _ := labels[j].network.Mask.Size()
+		if a != b {
+			return a > b
+		}
+		return labels[i].name < labels[j].name
+	})
+	return labels, nil
+}
+
+// labelFor names the client host, empty when no label covers it.
+func labelFor(ip net.IP) string {
+	for _, l := range clientLabels {
+		if l.network.Contains(ip) {
+			return l.name
+		}
+	}
+	return ""
+}
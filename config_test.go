@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const testConfig = `
+capture:
+  interface: lo
+  ports: [2181, 2182]
+  backend: afpacket
+  afpacket:
+    fanout: 4
+    blocks: 64
+log_level: warn
+filter: 'op == GetData'
+labels:
+  kafka: [10.1.0.0/16]
+  broker-1: [10.1.0.5]
+path_templates:
+  - /kafka/brokers/ids/*
+outputs:
+  trigger_cooldown: 30s
+thresholds:
+  slow: [100ms, 'GetData=20ms']
+  triggers: [decode-error]
+`
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "zkpacket-config")
+	require.NoError(t, err)
+	fileName := filepath.Join(dir, "zkpacket.yaml")
+	require.NoError(t, ioutil.WriteFile(fileName, []byte(content), 0644))
+	return fileName
+}
+
+func TestConfigFlagsOverride(t *testing.T) {
+	fileName := writeConfig(t, testConfig)
+	defer os.RemoveAll(filepath.Dir(fileName))
+	defer func(d string, p portList, cooldown time.Duration) {
+		device, serverPorts, triggerCooldown = d, p, cooldown
+		filterExpr, opFilter, thresholds, triggers = "", nil, nil, triggerRules{}
+		pathTemplates, clientLabels = nil, nil
+		captureBackend, afpacketFanout, afpacketBlocks = backendPcap, 1, 128
+		dl.SetLevel(zap.InfoLevel)
+	}(device, serverPorts, triggerCooldown)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	captureFlags(fs)
+	pipelineFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-interface", "eth1", "-slow-threshold", "1s", "-afpacket-fanout", "2"}))
+
+	cfg, err := loadConfig(fileName)
+	require.NoError(t, err)
+	require.NoError(t, cfg.applyStartup(setFlags(fs)))
+
+	assert.Equal(t, "eth1", device)
+	assert.Equal(t, portList{2181, 2182}, serverPorts)
+	assert.Equal(t, "tcp and (port 2181 or port 2182)", captureFilter())
+	assert.Equal(t, backendAFPacket, captureBackend)
+	assert.Equal(t, 2, afpacketFanout)
+	assert.Equal(t, 64, afpacketBlocks)
+	assert.Equal(t, 30*time.Second, triggerCooldown)
+	assert.Equal(t, zap.WarnLevel, dl.Level())
+	assert.Equal(t, "op == GetData", filterExpr)
+	assert.True(t, triggers.onDecodeError)
+
+	threshold, ok := thresholds.thresholdFor(proto.OpGetData, "/a")
+	require.True(t, ok)
+	assert.Equal(t, time.Second, threshold, "the flag replaces the thresholds of the file")
+
+	assert.Equal(t, "/kafka/brokers/ids/*", templatePath("/kafka/brokers/ids/3"))
+	assert.Equal(t, "/other", templatePath("/other"))
+	assert.Equal(t, "broker-1", labelFor(net.ParseIP("10.1.0.5")))
+	assert.Equal(t, "kafka", labelFor(net.ParseIP("10.1.2.3")))
+	assert.Equal(t, "", labelFor(net.ParseIP("10.2.0.1")))
+}
+
+func TestConfigReloadKeepsSettingsOnError(t *testing.T) {
+	defer func() {
+		filterExpr, opFilter = "", nil
+		dl.SetLevel(zap.InfoLevel)
+	}()
+
+	cfg := &fileConfig{LogLevel: "debug", Filter: "op == Create"}
+	require.NoError(t, cfg.applyRuntime(map[string]bool{}))
+	assert.Equal(t, zap.DebugLevel, dl.Level())
+
+	bad := &fileConfig{LogLevel: "error", Filter: "op =="}
+	assert.Error(t, bad.applyRuntime(map[string]bool{}))
+	assert.Equal(t, zap.DebugLevel, dl.Level())
+	assert.Equal(t, "op == Create", filterExpr)
+
+	fileName := writeConfig(t, "capture:\n  interfce: eth0\n")
+	defer os.RemoveAll(filepath.Dir(fileName))
+	_, err := loadConfig(fileName)
+	assert.Error(t, err, "unknown keys are rejected")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/loadgen"
+	"github.com/jeffbean/zkpacket/pcapgen"
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/zktest"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// TestEndToEnd runs zkload through the proxy to the fake server and checks zkpacket saw exactly the operations
+// and errors of zkload's manifest. `make e2e` runs it.
+func TestEndToEnd(t *testing.T) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	dir, err := ioutil.TempDir("", "e2e")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, args := range map[string][]string{
+		"rate":        {"-rate", "200", "-duration", "500ms", "-sessions", "2", "-goroutines", "2"},
+		"deep-multi":  {"-scenario", "deep-multi", "-size", "10"},
+		"set-watches": {"-scenario", "set-watches", "-size", "5"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, err := zktest.NewServer()
+			require.NoError(t, err)
+			defer server.Close()
+
+			topStats = newTopAggregator(time.Time{})
+			defer func() { topStats = nil }()
+			pool := newPool()
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			stop := make(chan struct{})
+			served := make(chan error)
+			go func() { served <- newProxy(server.Addr, pool).serve(l, stop) }()
+
+			manifest := filepath.Join(dir, name+".yaml")
+			fs := flag.NewFlagSet("zkload", flag.ContinueOnError)
+			loadgen.RegisterFlags(fs)
+			require.NoError(t, fs.Parse(append([]string{
+				"-zk-host", l.Addr().String(), "-seed", "1", "-prefix", "/e2e", "-manifest", manifest,
+			}, args...)))
+			require.NoError(t, loadgen.Run(zap.NewNop()))
+
+			close(stop)
+			require.NoError(t, <-served)
+			pool.Close()
+
+			m, err := loadgen.LoadManifest(manifest)
+			require.NoError(t, err)
+			require.NotEmpty(t, m.Counts)
+			var out bytes.Buffer
+			stateMu.Lock()
+			rows := checkManifest(m, topStats.ops)
+			stateMu.Unlock()
+			assert.Zero(t, writeCheck(&out, rows), "zkpacket saw different operations than zkload sent:\n%v", out.String())
+			if name == "deep-multi" {
+				assert.Equal(t, 3, m.Errors["OpMulti"], "the failed multis")
+			}
+		})
+	}
+}
+
+// TestEndToEndCapture decodes a generated capture of multis answered like ZooKeeper does, with an ok header
+// and the error in the results, and checks it against the manifest zkload would have written for it.
+func TestEndToEndCapture(t *testing.T) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	defer func(w io.Writer) { output = w }(output)
+	output = ioutil.Discard
+	resetTrackingState()
+	defer resetTrackingState()
+	topStats = newTopAggregator(time.Time{})
+	defer func() { topStats = nil }()
+
+	var buf bytes.Buffer
+	w, err := pcapgen.NewWriter(&buf, time.Unix(1500000000, 0))
+	require.NoError(t, err)
+	c, err := w.Dial(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 100), Port: zkDefaultPort})
+	require.NoError(t, err)
+	require.NoError(t, c.Connect(pcapgen.Connect{Session: 1, Timeout: 10 * time.Second}))
+	for _, op := range []pcapgen.Op{
+		{Type: proto.OpMulti, Ops: []pcapgen.Op{
+			{Type: proto.OpCreate, Path: "/jobs/1"},
+			{Type: proto.OpSetData, Path: "/jobs", Data: []byte("1")},
+		}},
+		{Type: proto.OpMulti, Ops: []pcapgen.Op{
+			{Type: proto.OpCheck, Path: "/jobs", Version: 7, Err: zk.ErrCode(-103)},
+			{Type: proto.OpDelete, Path: "/jobs/1"},
+		}},
+		{Type: proto.OpMulti, Ops: []pcapgen.Op{
+			{Type: proto.OpSetData, Path: "/jobs", Data: []byte("2")},
+			{Type: proto.OpCreate, Path: "/jobs/1", Err: zk.ErrCode(-110)},
+		}},
+		{Type: proto.OpGetData, Path: "/jobs"},
+	} {
+		require.NoError(t, c.Pipeline(time.Millisecond, op))
+	}
+
+	capturePackets(newMemorySource(t, &buf), newPool(), 0, nil)
+
+	m := &loadgen.Manifest{
+		Counts: map[string]int{"OpMulti": 3, "OpGetData": 1},
+		Errors: map[string]int{"OpMulti": 2},
+	}
+	var out bytes.Buffer
+	stateMu.Lock()
+	rows := checkManifest(m, topStats.ops)
+	stateMu.Unlock()
+	assert.Zero(t, writeCheck(&out, rows), "zkpacket saw different operations than the capture has:\n%v", out.String())
+}
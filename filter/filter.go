@@ -0,0 +1,74 @@
+// Package filter implements a small expression language over decoded ZooKeeper operations.
+//
+// Expressions compare fields of an operation and combine the comparisons with and, or, not and
+// parentheses, for example:
+//
+//	op in (SetData, Create) and path ^= "/kafka" and latency > 50ms and client in 10.1.0.0/16
+//
+// Fields: op, path, client, session, latency, err, xid, watch and size. Comparison operators are
+// == (or =), !=, <, <=, >, >=, ^= (prefix), $= (suffix), ~= (regular expression) and in.
+package filter
+
+import (
+	"net"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+)
+
+// Message holds the decoded fields of a ZooKeeper operation a filter can match on.
+// Fields that are not known yet, like the latency of a request still in flight, are left zero.
+type Message struct {
+	Op      proto.OpType
+	Path    string
+	Client  net.IP
+	Session int64
+	Latency time.Duration
+	Err     zk.ErrCode
+	Xid     int32
+	Watch   bool
+	// Size is the size in bytes of the data sent with the request
+	Size int
+}
+
+// Filter is a compiled filter expression. The nil Filter matches every message.
+type Filter struct {
+	expr  string
+	match func(*Message) bool
+}
+
+// Parse compiles the expression into a Filter. An empty expression matches everything.
+func Parse(expr string) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 1 {
+		return &Filter{expr: expr, match: matchAll}, nil
+	}
+	p := &parser{tokens: tokens}
+	match, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{expr: expr, match: match}, nil
+}
+
+// Match reports if the message satisfies the filter.
+func (f *Filter) Match(m *Message) bool {
+	if f == nil {
+		return true
+	}
+	return f.match(m)
+}
+
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+func matchAll(*Message) bool { return true }
@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterMatch(t *testing.T) {
+	msg := &Message{
+		Op:      proto.OpSetData,
+		Path:    "/kafka/brokers/ids/1",
+		Client:  net.ParseIP("10.1.4.2"),
+		Session: 0x15f3a2b7c0d0001,
+		Latency: 75 * time.Millisecond,
+		Err:     -101,
+		Xid:     42,
+		Size:    128,
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{``, true},
+		{`op in (SetData, Create) and path ^= "/kafka" and latency > 50ms and client in 10.1.0.0/16`, true},
+		{`op == OpSetData`, true},
+		{`op != setdata`, false},
+		{`op = GetData or op = SetData`, true},
+		{`path $= "/1"`, true},
+		{`path ~= "^/kafka/.*/ids"`, true},
+		{`path in ("/a", "/kafka/brokers/ids/1")`, true},
+		{`latency <= 50ms`, false},
+		{`not latency < 1s`, false},
+		{`client == 10.1.4.2`, true},
+		{`client != 10.1.4.2`, false},
+		{`client in (192.168.0.0/16, "10.0.0.0/8")`, true},
+		{`err == NoNode`, true},
+		{`err == -101 and xid >= 42 and size < 1024`, true},
+		{`session == 0x15f3a2b7c0d0001`, true},
+		{`watch`, false},
+		{`not watch`, true},
+		{`watch == false`, true},
+		{`(op == Create or op == Delete) and path ^= /kafka`, false},
+	}
+	for _, tt := range tests {
+		f, err := Parse(tt.expr)
+		if assert.NoError(t, err, tt.expr) {
+			assert.Equal(t, tt.want, f.Match(msg), tt.expr)
+		}
+	}
+}
+
+func TestFilterParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		`op`,
+		`bogus == 1`,
+		`op == NotAnOp`,
+		`latency > 50`,
+		`path < "/a"`,
+		`client in 10.1.0.0/99`,
+		`path == "/a`,
+		`(op == Create`,
+		`op in (Create, )`,
+		`op == Create and`,
+		`path ~= "("`,
+		`op == Create path == "/a"`,
+	} {
+		_, err := Parse(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestNilFilterMatchesAll(t *testing.T) {
+	var f *Filter
+	assert.True(t, f.Match(&Message{}))
+}
@@ -0,0 +1,107 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOperator
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q at offset %d", t.text, t.pos)
+}
+
+// is reports if the token is the given keyword, ignoring case.
+func (t token) is(keyword string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, keyword)
+}
+
+const operatorChars = "=!<>^$~"
+
+var operators = []string{"==", "!=", "<=", ">=", "^=", "$=", "~=", "=", "<", ">"}
+
+// lex splits an expression into tokens. Words are any run of characters that are not
+// whitespace, operators, quotes, commas or parentheses so literals like 10.1.0.0/16 or 50ms
+// come through as a single token.
+func lex(expr string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(expr) {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tokComma, ",", i})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			s, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %v", i, err)
+			}
+			tokens = append(tokens, token{tokString, s, i})
+			i = end + 1
+		case strings.ContainsRune(operatorChars, c):
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unknown operator %q at offset %d", c, i)
+			}
+			tokens = append(tokens, token{tokOperator, op, i})
+			i += len(op)
+		default:
+			start := i
+			for i < len(expr) && !isWordBreak(rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokWord, expr[start:i], start})
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(expr)}), nil
+}
+
+func isWordBreak(c rune) bool {
+	return unicode.IsSpace(c) || strings.ContainsRune(`(),"`+operatorChars, c)
+}
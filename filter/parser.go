@@ -0,0 +1,358 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/zkerrors"
+)
+
+type matcher func(*Message) bool
+
+// compiler builds a matcher for a field given the comparison operator and its values.
+// Only the in operator has more than one value.
+type compiler func(op string, values []token) (matcher, error)
+
+var fields = map[string]compiler{
+	"op":     compileOp,
+	"path":   compileString(func(m *Message) string { return m.Path }),
+	"client": compileClient,
+	"latency": compileInt(func(m *Message) int64 { return int64(m.Latency) }, func(s string) (int64, error) {
+		d, err := time.ParseDuration(s)
+		return int64(d), err
+	}),
+	"session": compileInt(func(m *Message) int64 { return m.Session }, parseInt),
+	"err":     compileInt(func(m *Message) int64 { return int64(m.Err) }, parseErrCode),
+	"xid":     compileInt(func(m *Message) int64 { return int64(m.Xid) }, parseInt),
+	"size":    compileInt(func(m *Message) int64 { return int64(m.Size) }, parseInt),
+	"watch":   compileBool(func(m *Message) bool { return m.Watch }),
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parse() (matcher, error) {
+	m, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %v", t)
+	}
+	return m, nil
+}
+
+func (p *parser) parseOr() (matcher, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m *Message) bool { return l(m) || right(m) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (matcher, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m *Message) bool { return l(m) && right(m) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (matcher, error) {
+	if p.peek().is("not") {
+		p.next()
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *Message) bool { return !inner(m) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (matcher, error) {
+	t := p.next()
+	switch t.kind {
+	case tokLParen:
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, fmt.Errorf("expected ) but found %v", closing)
+		}
+		return m, nil
+	case tokWord:
+		return p.parseComparison(t)
+	}
+	return nil, fmt.Errorf("expected a field or ( but found %v", t)
+}
+
+func (p *parser) parseComparison(field token) (matcher, error) {
+	compile, ok := fields[strings.ToLower(field.text)]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %v", field)
+	}
+	var name string
+	var values []token
+	switch op := p.peek(); {
+	case op.kind == tokOperator:
+		p.next()
+		value := p.next()
+		if value.kind != tokWord && value.kind != tokString {
+			return nil, fmt.Errorf("expected a value after %v but found %v", op, value)
+		}
+		name, values = op.text, []token{value}
+		if name == "=" {
+			name = "=="
+		}
+	case op.is("in"):
+		p.next()
+		var err error
+		if values, err = p.parseList(); err != nil {
+			return nil, err
+		}
+		name = "in"
+	}
+	// With no operator the field is a boolean test on its own, like "watch".
+	m, err := compile(name, values)
+	if err != nil {
+		return nil, fmt.Errorf("field %v: %v", field, err)
+	}
+	return m, nil
+}
+
+// parseList reads either a single value or a parenthesised, comma separated list of values.
+func (p *parser) parseList() ([]token, error) {
+	if p.peek().kind != tokLParen {
+		value := p.next()
+		if value.kind != tokWord && value.kind != tokString {
+			return nil, fmt.Errorf("expected a value after in but found %v", value)
+		}
+		return []token{value}, nil
+	}
+	p.next()
+	var values []token
+	for {
+		value := p.next()
+		if value.kind != tokWord && value.kind != tokString {
+			return nil, fmt.Errorf("expected a value in list but found %v", value)
+		}
+		values = append(values, value)
+		sep := p.next()
+		if sep.kind == tokRParen {
+			return values, nil
+		}
+		if sep.kind != tokComma {
+			return nil, fmt.Errorf("expected , or ) in list but found %v", sep)
+		}
+	}
+}
+
+func unsupported(op string) error {
+	if op == "" {
+		return fmt.Errorf("missing comparison")
+	}
+	return fmt.Errorf("operator %v is not supported", op)
+}
+
+func compileOp(op string, values []token) (matcher, error) {
+	ops := make(map[proto.OpType]bool, len(values))
+	for _, v := range values {
+		o, ok := proto.OpTypeFromName(v.text)
+		if !ok {
+			return nil, fmt.Errorf("unknown operation %v", v)
+		}
+		ops[o] = true
+	}
+	switch op {
+	case "==", "in":
+		return func(m *Message) bool { return ops[m.Op] }, nil
+	case "!=":
+		return func(m *Message) bool { return !ops[m.Op] }, nil
+	}
+	return nil, unsupported(op)
+}
+
+func compileString(get func(*Message) string) compiler {
+	return func(op string, values []token) (matcher, error) {
+		switch op {
+		case "in":
+			set := make(map[string]bool, len(values))
+			for _, v := range values {
+				set[v.text] = true
+			}
+			return func(m *Message) bool { return set[get(m)] }, nil
+		case "==", "!=", "^=", "$=", "~=":
+		default:
+			return nil, unsupported(op)
+		}
+		value := values[0].text
+		switch op {
+		case "==":
+			return func(m *Message) bool { return get(m) == value }, nil
+		case "!=":
+			return func(m *Message) bool { return get(m) != value }, nil
+		case "^=":
+			return func(m *Message) bool { return strings.HasPrefix(get(m), value) }, nil
+		case "$=":
+			return func(m *Message) bool { return strings.HasSuffix(get(m), value) }, nil
+		}
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *Message) bool { return re.MatchString(get(m)) }, nil
+	}
+}
+
+func compileInt(get func(*Message) int64, parse func(string) (int64, error)) compiler {
+	return func(op string, values []token) (matcher, error) {
+		nums := make([]int64, len(values))
+		for i, v := range values {
+			n, err := parse(v.text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %v: %v", v, err)
+			}
+			nums[i] = n
+		}
+		var cmp func(a, b int64) bool
+		switch op {
+		case "in":
+			return func(m *Message) bool {
+				got := get(m)
+				for _, n := range nums {
+					if got == n {
+						return true
+					}
+				}
+				return false
+			}, nil
+		case "==":
+			cmp = func(a, b int64) bool { return a == b }
+		case "!=":
+			cmp = func(a, b int64) bool { return a != b }
+		case "<":
+			cmp = func(a, b int64) bool { return a < b }
+		case "<=":
+			cmp = func(a, b int64) bool { return a <= b }
+		case ">":
+			cmp = func(a, b int64) bool { return a > b }
+		case ">=":
+			cmp = func(a, b int64) bool { return a >= b }
+		default:
+			return nil, unsupported(op)
+		}
+		n := nums[0]
+		return func(m *Message) bool { return cmp(get(m), n) }, nil
+	}
+}
+
+func compileBool(get func(*Message) bool) compiler {
+	return func(op string, values []token) (matcher, error) {
+		want := true
+		switch op {
+		case "":
+		case "==", "!=":
+			b, err := strconv.ParseBool(values[0].text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %v: %v", values[0], err)
+			}
+			want = b == (op == "==")
+		default:
+			return nil, unsupported(op)
+		}
+		return func(m *Message) bool { return get(m) == want }, nil
+	}
+}
+
+func compileClient(op string, values []token) (matcher, error) {
+	nets := make([]*net.IPNet, len(values))
+	for i, v := range values {
+		ipNet, err := parseIPNet(v.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %v: %v", v, err)
+		}
+		nets[i] = ipNet
+	}
+	contains := func(m *Message) bool {
+		for _, n := range nets {
+			if n.Contains(m.Client) {
+				return true
+			}
+		}
+		return false
+	}
+	switch op {
+	case "==", "in":
+		return contains, nil
+	case "!=":
+		return func(m *Message) bool { return !contains(m) }, nil
+	}
+	return nil, unsupported(op)
+}
+
+// parseIPNet accepts either a CIDR block or a single address, which is treated as a host route.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP address")
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseInt accepts decimal as well as prefixed hex values, which is how session IDs are usually shown.
+func parseInt(s string) (int64, error) {
+	return strconv.ParseInt(s, 0, 64)
+}
+
+// parseErrCode accepts numeric codes like -101 as well as names like NoNode.
+func parseErrCode(s string) (int64, error) {
+	if ec, ok := zkerrors.ZKErrCodeFromName(s); ok {
+		return int64(ec), nil
+	}
+	return strconv.ParseInt(s, 10, 32)
+}
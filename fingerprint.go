@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var clientsDesc = prometheus.NewDesc("zk_clients",
+	"Number of sessions by what their handshake tells of the client library.",
+	[]string{"read_only_flag", "protocol_version", "read_only", "first_op", "set_watches"}, nil)
+
+// clientFingerprint are the traits of a session that tell client libraries and their versions apart.
+type clientFingerprint struct {
+	// handshake is set when the connect request was captured, the traits it holds are unknown otherwise
+	handshake       bool
+	protocolVersion int32
+	// readOnly is the read-only flag of the connect request, empty for clients that don't send it
+	readOnly string
+	// firstOp is the first request after the connect
+	firstOp    string
+	setWatches bool
+}
+
+func newFingerprint(h *sniffer.Handshake) clientFingerprint {
+	if h == nil {
+		return clientFingerprint{}
+	}
+	f := clientFingerprint{handshake: true, protocolVersion: h.ProtocolVersion}
+	if h.ReadOnly != nil {
+		f.readOnly = strconv.FormatBool(*h.ReadOnly)
+	}
+	return f
+}
+
+// observe records a request of the session.
+func (f *clientFingerprint) observe(op proto.OpType) {
+	if f.firstOp == "" {
+		f.firstOp = op.String()
+	}
+	if op == proto.OpSetWatches {
+		f.setWatches = true
+	}
+}
+
+// readOnlyFlag tells if the connect request had the read-only flag. Clients since ZooKeeper 3.4 send it, older
+// ones and libraries that never took it up, like go-zookeeper, don't.
+func (f clientFingerprint) readOnlyFlag() string {
+	switch {
+	case !f.handshake:
+		return "unknown"
+	case f.readOnly == "":
+		return "absent"
+	default:
+		return "sent"
+	}
+}
+
+func (f clientFingerprint) labels() []string {
+	version := ""
+	if f.handshake {
+		version = strconv.Itoa(int(f.protocolVersion))
+	}
+	return []string{f.readOnlyFlag(), version, f.readOnly, f.firstOp, strconv.FormatBool(f.setWatches)}
+}
+
+// observeHandshake records the timeouts of a connect and counts the reconnects of clients that had seen a
+// transaction before.
+func observeHandshake(s *sniffer.Session) {
+	if h := s.Handshake; h != nil {
+		sessionTimeoutHistogram.With(prometheus.Labels{"timeout": "requested"}).Observe(h.Timeout.Seconds())
+		if h.LastZxidSeen != 0 {
+			reconnectCounter.WithLabelValues().Inc()
+		}
+	}
+	if !s.Expired {
+		sessionTimeoutHistogram.With(prometheus.Labels{"timeout": "negotiated"}).Observe(s.Timeout.Seconds())
+	}
+}
+
+// clientFingerprints counts the live sessions by fingerprint when scraped.
+type clientFingerprints struct{}
+
+func (clientFingerprints) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientsDesc
+}
+
+func (clientFingerprints) Collect(ch chan<- prometheus.Metric) {
+	stateMu.Lock()
+	expireSessions(captureNow())
+	counts := make(map[clientFingerprint]int)
+	for _, s := range connSessions {
+		counts[s.fingerprint]++
+	}
+	stateMu.Unlock()
+
+	for f, n := range counts {
+		ch <- prometheus.MustNewConstMetric(clientsDesc, prometheus.GaugeValue, float64(n), f.labels()...)
+	}
+}
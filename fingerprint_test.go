@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientFingerprints(t *testing.T) {
+	resetTrackingState()
+	defer resetTrackingState()
+	defer func() { clock = &captureClock{} }()
+
+	start := time.Unix(1500000000, 0)
+	clock = &captureClock{offline: true}
+	clock.tick(start)
+	readOnly := false
+	java := sniffer.Client{Host: net.ParseIP("10.0.0.1"), Port: 5000}
+	golang := sniffer.Client{Host: net.ParseIP("10.0.0.2"), Port: 5000}
+	unknown := sniffer.Client{Host: net.ParseIP("10.0.0.3"), Port: 5000}
+
+	reconnects := counterValue(t, reconnectCounter.WithLabelValues())
+	p := &pipeline{}
+	p.Session(&sniffer.Session{Client: java, Time: start, ID: 1, Timeout: 6 * time.Second,
+		Handshake: &sniffer.Handshake{LastZxidSeen: 0x100000003, Timeout: 6 * time.Second, SessionID: 1, ReadOnly: &readOnly}})
+	p.Session(&sniffer.Session{Client: golang, Time: start, ID: 2, Timeout: 10 * time.Second,
+		Handshake: &sniffer.Handshake{Timeout: 30 * time.Second}})
+	p.Session(&sniffer.Session{Client: unknown, Time: start, ID: 3, Timeout: 10 * time.Second})
+	assert.Equal(t, reconnects+1, counterValue(t, reconnectCounter.WithLabelValues()))
+
+	p.Request(&sniffer.Request{Client: java, Time: start, Xid: -8, Op: proto.OpSetWatches})
+	p.Request(&sniffer.Request{Client: java, Time: start, Xid: 1, Op: proto.OpGetData})
+	p.Request(&sniffer.Request{Client: golang, Time: start, Xid: 1, Op: proto.OpExists})
+	p.Request(&sniffer.Request{Client: golang, Time: start, Xid: 2, Op: proto.OpGetData})
+	assert.Equal(t, 30*time.Second, connSessions[golang.String()].requested)
+
+	ch := make(chan prometheus.Metric, 10)
+	clientFingerprints{}.Collect(ch)
+	close(ch)
+	var clients []string
+	for m := range ch {
+		out := &dto.Metric{}
+		require.NoError(t, m.Write(out))
+		var labels []string
+		for _, l := range out.Label {
+			labels = append(labels, l.GetName()+"="+l.GetValue())
+		}
+		require.Equal(t, 1.0, out.GetGauge().GetValue())
+		clients = append(clients, strings.Join(labels, ","))
+	}
+	sort.Strings(clients)
+	assert.Equal(t, []string{
+		"first_op=,protocol_version=,read_only=,read_only_flag=unknown,set_watches=false",
+		"first_op=OpExists,protocol_version=0,read_only=,read_only_flag=absent,set_watches=false",
+		"first_op=OpSetWatches,protocol_version=0,read_only=false,read_only_flag=sent,set_watches=true",
+	}, clients)
+
+	// Closed and expired sessions are not counted
+	p.Closed(java, start)
+	clock.tick(start.Add(11 * time.Second))
+	ch = make(chan prometheus.Metric, 10)
+	clientFingerprints{}.Collect(ch)
+	close(ch)
+	assert.Empty(t, ch)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the testdata pcaps")
+
+// goldenMetrics are the metrics the golden files keep. The processing time depends on the machine.
+var goldenMetrics = map[string]bool{
+	"zk_op_count":                        true,
+	"zk_op_seconds":                      true,
+	"zk_ping_seconds":                    true,
+	"zk_session_reconnects_total":        true,
+	"zk_session_timeout_seconds":         true,
+	"zk_clients":                         true,
+	"zk_zxid_epoch":                      true,
+	"zk_zxid_counter":                    true,
+	"zk_transactions_total":              true,
+	"zk_epoch_changes_total":             true,
+	"zk_slow_ops_total":                  true,
+	"zkpacket_decode_errors_total":       true,
+	"zkpacket_packets_processed_total":   true,
+	"zkpacket_truncated_packets_total":   true,
+	"zkpacket_unmatched_responses_total": true,
+	"zkpacket_unanswered_requests_total": true,
+	"zkpacket_pending_requests":          true,
+}
+
+// TestGolden runs every pcap in testdata through the pipeline like `zkpacket read` and compares what was
+// decoded and the metrics with the golden file next to it. Run `go test -run Golden -update` to rewrite them
+// after a change in behaviour, and review the diff.
+func TestGolden(t *testing.T) {
+	pcaps, err := filepath.Glob("testdata/*.pcap")
+	require.NoError(t, err)
+	require.NotEmpty(t, pcaps)
+	for _, name := range pcaps {
+		name := name
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			got := runGolden(t, name)
+			goldenName := strings.TrimSuffix(name, ".pcap") + ".golden"
+			if *update {
+				require.NoError(t, ioutil.WriteFile(goldenName, []byte(got), 0644))
+				return
+			}
+			want, err := ioutil.ReadFile(goldenName)
+			require.NoError(t, err, "run go test -run Golden -update to create it")
+			assert.Equal(t, string(want), got, "%v changed, run go test -run Golden -update if that is expected", name)
+		})
+	}
+}
+
+// fileSource reads a pcap file without libpcap.
+type fileSource struct {
+	*pcapgo.Reader
+	f *os.File
+}
+
+func (s fileSource) LinkType() layers.LinkType { return s.Reader.LinkType() }
+func (s fileSource) Stats() (captureStats, error) {
+	return captureStats{}, fmt.Errorf("no statistics for files")
+}
+func (s fileSource) Close() { s.f.Close() }
+
+// runGolden decodes the pcap with fresh tracking state and metrics and returns the golden file content.
+func runGolden(t *testing.T, name string) string {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	resetTrackingState()
+	operationCounter.Reset()
+	operationHistogram.Reset()
+	pingHistogram.Reset()
+	sessionTimeoutHistogram.Reset()
+	reconnectCounter.Reset()
+	zxidEpochGauge.Reset()
+	zxidCounterGauge.Reset()
+	transactionCounter.Reset()
+	epochChangeCounter.Reset()
+	zxids = newZxidTracker()
+	defer func() { clock = &captureClock{} }()
+	clock = &captureClock{offline: true}
+	slowOperationCounter.Reset()
+	decodeErrorCounter.Reset()
+	defer func(w io.Writer) { output = w }(output)
+	output = ioutil.Discard
+
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	r, err := pcapgo.NewReader(f)
+	require.NoError(t, err)
+	source := fileSource{Reader: r, f: f}
+	defer source.Close()
+
+	g := &goldenRecorder{}
+	pool := newPool(sniffer.WithObserver(g))
+	capturePackets(source, pool, 0, nil)
+	for _, req := range pool.Pending() {
+		g.printf("pending %v %v xid=%v %v %q", req.Time.Format(time.RFC3339Nano), req.Client, req.Xid, req.Op, req.Path)
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	g.buf.WriteString("\n")
+	for _, family := range families {
+		if goldenMetrics[family.GetName()] {
+			_, err := expfmt.MetricFamilyToText(&g.buf, family)
+			require.NoError(t, err)
+		}
+	}
+	return g.buf.String()
+}
+
+// goldenRecorder writes a line for everything the sniffer decodes.
+type goldenRecorder struct {
+	sniffer.NopObserver
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (g *goldenRecorder) printf(format string, args ...interface{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(&g.buf, format+"\n", args...)
+}
+
+func (g *goldenRecorder) Session(s *sniffer.Session) {
+	g.printf("session %v %v id=%#x timeout=%v expired=%v", s.Time.Format(time.RFC3339Nano), s.Client, s.ID, s.Timeout, s.Expired)
+}
+
+func (g *goldenRecorder) Response(r *sniffer.Response) {
+	body, err := json.Marshal(r.Body)
+	if err != nil {
+		body = []byte(err.Error())
+	}
+	req := r.Request
+	g.printf("response %v %v session=%#x xid=%v %v %q watch=%v size=%v zxid=%v err=%v latency=%v body=%s",
+		r.Time.Format(time.RFC3339Nano), req.Client, r.Session, req.Xid, req.Op, req.Path, req.Watch, req.Size, r.Zxid, int32(r.Err), r.Latency, body)
+}
+
+func (g *goldenRecorder) WatchEvent(e *sniffer.WatchEvent) {
+	g.printf("watch %v %v zxid=%v %v state=%v %q", e.Time.Format(time.RFC3339Nano), e.Client, e.Zxid, e.Type, int32(e.State), e.Path)
+}
+
+func (g *goldenRecorder) DecodeError(c sniffer.Client, err error) {
+	g.printf("decode_error %v %v", c, err)
+}
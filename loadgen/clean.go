@@ -0,0 +1,89 @@
+package loadgen
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"go.uber.org/zap"
+)
+
+var (
+	// prefix is the node every generated node is created under
+	prefix = "/zkload"
+	// keep leaves the generated nodes in place on exit
+	keep bool
+)
+
+// checkPrefix refuses prefixes that would have zkload clean up nodes it didn't create.
+func checkPrefix(p string) error {
+	if !strings.HasPrefix(p, "/") || path.Clean(p) != p {
+		return fmt.Errorf("the prefix %q is not an absolute path", p)
+	}
+	if p == "/" || p == "/zookeeper" || strings.HasPrefix(p, "/zookeeper/") {
+		return fmt.Errorf("the prefix %q would remove nodes zkload didn't create", p)
+	}
+	return nil
+}
+
+// createPath creates the node and any missing parents.
+func createPath(conn *zk.Conn, node string) error {
+	for i := 1; i <= len(node); i++ {
+		if i < len(node) && node[i] != '/' {
+			continue
+		}
+		if _, err := conn.Create(node[:i], nil, 0, zk.WorldACL(zk.PermAll)); err != nil && err != zk.ErrNodeExists {
+			return fmt.Errorf("failed to create %v: %v", node[:i], err)
+		}
+	}
+	return nil
+}
+
+// deleteTree deletes the node and everything under it.
+func deleteTree(conn *zk.Conn, node string) error {
+	children, _, err := conn.Children(node)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list %v: %v", node, err)
+	}
+	for _, child := range children {
+		if err := deleteTree(conn, node+"/"+child); err != nil {
+			return err
+		}
+	}
+	if err := conn.Delete(node, -1); err != nil && err != zk.ErrNoNode {
+		return fmt.Errorf("failed to delete %v: %v", node, err)
+	}
+	return nil
+}
+
+// cleanup removes the prefix and everything under it on exit, unless -keep is set.
+func cleanup(conn *zk.Conn) error {
+	if keep {
+		return nil
+	}
+	logger.Info("removing the generated nodes", zap.String("prefix", prefix))
+	return deleteTree(conn, prefix)
+}
+
+// Clean removes the -prefix and everything under it.
+func Clean(l *zap.Logger) error {
+	logger = l
+	if err := checkPrefix(prefix); err != nil {
+		return err
+	}
+	conn, err := dial([]string{zkHost}, 3*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := deleteTree(conn.Conn, prefix); err != nil {
+		return err
+	}
+	logger.Info("removed", zap.String("prefix", prefix))
+	return nil
+}
@@ -0,0 +1,74 @@
+package loadgen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/zktest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCheckPrefix(t *testing.T) {
+	for _, p := range []string{"/zkload", "/test/zkload", "/zookeeper-load"} {
+		assert.NoError(t, checkPrefix(p), p)
+	}
+	for _, p := range []string{"", "zkload", "/", "/zkload/", "/a//b", "/zookeeper", "/zookeeper/quota"} {
+		assert.Error(t, checkPrefix(p), p)
+	}
+}
+
+func TestCreatePath(t *testing.T) {
+	server, err := zktest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	conn, err := dial([]string{server.Addr}, defaultSessionTimeout)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, createPath(conn.Conn, "/a/b/c"))
+	require.NoError(t, createPath(conn.Conn, "/a/b/d"), "existing parents are kept")
+	children, _ := server.Children("/a/b")
+	assert.Equal(t, []string{"c", "d"}, children)
+
+	require.NoError(t, deleteTree(conn.Conn, "/a"))
+	_, ok := server.Get("/a")
+	assert.False(t, ok)
+	assert.NoError(t, deleteTree(conn.Conn, "/a"), "a missing tree is already deleted")
+}
+
+func TestClean(t *testing.T) {
+	server, err := zktest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	defer func(host, p string) { zkHost, prefix = host, p }(zkHost, prefix)
+	zkHost, prefix = server.Addr, "/test/zkload"
+
+	conn, err := dial([]string{server.Addr}, 5*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, createPath(conn.Conn, "/test/zkload/a/b"))
+	require.NoError(t, createPath(conn.Conn, "/test/other"))
+
+	keep = true
+	require.NoError(t, cleanup(conn.Conn))
+	keep = false
+	_, ok := server.Get("/test/zkload/a/b")
+	assert.True(t, ok, "-keep leaves the nodes")
+
+	require.NoError(t, Clean(zap.NewNop()))
+	children, _ := server.Children("/test")
+	assert.Equal(t, []string{"other"}, children)
+	require.NoError(t, Clean(zap.NewNop()), "cleaning twice")
+
+	prefix = "/"
+	assert.Error(t, Clean(zap.NewNop()))
+}
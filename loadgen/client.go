@@ -0,0 +1,308 @@
+package loadgen
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/workload"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	clientLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "zkload_op_seconds",
+			Help: "The time from calling the client to its answer, by operation as sent on the wire.",
+		},
+		[]string{"operation"},
+	)
+	clientErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "zkload_op_errors_total",
+			Help: "Number of operations the client returned an error for.",
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(clientLatency)
+	prometheus.MustRegister(clientErrors)
+}
+
+// client is a connection that times the operations sent through do, for the metrics and the request log.
+type client struct {
+	*zk.Conn
+	// events are the session events, the client drops them when nobody reads them
+	events <-chan zk.Event
+	tap    *xidTap
+	faults *faults
+}
+
+func dial(servers []string, timeout time.Duration) (*client, error) {
+	tap := &xidTap{expected: make(map[string]int), sent: make(map[string][]sentRequest)}
+	f := &faults{}
+	conn, events, err := zk.Connect(servers, timeout, zk.WithLogger(zap.NewStdLog(logger)), zk.WithDialer(f.dialer(tap.dial)))
+	if err != nil {
+		return nil, err
+	}
+	return &client{Conn: conn, events: events, tap: tap, faults: f}, nil
+}
+
+// do sends the operation and records how long the client took to answer.
+func (c *client) do(op *workload.Op) error {
+	c.tap.expect(op.Path)
+	start := time.Now()
+	err := runOp(c.Conn, op)
+	if err == errNotReplayable {
+		c.tap.take(op.Path)
+		return err
+	}
+	latency := time.Since(start)
+
+	name := op.Op
+	sent, ok := c.tap.take(op.Path)
+	if ok {
+		name = sent.op.String()
+	}
+	clientLatency.WithLabelValues(name).Observe(latency.Seconds())
+	if err != nil {
+		clientErrors.WithLabelValues(name).Inc()
+	}
+	requests.write(&RequestRecord{
+		Time:    start,
+		Session: c.SessionID(),
+		Xid:     sent.xid,
+		Op:      name,
+		Path:    op.Path,
+		Latency: latency,
+		Err:     errString(err),
+	})
+	return err
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+type sentRequest struct {
+	xid int32
+	op  proto.OpType
+}
+
+// xidTap reads the header of the requests the client writes, as the client doesn't tell the xid of a request.
+// Requests are told apart by their path, the oldest request sent on a path is taken first. Only requests on the
+// paths do is sending on are kept, not the ones sent by calling the client directly.
+type xidTap struct {
+	mu       sync.Mutex
+	expected map[string]int
+	sent     map[string][]sentRequest
+}
+
+// expect tells the tap do is about to send a request on the path.
+func (t *xidTap) expect(path string) {
+	t.mu.Lock()
+	t.expected[path]++
+	t.mu.Unlock()
+}
+
+func (t *xidTap) dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &tapConn{Conn: conn, tap: t, pending: make(map[int32]ManifestOp)}, nil
+}
+
+// write is called with every frame before the client writes it.
+func (t *xidTap) write(frame []byte) {
+	if len(frame) < 4+proto.RequestHeaderByteLength {
+		return
+	}
+	xid := int32(binary.BigEndian.Uint32(frame[4:]))
+	op := proto.OpType(binary.BigEndian.Uint32(frame[8:]))
+	// The connect has no header, pings and the watch resets on reconnect have negative xids or are not sent
+	// through do
+	if xid <= 0 || op == proto.OpSetWatches || op == proto.OpSetAuth || op == proto.OpClose {
+		return
+	}
+	path, _ := requestPath(op, frame[4+proto.RequestHeaderByteLength:])
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.expected[path] == 0 {
+		return
+	}
+	t.expected[path]--
+	t.sent[path] = append(t.sent[path], sentRequest{xid: xid, op: op})
+}
+
+// take removes the oldest request sent on the path, false when do's request was not sent.
+func (t *xidTap) take(path string) (sentRequest, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sent := t.sent[path]
+	if len(sent) == 0 {
+		if t.expected[path] > 0 {
+			t.expected[path]--
+		}
+		return sentRequest{}, false
+	}
+	if len(sent) == 1 {
+		delete(t.sent, path)
+	} else {
+		t.sent[path] = sent[1:]
+	}
+	return sent[0], true
+}
+
+// requestPath is the path a request body starts with, empty for a multi and the requests without one, and the
+// watch flag that follows the path of the reads.
+func requestPath(op proto.OpType, body []byte) (string, bool) {
+	switch op {
+	case proto.OpMulti, proto.OpClose, proto.OpSetWatches, proto.OpSetAuth, proto.OpSasl:
+		return "", false
+	}
+	if len(body) < 4 {
+		return "", false
+	}
+	n := int(int32(binary.BigEndian.Uint32(body)))
+	if n < 0 || 4+n > len(body) {
+		return "", false
+	}
+	path := string(body[4 : 4+n])
+	switch op {
+	case proto.OpGetData, proto.OpExists, proto.OpGetChildren, proto.OpGetChildren2:
+		return path, len(body) > 4+n && body[4+n] != 0
+	}
+	return path, false
+}
+
+// tapConn shows the frames of a connection to the xid tap and, when zkload writes a manifest, pairs the
+// requests with the headers of their answers.
+type tapConn struct {
+	net.Conn
+	tap *xidTap
+
+	mu sync.Mutex
+	// wrote and read are set once the connect request and response went by, they have no header
+	wrote, read bool
+	pending     map[int32]ManifestOp
+	// in is what was read of an answer that is not complete yet
+	in []byte
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+	// Before the write, the answer can arrive before Write returns
+	c.tap.write(b)
+	if manifest != nil {
+		c.request(b)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *tapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && manifest != nil {
+		c.answers(b[:n])
+	}
+	return n, err
+}
+
+func (c *tapConn) Close() error {
+	if manifest != nil {
+		c.unanswered()
+	}
+	return c.Conn.Close()
+}
+
+func (c *tapConn) request(frame []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.wrote {
+		c.wrote = true
+		return
+	}
+	if len(frame) < 4+proto.RequestHeaderByteLength {
+		return
+	}
+	xid := int32(binary.BigEndian.Uint32(frame[4:]))
+	op := proto.OpType(binary.BigEndian.Uint32(frame[8:]))
+	if op == proto.OpPing {
+		return
+	}
+	path, watch := requestPath(op, frame[4+proto.RequestHeaderByteLength:])
+	c.pending[xid] = ManifestOp{Op: op.String(), Path: path, Watch: watch}
+}
+
+// answers reads the response headers out of the stream the client reads.
+func (c *tapConn) answers(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.in = append(c.in, b...)
+	for len(c.in) >= 4 {
+		n := 4 + int(binary.BigEndian.Uint32(c.in))
+		if len(c.in) < n {
+			return
+		}
+		frame := c.in[4:n]
+		if !c.read {
+			c.read = true
+		} else if len(frame) >= proto.ResponseHeaderByteLength {
+			xid := int32(binary.BigEndian.Uint32(frame))
+			if op, ok := c.pending[xid]; ok {
+				delete(c.pending, xid)
+				op.Err = zk.ErrCode(int32(binary.BigEndian.Uint32(frame[12:])))
+				if op.Err == 0 && op.Op == proto.OpMulti.String() {
+					op.Err = multiErr(frame[proto.ResponseHeaderByteLength:])
+				}
+				manifest.add(op)
+			}
+		}
+		c.in = c.in[n:]
+	}
+	if len(c.in) == 0 {
+		c.in = nil
+	}
+}
+
+// multiErr is the error of the first failed operation in the results of a multi.
+func multiErr(body []byte) zk.ErrCode {
+	multi := &proto.MultiResponse{}
+	if _, err := multi.Decode(body); err != nil {
+		return 0
+	}
+	return multi.Err()
+}
+
+// unanswered adds the requests still waiting for an answer when the connection closes.
+func (c *tapConn) unanswered() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	xids := make([]int, 0, len(c.pending))
+	for xid := range c.pending {
+		xids = append(xids, int(xid))
+	}
+	sort.Ints(xids)
+	for _, xid := range xids {
+		op := c.pending[int32(xid)]
+		op.NoResponse = true
+		manifest.add(op)
+	}
+	c.pending = make(map[int32]ManifestOp)
+}
+
+// sessionString formats a session id like the zkpacket event stream.
+func sessionString(id int64) string {
+	return "0x" + strconv.FormatInt(id, 16)
+}
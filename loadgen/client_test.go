@@ -0,0 +1,64 @@
+package loadgen
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/workload"
+	"github.com/jeffbean/zkpacket/zktest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestClientRequestLog(t *testing.T) {
+	server, err := zktest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	f, err := ioutil.TempFile("", "requests")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	requests, err = newRequestLog(f.Name(), "json")
+	require.NoError(t, err)
+	defer func() { requests = nil }()
+
+	conn, err := dial([]string{server.Addr}, 5*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, op := range []workload.Op{
+		{Op: "OpCreate", Path: "/a"},
+		{Op: "OpGetChildren", Path: "/a"},
+		{Op: "OpGetData", Path: "/missing"},
+		{Op: "OpMulti", Ops: []workload.Op{{Op: "OpCreate", Path: "/a/b"}, {Op: "OpDelete", Path: "/a/b", Version: -1}}},
+	} {
+		conn.do(&op)
+	}
+	require.NoError(t, requests.Close())
+	assert.Empty(t, conn.tap.sent, "every request is taken")
+
+	r, err := os.Open(f.Name())
+	require.NoError(t, err)
+	defer r.Close()
+	records, err := ReadRequestLog(r)
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	var ops, errs []string
+	for i, rec := range records {
+		ops = append(ops, rec.Op)
+		errs = append(errs, rec.Err)
+		assert.Equal(t, conn.SessionID(), rec.Session)
+		assert.True(t, rec.Latency > 0)
+		if i > 0 {
+			assert.True(t, rec.Xid > records[i-1].Xid, "the xids of the wire increase")
+		}
+	}
+	assert.Equal(t, []string{"OpCreate", "OpGetChildren2", "OpGetData", "OpMulti"}, ops)
+	assert.Equal(t, []string{"", "", "zk: node does not exist", ""}, errs)
+}
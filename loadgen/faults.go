@@ -0,0 +1,87 @@
+package loadgen
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+)
+
+// faults breaks a client's connection on purpose for the scenarios: it can drop the connection and pause the
+// client, dropping its pings and holding its reconnects until it is resumed.
+type faults struct {
+	mu   sync.Mutex
+	conn net.Conn
+	// paused is closed on resume, nil when the client runs normally
+	paused chan struct{}
+}
+
+func (f *faults) dialer(next zk.Dialer) zk.Dialer {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		f.mu.Lock()
+		paused := f.paused
+		f.mu.Unlock()
+		if paused != nil {
+			<-paused
+		}
+		conn, err := next(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		f.mu.Lock()
+		f.conn = conn
+		f.mu.Unlock()
+		return &faultConn{Conn: conn, faults: f}, nil
+	}
+}
+
+// pause stops the pings of the client. It stops hearing from the server too once it times out the connection,
+// as its reconnects wait for resume.
+func (f *faults) pause() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paused == nil {
+		f.paused = make(chan struct{})
+	}
+}
+
+func (f *faults) resume() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paused != nil {
+		close(f.paused)
+		f.paused = nil
+	}
+}
+
+// disconnect closes the connection, the client reconnects to the same session.
+func (f *faults) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+func (f *faults) dropping(frame []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.paused != nil && len(frame) >= 4+proto.RequestHeaderByteLength &&
+		proto.OpType(binary.BigEndian.Uint32(frame[8:])) == proto.OpPing
+}
+
+type faultConn struct {
+	net.Conn
+	faults *faults
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if c.faults.dropping(b) {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
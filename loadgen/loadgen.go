@@ -0,0 +1,270 @@
+// Package loadgen generates ZooKeeper traffic for exercising zkpacket. It backs both the zkload binary
+// and the zkpacket load subcommand.
+package loadgen
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	logger    *zap.Logger
+	contents  = []byte("hello")
+	zkHost    string
+	frequency string
+	randSeed  int64
+	// metricsAddress serves the client latency metrics when set
+	metricsAddress string
+)
+
+// Usage describes the load generator for command help.
+var Usage = `Connects to a ZooKeeper ensemble and runs a fixed set of operations on a new znode every -frequency.
+With -profile it runs the operations a profile file describes instead, one every -frequency. With -rate the
+operations are sent at a target rate from many sessions, and a summary of the latencies is printed at the end.
+With -replay it runs the sessions of a recorded workload instead, at their recorded pace times -speed.
+Generated nodes are created under -prefix, which is removed on exit unless -keep is set. The clean command
+removes the -prefix of an earlier run.
+-manifest writes every request sent and the error of its answer, for zkpacket check to compare with what it saw.
+-metrics-address serves the client side latencies as Prometheus metrics and -request-log writes every operation
+with its xid, to compare with what zkpacket saw on the wire. With -scenario it runs one of these edge cases, scaled
+by -size, and fails when ZooKeeper doesn't answer as expected:
+
+` + scenarioUsage()
+
+type znode struct{ path string }
+
+func (z *znode) String() string {
+	return fmt.Sprintf("%v", z.path)
+}
+
+// RegisterFlags adds the load generator flags to the flag set.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&zkHost, "zk-host", "127.0.0.1", "Host address of zookeeper ensemble")
+	fs.StringVar(&prefix, "prefix", prefix, "Node every generated node is created under, removed on exit")
+	fs.BoolVar(&keep, "keep", false, "Keep the nodes under -prefix on exit, the tree of a -profile is reused by the next run")
+	fs.StringVar(&frequency, "frequency", "10s", "How often to run a bunch of actions on a znode")
+	fs.Int64Var(&randSeed, "seed", time.Now().UnixNano(), "Optional seeded int64 for the randomness")
+	fs.StringVar(&profileFile, "profile", "", "Generate the load a profile file describes instead of the fixed set of operations")
+	fs.Float64Var(&rate, "rate", 0, "Operations per second of all sessions together, sent without waiting for answers. Zero runs one set of operations every -frequency instead")
+	fs.IntVar(&sessions, "sessions", sessions, "Sessions the -rate is spread over")
+	fs.IntVar(&goroutines, "goroutines", goroutines, "Goroutines sending operations on each session")
+	fs.DurationVar(&rampUp, "ramp-up", 0, "Time to grow to the -rate from zero")
+	fs.DurationVar(&rampDown, "ramp-down", 0, "Time to shrink from the -rate to zero at the end of the -duration")
+	fs.DurationVar(&duration, "duration", 0, "Length of a -rate run including the ramps, zero runs until interrupted")
+	fs.StringVar(&replayFile, "replay", "", "Replay a workload file written by zkpacket record -format workload instead of generating load")
+	fs.Float64Var(&replaySpeed, "speed", replaySpeed, "Replay speed, 2 replays the workload twice as fast")
+	fs.StringVar(&scenarioName, "scenario", "", "Run a scenario instead of generating load: "+scenarioNames())
+	fs.IntVar(&scenarioSize, "size", 0, "Size of the -scenario, zero for its default")
+	fs.StringVar(&metricsAddress, "metrics-address", "", "Address to serve the client latency metrics on at /metrics, e.g. :9142")
+	fs.StringVar(&requestLogFile, "request-log", "", "Write every operation with its session, xid and latency to this file")
+	fs.StringVar(&manifestFile, "manifest", "", "Write every request sent on the wire and the error of its answer to this file on exit")
+	fs.StringVar(&requestLogFormat, "request-log-format", requestLogFormat, "Format of the -request-log, csv or json")
+}
+
+func printWatchEvents(eventChan <-chan zk.Event) {
+	select {
+	case ev := <-eventChan:
+		if ev.Err != nil {
+			logger.Error("event error", zap.Error(ev.Err))
+		}
+		logger.Info("EVENT!", zap.Any("event", ev))
+	}
+}
+
+func updateNodes(stopchan chan int, r *rand.Rand, conn *zk.Conn, tickerChan <-chan time.Time) {
+	for {
+		select {
+		case <-tickerChan:
+			// logger.Debug("ticker tick", zap.Int64("conn", conn.SessionID()))
+			node := &znode{fmt.Sprintf("%v/node-%v", prefix, r.Int31())}
+			if _, err := conn.Create(node.String(), contents, 1 /*flags */, zk.WorldACL(0x1f)); err != nil {
+				logger.Error("failed to create node", zap.Error(err), zap.Stringer("node", node))
+			}
+			_, _, eventChan, err := conn.GetW(node.String())
+			if err != nil {
+				logger.Error("failed to GetW", zap.Stringer("node", node), zap.Error(err))
+			}
+			go printWatchEvents(eventChan)
+			if _, _, err := conn.Get(node.String()); err != nil {
+				logger.Error("failed to get", zap.Stringer("node", node), zap.Error(err))
+			}
+			if _, _, err := conn.Exists(node.String()); err != nil {
+				logger.Error("failed to Exists", zap.Stringer("node", node), zap.Error(err))
+			}
+			if _, _, err := conn.GetACL(node.String()); err != nil {
+				logger.Error("failed to get ACL", zap.Stringer("node", node), zap.Error(err))
+			}
+			if _, err := conn.SetACL(node.String(), zk.WorldACL(0x1f), 0 /* version */); err != nil {
+				logger.Error("failed to set ACL", zap.Stringer("node", node), zap.Error(err))
+			}
+			if _, _, err := conn.GetACL(node.String()); err != nil {
+				logger.Error("failed to get ACL", zap.Stringer("node", node), zap.Error(err))
+			}
+			if _, _, err := conn.Children(node.String()); err != nil {
+				logger.Error("failed to get children", zap.Stringer("node", node), zap.Error(err))
+			}
+			if _, err := conn.Set(node.String(), []byte("i want to set this now"), -1 /* version */); err != nil {
+				logger.Error("failed to Set", zap.Stringer("node", node), zap.Error(err))
+			}
+			_, _, _, err = conn.GetW(node.String())
+			if err != nil {
+				logger.Error("failed to GetW", zap.Stringer("node", node), zap.Error(err))
+			}
+			multiNode := &znode{fmt.Sprintf("%v/multinode-%v", prefix, r.Int31())}
+			ops := []interface{}{
+				&zk.CreateRequest{Path: multiNode.String(), Data: []byte{1, 2, 3, 4}, Acl: zk.WorldACL(zk.PermAll)},
+				&zk.SetDataRequest{Path: multiNode.String(), Data: []byte{1, 2, 3, 4, 5}, Version: -1},
+			}
+			if res, err := conn.Multi(ops...); err != nil {
+				logger.Error("Multi returned error", zap.Error(err), zap.Stringer("node", node))
+			} else if len(res) != 2 {
+				logger.Error("Expected 2 responses", zap.Int("actual", len(res)))
+			}
+
+		case <-stopchan:
+			// stop
+			logger.Info("stopping node routine")
+			return
+		}
+	}
+}
+
+// handleCtrlC waits for a signal and stops the node routine, once its current operations are done.
+func handleCtrlC(c chan os.Signal, quit chan int) {
+	sig := <-c
+	fmt.Println("\nsignal: ", sig)
+	quit <- 1 // stop other routines
+}
+
+// NewLogger builds the compact console logger zkload has always used.
+func NewLogger() *zap.Logger {
+	loggerConfig := zap.NewDevelopmentConfig()
+	loggerConfig.EncoderConfig = zapcore.EncoderConfig{
+		LevelKey:      "L",
+		TimeKey:       "",
+		MessageKey:    "M",
+		NameKey:       "N",
+		CallerKey:     "C",
+		StacktraceKey: "S",
+		EncodeLevel:   zapcore.CapitalColorLevelEncoder,
+	}
+	l, _ := loggerConfig.Build()
+	return l
+}
+
+func serveMetrics() {
+	if metricsAddress == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(metricsAddress, mux); err != nil {
+			logger.Error("metrics server stopped", zap.Error(err))
+		}
+	}()
+}
+
+// Run generates load with the flags registered by RegisterFlags until interrupted, then removes the nodes it
+// created.
+func Run(l *zap.Logger) error {
+	logger = l
+	if err := checkPrefix(prefix); err != nil {
+		return err
+	}
+	serveMetrics()
+	if requestLogFile != "" {
+		var err error
+		if requests, err = newRequestLog(requestLogFile, requestLogFormat); err != nil {
+			return err
+		}
+		defer requests.Close()
+	}
+	if manifestFile != "" {
+		manifest = newManifestRecorder(randSeed)
+	}
+	err := load()
+	if manifestFile != "" {
+		if writeErr := writeManifest(manifestFile, manifest.manifest()); err == nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+// load runs the mode the flags choose.
+func load() error {
+	if scenarioName != "" {
+		return runScenario([]string{zkHost})
+	}
+	if replayFile != "" {
+		return replayWorkload()
+	}
+	if rate > 0 {
+		p := defaultProfile()
+		if profileFile != "" {
+			var err error
+			if p, err = LoadProfile(profileFile); err != nil {
+				return err
+			}
+		}
+		return generate([]string{zkHost}, p)
+	}
+
+	quit := make(chan int)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	freq, err := time.ParseDuration(frequency)
+	if err != nil {
+		return fmt.Errorf("failed to parse frequency duration: %v", err)
+	}
+
+	conn, err := dial([]string{zkHost}, 3*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Create and seed the generator.
+	// Typically a non-fixed seed should be used, such as time.Now().UnixNano().
+	// Using a fixed seed will produce the same output on every run.
+	r := rand.New(rand.NewSource(randSeed))
+
+	var profile *Profile
+	if profileFile != "" {
+		if profile, err = LoadProfile(profileFile); err != nil {
+			return err
+		}
+		if err := createTree(conn.Conn, profile); err != nil {
+			return err
+		}
+	} else if err := createPath(conn.Conn, prefix); err != nil {
+		return err
+	}
+
+	ticker := time.Tick(freq)
+	// r2 := rand.New(rand.NewSource(time.Now().UnixNano()))
+	// ticker2 := time.Tick(freq)
+	// go updateNodes(quit, r2, conn, ticker2)
+	time.Sleep(5 * time.Second)
+	if profile != nil {
+		go runProfile(quit, newGenerator(profile, r, 0), conn, ticker)
+	} else {
+		go updateNodes(quit, r, conn.Conn, ticker)
+	}
+
+	handleCtrlC(c, quit)
+	return cleanup(conn.Conn)
+}
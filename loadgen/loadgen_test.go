@@ -0,0 +1,62 @@
+package loadgen
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/zktest"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestUpdateNodes(t *testing.T) {
+	server, err := zktest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+	if logger == nil {
+		// Set once, watch goroutines of earlier runs still log
+		logger = zap.NewNop()
+	}
+
+	conn, _, err := zk.Connect([]string{server.Addr}, 5*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, createPath(conn, prefix))
+
+	stop := make(chan int)
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		updateNodes(stop, rand.New(rand.NewSource(1)), conn, ticks)
+		close(done)
+	}()
+	ticks <- time.Now()
+	// The stop is only received once the tick's operations are done
+	stop <- 1
+	<-done
+
+	children, ok := server.Children(prefix)
+	require.True(t, ok)
+	var nodes, multiNodes int
+	for _, child := range children {
+		switch {
+		case strings.HasPrefix(child, "node-"):
+			nodes++
+			data, _ := server.Get(prefix + "/" + child)
+			assert.Equal(t, "i want to set this now", string(data))
+		case strings.HasPrefix(child, "multinode-"):
+			multiNodes++
+		}
+	}
+	assert.Equal(t, 1, nodes)
+	assert.Equal(t, 1, multiNodes)
+
+	require.NoError(t, cleanup(conn))
+	_, ok = server.Get(prefix)
+	assert.False(t, ok, "the nodes are removed on exit")
+}
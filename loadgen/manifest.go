@@ -0,0 +1,116 @@
+package loadgen
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	manifestFile string
+	// manifest records every request sent on the wire, nil when disabled
+	manifest *manifestRecorder
+)
+
+// Manifest is every request zkload sent on the wire and the error its answer had, the operations a sniffer
+// between zkload and the server must have seen.
+type Manifest struct {
+	Seed int64 `yaml:"seed"`
+	// Counts are the answered requests by operation, Errors the ones answered with an error
+	Counts map[string]int `yaml:"counts"`
+	Errors map[string]int `yaml:"errors,omitempty"`
+	Ops    []ManifestOp   `yaml:"ops"`
+}
+
+// ManifestOp is a request in the order its answer arrived.
+type ManifestOp struct {
+	// Op is the operation as sent on the wire, e.g. OpGetChildren2 for a getChildren
+	Op    string `yaml:"op"`
+	Path  string `yaml:"path,omitempty"`
+	Watch bool   `yaml:"watch,omitempty"`
+	// Err is the error code of the answer's header. ZooKeeper answers a failed multi with an ok header, its
+	// error is the one of the first failed operation in the results.
+	Err zk.ErrCode `yaml:"err,omitempty"`
+	// NoResponse is set when the connection closed before the answer arrived
+	NoResponse bool `yaml:"no_response,omitempty"`
+}
+
+type manifestRecorder struct {
+	mu   sync.Mutex
+	seed int64
+	ops  []ManifestOp
+}
+
+func newManifestRecorder(seed int64) *manifestRecorder {
+	return &manifestRecorder{seed: seed}
+}
+
+func (m *manifestRecorder) add(op ManifestOp) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.ops = append(m.ops, op)
+	m.mu.Unlock()
+}
+
+func (m *manifestRecorder) manifest() *Manifest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := &Manifest{
+		Seed:   m.seed,
+		Counts: make(map[string]int),
+		Errors: make(map[string]int),
+		Ops:    append([]ManifestOp(nil), m.ops...),
+	}
+	for _, op := range m.ops {
+		if op.NoResponse {
+			continue
+		}
+		out.Counts[op.Op]++
+		if op.Err != 0 {
+			out.Errors[op.Op]++
+		}
+	}
+	return out
+}
+
+// Write writes the manifest as YAML.
+func (m *Manifest) Write(w io.Writer) error {
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func writeManifest(fileName string, m *Manifest) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := m.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadManifest reads a manifest written by zkload -manifest.
+func LoadManifest(fileName string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := yaml.UnmarshalStrict(data, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %v: %v", fileName, err)
+	}
+	return m, nil
+}
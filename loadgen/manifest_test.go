@@ -0,0 +1,73 @@
+package loadgen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r := newManifestRecorder(7)
+	r.add(ManifestOp{Op: "OpCreate", Path: "/a"})
+	r.add(ManifestOp{Op: "OpGetData", Path: "/a", Watch: true})
+	r.add(ManifestOp{Op: "OpGetData", Path: "/b", Err: zk.ErrCode(-101)})
+	r.add(ManifestOp{Op: "OpSetData", Path: "/a", NoResponse: true})
+	var nilRecorder *manifestRecorder
+	nilRecorder.add(ManifestOp{Op: "OpCreate"})
+
+	m := r.manifest()
+	assert.Equal(t, int64(7), m.Seed)
+	assert.Equal(t, map[string]int{"OpCreate": 1, "OpGetData": 2}, m.Counts, "unanswered requests are not counted")
+	assert.Equal(t, map[string]int{"OpGetData": 1}, m.Errors)
+	assert.Len(t, m.Ops, 4)
+
+	name := filepath.Join(dir, "manifest.yaml")
+	require.NoError(t, writeManifest(name, m))
+	read, err := LoadManifest(name)
+	require.NoError(t, err)
+	assert.Equal(t, m, read)
+
+	require.NoError(t, ioutil.WriteFile(name, []byte("seed: 1\nunknown: 2\n"), 0644))
+	_, err = LoadManifest(name)
+	assert.Error(t, err)
+	_, err = LoadManifest(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestManifestMultiErr(t *testing.T) {
+	defer func() { manifest = nil }()
+	manifest = newManifestRecorder(1)
+
+	// A failed multi has an ok header, the errors are in the results
+	var body bytes.Buffer
+	for _, v := range []interface{}{
+		int32(3), int64(9), int32(0),
+		int32(-1), false, int32(0), int32(0),
+		int32(-1), false, int32(-101), int32(-101),
+		int32(-1), false, int32(-2), int32(-2),
+		int32(-1), true, int32(-1),
+	} {
+		require.NoError(t, binary.Write(&body, binary.BigEndian, v))
+	}
+	frame := make([]byte, 4, 4+body.Len())
+	binary.BigEndian.PutUint32(frame, uint32(body.Len()))
+	frame = append(frame, body.Bytes()...)
+
+	c := &tapConn{read: true, pending: map[int32]ManifestOp{3: {Op: "OpMulti"}}}
+	c.answers(frame)
+	m := manifest.manifest()
+	require.Len(t, m.Ops, 1)
+	assert.Equal(t, zk.ErrCode(-101), m.Ops[0].Err, "the error of the first failed operation")
+	assert.Equal(t, map[string]int{"OpMulti": 1}, m.Errors)
+}
@@ -0,0 +1,384 @@
+package loadgen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/workload"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// maxLeaves bounds the tree of a profile, every node is created before the load starts
+const maxLeaves = 100000
+
+var profileFile string
+
+// Profile describes the load to generate, read from YAML:
+//
+//	ops: {getData: 70, exists: 10, setData: 10, create: 4, delete: 4, multi: 2}
+//	paths: {distribution: zipf, s: 1.2}
+//	tree: {depth: 2, fanout: 20}
+//	data: {distribution: uniform, min: 10, max: 1000}
+//	watch_ratio: 0.2
+//	multi: {ops: [create, setData, delete]}
+//
+// The tree is created under /zkload before the load starts. Reads, setDatas and multis go to its leaves, picked
+// by the path distribution, getChildren to the parent of a leaf. A create adds a child to a leaf and a delete
+// removes the oldest child the generator created, failing with noNode when there is none.
+type Profile struct {
+	// Ops is the share of each operation in percent, they add up to 100
+	Ops   map[string]float64 `yaml:"ops"`
+	Paths PathDistribution   `yaml:"paths"`
+	Tree  Tree               `yaml:"tree"`
+	Data  SizeDistribution   `yaml:"data"`
+	// WatchRatio is the share of getData, exists and getChildren that set a watch
+	WatchRatio float64    `yaml:"watch_ratio"`
+	Multi      MultiShape `yaml:"multi"`
+}
+
+// PathDistribution is how the leaf of an operation is picked.
+type PathDistribution struct {
+	// Distribution is uniform, zipf or hot
+	Distribution string `yaml:"distribution"`
+	// S is the zipf exponent, larger than 1. The higher it is the more the first leaves are used.
+	S float64 `yaml:"s"`
+	// HotSet is the share of leaves that are hot and HotOps the share of operations that go to them
+	HotSet float64 `yaml:"hot_set"`
+	HotOps float64 `yaml:"hot_ops"`
+}
+
+// Tree is the shape of the nodes the load runs on.
+type Tree struct {
+	Depth  int `yaml:"depth"`
+	Fanout int `yaml:"fanout"`
+}
+
+// SizeDistribution is the size of the data of creates and setDatas.
+type SizeDistribution struct {
+	// Distribution is fixed, uniform between Min and Max, or exponential with a mean of Size capped at Max
+	Distribution string `yaml:"distribution"`
+	Size         int    `yaml:"size"`
+	Min          int    `yaml:"min"`
+	Max          int    `yaml:"max"`
+}
+
+// MultiShape is what a multi does.
+type MultiShape struct {
+	// Ops are create, setData, check and delete, run in order on a new node under the leaf
+	Ops []string `yaml:"ops"`
+}
+
+// profileOps are the operations a profile can generate.
+var profileOps = map[proto.OpType]bool{
+	proto.OpCreate:      true,
+	proto.OpDelete:      true,
+	proto.OpExists:      true,
+	proto.OpGetData:     true,
+	proto.OpSetData:     true,
+	proto.OpGetACL:      true,
+	proto.OpGetChildren: true,
+	proto.OpSync:        true,
+	proto.OpMulti:       true,
+}
+
+var multiOps = map[proto.OpType]bool{
+	proto.OpCreate:  true,
+	proto.OpSetData: true,
+	proto.OpCheck:   true,
+	proto.OpDelete:  true,
+}
+
+// LoadProfile reads a profile file.
+func LoadProfile(fileName string) (*Profile, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	p := &Profile{
+		Paths: PathDistribution{Distribution: "uniform"},
+		Tree:  Tree{Depth: 1, Fanout: 10},
+		Data:  SizeDistribution{Distribution: "fixed"},
+		Multi: MultiShape{Ops: []string{"create", "setData", "delete"}},
+	}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("invalid profile %v: %v", fileName, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid profile %v: %v", fileName, err)
+	}
+	return p, nil
+}
+
+func (p *Profile) validate() error {
+	if len(p.Ops) == 0 {
+		return fmt.Errorf("no ops")
+	}
+	var total float64
+	var multi bool
+	for name, share := range p.Ops {
+		op, ok := proto.OpTypeFromName(name)
+		if !ok || !profileOps[op] {
+			return fmt.Errorf("unsupported operation %q", name)
+		}
+		if share < 0 {
+			return fmt.Errorf("negative share for %v", name)
+		}
+		total += share
+		multi = multi || op == proto.OpMulti && share > 0
+	}
+	if math.Abs(total-100) > 0.001 {
+		return fmt.Errorf("the ops add up to %v%%, not 100%%", total)
+	}
+
+	switch p.Paths.Distribution {
+	case "uniform":
+	case "zipf":
+		if p.Paths.S <= 1 {
+			return fmt.Errorf("the zipf exponent s must be larger than 1")
+		}
+	case "hot":
+		if p.Paths.HotSet <= 0 || p.Paths.HotSet >= 1 || p.Paths.HotOps < 0 || p.Paths.HotOps > 1 {
+			return fmt.Errorf("hot_set must be between 0 and 1 and hot_ops between 0 and 1")
+		}
+	default:
+		return fmt.Errorf("unknown path distribution %q", p.Paths.Distribution)
+	}
+
+	if p.Tree.Depth < 1 || p.Tree.Fanout < 1 {
+		return fmt.Errorf("the tree needs a depth and fanout of at least 1")
+	}
+	if math.Pow(float64(p.Tree.Fanout), float64(p.Tree.Depth)) > maxLeaves {
+		return fmt.Errorf("the tree has more than %v leaves", maxLeaves)
+	}
+
+	d := p.Data
+	switch d.Distribution {
+	case "fixed", "exponential":
+		if d.Size < 0 {
+			return fmt.Errorf("negative data size")
+		}
+	case "uniform":
+		if d.Min < 0 || d.Max < d.Min {
+			return fmt.Errorf("the data sizes need 0 <= min <= max")
+		}
+	default:
+		return fmt.Errorf("unknown data distribution %q", d.Distribution)
+	}
+
+	if p.WatchRatio < 0 || p.WatchRatio > 1 {
+		return fmt.Errorf("watch_ratio must be between 0 and 1")
+	}
+	if multi && len(p.Multi.Ops) == 0 {
+		return fmt.Errorf("multi without ops")
+	}
+	for _, name := range p.Multi.Ops {
+		if op, ok := proto.OpTypeFromName(name); !ok || !multiOps[op] {
+			return fmt.Errorf("unsupported multi operation %q", name)
+		}
+	}
+	return nil
+}
+
+// leaves is the number of leaves of the tree.
+func (p *Profile) leaves() int {
+	n := 1
+	for i := 0; i < p.Tree.Depth; i++ {
+		n *= p.Tree.Fanout
+	}
+	return n
+}
+
+// leafPath is the path of the leaf with the index, <prefix>/n1/n4 for the leaf 14 of a tree of fanout 10.
+func (p *Profile) leafPath(leaf int) string {
+	parts := make([]string, p.Tree.Depth)
+	for i := p.Tree.Depth - 1; i >= 0; i-- {
+		parts[i] = "n" + strconv.Itoa(leaf%p.Tree.Fanout)
+		leaf /= p.Tree.Fanout
+	}
+	return path.Join(append([]string{prefix}, parts...)...)
+}
+
+// createTree creates the nodes of the profile's tree that don't exist yet.
+func createTree(conn *zk.Conn, p *Profile) error {
+	if err := createPath(conn, prefix); err != nil {
+		return err
+	}
+	var create func(node string, depth int) error
+	create = func(node string, depth int) error {
+		if depth > 0 {
+			if _, err := conn.Create(node, nil, 0, zk.WorldACL(zk.PermAll)); err != nil && err != zk.ErrNodeExists {
+				return fmt.Errorf("failed to create %v: %v", node, err)
+			}
+		}
+		if depth == p.Tree.Depth {
+			return nil
+		}
+		for i := 0; i < p.Tree.Fanout; i++ {
+			if err := create(node+"/n"+strconv.Itoa(i), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return create(prefix, 0)
+}
+
+type weightedOp struct {
+	op proto.OpType
+	// until is the sum of the shares of this and the previous operations
+	until float64
+}
+
+// generator makes the operations of a profile. Every goroutine generating load has its own.
+type generator struct {
+	p      *Profile
+	r      *rand.Rand
+	ops    []weightedOp
+	multi  []proto.OpType
+	leaves int
+	zipf   *rand.Zipf
+	// name keeps the nodes of generators apart
+	name    string
+	nodes   int
+	created []string
+}
+
+func newGenerator(p *Profile, r *rand.Rand, id int) *generator {
+	g := &generator{p: p, r: r, leaves: p.leaves(), name: "g" + strconv.Itoa(id)}
+	// Sorted so the same seed generates the same operations
+	names := make([]string, 0, len(p.Ops))
+	for name := range p.Ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var until float64
+	for _, name := range names {
+		if p.Ops[name] > 0 {
+			op, _ := proto.OpTypeFromName(name)
+			until += p.Ops[name]
+			g.ops = append(g.ops, weightedOp{op: op, until: until})
+		}
+	}
+	for _, name := range p.Multi.Ops {
+		op, _ := proto.OpTypeFromName(name)
+		g.multi = append(g.multi, op)
+	}
+	if p.Paths.Distribution == "zipf" && g.leaves > 1 {
+		g.zipf = rand.NewZipf(r, p.Paths.S, 1, uint64(g.leaves-1))
+	}
+	return g
+}
+
+// leaf picks the leaf of the next operation.
+func (g *generator) leaf() int {
+	switch g.p.Paths.Distribution {
+	case "zipf":
+		if g.zipf == nil {
+			return 0
+		}
+		return int(g.zipf.Uint64())
+	case "hot":
+		hot := int(math.Ceil(g.p.Paths.HotSet * float64(g.leaves)))
+		if hot >= g.leaves || g.r.Float64() < g.p.Paths.HotOps {
+			return g.r.Intn(hot)
+		}
+		return hot + g.r.Intn(g.leaves-hot)
+	}
+	return g.r.Intn(g.leaves)
+}
+
+// size picks the size of the next data.
+func (g *generator) size() int {
+	d := g.p.Data
+	switch d.Distribution {
+	case "uniform":
+		return d.Min + g.r.Intn(d.Max-d.Min+1)
+	case "exponential":
+		n := int(g.r.ExpFloat64() * float64(d.Size))
+		if d.Max > 0 && n > d.Max {
+			n = d.Max
+		}
+		return n
+	}
+	return d.Size
+}
+
+func (g *generator) watch() bool {
+	return g.p.WatchRatio > 0 && g.r.Float64() < g.p.WatchRatio
+}
+
+// newNode is the path of a node the generator creates under the leaf.
+func (g *generator) newNode(leaf string) string {
+	g.nodes++
+	return fmt.Sprintf("%v/%v-%d", leaf, g.name, g.nodes)
+}
+
+// next is the next operation of the profile.
+func (g *generator) next() workload.Op {
+	x := g.r.Float64() * g.ops[len(g.ops)-1].until
+	typ := g.ops[len(g.ops)-1].op
+	for _, o := range g.ops {
+		if x < o.until {
+			typ = o.op
+			break
+		}
+	}
+
+	leaf := g.p.leafPath(g.leaf())
+	op := workload.Op{Op: typ.String(), Path: leaf, Version: -1}
+	switch typ {
+	case proto.OpCreate:
+		op.Path = g.newNode(leaf)
+		op.Size = g.size()
+		g.created = append(g.created, op.Path)
+	case proto.OpDelete:
+		op.Path = leaf + "/" + g.name + "-none"
+		if len(g.created) > 0 {
+			op.Path, g.created = g.created[0], g.created[1:]
+		}
+	case proto.OpSetData:
+		op.Size = g.size()
+	case proto.OpGetData, proto.OpExists:
+		op.Watch = g.watch()
+	case proto.OpGetChildren:
+		op.Path = path.Dir(leaf)
+		op.Watch = g.watch()
+	case proto.OpMulti:
+		node := g.newNode(leaf)
+		op.Path = ""
+		for _, t := range g.multi {
+			sub := workload.Op{Op: t.String(), Path: node, Version: -1}
+			if t == proto.OpCreate || t == proto.OpSetData {
+				sub.Size = g.size()
+			}
+			op.Ops = append(op.Ops, sub)
+		}
+	}
+	return op
+}
+
+// runProfile sends the next operation of the generator every tick until stopped.
+func runProfile(stopchan chan int, g *generator, conn *client, tickerChan <-chan time.Time) {
+	for {
+		select {
+		case <-tickerChan:
+			op := g.next()
+			if err := conn.do(&op); err != nil {
+				logger.Debug("operation failed", zap.String("op", op.Op), zap.String("path", op.Path), zap.Error(err))
+			}
+		case <-stopchan:
+			logger.Info("stopping profile routine")
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package loadgen
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/zktest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func loadProfile(t *testing.T, content string) (*Profile, error) {
+	f, err := ioutil.TempFile("", "profile")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return LoadProfile(f.Name())
+}
+
+func TestLoadProfile(t *testing.T) {
+	p, err := loadProfile(t, `
+ops: {getData: 70, setData: 20, multi: 10}
+paths: {distribution: zipf, s: 1.5}
+tree: {depth: 2, fanout: 5}
+data: {distribution: uniform, min: 1, max: 10}
+watch_ratio: 0.5
+`)
+	require.NoError(t, err)
+	assert.Equal(t, 25, p.leaves())
+	assert.Equal(t, []string{"create", "setData", "delete"}, p.Multi.Ops, "the default multi")
+	assert.Equal(t, "/zkload/n2/n3", p.leafPath(13))
+
+	for content, want := range map[string]string{
+		`ops: {getData: 50}`: "the ops add up to 50%, not 100%",
+		`ops: {fly: 100}`:    `unsupported operation "fly"`,
+		`{ops: {getData: 100}, paths: {distribution: zipf}}`:                   "the zipf exponent s must be larger than 1",
+		`{ops: {getData: 100}, paths: {distribution: normal}}`:                 `unknown path distribution "normal"`,
+		`{ops: {getData: 100}, tree: {depth: 6, fanout: 10}}`:                  "the tree has more than 100000 leaves",
+		`{ops: {getData: 100}, data: {distribution: uniform, min: 5, max: 1}}`: "the data sizes need 0 <= min <= max",
+		`{ops: {multi: 100}, multi: {ops: [getData]}}`:                         `unsupported multi operation "getData"`,
+		`{ops: {getData: 100}, color: red}`:                                    "field color not found",
+	} {
+		_, err := loadProfile(t, content)
+		if assert.Error(t, err, content) {
+			assert.Contains(t, err.Error(), want)
+		}
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	p := &Profile{
+		Ops:        map[string]float64{"getData": 50, "create": 25, "delete": 25},
+		Paths:      PathDistribution{Distribution: "hot", HotSet: 0.1, HotOps: 0.9},
+		Tree:       Tree{Depth: 2, Fanout: 10},
+		Data:       SizeDistribution{Distribution: "fixed", Size: 7},
+		WatchRatio: 0.2,
+	}
+	require.NoError(t, p.validate())
+	g := newGenerator(p, rand.New(rand.NewSource(1)), 3)
+	counts := make(map[string]int)
+	var hot, watches int
+	const n = 10000
+	for i := 0; i < n; i++ {
+		op := g.next()
+		counts[op.Op]++
+		switch op.Op {
+		case "OpGetData":
+			if strings.HasPrefix(op.Path, "/zkload/n0/") {
+				hot++
+			}
+			if op.Watch {
+				watches++
+			}
+		case "OpCreate":
+			assert.Equal(t, 7, op.Size)
+			assert.Contains(t, op.Path, "/g3-")
+		}
+	}
+	assert.InDelta(t, n/2, counts["OpGetData"], n/20)
+	assert.InDelta(t, n/4, counts["OpCreate"], n/20)
+	// The hot set is the first 10 leaves, all under n0
+	assert.InDelta(t, 0.9, float64(hot)/float64(counts["OpGetData"]), 0.03)
+	assert.InDelta(t, 0.2, float64(watches)/float64(counts["OpGetData"]), 0.03)
+
+	same := newGenerator(p, rand.New(rand.NewSource(1)), 3)
+	other := newGenerator(p, rand.New(rand.NewSource(1)), 3)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, same.next(), other.next(), "the same seed generates the same operations")
+	}
+}
+
+func TestGeneratorZipf(t *testing.T) {
+	p := &Profile{
+		Ops:   map[string]float64{"exists": 100},
+		Paths: PathDistribution{Distribution: "zipf", S: 2},
+		Tree:  Tree{Depth: 1, Fanout: 100},
+	}
+	g := newGenerator(p, rand.New(rand.NewSource(1)), 0)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[g.next().Path]++
+	}
+	assert.True(t, counts["/zkload/n0"] > counts["/zkload/n1"])
+	assert.True(t, counts["/zkload/n1"] > counts["/zkload/n2"])
+	assert.True(t, counts["/zkload/n0"] > 500, "the first leaf gets most operations")
+}
+
+func TestRunProfile(t *testing.T) {
+	server, err := zktest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	conn, err := dial([]string{server.Addr}, 5*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	p := &Profile{
+		Ops:   map[string]float64{"create": 50, "multi": 50},
+		Paths: PathDistribution{Distribution: "uniform"},
+		Tree:  Tree{Depth: 2, Fanout: 2},
+		Data:  SizeDistribution{Distribution: "fixed", Size: 3},
+		Multi: MultiShape{Ops: []string{"create", "setData"}},
+	}
+	require.NoError(t, p.validate())
+	require.NoError(t, createTree(conn.Conn, p))
+	require.NoError(t, createTree(conn.Conn, p), "the tree of an earlier run is reused")
+	children, ok := server.Children("/zkload/n1")
+	require.True(t, ok)
+	assert.Equal(t, []string{"n0", "n1"}, children)
+
+	stop := make(chan int)
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		runProfile(stop, newGenerator(p, rand.New(rand.NewSource(1)), 0), conn, ticks)
+		close(done)
+	}()
+	for i := 0; i < 20; i++ {
+		ticks <- time.Now()
+	}
+	stop <- 1
+	<-done
+
+	var created int
+	for _, leaf := range []string{"/zkload/n0/n0", "/zkload/n0/n1", "/zkload/n1/n0", "/zkload/n1/n1"} {
+		children, _ := server.Children(leaf)
+		for _, c := range children {
+			data, _ := server.Get(leaf + "/" + c)
+			assert.Len(t, data, 3)
+		}
+		created += len(children)
+	}
+	assert.Equal(t, 20, created, "every create and multi adds a node")
+}
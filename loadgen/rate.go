@@ -0,0 +1,327 @@
+package loadgen
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// rate is the target of operations per second of all sessions, zero runs the -frequency ticker instead
+	rate       float64
+	sessions   = 1
+	goroutines = 1
+	rampUp     time.Duration
+	rampDown   time.Duration
+	// duration is the length of the run including the ramps, zero runs until interrupted
+	duration time.Duration
+)
+
+// queueSize is how many scheduled operations wait for a free goroutine before the schedule falls behind.
+const queueSize = 10000
+
+// defaultProfile resembles the fixed set of operations zkload runs without a profile.
+func defaultProfile() *Profile {
+	return &Profile{
+		Ops: map[string]float64{
+			"create": 10, "getData": 30, "exists": 10, "getACL": 20, "getChildren": 10, "setData": 10, "multi": 10,
+		},
+		Paths:      PathDistribution{Distribution: "uniform"},
+		Tree:       Tree{Depth: 1, Fanout: 100},
+		Data:       SizeDistribution{Distribution: "fixed", Size: 22},
+		WatchRatio: 0.5,
+		Multi:      MultiShape{Ops: []string{"create", "setData", "delete"}},
+	}
+}
+
+// schedule is when the operations of a run are sent: the rate grows linearly to its target over the ramp up,
+// stays there and shrinks linearly to zero over the ramp down.
+type schedule struct {
+	rate     float64
+	up, down time.Duration
+	// steady is the time at the target rate, negative runs at it until stopped
+	steady time.Duration
+}
+
+func newSchedule(rate float64, up, down, total time.Duration) (schedule, error) {
+	if rate <= 0 {
+		return schedule{}, fmt.Errorf("the rate must be positive")
+	}
+	if up < 0 || down < 0 {
+		return schedule{}, fmt.Errorf("negative ramp")
+	}
+	if total <= 0 {
+		if down > 0 {
+			return schedule{}, fmt.Errorf("a ramp down needs a duration")
+		}
+		return schedule{rate: rate, up: up, steady: -1}, nil
+	}
+	if up+down > total {
+		return schedule{}, fmt.Errorf("the ramps take longer than the duration")
+	}
+	return schedule{rate: rate, up: up, down: down, steady: total - up - down}, nil
+}
+
+// at is the time since the start the n-th operation is sent at, false when the run is over before it. It inverts
+// the number of operations sent by a time, the integral of the rate.
+func (s schedule) at(n int) (time.Duration, bool) {
+	m := float64(n)
+	up, down := s.up.Seconds(), s.down.Seconds()
+	// Operations sent during the ramp up
+	upOps := s.rate * up / 2
+	if m < upOps {
+		return seconds(math.Sqrt(2 * up * m / s.rate)), true
+	}
+	m -= upOps
+	if s.steady < 0 || m < s.rate*s.steady.Seconds() {
+		return s.up + seconds(m/s.rate), true
+	}
+	m -= s.rate * s.steady.Seconds()
+	if m >= s.rate*down/2 {
+		return 0, false
+	}
+	return s.up + s.steady + seconds(down-math.Sqrt(down*down-2*down*m/s.rate)), true
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// opStats are the client side latencies of an operation, measured from the time it was scheduled so a slow
+// server doesn't hide the operations it delayed.
+type opStats struct {
+	latencies latencyHistogram
+	errors    int
+}
+
+// latencyBuckets is the number of buckets each doubling of the latency is split in, the percentiles are
+// within 0.1% of the latencies.
+const latencyBuckets = 1024
+
+// latencyHistogram counts latencies in buckets of a microsecond up to 2*latencyBuckets microseconds, and in
+// buckets twice as wide every latencyBuckets buckets after, so its size depends on the highest latency and
+// not on how many operations a run sends.
+type latencyHistogram struct {
+	counts []uint64
+	count  int
+	max    time.Duration
+}
+
+// latencyBucket is the index of the bucket of the latency.
+func latencyBucket(d time.Duration) int {
+	v := int64(d / time.Microsecond)
+	if v < 0 {
+		v = 0
+	}
+	var shift uint
+	for v >= 2*latencyBuckets {
+		v >>= 1
+		shift++
+	}
+	return int(shift)*latencyBuckets + int(v)
+}
+
+// bucketTop is the highest latency of the bucket.
+func bucketTop(i int) time.Duration {
+	var shift uint
+	if i >= 2*latencyBuckets {
+		shift = uint(i/latencyBuckets - 1)
+	}
+	v := int64(i) - int64(shift)*latencyBuckets
+	return time.Duration((v+1)<<shift-1) * time.Microsecond
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	i := latencyBucket(d)
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]uint64, i+1-len(h.counts))...)
+	}
+	h.counts[i]++
+	h.count++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	if len(o.counts) > len(h.counts) {
+		h.counts = append(h.counts, make([]uint64, len(o.counts)-len(h.counts))...)
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	h.count += o.count
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// percentile is the latency the share p of the latencies are at or below, the top of its bucket.
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	rank := uint64(math.Ceil(p * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			if top := bucketTop(i); top < h.max {
+				return top
+			}
+			break
+		}
+	}
+	return h.max
+}
+
+type runStats map[string]*opStats
+
+func (s runStats) add(op string, latency time.Duration, err error) {
+	st, ok := s[op]
+	if !ok {
+		st = &opStats{}
+		s[op] = st
+	}
+	st.latencies.add(latency)
+	if err != nil {
+		st.errors++
+	}
+}
+
+func (s runStats) merge(o runStats) {
+	for op, st := range o {
+		into, ok := s[op]
+		if !ok {
+			s[op] = st
+			continue
+		}
+		into.latencies.merge(&st.latencies)
+		into.errors += st.errors
+	}
+}
+
+// percentile is the latency the share p of the sorted latencies are at or below.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// writeSummary prints the throughput and latency percentiles of each operation.
+func writeSummary(w io.Writer, stats runStats, elapsed time.Duration) {
+	ops := make([]string, 0, len(stats))
+	var total, errors int
+	for op, st := range stats {
+		ops = append(ops, op)
+		total += st.latencies.count
+		errors += st.errors
+	}
+	sort.Strings(ops)
+
+	fmt.Fprintf(w, "%d operations in %v, %.1f ops/s, %d errors\n\n", total, elapsed-elapsed%time.Millisecond,
+		float64(total)/elapsed.Seconds(), errors)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPERATION\tCOUNT\tERRORS\tOPS/S\tP50\tP90\tP99\tP99.9\tMAX")
+	for _, op := range ops {
+		h := &stats[op].latencies
+		fmt.Fprintf(tw, "%v\t%d\t%d\t%.1f\t%v\t%v\t%v\t%v\t%v\n", op, h.count, stats[op].errors,
+			float64(h.count)/elapsed.Seconds(),
+			h.percentile(0.5), h.percentile(0.9), h.percentile(0.99), h.percentile(0.999), h.max)
+	}
+	tw.Flush()
+}
+
+// generate runs the profile, or the default one, at -rate on -sessions connections until -duration is over or
+// it is interrupted, and prints a summary.
+func generate(servers []string, p *Profile) error {
+	if sessions < 1 || goroutines < 1 {
+		return fmt.Errorf("there must be at least one session and goroutine")
+	}
+	s, err := newSchedule(rate, rampUp, rampDown, duration)
+	if err != nil {
+		return err
+	}
+
+	conns := make([]*client, sessions)
+	for i := range conns {
+		if conns[i], err = dial(servers, defaultSessionTimeout); err != nil {
+			return err
+		}
+		defer conns[i].Close()
+	}
+	if err := createTree(conns[0].Conn, p); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
+	go func() {
+		<-c
+		close(stop)
+	}()
+
+	logger.Info("generating load", zap.Float64("rate", rate), zap.Int("sessions", sessions),
+		zap.Int("goroutines", goroutines), zap.Duration("duration", duration))
+	start := time.Now()
+	stats := run(conns, goroutines, p, s, randSeed, stop)
+	writeSummary(os.Stdout, stats, time.Since(start))
+	return cleanup(conns[0].Conn)
+}
+
+// run sends the operations of the profile at the times of the schedule from the goroutines of each connection.
+// The schedule doesn't wait for answers, an operation that finds every goroutine busy waits in a queue and its
+// latency includes the wait.
+func run(conns []*client, perConn int, p *Profile, s schedule, seed int64, stop <-chan struct{}) runStats {
+	queue := make(chan time.Time, queueSize)
+	results := make([]runStats, len(conns)*perConn)
+	var wg sync.WaitGroup
+	for i := range results {
+		results[i] = make(runStats)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn := conns[i%len(conns)]
+			g := newGenerator(p, rand.New(rand.NewSource(seed+int64(i))), i)
+			for scheduled := range queue {
+				op := g.next()
+				err := conn.do(&op)
+				results[i].add(op.Op, time.Since(scheduled), err)
+			}
+		}(i)
+	}
+
+	start := time.Now()
+	for n := 0; ; n++ {
+		at, ok := s.at(n)
+		if !ok || !waitUntil(start, at, 1, stop) {
+			break
+		}
+		queue <- start.Add(at)
+	}
+	close(queue)
+	wg.Wait()
+
+	stats := make(runStats)
+	for _, r := range results {
+		stats.merge(r)
+	}
+	return stats
+}
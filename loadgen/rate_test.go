@@ -0,0 +1,142 @@
+package loadgen
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/zktest"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// count is the number of operations of a schedule that ends.
+func count(s schedule) int {
+	n := 0
+	for {
+		if _, ok := s.at(n); !ok {
+			return n
+		}
+		n++
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	s, err := newSchedule(100, 2*time.Second, 4*time.Second, 10*time.Second)
+	require.NoError(t, err)
+	// 100 during the ramp up, 400 steady and 200 during the ramp down
+	assert.Equal(t, 700, count(s))
+
+	at := func(n int) time.Duration {
+		d, ok := s.at(n)
+		require.True(t, ok)
+		return d
+	}
+	assert.Equal(t, time.Duration(0), at(0))
+	assert.Equal(t, time.Second, at(25), "a quarter of the ramp up operations are sent in its first half")
+	assert.Equal(t, 2*time.Second, at(100))
+	assert.Equal(t, 3*time.Second, at(200))
+	assert.Equal(t, 6*time.Second, at(500))
+	assert.Equal(t, 8*time.Second, at(650), "three quarters of the ramp down operations are sent in its first half")
+	for n := 1; n < 700; n++ {
+		assert.True(t, at(n) > at(n-1))
+	}
+
+	s, err = newSchedule(10, 0, 0, 0)
+	require.NoError(t, err)
+	d, ok := s.at(1000000)
+	assert.True(t, ok, "without a duration the run doesn't end")
+	assert.Equal(t, 100000*time.Second, d)
+
+	for _, args := range []struct {
+		rate          float64
+		up, down, all time.Duration
+	}{
+		{0, 0, 0, 0},
+		{10, 0, time.Second, 0},
+		{10, time.Second, time.Second, time.Second},
+		{10, -time.Second, 0, 0},
+	} {
+		_, err := newSchedule(args.rate, args.up, args.down, args.all)
+		assert.Error(t, err, "%+v", args)
+	}
+}
+
+func TestWriteSummary(t *testing.T) {
+	stats := make(runStats)
+	for i := 1; i <= 1000; i++ {
+		stats.add("OpGetData", time.Duration(i)*time.Millisecond, nil)
+	}
+	stats.add("OpCreate", time.Millisecond, zk.ErrNodeExists)
+	var buf bytes.Buffer
+	writeSummary(&buf, stats, 10*time.Second)
+	assert.Equal(t, `1001 operations in 10s, 100.1 ops/s, 1 errors
+
+OPERATION  COUNT  ERRORS  OPS/S  P50        P90        P99        P99.9      MAX
+OpCreate   1      1       0.1    1ms        1ms        1ms        1ms        1ms
+OpGetData  1000   0       100.0  500.223ms  900.095ms  990.207ms  999.423ms  1s
+`, buf.String())
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	for i := 0; i < 1000000; i++ {
+		h.add(time.Duration(i%5000) * time.Millisecond)
+	}
+	assert.Equal(t, 1000000, h.count)
+	assert.Equal(t, 4999*time.Millisecond, h.max)
+	assert.True(t, len(h.counts) < 16*latencyBuckets, "the size depends on the highest latency, it is %v", len(h.counts))
+	for _, p := range []float64{0.5, 0.9, 0.99} {
+		want := time.Duration(p*5000) * time.Millisecond
+		got := h.percentile(p)
+		assert.True(t, got >= want-time.Millisecond && got <= want+want/1000, "p%v is %v", p*100, got)
+	}
+
+	var merged latencyHistogram
+	merged.add(5 * time.Millisecond)
+	merged.merge(&h)
+	assert.Equal(t, 1000001, merged.count)
+	assert.Equal(t, h.max, merged.percentile(1))
+	assert.Equal(t, 1500*time.Microsecond, bucketTop(latencyBucket(1500*time.Microsecond)), "exact below 2048µs")
+}
+
+func TestRun(t *testing.T) {
+	server, err := zktest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	var conns []*client
+	for i := 0; i < 2; i++ {
+		conn, err := dial([]string{server.Addr}, 5*time.Second)
+		require.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	p := defaultProfile()
+	require.NoError(t, p.validate())
+	require.NoError(t, createTree(conns[0].Conn, p))
+
+	s, err := newSchedule(200, 100*time.Millisecond, 100*time.Millisecond, 400*time.Millisecond)
+	require.NoError(t, err)
+	start := time.Now()
+	stats := run(conns, 2, p, s, 1, make(chan struct{}))
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+
+	var total int
+	for op, st := range stats {
+		total += st.latencies.count
+		assert.Zero(t, st.errors, op)
+	}
+	assert.Equal(t, count(s), total, "every scheduled operation is sent")
+
+	s, err = newSchedule(1, 0, 0, 0)
+	require.NoError(t, err)
+	stop := make(chan struct{})
+	close(stop)
+	assert.Empty(t, run(conns, 1, p, s, 1, stop))
+}
@@ -0,0 +1,241 @@
+package loadgen
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/workload"
+	"github.com/jeffbean/zkpacket/zkerrors"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"go.uber.org/zap"
+)
+
+var (
+	replayFile  string
+	replaySpeed = 1.0
+)
+
+// defaultSessionTimeout is the timeout of replayed sessions whose connect was not recorded
+const defaultSessionTimeout = 10 * time.Second
+
+// errNotReplayable is returned for the operations a replay skips.
+var errNotReplayable = errors.New("operation can't be replayed")
+
+// replayResult counts what a replay ran.
+type replayResult struct {
+	ops int
+	// mismatches are operations answered with another error than recorded
+	mismatches int
+	// skipped are operations the client can't send
+	skipped int
+}
+
+func (r *replayResult) add(o replayResult) {
+	r.ops += o.ops
+	r.mismatches += o.mismatches
+	r.skipped += o.skipped
+}
+
+// replayWorkload replays the -replay workload file against the ensemble until it is done or interrupted.
+func replayWorkload() error {
+	if replaySpeed <= 0 {
+		return fmt.Errorf("invalid speed %v, it must be positive", replaySpeed)
+	}
+	w, err := workload.Load(replayFile)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
+	go func() {
+		<-c
+		close(stop)
+	}()
+
+	logger.Info("replaying workload", zap.String("file", replayFile), zap.Int("sessions", len(w.Sessions)),
+		zap.Int("ops", w.Len()), zap.Float64("speed", replaySpeed))
+	start := time.Now()
+	res := replay([]string{zkHost}, w, replaySpeed, stop)
+	logger.Info("replayed workload", zap.Int("ops", res.ops), zap.Int("mismatches", res.mismatches),
+		zap.Int("skipped", res.skipped), zap.Duration("elapsed", time.Since(start)))
+	return nil
+}
+
+// replay runs every session of the workload on its own connection, concurrently. Each operation is sent at
+// its recorded time divided by the speed, or once the session's previous operation is answered when that
+// takes longer.
+func replay(servers []string, w *workload.Workload, speed float64, stop <-chan struct{}) replayResult {
+	start := time.Now()
+	results := make([]replayResult, len(w.Sessions))
+	var wg sync.WaitGroup
+	for i, s := range w.Sessions {
+		wg.Add(1)
+		go func(i int, s *workload.Session) {
+			defer wg.Done()
+			results[i] = replaySession(servers, s, start, speed, stop)
+		}(i, s)
+	}
+	wg.Wait()
+
+	var total replayResult
+	for _, r := range results {
+		total.add(r)
+	}
+	return total
+}
+
+func replaySession(servers []string, s *workload.Session, start time.Time, speed float64, stop <-chan struct{}) (res replayResult) {
+	if len(s.Ops) == 0 || !waitUntil(start, s.Ops[0].At, speed, stop) {
+		return res
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = defaultSessionTimeout
+	}
+	conn, err := dial(servers, timeout)
+	if err != nil {
+		logger.Error("failed to connect session", zap.Int64("session", s.ID), zap.Error(err))
+		return res
+	}
+	defer conn.Close()
+
+	for i := range s.Ops {
+		op := &s.Ops[i]
+		if !waitUntil(start, op.At, speed, stop) {
+			return res
+		}
+		if typ, _ := op.Type(); typ == proto.OpClose {
+			return res
+		}
+		err := conn.do(op)
+		if err == errNotReplayable {
+			res.skipped++
+			continue
+		}
+		res.ops++
+		if !op.NoResponse && !errMatches(err, op.Err) {
+			res.mismatches++
+			logger.Debug("operation answered differently than recorded", zap.Int64("session", s.ID),
+				zap.String("op", op.Op), zap.String("path", op.Path), zap.Int32("recorded", int32(op.Err)), zap.Error(err))
+		}
+	}
+	return res
+}
+
+// waitUntil sleeps until the time of the operation, scaled by the speed, has passed since start. It is false
+// when stopped.
+func waitUntil(start time.Time, at time.Duration, speed float64, stop <-chan struct{}) bool {
+	d := time.Until(start.Add(time.Duration(float64(at) / speed)))
+	if d <= 0 {
+		select {
+		case <-stop:
+			return false
+		default:
+			return true
+		}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// runOp sends the operation and waits for its answer. Watches are set but their events are not read.
+func runOp(conn *zk.Conn, op *workload.Op) error {
+	typ, _ := op.Type()
+	var err error
+	switch typ {
+	case proto.OpCreate:
+		_, err = conn.Create(op.Path, op.Payload(), op.Flags, zk.WorldACL(zk.PermAll))
+	case proto.OpDelete:
+		err = conn.Delete(op.Path, op.Version)
+	case proto.OpExists:
+		var ok bool
+		if op.Watch {
+			ok, _, _, err = conn.ExistsW(op.Path)
+		} else {
+			ok, _, err = conn.Exists(op.Path)
+		}
+		if err == nil && !ok {
+			// The client hides the server's answer for a missing node
+			err = zk.ErrNoNode
+		}
+	case proto.OpGetData:
+		if op.Watch {
+			_, _, _, err = conn.GetW(op.Path)
+		} else {
+			_, _, err = conn.Get(op.Path)
+		}
+	case proto.OpSetData:
+		_, err = conn.Set(op.Path, op.Payload(), op.Version)
+	case proto.OpGetACL:
+		_, _, err = conn.GetACL(op.Path)
+	case proto.OpSetACL:
+		_, err = conn.SetACL(op.Path, zk.WorldACL(zk.PermAll), op.Version)
+	case proto.OpGetChildren, proto.OpGetChildren2:
+		if op.Watch {
+			_, _, _, err = conn.ChildrenW(op.Path)
+		} else {
+			_, _, err = conn.Children(op.Path)
+		}
+	case proto.OpSync:
+		_, err = conn.Sync(op.Path)
+	case proto.OpMulti:
+		ops := make([]interface{}, len(op.Ops))
+		for i := range op.Ops {
+			if ops[i], err = multiOp(&op.Ops[i]); err != nil {
+				return err
+			}
+		}
+		var res []zk.MultiResponse
+		res, err = conn.Multi(ops...)
+		if err == nil {
+			// ZooKeeper answers a failed multi with an ok header and the error in the results
+			for _, r := range res {
+				if r.Error != nil {
+					return r.Error
+				}
+			}
+		}
+	default:
+		return errNotReplayable
+	}
+	return err
+}
+
+func multiOp(op *workload.Op) (interface{}, error) {
+	typ, _ := op.Type()
+	switch typ {
+	case proto.OpCreate:
+		return &zk.CreateRequest{Path: op.Path, Data: op.Payload(), Acl: zk.WorldACL(zk.PermAll), Flags: op.Flags}, nil
+	case proto.OpDelete:
+		return &zk.DeleteRequest{Path: op.Path, Version: op.Version}, nil
+	case proto.OpSetData:
+		return &zk.SetDataRequest{Path: op.Path, Data: op.Payload(), Version: op.Version}, nil
+	case proto.OpCheck:
+		return &zk.CheckVersionRequest{Path: op.Path, Version: op.Version}, nil
+	}
+	return nil, errNotReplayable
+}
+
+// errMatches is true when the client returned the error of the recorded code.
+func errMatches(err error, code zk.ErrCode) bool {
+	if code == 0 {
+		return err == nil
+	}
+	return err != nil && err.Error() == "zk: "+zkerrors.ZKErrCodeToMessage(code)
+}
@@ -0,0 +1,69 @@
+package loadgen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/workload"
+	"github.com/jeffbean/zkpacket/zktest"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestReplay(t *testing.T) {
+	server, err := zktest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	w := &workload.Workload{Sessions: []*workload.Session{
+		{ID: 1, Timeout: 5 * time.Second, Ops: []workload.Op{
+			{Op: "OpCreate", Path: "/replay", Size: 3},
+			{At: 10 * time.Millisecond, Op: "OpSetData", Path: "/replay", Data: "recorded", Version: -1},
+			{At: 20 * time.Millisecond, Op: "OpMulti", Ops: []workload.Op{
+				{Op: "OpCreate", Path: "/replay/a"},
+				{Op: "OpCheck", Path: "/replay", Version: 1},
+			}},
+			{At: 30 * time.Millisecond, Op: "OpClose"},
+			{At: 40 * time.Millisecond, Op: "OpCreate", Path: "/after-close"},
+		}},
+		{ID: 2, Ops: []workload.Op{
+			{At: 200 * time.Millisecond, Op: "OpGetData", Path: "/replay", Watch: true},
+			{At: 210 * time.Millisecond, Op: "OpExists", Path: "/missing", Err: zk.ErrCode(-101)},
+			// Recorded as ok but the node doesn't exist on the target
+			{At: 220 * time.Millisecond, Op: "OpDelete", Path: "/other", Version: -1},
+			{At: 230 * time.Millisecond, Op: "OpReconfig"},
+			{At: 240 * time.Millisecond, Op: "OpGetChildren2", Path: "/replay"},
+		}},
+	}}
+
+	start := time.Now()
+	res := replay([]string{server.Addr}, w, 2, make(chan struct{}))
+	assert.True(t, time.Since(start) >= 120*time.Millisecond, "the operations keep their pace at twice the speed")
+	assert.Equal(t, replayResult{ops: 7, mismatches: 1, skipped: 1}, res)
+
+	data, ok := server.Get("/replay")
+	require.True(t, ok)
+	assert.Equal(t, "recorded", string(data))
+	children, _ := server.Children("/replay")
+	assert.Equal(t, []string{"a"}, children)
+	_, ok = server.Get("/after-close")
+	assert.False(t, ok, "the session ends at its close")
+}
+
+func TestReplayStop(t *testing.T) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	w := &workload.Workload{Sessions: []*workload.Session{
+		{Ops: []workload.Op{{At: time.Hour, Op: "OpCreate", Path: "/never"}}},
+	}}
+	stop := make(chan struct{})
+	close(stop)
+	assert.Equal(t, replayResult{}, replay([]string{"127.0.0.1:1"}, w, 1, stop))
+}
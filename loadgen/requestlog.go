@@ -0,0 +1,210 @@
+package loadgen
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	requestLogFile   string
+	requestLogFormat = "csv"
+	// requests is the request log, nil when disabled
+	requests *requestLog
+)
+
+// RequestRecord is an operation zkload sent, a line of the request log.
+type RequestRecord struct {
+	// Time is when the client was called
+	Time    time.Time
+	Session int64
+	// Xid is read from the request on the wire, zero when it was not sent
+	Xid int32
+	// Op is the operation as sent on the wire, e.g. OpGetChildren2 for a getChildren
+	Op   string
+	Path string
+	// Latency is the time the client took to answer
+	Latency time.Duration
+	// Err is the error the client returned, empty for none
+	Err string
+}
+
+// requestLine is a RequestRecord in the request log, with the field names and formats of the zkpacket event
+// stream.
+type requestLine struct {
+	Time           time.Time `json:"time"`
+	Session        string    `json:"session"`
+	Xid            int32     `json:"xid"`
+	Op             string    `json:"op"`
+	Path           string    `json:"path,omitempty"`
+	LatencySeconds float64   `json:"latency_seconds"`
+	Err            string    `json:"err,omitempty"`
+}
+
+var csvHeader = []string{"time", "session", "xid", "op", "path", "latency_seconds", "err"}
+
+// requestLog writes a line for every operation, as CSV or JSON lines.
+type requestLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	csv *csv.Writer
+	enc *json.Encoder
+}
+
+func newRequestLog(fileName, format string) (*requestLog, error) {
+	if format != "csv" && format != "json" {
+		return nil, fmt.Errorf("unknown request log format %q, use csv or json", format)
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	l := &requestLog{f: f, w: bufio.NewWriter(f)}
+	if format == "json" {
+		l.enc = json.NewEncoder(l.w)
+		return l, nil
+	}
+	l.csv = csv.NewWriter(l.w)
+	if err := l.csv.Write(csvHeader); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *requestLog) write(r *RequestRecord) {
+	if l == nil {
+		return
+	}
+	line := requestLine{
+		Time:           r.Time,
+		Session:        sessionString(r.Session),
+		Xid:            r.Xid,
+		Op:             r.Op,
+		Path:           r.Path,
+		LatencySeconds: r.Latency.Seconds(),
+		Err:            r.Err,
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	if l.enc != nil {
+		err = l.enc.Encode(line)
+	} else {
+		err = l.csv.Write([]string{
+			line.Time.Format(time.RFC3339Nano), line.Session, strconv.Itoa(int(line.Xid)), line.Op, line.Path,
+			strconv.FormatFloat(line.LatencySeconds, 'f', -1, 64), line.Err,
+		})
+	}
+	if err != nil {
+		logger.Error("failed to write the request log", zap.String("file", l.f.Name()), zap.Error(err))
+	}
+}
+
+func (l *requestLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.csv != nil {
+		l.csv.Flush()
+	}
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// ReadRequestLog reads a request log written as CSV or JSON lines.
+func ReadRequestLog(r io.Reader) ([]RequestRecord, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		return readJSONRequests(data)
+	}
+	return readCSVRequests(data)
+}
+
+func readJSONRequests(data []byte) ([]RequestRecord, error) {
+	var records []RequestRecord
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var line requestLine
+		if err := dec.Decode(&line); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid request log: %v", err)
+		}
+		record, err := line.record()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+func readCSVRequests(data []byte) ([]RequestRecord, error) {
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid request log: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	if len(rows[0]) != len(csvHeader) || rows[0][0] != csvHeader[0] {
+		return nil, fmt.Errorf("invalid request log: the header is not %v", csvHeader)
+	}
+	var records []RequestRecord
+	for i, row := range rows[1:] {
+		line := requestLine{Session: row[1], Op: row[3], Path: row[4], Err: row[6]}
+		var err error
+		var xid int64
+		if line.Time, err = time.Parse(time.RFC3339Nano, row[0]); err == nil {
+			if xid, err = strconv.ParseInt(row[2], 10, 32); err == nil {
+				line.LatencySeconds, err = strconv.ParseFloat(row[5], 64)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid request log line %d: %v", i+2, err)
+		}
+		line.Xid = int32(xid)
+		record, err := line.record()
+		if err != nil {
+			return nil, fmt.Errorf("invalid request log line %d: %v", i+2, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (l *requestLine) record() (RequestRecord, error) {
+	session, err := strconv.ParseInt(l.Session, 0, 64)
+	if err != nil {
+		return RequestRecord{}, fmt.Errorf("invalid session %q", l.Session)
+	}
+	return RequestRecord{
+		Time:    l.Time,
+		Session: session,
+		Xid:     l.Xid,
+		Op:      l.Op,
+		Path:    l.Path,
+		Latency: time.Duration(l.LatencySeconds * float64(time.Second)),
+		Err:     l.Err,
+	}, nil
+}
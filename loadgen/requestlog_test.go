@@ -0,0 +1,55 @@
+package loadgen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "requestlog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	records := []RequestRecord{
+		{Time: time.Date(2017, 6, 1, 10, 0, 0, 123, time.UTC), Session: 0x15c6e3b3f2d0000, Xid: 1, Op: "OpCreate",
+			Path: "/a,b", Latency: 1500 * time.Microsecond},
+		{Time: time.Date(2017, 6, 1, 10, 0, 1, 0, time.UTC), Session: 0x15c6e3b3f2d0000, Xid: 2, Op: "OpGetData",
+			Path: "/missing", Latency: time.Millisecond, Err: "zk: node does not exist"},
+	}
+	for _, format := range []string{"csv", "json"} {
+		t.Run(format, func(t *testing.T) {
+			name := filepath.Join(dir, "requests."+format)
+			l, err := newRequestLog(name, format)
+			require.NoError(t, err)
+			for i := range records {
+				l.write(&records[i])
+			}
+			require.NoError(t, l.Close())
+
+			f, err := os.Open(name)
+			require.NoError(t, err)
+			defer f.Close()
+			read, err := ReadRequestLog(f)
+			require.NoError(t, err)
+			assert.Equal(t, records, read)
+		})
+	}
+
+	_, err = newRequestLog(filepath.Join(dir, "requests.xml"), "xml")
+	assert.Error(t, err)
+	_, err = ReadRequestLog(strings.NewReader("a,b\n1,2\n"))
+	assert.Error(t, err, "not a request log header")
+	_, err = ReadRequestLog(strings.NewReader(`{"session":"zero"}`))
+	assert.Error(t, err)
+
+	var disabled *requestLog
+	disabled.write(&records[0])
+	assert.NoError(t, disabled.Close())
+}
@@ -0,0 +1,609 @@
+package loadgen
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jeffbean/zkpacket/workload"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"go.uber.org/zap"
+)
+
+var (
+	scenarioName string
+	// scenarioSize scales the scenario, zero runs it at its default size
+	scenarioSize int
+)
+
+const (
+	// maxData is the largest data the scenarios write, jute.maxbuffer less room for the rest of the request
+	maxData = 1<<20 - 1<<10
+	// expiryTimeout is the session timeout asked for by sessions that are expired, the minimum of a default
+	// ZooKeeper so they expire quickly
+	expiryTimeout = 4 * time.Second
+	// expiryWait bounds the wait for a paused session to expire, twice the largest timeout of a default ZooKeeper
+	expiryWait = 80 * time.Second
+	// watchWait bounds the wait for watches to fire
+	watchWait = 30 * time.Second
+	// batchSize is how many nodes a multi creates at once
+	batchSize = 100
+	// churners is how many goroutines connect and close at once
+	churners = 10
+)
+
+// scenario runs operations that are hard on a sniffer and checks ZooKeeper answered them as expected.
+type scenario struct {
+	name string
+	help string
+	// size is the default -size
+	size int
+	run  func(r *scenarioRun) error
+}
+
+// scenarioRun is what a scenario runs with: its own node to work under and a session for setting it up.
+type scenarioRun struct {
+	servers []string
+	root    string
+	size    int
+	conn    *client
+	// stop is closed on SIGINT or SIGTERM, the scenario returns errInterrupted as soon as it can
+	stop <-chan struct{}
+}
+
+// errInterrupted is the error of a scenario stopped by a signal.
+var errInterrupted = errors.New("interrupted")
+
+// interrupted returns errInterrupted once the run is stopped.
+func (r *scenarioRun) interrupted() error {
+	select {
+	case <-r.stop:
+		return errInterrupted
+	default:
+		return nil
+	}
+}
+
+var scenarios = []*scenario{
+	{
+		name: "watch-storm",
+		help: "-size sessions watch one node, then a single setData fires all the watches",
+		size: 1000,
+		run:  watchStorm,
+	},
+	{
+		name: "huge-znodes",
+		help: "creates, reads and writes -size nodes with data just under jute.maxbuffer",
+		size: 5,
+		run:  hugeZnodes,
+	},
+	{
+		name: "wide-children",
+		help: "creates -size children under one node and lists them",
+		size: 10000,
+		run:  wideChildren,
+	},
+	{
+		name: "deep-multi",
+		help: "multis of -size operations that succeed or fail at the first, middle or last operation",
+		size: 100,
+		run:  deepMulti,
+	},
+	{
+		name: "connect-churn",
+		help: "opens and closes -size sessions",
+		size: 1000,
+		run:  connectChurn,
+	},
+	{
+		name: "session-expiry",
+		help: "-size sessions stop pinging until the server expires them",
+		size: 1,
+		run:  sessionExpiry,
+	},
+	{
+		name: "set-watches",
+		help: "a session watching -size nodes reconnects while they change and restores its watches with SetWatches",
+		size: 100,
+		run:  setWatches,
+	},
+}
+
+// scenarioRoot holds a node for each scenario, removed when the scenario is over.
+func scenarioRoot() string {
+	return prefix + "/scenarios"
+}
+
+func findScenario(name string) *scenario {
+	for _, s := range scenarios {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func scenarioNames() string {
+	names := make([]string, len(scenarios))
+	for i, s := range scenarios {
+		names[i] = s.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// scenarioUsage lists the scenarios for command help.
+func scenarioUsage() string {
+	lines := make([]string, len(scenarios))
+	for i, s := range scenarios {
+		lines[i] = fmt.Sprintf("  %-15v %v, size %v", s.name, s.help, s.size)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runScenario runs the -scenario under its own node and removes the node at the end, also when it is
+// interrupted.
+func runScenario(servers []string) error {
+	s := findScenario(scenarioName)
+	if s == nil {
+		return fmt.Errorf("unknown scenario %q, use one of %v", scenarioName, scenarioNames())
+	}
+	size := scenarioSize
+	if size <= 0 {
+		size = s.size
+	}
+	conn, err := dial(servers, defaultSessionTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
+	go func() {
+		<-c
+		logger.Warn("interrupted, stopping the scenario")
+		close(stop)
+	}()
+
+	r := &scenarioRun{servers: servers, root: scenarioRoot() + "/" + s.name, size: size, conn: conn, stop: stop}
+	if err := deleteTree(conn.Conn, r.root); err != nil {
+		return err
+	}
+	if err := createPath(conn.Conn, r.root); err != nil {
+		return err
+	}
+
+	logger.Info("running scenario", zap.String("scenario", s.name), zap.Int("size", size))
+	start := time.Now()
+	err = s.run(r)
+	if cleanupErr := deleteTree(conn.Conn, r.root); cleanupErr != nil {
+		logger.Error("failed to remove the scenario's nodes", zap.String("path", r.root), zap.Error(cleanupErr))
+	}
+	if err != nil {
+		return fmt.Errorf("scenario %v: %v", s.name, err)
+	}
+	logger.Info("scenario done", zap.String("scenario", s.name), zap.Duration("elapsed", time.Since(start)))
+	return nil
+}
+
+// dialAll connects n sessions, closing them all when one fails.
+func dialAll(servers []string, n int, timeout time.Duration) ([]*client, error) {
+	conns := make([]*client, 0, n)
+	for i := 0; i < n; i++ {
+		c, err := dial(servers, timeout)
+		if err != nil {
+			closeAll(conns)
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+	return conns, nil
+}
+
+func closeAll(conns []*client) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// awaitEvents forwards the events of the watch channel of the given type.
+func awaitEvents(ch <-chan zk.Event, typ zk.EventType, to chan<- time.Time) {
+	go func() {
+		for ev := range ch {
+			if ev.Type == typ {
+				to <- time.Now()
+			}
+		}
+	}()
+}
+
+// collect waits for n times from the channel and returns the ones received before the wait is over or the
+// run is stopped.
+func (r *scenarioRun) collect(times <-chan time.Time, n int, wait time.Duration) []time.Time {
+	var got []time.Time
+	deadline := time.After(wait)
+	for len(got) < n {
+		select {
+		case t := <-times:
+			got = append(got, t)
+		case <-deadline:
+			return got
+		case <-r.stop:
+			return got
+		}
+	}
+	return got
+}
+
+func watchStorm(r *scenarioRun) error {
+	path := r.root + "/storm"
+	if err := r.conn.do(&workload.Op{Op: "OpCreate", Path: path}); err != nil {
+		return err
+	}
+	watchers, err := dialAll(r.servers, r.size, defaultSessionTimeout)
+	if err != nil {
+		return err
+	}
+	defer closeAll(watchers)
+
+	fired := make(chan time.Time, r.size)
+	errs := make(chan error, r.size)
+	var wg sync.WaitGroup
+	// Sets the watches from a bounded number of goroutines so connecting doesn't overwhelm the server
+	sem := make(chan struct{}, batchSize)
+	for _, w := range watchers {
+		if r.interrupted() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(w *client) {
+			defer func() { <-sem; wg.Done() }()
+			_, _, ch, err := w.GetW(path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			awaitEvents(ch, zk.EventNodeDataChanged, fired)
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return fmt.Errorf("failed to set a watch: %v", err)
+	}
+	if err := r.interrupted(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if err := r.conn.do(&workload.Op{Op: "OpSetData", Path: path, Size: 1, Version: -1}); err != nil {
+		return err
+	}
+	got := r.collect(fired, r.size, watchWait)
+	if err := r.interrupted(); err != nil {
+		return err
+	}
+	delays := make([]time.Duration, len(got))
+	for i, t := range got {
+		delays[i] = t.Sub(start)
+	}
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	logger.Info("watch storm", zap.Int("watchers", r.size), zap.Int("fired", len(got)),
+		zap.Duration("p50", percentile(delays, 0.5)), zap.Duration("max", percentile(delays, 1)))
+	if len(got) < r.size {
+		return fmt.Errorf("%v of %v watches fired", len(got), r.size)
+	}
+	return nil
+}
+
+func hugeZnodes(r *scenarioRun) error {
+	for i := 0; i < r.size; i++ {
+		if err := r.interrupted(); err != nil {
+			return err
+		}
+		path := fmt.Sprintf("%v/huge-%d", r.root, i)
+		for _, op := range []workload.Op{
+			{Op: "OpCreate", Path: path, Size: maxData},
+			{Op: "OpGetData", Path: path},
+			{Op: "OpSetData", Path: path, Size: maxData, Version: -1},
+			{Op: "OpGetData", Path: path, Watch: true},
+		} {
+			if err := r.conn.do(&op); err != nil {
+				return fmt.Errorf("%v %v: %v", op.Op, path, err)
+			}
+		}
+	}
+	logger.Info("huge znodes", zap.Int("nodes", r.size), zap.Int("bytes", maxData))
+	return nil
+}
+
+func wideChildren(r *scenarioRun) error {
+	parent := r.root + "/wide"
+	if err := r.conn.do(&workload.Op{Op: "OpCreate", Path: parent}); err != nil {
+		return err
+	}
+	for i := 0; i < r.size; i += batchSize {
+		if err := r.interrupted(); err != nil {
+			return err
+		}
+		multi := workload.Op{Op: "OpMulti"}
+		for j := i; j < i+batchSize && j < r.size; j++ {
+			multi.Ops = append(multi.Ops, workload.Op{Op: "OpCreate", Path: fmt.Sprintf("%v/child-%08d", parent, j)})
+		}
+		if err := r.conn.do(&multi); err != nil {
+			return fmt.Errorf("failed to create children: %v", err)
+		}
+	}
+	for _, watch := range []bool{false, true} {
+		if err := r.conn.do(&workload.Op{Op: "OpGetChildren", Path: parent, Watch: watch}); err != nil {
+			return err
+		}
+	}
+	children, _, err := r.conn.Children(parent)
+	if err != nil {
+		return err
+	}
+	logger.Info("wide children", zap.Int("children", len(children)))
+	if len(children) != r.size {
+		return fmt.Errorf("listed %v children instead of %v", len(children), r.size)
+	}
+	return nil
+}
+
+func deepMulti(r *scenarioRun) error {
+	parent := r.root + "/multi"
+	if err := r.conn.do(&workload.Op{Op: "OpCreate", Path: parent}); err != nil {
+		return err
+	}
+	node := func(i int) string { return fmt.Sprintf("%v/m-%d", parent, i) }
+	create := workload.Op{Op: "OpMulti"}
+	for i := 0; i < r.size; i++ {
+		create.Ops = append(create.Ops, workload.Op{Op: "OpCreate", Path: node(i), Size: 10})
+	}
+	if err := r.conn.do(&create); err != nil {
+		return fmt.Errorf("failed to create the nodes: %v", err)
+	}
+
+	// Each multi sets every node but one operation fails, rolling the whole multi back
+	failures := []struct {
+		at  int
+		op  workload.Op
+		err error
+	}{
+		{0, workload.Op{Op: "OpCheck", Path: node(0), Version: 100}, zk.ErrBadVersion},
+		{r.size / 2, workload.Op{Op: "OpDelete", Path: parent + "/missing", Version: -1}, zk.ErrNoNode},
+		{r.size - 1, workload.Op{Op: "OpCreate", Path: node(0)}, zk.ErrNodeExists},
+	}
+	for _, f := range failures {
+		if err := r.interrupted(); err != nil {
+			return err
+		}
+		multi := workload.Op{Op: "OpMulti"}
+		for i := 0; i < r.size; i++ {
+			op := workload.Op{Op: "OpSetData", Path: node(i), Size: 20, Version: -1}
+			if i == f.at {
+				op = f.op
+			}
+			multi.Ops = append(multi.Ops, op)
+		}
+		if err := r.conn.do(&multi); err != f.err {
+			return fmt.Errorf("a multi failing at operation %v returned %v instead of %v", f.at, err, f.err)
+		}
+	}
+	data, _, err := r.conn.Get(node(r.size - 1))
+	if err != nil {
+		return err
+	}
+	if len(data) != 10 {
+		return errors.New("a failed multi was not rolled back")
+	}
+
+	remove := workload.Op{Op: "OpMulti"}
+	for i := 0; i < r.size; i++ {
+		remove.Ops = append(remove.Ops, workload.Op{Op: "OpDelete", Path: node(i), Version: -1})
+	}
+	if err := r.conn.do(&remove); err != nil {
+		return fmt.Errorf("failed to delete the nodes: %v", err)
+	}
+	logger.Info("deep multi", zap.Int("ops", r.size), zap.Int("failed", len(failures)))
+	return nil
+}
+
+func connectChurn(r *scenarioRun) error {
+	sessions := make(chan int)
+	errs := make(chan error, r.size)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < churners; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range sessions {
+				c, err := dial(r.servers, defaultSessionTimeout)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				// The first request waits for the session
+				if err := c.do(&workload.Op{Op: "OpExists", Path: r.root}); err != nil {
+					errs <- err
+				}
+				c.Close()
+			}
+		}()
+	}
+	for i := 0; i < r.size && r.interrupted() == nil; i++ {
+		sessions <- i
+	}
+	close(sessions)
+	wg.Wait()
+	close(errs)
+	if err := r.interrupted(); err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start)
+	failed := len(errs)
+	logger.Info("connect churn", zap.Int("sessions", r.size), zap.Int("failed", failed),
+		zap.Float64("sessions_per_second", float64(r.size)/elapsed.Seconds()))
+	if err := <-errs; err != nil {
+		return fmt.Errorf("%v of %v sessions failed, the first with %v", failed, r.size, err)
+	}
+	return nil
+}
+
+func sessionExpiry(r *scenarioRun) error {
+	errs := make(chan error, r.size)
+	var wg sync.WaitGroup
+	for i := 0; i < r.size; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := expireSession(r, fmt.Sprintf("%v/ephemeral-%d", r.root, i)); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// expireSession pauses a session that owns an ephemeral node until the server deletes the node, then lets
+// the client find out its session expired.
+func expireSession(r *scenarioRun, node string) error {
+	c, err := dial(r.servers, expiryTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	expired := make(chan struct{})
+	go func() {
+		for ev := range c.events {
+			if ev.State == zk.StateExpired {
+				close(expired)
+				return
+			}
+		}
+	}()
+
+	if err := c.do(&workload.Op{Op: "OpCreate", Path: node, Flags: zk.FlagEphemeral}); err != nil {
+		return err
+	}
+	session := c.SessionID()
+	_, _, deleted, err := r.conn.ExistsW(node)
+	if err != nil {
+		return err
+	}
+	deletedAt := make(chan time.Time, 1)
+	awaitEvents(deleted, zk.EventNodeDeleted, deletedAt)
+
+	start := time.Now()
+	c.faults.pause()
+	got := r.collect(deletedAt, 1, expiryWait)
+	c.faults.resume()
+	if err := r.interrupted(); err != nil {
+		return err
+	}
+	if len(got) == 0 {
+		return fmt.Errorf("session %v did not expire in %v", sessionString(session), expiryWait)
+	}
+	select {
+	case <-expired:
+	case <-r.stop:
+		return errInterrupted
+	case <-time.After(watchWait):
+		return fmt.Errorf("the client of session %v was not told it expired", sessionString(session))
+	}
+	logger.Info("session expired", zap.String("session", sessionString(session)),
+		zap.Duration("after", got[0].Sub(start)))
+	return nil
+}
+
+func setWatches(r *scenarioRun) error {
+	parent := r.root + "/watches"
+	if err := r.conn.do(&workload.Op{Op: "OpCreate", Path: parent}); err != nil {
+		return err
+	}
+	node := func(i int) string { return fmt.Sprintf("%v/w-%d", parent, i) }
+	missing := func(i int) string { return fmt.Sprintf("%v/missing-%d", parent, i) }
+	for i := 0; i < r.size; i++ {
+		if err := r.conn.do(&workload.Op{Op: "OpCreate", Path: node(i)}); err != nil {
+			return err
+		}
+	}
+
+	watcher, err := dial(r.servers, defaultSessionTimeout)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// A data watch on every node, an exist watch on every missing node and a child watch on the parent
+	fired := make(chan time.Time, 2*r.size+1)
+	for i := 0; i < r.size; i++ {
+		_, _, ch, err := watcher.GetW(node(i))
+		if err != nil {
+			return err
+		}
+		awaitEvents(ch, zk.EventNodeDataChanged, fired)
+		_, _, ch, err = watcher.ExistsW(missing(i))
+		if err != nil {
+			return err
+		}
+		awaitEvents(ch, zk.EventNodeCreated, fired)
+	}
+	_, _, ch, err := watcher.ChildrenW(parent)
+	if err != nil {
+		return err
+	}
+	awaitEvents(ch, zk.EventNodeChildrenChanged, fired)
+
+	change := func(from, to int) error {
+		for i := from; i < to; i++ {
+			if err := r.interrupted(); err != nil {
+				return err
+			}
+			if err := r.conn.do(&workload.Op{Op: "OpSetData", Path: node(i), Size: 1, Version: -1}); err != nil {
+				return err
+			}
+			if err := r.conn.do(&workload.Op{Op: "OpCreate", Path: missing(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// Half the nodes change while the watcher is away, their watches fire when its SetWatches arrives. The
+	// other half change once the restored watches are set.
+	watcher.faults.pause()
+	watcher.faults.disconnect()
+	err = change(0, r.size/2)
+	watcher.faults.resume()
+	if err != nil {
+		return err
+	}
+	if err := watcher.do(&workload.Op{Op: "OpExists", Path: parent}); err != nil {
+		return fmt.Errorf("failed to reconnect: %v", err)
+	}
+	if err := change(r.size/2, r.size); err != nil {
+		return err
+	}
+
+	got := r.collect(fired, 2*r.size+1, watchWait)
+	if err := r.interrupted(); err != nil {
+		return err
+	}
+	logger.Info("set watches", zap.Int("watches", 2*r.size+1), zap.Int("fired", len(got)))
+	if len(got) < 2*r.size+1 {
+		return fmt.Errorf("%v of %v restored watches fired", len(got), 2*r.size+1)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package loadgen
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/zktest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestScenarios(t *testing.T) {
+	server, err := zktest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	defer func() { scenarioName, scenarioSize = "", 0 }()
+
+	for name, size := range map[string]int{
+		"watch-storm":    50,
+		"huge-znodes":    2,
+		"wide-children":  250,
+		"deep-multi":     10,
+		"connect-churn":  20,
+		"session-expiry": 2,
+		"set-watches":    10,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if name == "session-expiry" && testing.Short() {
+				t.Skip("waits for the session timeout")
+			}
+			scenarioName, scenarioSize = name, size
+			require.NoError(t, runScenario([]string{server.Addr}))
+			children, ok := server.Children(scenarioRoot())
+			require.True(t, ok)
+			assert.Empty(t, children, "the scenario's nodes are removed")
+		})
+	}
+
+	scenarioName = "meteor"
+	assert.Error(t, runScenario([]string{server.Addr}))
+}
+
+func TestScenarioInterrupted(t *testing.T) {
+	server, err := zktest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	defer func() { scenarioName, scenarioSize = "", 0 }()
+	// Keeps an interrupt sent before the scenario listens for it from ending the test binary
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+
+	scenarioName, scenarioSize = "session-expiry", 1
+	done := make(chan error)
+	start := time.Now()
+	go func() { done <- runScenario([]string{server.Addr}) }()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			assert.EqualError(t, err, "scenario session-expiry: interrupted")
+			assert.True(t, time.Since(start) < expiryTimeout, "the scenario doesn't wait for the session to expire")
+			children, ok := server.Children(scenarioRoot())
+			require.True(t, ok)
+			assert.Empty(t, children, "the scenario's nodes are removed")
+			return
+		case <-ticker.C:
+			require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGINT))
+		}
+	}
+}
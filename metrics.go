@@ -1,6 +1,13 @@
 package main
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"sync"
+	"time"
+
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var (
 	operationCounter = prometheus.NewCounterVec(
@@ -17,6 +24,91 @@ var (
 		},
 		[]string{"operation"},
 	)
+	pingHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "zk_ping_seconds",
+			Help:    "The time the server took to answer client pings.",
+			Buckets: prometheus.ExponentialBuckets(1e-4 /* start */, 2 /* factor */, 16 /* count */),
+		},
+		nil,
+	)
+	sessionTimeoutHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "zk_session_timeout_seconds",
+			Help:    "The session timeouts clients requested and the ones servers negotiated.",
+			Buckets: prometheus.ExponentialBuckets(0.5 /* start */, 2 /* factor */, 10 /* count */),
+		},
+		[]string{"timeout"},
+	)
+	reconnectCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "zk_session_reconnects_total",
+			Help: "Number of connects of clients that had seen a transaction, after losing their connection.",
+		},
+		nil,
+	)
+	zxidEpochGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "zk_zxid_epoch",
+			Help: "Epoch of the highest zxid the server answered with, it changes with every new leader.",
+		},
+		[]string{"server"},
+	)
+	zxidCounterGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "zk_zxid_counter",
+			Help: "Counter of the highest zxid the server answered with, the epoch rolls over when it reaches 2^32.",
+		},
+		[]string{"server"},
+	)
+	transactionCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "zk_transactions_total",
+			Help: "Number of transactions the server applied, from the increase of the zxids it answered with.",
+		},
+		[]string{"server"},
+	)
+	epochChangeCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "zk_epoch_changes_total",
+			Help: "Number of times the zxid epoch of the server changed, which means a new leader was elected.",
+		},
+		[]string{"server"},
+	)
+	slowOperationCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "zk_slow_ops_total",
+			Help: "Number of operations slower than their configured threshold.",
+		},
+		[]string{"operation"},
+	)
+	triggeredCaptureCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "zkpacket_triggered_captures_total",
+			Help: "Number of pcap dumps written by a trigger.",
+		},
+		[]string{"reason"},
+	)
+	streamDroppedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "zkpacket_stream_dropped_events_total",
+			Help: "Number of events dropped for event stream subscribers that fell behind.",
+		},
+	)
+	decodeErrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "zkpacket_decode_errors_total",
+			Help: "Number of packets that failed to decode by reason and by operation when the header was read.",
+		},
+		[]string{"reason", "operation"},
+	)
+	packetProcessingHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "zkpacket_packet_processing_seconds",
+			Help:    "The time taken to decode a packet and run the outputs on it.",
+			Buckets: prometheus.ExponentialBuckets(1e-6 /* start */, 4 /* factor */, 10 /* count */),
+		},
+	)
 	packetSizeHistogram = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "packet_size",
@@ -30,5 +122,143 @@ func init() {
 	// Metrics have to be registered to be exposed:
 	prometheus.MustRegister(operationCounter)
 	prometheus.MustRegister(operationHistogram)
+	prometheus.MustRegister(pingHistogram)
+	prometheus.MustRegister(sessionTimeoutHistogram)
+	prometheus.MustRegister(reconnectCounter)
+	prometheus.MustRegister(zxidEpochGauge)
+	prometheus.MustRegister(zxidCounterGauge)
+	prometheus.MustRegister(transactionCounter)
+	prometheus.MustRegister(epochChangeCounter)
+	prometheus.MustRegister(slowOperationCounter)
+	prometheus.MustRegister(triggeredCaptureCounter)
+	prometheus.MustRegister(streamDroppedCounter)
+	prometheus.MustRegister(decodeErrorCounter)
+	prometheus.MustRegister(packetProcessingHistogram)
+	prometheus.MustRegister(health)
+	prometheus.MustRegister(heartbeats{})
+	prometheus.MustRegister(clientFingerprints{})
 	// prometheus.MustRegister(packetSizeHistogram)
 }
+
+// health is the capture the self metrics are read from.
+var health = &captureHealth{}
+
+var (
+	pcapReceivedDesc = prometheus.NewDesc("zkpacket_pcap_received_packets_total",
+		"Number of packets received by the capture, as reported by the kernel.", nil, nil)
+	pcapDroppedDesc = prometheus.NewDesc("zkpacket_pcap_dropped_packets_total",
+		"Number of packets dropped because zkpacket did not read them fast enough, as reported by the kernel.", nil, nil)
+	pcapIfDroppedDesc = prometheus.NewDesc("zkpacket_pcap_interface_dropped_packets_total",
+		"Number of packets dropped by the network interface, as reported by libpcap.", nil, nil)
+	packetsDesc = prometheus.NewDesc("zkpacket_packets_processed_total",
+		"Number of packets decoded.", nil, nil)
+	truncatedDesc = prometheus.NewDesc("zkpacket_truncated_packets_total",
+		"Number of packets cut short by the snapshot length.", nil, nil)
+	unmatchedDesc = prometheus.NewDesc("zkpacket_unmatched_responses_total",
+		"Number of responses whose request was not captured.", nil, nil)
+	unansweredDesc = prometheus.NewDesc("zkpacket_unanswered_requests_total",
+		"Number of requests whose connection ended before they were answered.", nil, nil)
+	pendingDesc = prometheus.NewDesc("zkpacket_pending_requests",
+		"Number of requests waiting for their response.", nil, nil)
+)
+
+// captureHealth reads the pcap and decoding counters when scraped, so the capture itself doesn't pay for them.
+type captureHealth struct {
+	mu     sync.Mutex
+	handle packetSource
+	pool   *sniffer.Pool
+}
+
+// watch starts reporting the capture. The handle is nil once it is closed, the pool is kept.
+func (h *captureHealth) watch(handle packetSource, pool *sniffer.Pool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handle = handle
+	if pool != nil {
+		h.pool = pool
+	}
+}
+
+func (h *captureHealth) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pcapReceivedDesc
+	ch <- pcapDroppedDesc
+	ch <- pcapIfDroppedDesc
+	ch <- packetsDesc
+	ch <- truncatedDesc
+	ch <- unmatchedDesc
+	ch <- unansweredDesc
+	ch <- pendingDesc
+}
+
+func (h *captureHealth) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.handle != nil {
+		// Reading a file has no capture statistics
+		if stats, err := h.handle.Stats(); err == nil {
+			ch <- prometheus.MustNewConstMetric(pcapReceivedDesc, prometheus.CounterValue, float64(stats.received))
+			ch <- prometheus.MustNewConstMetric(pcapDroppedDesc, prometheus.CounterValue, float64(stats.dropped))
+			ch <- prometheus.MustNewConstMetric(pcapIfDroppedDesc, prometheus.CounterValue, float64(stats.ifDropped))
+		}
+	}
+	if h.pool != nil {
+		stats := h.pool.Stats()
+		ch <- prometheus.MustNewConstMetric(packetsDesc, prometheus.CounterValue, float64(stats.Packets))
+		ch <- prometheus.MustNewConstMetric(truncatedDesc, prometheus.CounterValue, float64(stats.Truncated))
+		ch <- prometheus.MustNewConstMetric(unmatchedDesc, prometheus.CounterValue, float64(stats.Unmatched))
+		ch <- prometheus.MustNewConstMetric(unansweredDesc, prometheus.CounterValue, float64(stats.Unanswered))
+		ch <- prometheus.MustNewConstMetric(pendingDesc, prometheus.GaugeValue, float64(stats.Pending))
+	}
+}
+
+var (
+	heartbeatRatioDesc = prometheus.NewDesc("zk_session_heartbeat_ratio",
+		"Time since the session last sent anything to the server, as a share of its negotiated timeout.",
+		[]string{"session", "client"}, nil)
+	nearExpiryDesc = prometheus.NewDesc("zk_sessions_near_expiry",
+		"Number of sessions that went two thirds of their timeout without a heartbeat.", nil, nil)
+)
+
+// heartbeats reports how close each tracked session is to being expired by the server when scraped.
+type heartbeats struct{}
+
+func (heartbeats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- heartbeatRatioDesc
+	ch <- nearExpiryDesc
+}
+
+func (heartbeats) Collect(ch chan<- prometheus.Metric) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	now := captureNow()
+	expireSessions(now)
+	var near int
+	for conn, s := range connSessions {
+		if s.timeout <= 0 {
+			continue
+		}
+		if s.nearExpiry(now) {
+			near++
+		}
+		ratio := float64(s.heartbeatAge(now)) / float64(s.timeout)
+		ch <- prometheus.MustNewConstMetric(heartbeatRatioDesc, prometheus.GaugeValue, ratio, sessionString(s.id), conn)
+	}
+	ch <- prometheus.MustNewConstMetric(nearExpiryDesc, prometheus.GaugeValue, float64(near))
+}
+
+// observePacketTime records how long a packet took to process.
+func observePacketTime(d time.Duration) {
+	packetProcessingHistogram.Observe(d.Seconds())
+}
+
+// countDecodeError counts the error by its reason, and by its operation when the header was read.
+func countDecodeError(err error) {
+	reason, op := "unknown", ""
+	if e, ok := err.(*sniffer.DecodeError); ok {
+		reason = e.Reason
+		if reason == sniffer.ReasonRequestBody || reason == sniffer.ReasonResponseBody {
+			op = e.Op.String()
+		}
+	}
+	decodeErrorCounter.With(prometheus.Labels{"reason": reason, "operation": op}).Inc()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, c.Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestCountDecodeError(t *testing.T) {
+	body := decodeErrorCounter.With(prometheus.Labels{"reason": sniffer.ReasonResponseBody, "operation": "OpGetData"})
+	header := decodeErrorCounter.With(prometheus.Labels{"reason": sniffer.ReasonRequestHeader, "operation": ""})
+	unknown := decodeErrorCounter.With(prometheus.Labels{"reason": "unknown", "operation": ""})
+	before := []float64{counterValue(t, body), counterValue(t, header), counterValue(t, unknown)}
+
+	countDecodeError(&sniffer.DecodeError{Reason: sniffer.ReasonResponseBody, Op: proto.OpGetData, Err: errors.New("eof")})
+	countDecodeError(&sniffer.DecodeError{Reason: sniffer.ReasonRequestHeader, Op: proto.OpGetData, Err: errors.New("eof")})
+	countDecodeError(errors.New("eof"))
+
+	assert.Equal(t, before[0]+1, counterValue(t, body))
+	assert.Equal(t, before[1]+1, counterValue(t, header), "the operation is only known once the header is read")
+	assert.Equal(t, before[2]+1, counterValue(t, unknown))
+}
+
+func TestRequestBodyDecodeError(t *testing.T) {
+	resetTrackingState()
+	defer resetTrackingState()
+	body := decodeErrorCounter.With(prometheus.Labels{"reason": sniffer.ReasonRequestBody, "operation": "OpGetData"})
+	before := counterValue(t, body)
+
+	c := sniffer.Client{Host: net.ParseIP("10.0.0.1"), Port: 5000}
+	pool := sniffer.NewPool(1, func(int) sniffer.Observer { return &pipeline{} })
+	pool.HandlePacket(requestPacket(t, c, time.Unix(1500000000, 0), 1, proto.OpGetData, &struct{ Length int32 }{100}))
+	pool.Close()
+	assert.Equal(t, before+1, counterValue(t, body))
+	assert.Len(t, pool.Pending(), 1, "the request waits for its response")
+}
+
+func TestCaptureHealth(t *testing.T) {
+	h := &captureHealth{}
+	pool := sniffer.NewPool(1, nil)
+	pool.Close()
+	h.watch(nil, pool)
+
+	ch := make(chan prometheus.Metric, 10)
+	h.Collect(ch)
+	close(ch)
+	var names []string
+	for m := range ch {
+		names = append(names, m.Desc().String())
+	}
+	// Without a handle only the decoding is reported
+	require.Len(t, names, 5)
+	assert.Contains(t, names[0], "zkpacket_packets_processed_total")
+	assert.Contains(t, names[4], "zkpacket_pending_requests")
+}
+
+func TestHeartbeats(t *testing.T) {
+	resetTrackingState()
+	defer resetTrackingState()
+	defer func() { clock = &captureClock{} }()
+
+	start := time.Unix(1500000000, 0)
+	healthy := sniffer.Client{Host: net.ParseIP("10.0.0.1"), Port: 5000}
+	silent := sniffer.Client{Host: net.ParseIP("10.0.0.2"), Port: 5000}
+	p := &pipeline{}
+	p.Session(&sniffer.Session{Client: healthy, Time: start, ID: 1, Timeout: 6 * time.Second})
+	p.Session(&sniffer.Session{Client: silent, Time: start, ID: 2, Timeout: 6 * time.Second})
+	p.Session(&sniffer.Session{Client: sniffer.Client{Host: net.ParseIP("10.0.0.3"), Port: 5000}, Time: start, Expired: true})
+	p.Ping(&sniffer.Ping{Client: healthy, Time: start.Add(3 * time.Second), Latency: time.Millisecond, Session: 1})
+	clock = &captureClock{offline: true}
+	clock.tick(start.Add(4500 * time.Millisecond))
+
+	assert.False(t, connSessions[healthy.String()].nearExpiry(clock.now()))
+	assert.True(t, connSessions[silent.String()].nearExpiry(clock.now()))
+
+	ch := make(chan prometheus.Metric, 10)
+	heartbeats{}.Collect(ch)
+	close(ch)
+	ratios := map[string]float64{}
+	var near float64
+	for m := range ch {
+		out := &dto.Metric{}
+		require.NoError(t, m.Write(out))
+		if len(out.Label) == 0 {
+			near = out.GetGauge().GetValue()
+			continue
+		}
+		ratios[out.Label[1].GetValue()] = out.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"0x1": 0.25, "0x2": 0.75}, ratios, "sessions without a timeout are skipped")
+	assert.Equal(t, 1.0, near)
+
+	// The server expired the silent session, and the healthy one goes when its connection ends
+	clock.tick(start.Add(7 * time.Second))
+	heartbeats{}.Collect(make(chan prometheus.Metric, 10))
+	assert.Contains(t, connSessions, healthy.String())
+	assert.NotContains(t, connSessions, silent.String())
+	p.Closed(healthy, start.Add(7*time.Second))
+	assert.NotContains(t, connSessions, healthy.String())
+}
@@ -0,0 +1,194 @@
+// Package pcapgen writes pcap files of made up ZooKeeper conversations. A Writer keeps the capture clock and
+// the connections keep their TCP sequence numbers, so the files read like a capture of a real server: handshakes,
+// acknowledgements, pipelined requests, frames split over segments and IPv4 or IPv6 addresses. It backs the
+// zkpcapgen tool and the pcaps in testdata.
+package pcapgen
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	// snapshotLength is the snapshot length of the pcap header, no packet is cut short
+	snapshotLength = 65536
+	// window is the TCP window advertised by both sides
+	window = 29200
+	// defaultGap is the time between two packets written one after the other
+	defaultGap = 20 * time.Microsecond
+)
+
+var (
+	clientMAC = net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	serverMAC = net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x03}
+)
+
+// Writer writes the packets of its connections to a pcap file. Every packet is stamped with the clock of the
+// writer, which moves forward by Gap after each packet and by Advance.
+type Writer struct {
+	// Gap is the time between two packets written one after the other
+	Gap time.Duration
+
+	w   *pcapgo.Writer
+	now time.Time
+	// ipID is the identification of the next IPv4 packet
+	ipID uint16
+	// zxid is the last transaction of the server, shared by every connection
+	zxid int64
+}
+
+// NewWriter writes the pcap file header to w and starts the clock at start.
+func NewWriter(w io.Writer, start time.Time) (*Writer, error) {
+	pw := pcapgo.NewWriter(w)
+	if err := pw.WriteFileHeader(snapshotLength, layers.LinkTypeEthernet); err != nil {
+		return nil, err
+	}
+	return &Writer{Gap: defaultGap, w: pw, now: start}, nil
+}
+
+// Now is the timestamp of the next packet.
+func (w *Writer) Now() time.Time {
+	return w.now
+}
+
+// Advance moves the clock forward.
+func (w *Writer) Advance(d time.Duration) {
+	w.now = w.now.Add(d)
+}
+
+// Conn is a TCP connection between a client and a server.
+type Conn struct {
+	// MSS is the largest payload of a segment, longer writes are split. Zero sends every write in one segment.
+	MSS int
+
+	w              *Writer
+	client, server *net.TCPAddr
+	// clientSeq and serverSeq are the next sequence number each side sends
+	clientSeq, serverSeq uint32
+	// xid is the last request id the client used
+	xid int32
+}
+
+// Dial writes the handshake of a new connection from the client to the server. Both need the same IP version.
+func (w *Writer) Dial(client, server *net.TCPAddr) (*Conn, error) {
+	if (client.IP.To4() == nil) != (server.IP.To4() == nil) {
+		return nil, errors.New("client and server use different IP versions")
+	}
+	c := &Conn{
+		w:         w,
+		client:    client,
+		server:    server,
+		clientSeq: isn(client, server),
+		serverSeq: isn(server, client),
+	}
+	if err := c.segment(true, &layers.TCP{SYN: true}, nil); err != nil {
+		return nil, err
+	}
+	if err := c.segment(false, &layers.TCP{SYN: true, ACK: true}, nil); err != nil {
+		return nil, err
+	}
+	if err := c.segment(true, &layers.TCP{ACK: true}, nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// isn picks the initial sequence number of a side. It looks random like a real one but the same connection
+// always gets the same number, so a script always writes the same file.
+func isn(from, to *net.TCPAddr) uint32 {
+	h := fnv.New32a()
+	h.Write(from.IP)
+	h.Write(to.IP)
+	binary.Write(h, binary.BigEndian, uint16(from.Port))
+	binary.Write(h, binary.BigEndian, uint16(to.Port))
+	return h.Sum32()
+}
+
+// Write sends the payload from one side, in segments of at most MSS bytes, and writes the acknowledgement of
+// the other side.
+func (c *Conn) Write(toServer bool, payload []byte) error {
+	for len(payload) > 0 {
+		n := len(payload)
+		if c.MSS > 0 && n > c.MSS {
+			n = c.MSS
+		}
+		if err := c.segment(toServer, &layers.TCP{PSH: true, ACK: true}, payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return c.segment(!toServer, &layers.TCP{ACK: true}, nil)
+}
+
+// Close writes the client closing the connection and the server closing its side in turn.
+func (c *Conn) Close() error {
+	if err := c.segment(true, &layers.TCP{FIN: true, ACK: true}, nil); err != nil {
+		return err
+	}
+	if err := c.segment(false, &layers.TCP{FIN: true, ACK: true}, nil); err != nil {
+		return err
+	}
+	return c.segment(true, &layers.TCP{ACK: true}, nil)
+}
+
+// segment writes a TCP segment with the flags of tcp, filling in the ports, sequence numbers and window.
+func (c *Conn) segment(toServer bool, tcp *layers.TCP, payload []byte) error {
+	src, dst := c.client, c.server
+	seq, ack := &c.clientSeq, &c.serverSeq
+	srcMAC, dstMAC := clientMAC, serverMAC
+	if !toServer {
+		src, dst = dst, src
+		seq, ack = ack, seq
+		srcMAC, dstMAC = dstMAC, srcMAC
+	}
+	tcp.SrcPort = layers.TCPPort(src.Port)
+	tcp.DstPort = layers.TCPPort(dst.Port)
+	tcp.Seq = *seq
+	if tcp.ACK {
+		tcp.Ack = *ack
+	}
+	tcp.Window = window
+	if tcp.SYN {
+		tcp.Options = []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}}}
+	}
+
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC}
+	var ip gopacket.NetworkLayer
+	if src.IP.To4() != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip = &layers.IPv4{
+			Version: 4, TTL: 64, Id: c.w.ipID, Flags: layers.IPv4DontFragment,
+			Protocol: layers.IPProtocolTCP, SrcIP: src.IP.To4(), DstIP: dst.IP.To4(),
+		}
+		c.w.ipID++
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: src.IP, DstIP: dst.IP}
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		return err
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip.(gopacket.SerializableLayer), tcp, gopacket.Payload(payload)); err != nil {
+		return err
+	}
+
+	// SYN and FIN take a sequence number like a byte of data
+	*seq += uint32(len(payload))
+	if tcp.SYN || tcp.FIN {
+		*seq++
+	}
+	data := buf.Bytes()
+	ci := gopacket.CaptureInfo{Timestamp: c.w.now, CaptureLength: len(data), Length: len(data)}
+	c.w.now = c.w.now.Add(c.w.Gap)
+	return c.w.w.WritePacket(ci, data)
+}
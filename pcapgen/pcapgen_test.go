@@ -0,0 +1,148 @@
+package pcapgen
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testStart  = time.Unix(1500000000, 0)
+	testClient = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	testServer = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 100), Port: 2181}
+)
+
+// readPackets decodes every packet of the pcap.
+func readPackets(t *testing.T, data []byte) []gopacket.Packet {
+	r, err := pcapgo.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	var packets []gopacket.Packet
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			return packets
+		}
+		require.NoError(t, err)
+		packet := gopacket.NewPacket(data, r.LinkType(), gopacket.Default)
+		require.Nil(t, packet.ErrorLayer())
+		packet.Metadata().CaptureInfo = ci
+		packets = append(packets, packet)
+	}
+}
+
+func tcpOf(p gopacket.Packet) *layers.TCP {
+	return p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+}
+
+func TestConnSequenceNumbers(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, testStart)
+	require.NoError(t, err)
+	c, err := w.Dial(testClient, testServer)
+	require.NoError(t, err)
+	require.NoError(t, c.Write(true, []byte("request")))
+	w.Advance(time.Millisecond)
+	require.NoError(t, c.Write(false, []byte("response!")))
+	require.NoError(t, c.Close())
+
+	packets := readPackets(t, buf.Bytes())
+	require.Len(t, packets, 10)
+	syn, synAck := tcpOf(packets[0]), tcpOf(packets[1])
+	assert.True(t, syn.SYN)
+	assert.True(t, synAck.SYN && synAck.ACK)
+	assert.Equal(t, syn.Seq+1, synAck.Ack)
+	clientSeq, serverSeq := syn.Seq+1, synAck.Seq+1
+
+	request, requestAck := tcpOf(packets[3]), tcpOf(packets[4])
+	assert.Equal(t, clientSeq, request.Seq)
+	assert.Equal(t, "request", string(request.Payload))
+	assert.Equal(t, clientSeq+7, requestAck.Ack)
+	response := tcpOf(packets[5])
+	assert.Equal(t, serverSeq, response.Seq)
+	assert.Equal(t, clientSeq+7, response.Ack)
+	assert.Equal(t, layers.TCPPort(2181), response.SrcPort)
+
+	fin := tcpOf(packets[7])
+	assert.True(t, fin.FIN)
+	assert.Equal(t, clientSeq+7, fin.Seq)
+	assert.Equal(t, fin.Seq+1, tcpOf(packets[8]).Ack, "the FIN takes a sequence number")
+
+	for i := 1; i < len(packets); i++ {
+		assert.True(t, packets[i].Metadata().Timestamp.After(packets[i-1].Metadata().Timestamp))
+	}
+	assert.Equal(t, time.Millisecond+w.Gap, packets[5].Metadata().Timestamp.Sub(packets[4].Metadata().Timestamp))
+}
+
+func TestConnSameConnectionSameFile(t *testing.T) {
+	write := func() []byte {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, testStart)
+		require.NoError(t, err)
+		c, err := w.Dial(testClient, testServer)
+		require.NoError(t, err)
+		require.NoError(t, c.Write(true, []byte("request")))
+		return buf.Bytes()
+	}
+	assert.Equal(t, write(), write())
+}
+
+func TestConnMSS(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, testStart)
+	require.NoError(t, err)
+	c, err := w.Dial(testClient, testServer)
+	require.NoError(t, err)
+	c.MSS = 64
+	require.NoError(t, c.Write(true, make([]byte, 150)))
+
+	packets := readPackets(t, buf.Bytes())[3:]
+	require.Len(t, packets, 4)
+	var sizes []int
+	for _, p := range packets[:3] {
+		sizes = append(sizes, len(tcpOf(p).Payload))
+	}
+	assert.Equal(t, []int{64, 64, 22}, sizes)
+	assert.Equal(t, tcpOf(packets[0]).Seq+150, tcpOf(packets[3]).Ack)
+}
+
+func TestConnIPv6(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, testStart)
+	require.NoError(t, err)
+	client := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 50000}
+	server := &net.TCPAddr{IP: net.ParseIP("fd00::100"), Port: 2181}
+	_, err = w.Dial(client, testServer)
+	assert.Error(t, err, "the addresses use different IP versions")
+
+	_, err = w.Dial(client, server)
+	require.NoError(t, err)
+	packets := readPackets(t, buf.Bytes())
+	require.Len(t, packets, 3)
+	ip, ok := packets[0].NetworkLayer().(*layers.IPv6)
+	require.True(t, ok)
+	assert.Equal(t, client.IP, ip.SrcIP)
+}
+
+func TestScriptErrors(t *testing.T) {
+	step := func(s Step) error {
+		s.Client = "10.0.0.1:50000"
+		script := &Script{Start: testStart, Server: "10.0.0.100:2181", Steps: []Step{s}}
+		return script.Write(&bytes.Buffer{})
+	}
+	assert.NoError(t, step(Step{Ops: []ScriptOp{{Op: "getData", Path: "/a"}}}))
+	assert.EqualError(t, step(Step{Ops: []ScriptOp{{Op: "fly", Path: "/a"}}}), `step 1: unknown operation "fly"`)
+	assert.EqualError(t, step(Step{Ops: []ScriptOp{{Op: "create", Flags: []string{"forever"}}}}), `step 1: unknown create flag "forever"`)
+	assert.EqualError(t, step(Step{Ops: []ScriptOp{{Op: "create", Err: "oops"}}}), `step 1: unknown error "oops"`)
+	assert.EqualError(t, step(Step{Event: &ScriptEvent{Type: "moved"}}), `step 1: unknown event type "moved"`)
+
+	script := &Script{Server: "nowhere", Steps: []Step{{Client: "10.0.0.1:50000"}}}
+	assert.Error(t, script.Write(&bytes.Buffer{}))
+}
@@ -0,0 +1,232 @@
+package pcapgen
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/zkerrors"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"gopkg.in/yaml.v2"
+)
+
+// Script is a conversation between clients and a server, read from YAML:
+//
+//	start: 2017-07-14T02:40:00Z
+//	server: 10.0.0.100:2181
+//	steps:
+//	- client: 10.0.0.1:50000
+//	  connect: {session: 0x15d3f0e0a1b0000, timeout: 10s, latency: 1ms}
+//	- client: 10.0.0.1:50000
+//	  after: 5ms
+//	  latency: 2ms
+//	  ops:
+//	  - {op: getData, path: /a, watch: true, data: hello}
+//	  - {op: exists, path: /b, err: noNode}
+//	- client: 10.0.0.1:50000
+//	  event: {type: dataChanged, path: /a}
+//
+// A client's connection is opened by its first step and closed by a step with close. Every step happens after
+// the previous one.
+type Script struct {
+	Start  time.Time `yaml:"start"`
+	Server string    `yaml:"server"`
+	// Gap is the time between two packets written one after the other
+	Gap   time.Duration `yaml:"gap"`
+	Steps []Step        `yaml:"steps"`
+}
+
+// Step is something a client or the server of a connection does.
+type Step struct {
+	// Client is the address of the client, host:port
+	Client string `yaml:"client"`
+	// After is the time since the previous step
+	After time.Duration `yaml:"after"`
+	// MSS splits the writes of the connection from this step on into segments of at most MSS bytes
+	MSS int `yaml:"mss"`
+
+	Connect *ScriptConnect `yaml:"connect"`
+	// Ops are sent pipelined in one write, and answered in one write after Latency
+	Ops     []ScriptOp    `yaml:"ops"`
+	Latency time.Duration `yaml:"latency"`
+	Event   *ScriptEvent  `yaml:"event"`
+	// Close closes the TCP connection
+	Close bool `yaml:"close"`
+}
+
+// ScriptConnect is the handshake of a session.
+type ScriptConnect struct {
+	Session int64         `yaml:"session"`
+	Resume  bool          `yaml:"resume"`
+	Expired bool          `yaml:"expired"`
+	Timeout time.Duration `yaml:"timeout"`
+	Latency time.Duration `yaml:"latency"`
+}
+
+// ScriptOp is a request and its response.
+type ScriptOp struct {
+	// Op is the operation name, e.g. getData or OpGetData
+	Op   string `yaml:"op"`
+	Path string `yaml:"path"`
+	// Data is sent with a create or setData and answered to a getData
+	Data  string `yaml:"data"`
+	Watch bool   `yaml:"watch"`
+	// Version is the expected version, -1 when not set
+	Version *int32 `yaml:"version"`
+	// Flags are the create flags, ephemeral and sequence
+	Flags    []string   `yaml:"flags"`
+	Children []string   `yaml:"children"`
+	Ops      []ScriptOp `yaml:"ops"`
+	// Err is the error name the server answers with, e.g. noNode
+	Err        string `yaml:"err"`
+	NoResponse bool   `yaml:"no_response"`
+}
+
+// ScriptEvent is a watch notification.
+type ScriptEvent struct {
+	// Type is one of created, deleted, dataChanged and childrenChanged
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+}
+
+var eventTypes = map[string]zk.EventType{
+	"created":         zk.EventNodeCreated,
+	"deleted":         zk.EventNodeDeleted,
+	"dataChanged":     zk.EventNodeDataChanged,
+	"childrenChanged": zk.EventNodeChildrenChanged,
+}
+
+var createFlags = map[string]int32{
+	"ephemeral": zk.FlagEphemeral,
+	"sequence":  zk.FlagSequence,
+}
+
+// LoadScript reads a script file.
+func LoadScript(fileName string) (*Script, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	script := &Script{}
+	if err := yaml.UnmarshalStrict(data, script); err != nil {
+		return nil, fmt.Errorf("invalid script %v: %v", fileName, err)
+	}
+	return script, nil
+}
+
+// Write writes the pcap of the conversation to w.
+func (s *Script) Write(w io.Writer) error {
+	server, err := net.ResolveTCPAddr("tcp", s.Server)
+	if err != nil {
+		return fmt.Errorf("invalid server: %v", err)
+	}
+	pw, err := NewWriter(w, s.Start)
+	if err != nil {
+		return err
+	}
+	if s.Gap > 0 {
+		pw.Gap = s.Gap
+	}
+	conns := make(map[string]*Conn)
+	for i, step := range s.Steps {
+		if err := step.write(pw, server, conns); err != nil {
+			return fmt.Errorf("step %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *Step) write(w *Writer, server *net.TCPAddr, conns map[string]*Conn) error {
+	w.Advance(s.After)
+	conn, ok := conns[s.Client]
+	if !ok {
+		client, err := net.ResolveTCPAddr("tcp", s.Client)
+		if err != nil {
+			return fmt.Errorf("invalid client: %v", err)
+		}
+		if conn, err = w.Dial(client, server); err != nil {
+			return err
+		}
+		conns[s.Client] = conn
+	}
+	if s.MSS > 0 {
+		conn.MSS = s.MSS
+	}
+
+	if c := s.Connect; c != nil {
+		err := conn.Connect(Connect{Session: c.Session, Resume: c.Resume, Expired: c.Expired, Timeout: c.Timeout, Latency: c.Latency})
+		if err != nil {
+			return err
+		}
+	}
+	if len(s.Ops) > 0 {
+		ops := make([]Op, len(s.Ops))
+		for i, o := range s.Ops {
+			op, err := o.op()
+			if err != nil {
+				return err
+			}
+			ops[i] = op
+		}
+		if err := conn.Pipeline(s.Latency, ops...); err != nil {
+			return err
+		}
+	}
+	if e := s.Event; e != nil {
+		typ, ok := eventTypes[e.Type]
+		if !ok {
+			return fmt.Errorf("unknown event type %q", e.Type)
+		}
+		if err := conn.Event(typ, e.Path); err != nil {
+			return err
+		}
+	}
+	if s.Close {
+		delete(conns, s.Client)
+		return conn.Close()
+	}
+	return nil
+}
+
+func (o *ScriptOp) op() (Op, error) {
+	typ, ok := proto.OpTypeFromName(o.Op)
+	if !ok {
+		return Op{}, fmt.Errorf("unknown operation %q", o.Op)
+	}
+	op := Op{
+		Type:       typ,
+		Path:       o.Path,
+		Data:       []byte(o.Data),
+		Watch:      o.Watch,
+		Version:    -1,
+		Children:   o.Children,
+		NoResponse: o.NoResponse,
+	}
+	if o.Version != nil {
+		op.Version = *o.Version
+	}
+	for _, name := range o.Flags {
+		flag, ok := createFlags[name]
+		if !ok {
+			return Op{}, fmt.Errorf("unknown create flag %q", name)
+		}
+		op.Flags |= flag
+	}
+	if o.Err != "" {
+		if op.Err, ok = zkerrors.ZKErrCodeFromName(o.Err); !ok {
+			return Op{}, fmt.Errorf("unknown error %q", o.Err)
+		}
+	}
+	for _, sub := range o.Ops {
+		subOp, err := sub.op()
+		if err != nil {
+			return Op{}, err
+		}
+		op.Ops = append(op.Ops, subOp)
+	}
+	return op, nil
+}
@@ -0,0 +1,335 @@
+package pcapgen
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+)
+
+// syncConnected is the state of watch events sent to a connected client
+const syncConnected = 3
+
+// Frame encodes the structs as a length prefixed ZooKeeper frame.
+func Frame(parts ...interface{}) ([]byte, error) {
+	buf := make([]byte, 512)
+	n := 4
+	for i := 0; i < len(parts); {
+		m, err := zk.EncodePacket(buf[n:], parts[i])
+		if err == zk.ErrShortBuffer {
+			buf = append(buf, make([]byte, len(buf))...)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %T: %v", parts[i], err)
+		}
+		n += m
+		i++
+	}
+	binary.BigEndian.PutUint32(buf, uint32(n-4))
+	return buf[:n], nil
+}
+
+// Connect is the handshake of a session.
+type Connect struct {
+	// Session is the session the server hands out, or the one the client resumes
+	Session int64
+	// Resume reconnects to Session instead of asking for a new session
+	Resume bool
+	// Expired answers like a server that no longer knows the session
+	Expired bool
+	Timeout time.Duration
+	// Latency is the time the server takes to answer
+	Latency time.Duration
+}
+
+// Op is a request and the response of the server.
+type Op struct {
+	Type    proto.OpType
+	Path    string
+	Data    []byte
+	Watch   bool
+	Version int32
+	// Flags are the create flags, zk.FlagEphemeral and zk.FlagSequence
+	Flags int32
+	// Children are the children a getChildren is answered with
+	Children []string
+	// Ops are the operations of a multi, their Err fails the multi
+	Ops []Op
+	// Err is the error the server answers with
+	Err zk.ErrCode
+	// NoResponse leaves the request unanswered
+	NoResponse bool
+}
+
+// Request bodies the zk package keeps unexported.
+type pathRequest struct {
+	Path string
+}
+
+type pathWatchRequest struct {
+	Path  string
+	Watch bool
+}
+
+type setACLRequest struct {
+	Path    string
+	Acl     []zk.ACL
+	Version int32
+}
+
+// Response bodies the zk package keeps unexported.
+type pathResponse struct {
+	Path string
+}
+
+type statResponse struct {
+	Stat zk.Stat
+}
+
+type getDataResponse struct {
+	Data []byte
+	Stat zk.Stat
+}
+
+type getChildrenResponse struct {
+	Children []string
+}
+
+type getChildren2Response struct {
+	Children []string
+	Stat     zk.Stat
+}
+
+type getACLResponse struct {
+	Acl  []zk.ACL
+	Stat zk.Stat
+}
+
+type multiHeader struct {
+	Type proto.OpType
+	Done bool
+	Err  zk.ErrCode
+}
+
+type errorResponse struct {
+	Err zk.ErrCode
+}
+
+var (
+	worldACL = zk.WorldACL(zk.PermAll)
+	// multiDone ends the operations of a multi request and response
+	multiDone = &multiHeader{Type: -1, Done: true, Err: -1}
+)
+
+// Connect writes the connect request and, after the latency, the answer of the server.
+func (c *Conn) Connect(cn Connect) error {
+	req := &proto.ConnectRequest{TimeOut: int32(cn.Timeout / time.Millisecond), Passwd: make([]byte, 16)}
+	if cn.Resume {
+		req.SessionID = cn.Session
+		req.LastZxidSeen = c.w.zxid
+	}
+	frame, err := Frame(req)
+	if err != nil {
+		return err
+	}
+	if err := c.Write(true, frame); err != nil {
+		return err
+	}
+	c.w.Advance(cn.Latency)
+
+	resp := &proto.ConnectResponse{TimeOut: req.TimeOut, SessionID: cn.Session, Passwd: make([]byte, 16)}
+	if cn.Expired {
+		// The server answers a reconnect to an expired session with an empty session
+		resp.TimeOut, resp.SessionID = 0, 0
+	}
+	if frame, err = Frame(resp); err != nil {
+		return err
+	}
+	return c.Write(false, frame)
+}
+
+// Pipeline writes the requests in one go and, after the latency, the responses in one go, like a client that
+// doesn't wait for a response before sending its next request.
+func (c *Conn) Pipeline(latency time.Duration, ops ...Op) error {
+	var requests, responses []byte
+	for _, op := range ops {
+		xid := int32(-2)
+		if op.Type != proto.OpPing {
+			c.xid++
+			xid = c.xid
+		}
+		frame, err := Frame(append([]interface{}{&proto.RequestHeader{Xid: xid, Opcode: op.Type}}, requestBody(op)...)...)
+		if err != nil {
+			return err
+		}
+		requests = append(requests, frame...)
+		if op.NoResponse {
+			continue
+		}
+		if frame, err = c.response(xid, op); err != nil {
+			return err
+		}
+		responses = append(responses, frame...)
+	}
+	if err := c.Write(true, requests); err != nil {
+		return err
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	c.w.Advance(latency)
+	return c.Write(false, responses)
+}
+
+// Event writes a watch notification from the server.
+func (c *Conn) Event(typ zk.EventType, path string) error {
+	frame, err := Frame(&proto.ResponseHeader{Xid: -1, Zxid: -1}, &proto.WatcherEvent{Type: typ, State: syncConnected, Path: path})
+	if err != nil {
+		return err
+	}
+	return c.Write(false, frame)
+}
+
+func requestBody(op Op) []interface{} {
+	switch op.Type {
+	case proto.OpCreate:
+		return []interface{}{&zk.CreateRequest{Path: op.Path, Data: op.Data, Acl: worldACL, Flags: op.Flags}}
+	case proto.OpDelete:
+		return []interface{}{&zk.DeleteRequest{Path: op.Path, Version: op.Version}}
+	case proto.OpExists:
+		return []interface{}{&proto.ExistsRequest{Path: op.Path, Watch: op.Watch}}
+	case proto.OpGetData:
+		return []interface{}{&proto.GetDataRequest{Path: op.Path, Watch: op.Watch}}
+	case proto.OpSetData:
+		return []interface{}{&zk.SetDataRequest{Path: op.Path, Data: op.Data, Version: op.Version}}
+	case proto.OpGetACL, proto.OpSync:
+		return []interface{}{&pathRequest{Path: op.Path}}
+	case proto.OpSetACL:
+		return []interface{}{&setACLRequest{Path: op.Path, Acl: worldACL, Version: op.Version}}
+	case proto.OpGetChildren:
+		return []interface{}{&pathWatchRequest{Path: op.Path, Watch: op.Watch}}
+	case proto.OpGetChildren2:
+		return []interface{}{&proto.GetChildren2Request{Path: op.Path, Watch: op.Watch}}
+	case proto.OpCheck:
+		return []interface{}{&zk.CheckVersionRequest{Path: op.Path, Version: op.Version}}
+	case proto.OpMulti:
+		var body []interface{}
+		for _, o := range op.Ops {
+			body = append(body, &multiHeader{Type: o.Type, Err: -1})
+			body = append(body, requestBody(o)...)
+		}
+		return append(body, multiDone)
+	}
+	return nil
+}
+
+// response encodes the answer to the request. Writes take the next zxid.
+func (c *Conn) response(xid int32, op Op) ([]byte, error) {
+	if op.Err == 0 && isWrite(op) {
+		c.w.zxid++
+	}
+	header := &proto.ResponseHeader{Xid: xid, Zxid: c.w.zxid, Err: op.Err}
+	if op.Err != 0 {
+		return Frame(header)
+	}
+	return Frame(append([]interface{}{header}, c.responseBody(op)...)...)
+}
+
+func isWrite(op Op) bool {
+	switch op.Type {
+	case proto.OpCreate, proto.OpDelete, proto.OpSetData, proto.OpSetACL:
+		return true
+	case proto.OpMulti:
+		for _, o := range op.Ops {
+			if o.Err != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (c *Conn) responseBody(op Op) []interface{} {
+	stat := c.stat(op)
+	switch op.Type {
+	case proto.OpCreate:
+		path := op.Path
+		if op.Flags&zk.FlagSequence != 0 {
+			path = fmt.Sprintf("%v%010d", path, c.w.zxid)
+		}
+		return []interface{}{&pathResponse{Path: path}}
+	case proto.OpExists, proto.OpSetData, proto.OpSetACL:
+		return []interface{}{&statResponse{Stat: stat}}
+	case proto.OpGetData:
+		return []interface{}{&getDataResponse{Data: op.Data, Stat: stat}}
+	case proto.OpGetACL:
+		return []interface{}{&getACLResponse{Acl: worldACL, Stat: stat}}
+	case proto.OpGetChildren:
+		return []interface{}{&getChildrenResponse{Children: op.Children}}
+	case proto.OpGetChildren2:
+		return []interface{}{&getChildren2Response{Children: op.Children, Stat: stat}}
+	case proto.OpSync:
+		return []interface{}{&pathResponse{Path: op.Path}}
+	case proto.OpMulti:
+		return c.multiResults(op.Ops)
+	}
+	return nil
+}
+
+// multiResults answers the operations of a multi. When one fails every operation answers with an error,
+// the ones before it ok and the ones after it a runtime inconsistency, like ZooKeeper.
+func (c *Conn) multiResults(ops []Op) []interface{} {
+	failed := -1
+	for i, o := range ops {
+		if o.Err != 0 {
+			failed = i
+			break
+		}
+	}
+	var results []interface{}
+	for i, o := range ops {
+		switch {
+		case failed >= 0:
+			var code zk.ErrCode
+			if i == failed {
+				code = o.Err
+			} else if i > failed {
+				code = -2
+			}
+			results = append(results, &multiHeader{Type: proto.OpError, Err: code}, &errorResponse{Err: code})
+		case o.Type == proto.OpCreate || o.Type == proto.OpSetData:
+			results = append(results, &multiHeader{Type: o.Type})
+			results = append(results, c.responseBody(o)...)
+		default:
+			results = append(results, &multiHeader{Type: o.Type})
+		}
+	}
+	return append(results, multiDone)
+}
+
+// stat makes up the stat of the node the operation is on.
+func (c *Conn) stat(op Op) zk.Stat {
+	ms := c.w.now.UnixNano() / int64(time.Millisecond)
+	version := op.Version
+	if op.Type == proto.OpSetData {
+		version++
+	}
+	if version < 0 {
+		version = 0
+	}
+	return zk.Stat{
+		Czxid:       c.w.zxid,
+		Mzxid:       c.w.zxid,
+		Pzxid:       c.w.zxid,
+		Ctime:       ms,
+		Mtime:       ms,
+		Version:     version,
+		DataLength:  int32(len(op.Data)),
+		NumChildren: int32(len(op.Children)),
+	}
+}
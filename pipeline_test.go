@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/pcapgen"
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memorySource replays packets held in memory, n of them in a loop.
+type memorySource struct {
+	data [][]byte
+	ci   []gopacket.CaptureInfo
+	n, i int
+}
+
+func (s *memorySource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if s.i == s.n {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	j := s.i % len(s.data)
+	s.i++
+	return s.data[j], s.ci[j], nil
+}
+
+func (s *memorySource) LinkType() layers.LinkType    { return layers.LinkTypeEthernet }
+func (s *memorySource) Stats() (captureStats, error) { return captureStats{}, nil }
+func (s *memorySource) Close()                       {}
+
+// benchmarkCapture writes the sessions of many clients reading and writing nodes.
+func benchmarkCapture(b *testing.B) *memorySource {
+	var buf bytes.Buffer
+	w, err := pcapgen.NewWriter(&buf, time.Unix(1500000000, 0))
+	require.NoError(b, err)
+	server := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 100), Port: zkDefaultPort}
+	for i := 0; i < 256; i++ {
+		c, err := w.Dial(&net.TCPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 40000 + i}, server)
+		require.NoError(b, err)
+		require.NoError(b, c.Connect(pcapgen.Connect{Session: int64(i + 1), Timeout: 10 * time.Second}))
+		for j := 0; j < 16; j++ {
+			path := fmt.Sprintf("/bench/node-%d", j)
+			require.NoError(b, c.Pipeline(time.Millisecond,
+				pcapgen.Op{Type: proto.OpGetData, Path: path, Watch: j%4 == 0},
+				pcapgen.Op{Type: proto.OpSetData, Path: path, Data: []byte("data")},
+				pcapgen.Op{Type: proto.OpExists, Path: path + "/missing", Err: errNoNode},
+			))
+		}
+	}
+
+	return newMemorySource(b, &buf)
+}
+
+// newMemorySource reads the packets of a capture into memory, to be replayed once.
+func newMemorySource(t require.TestingT, capture io.Reader) *memorySource {
+	r, err := pcapgo.NewReader(capture)
+	require.NoError(t, err)
+	s := &memorySource{}
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		s.data, s.ci = append(s.data, data), append(s.ci, ci)
+	}
+	s.n = len(s.data)
+	return s
+}
+
+// BenchmarkPipeline decodes a capture through the pipeline a sniff runs, tracing every operation.
+func BenchmarkPipeline(b *testing.B) {
+	defer func(l *zap.Logger, out io.Writer, n int) { logger, output, workers = l, out, n }(logger, output, workers)
+	logger, output = zap.NewNop(), ioutil.Discard
+	source := benchmarkCapture(b)
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			resetTrackingState()
+			defer resetTrackingState()
+			workers = n
+			source.n, source.i = b.N, 0
+			b.ReportAllocs()
+			b.ResetTimer()
+			capturePackets(source, newPool(), 0, nil)
+		})
+	}
+}
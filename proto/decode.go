@@ -2,7 +2,6 @@ package proto
 
 import (
 	"encoding/binary"
-	"errors"
 	"reflect"
 
 	"github.com/jeffbean/zkpacket/zkerrors"
@@ -67,10 +66,9 @@ type decoder interface {
 	Decode(buf []byte) (int, error)
 }
 
-// Decode marshals the buffer into the stuct and returns the offset
+// Decode marshals the buffer into the stuct and returns the offset. A failed operation is not a decode
+// error, ZooKeeper answers a failed multi with an ok header and the errors in the results, see Err.
 func (r *MultiResponse) Decode(buf []byte) (int, error) {
-	var multiErr error
-
 	r.Ops = make([]multiResponseOp, 0)
 	r.DoneHeader = multiHeader{-1, true, -1}
 	total := 0
@@ -108,12 +106,46 @@ func (r *MultiResponse) Decode(buf []byte) (int, error) {
 			total += n
 		}
 		r.Ops = append(r.Ops, res)
-		if multiErr == nil && res.Err != zkerrors.ErrOk {
-			// Use the first error as the error returned from Multi().
-			multiErr = errors.New(zkerrors.ZKErrCodeToMessage(res.Err))
+	}
+	return total, nil
+}
+
+// Err is the error of the first failed operation, the error the client's Multi returns.
+func (r *MultiResponse) Err() zk.ErrCode {
+	for _, op := range r.Ops {
+		if op.Err != zkerrors.ErrOk {
+			return op.Err
+		}
+	}
+	return zkerrors.ErrOk
+}
+
+// Decode marshals the buffer into the multi request and returns the offset
+func (r *MultiRequest) Decode(buf []byte) (int, error) {
+	r.Ops = make([]MultiRequestOp, 0)
+	total := 0
+	for {
+		header := &multiHeader{}
+		n, err := zk.DecodePacket(buf[total:], header)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if header.Done {
+			r.DoneHeader = *header
+			return total, nil
+		}
+
+		op := zk.RequestStructForOp(int32(header.Type))
+		if op == nil {
+			return total, zk.ErrAPIError
 		}
+		if n, err = zk.DecodePacket(buf[total:], op); err != nil {
+			return total, err
+		}
+		total += n
+		r.Ops = append(r.Ops, MultiRequestOp{Header: *header, Op: op})
 	}
-	return total, multiErr
 }
 
 func decodePacketValue(buf []byte, v reflect.Value) (int, error) {
@@ -147,23 +179,45 @@ func decodePacketValue(buf []byte, v reflect.Value) (int, error) {
 			}
 		}
 	case reflect.Bool:
+		if len(buf) < 1 {
+			return n, zk.ErrShortBuffer
+		}
 		v.SetBool(buf[n] != 0)
 		n++
 	case reflect.Int32:
+		if len(buf) < 4 {
+			return n, zk.ErrShortBuffer
+		}
 		v.SetInt(int64(binary.BigEndian.Uint32(buf[n : n+4])))
 		n += 4
 	case reflect.Int64:
+		if len(buf) < 8 {
+			return n, zk.ErrShortBuffer
+		}
 		v.SetInt(int64(binary.BigEndian.Uint64(buf[n : n+8])))
 		n += 8
 	case reflect.String:
-		ln := int(binary.BigEndian.Uint32(buf[n : n+4]))
-		v.SetString(string(buf[n+4 : n+4+ln]))
+		ln, err := decodeLength(buf)
+		if err != nil {
+			return n, err
+		}
+		v.SetString(string(buf[4 : 4+ln]))
 		n += 4 + ln
 	case reflect.Slice:
 		switch v.Type().Elem().Kind() {
 		default:
-			count := int(binary.BigEndian.Uint32(buf[n : n+4]))
+			if len(buf) < 4 {
+				return n, zk.ErrShortBuffer
+			}
+			count := int(int32(binary.BigEndian.Uint32(buf[n : n+4])))
 			n += 4
+			// Every element takes at least a byte, a count past the buffer can't be right
+			if count > len(buf)-n {
+				return n, zk.ErrShortBuffer
+			}
+			if count < 0 {
+				count = 0
+			}
 			values := reflect.MakeSlice(v.Type(), count, count)
 			v.Set(values)
 			for i := 0; i < count; i++ {
@@ -174,13 +228,19 @@ func decodePacketValue(buf []byte, v reflect.Value) (int, error) {
 				}
 			}
 		case reflect.Uint8:
-			ln := int(int32(binary.BigEndian.Uint32(buf[n : n+4])))
-			if ln < 0 {
+			if len(buf) < 4 {
+				return n, zk.ErrShortBuffer
+			}
+			if int32(binary.BigEndian.Uint32(buf)) < 0 {
 				n += 4
 				v.SetBytes(nil)
 			} else {
+				ln, err := decodeLength(buf)
+				if err != nil {
+					return n, err
+				}
 				bytes := make([]byte, ln)
-				copy(bytes, buf[n+4:n+4+ln])
+				copy(bytes, buf[4:4+ln])
 				v.SetBytes(bytes)
 				n += 4 + ln
 			}
@@ -188,3 +248,19 @@ func decodePacketValue(buf []byte, v reflect.Value) (int, error) {
 	}
 	return n, nil
 }
+
+// decodeLength reads the length prefix of a string or a byte array at the start of buf. A negative length
+// is a null value, it has no data.
+func decodeLength(buf []byte) (int, error) {
+	if len(buf) < 4 {
+		return 0, zk.ErrShortBuffer
+	}
+	ln := int(int32(binary.BigEndian.Uint32(buf)))
+	if ln < 0 {
+		return 0, nil
+	}
+	if ln > len(buf)-4 {
+		return 0, zk.ErrShortBuffer
+	}
+	return ln, nil
+}
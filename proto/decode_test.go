@@ -1,7 +1,76 @@
 package proto
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 func TestDecode(t *testing.T) {
 	
 }
+
+func TestMultiRequestDecode(t *testing.T) {
+	parts := []interface{}{
+		&multiHeader{Type: OpCreate, Err: -1},
+		&zk.CreateRequest{Path: "/a", Data: []byte("hello"), Acl: zk.WorldACL(zk.PermAll), Flags: zk.FlagEphemeral},
+		&multiHeader{Type: OpCheck, Err: -1},
+		&zk.CheckVersionRequest{Path: "/b", Version: 3},
+		&multiHeader{Type: -1, Done: true, Err: -1},
+	}
+	buf := make([]byte, 256)
+	var n int
+	for _, p := range parts {
+		m, err := zk.EncodePacket(buf[n:], p)
+		require.NoError(t, err)
+		n += m
+	}
+
+	r := &MultiRequest{}
+	m, err := r.Decode(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, n, m)
+	require.Len(t, r.Ops, 2)
+	assert.Equal(t, OpCreate, r.Ops[0].Header.Type)
+	assert.Equal(t, &zk.CreateRequest{Path: "/a", Data: []byte("hello"), Acl: zk.WorldACL(zk.PermAll), Flags: zk.FlagEphemeral}, r.Ops[0].Op)
+	assert.Equal(t, &zk.CheckVersionRequest{Path: "/b", Version: 3}, r.Ops[1].Op)
+	assert.True(t, r.DoneHeader.Done)
+
+	_, err = r.Decode(buf[:n-4 : n-4])
+	assert.Error(t, err)
+}
+
+func TestMultiResponseDecodeTruncated(t *testing.T) {
+	parts := []interface{}{
+		&multiHeader{Type: OpCreate},
+		&struct{ Path string }{"/a"},
+		&multiHeader{Type: OpSetData},
+		&zk.Stat{Version: 1},
+		&multiHeader{Type: OpError, Err: zk.ErrCode(-101)},
+		&struct{ Err int32 }{-101},
+		&multiHeader{Type: -1, Done: true, Err: -1},
+	}
+	buf := make([]byte, 256)
+	var n int
+	for _, p := range parts {
+		m, err := zk.EncodePacket(buf[n:], p)
+		require.NoError(t, err)
+		n += m
+	}
+
+	r := &MultiResponse{}
+	m, err := r.Decode(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, n, m)
+	require.Len(t, r.Ops, 3)
+	assert.Equal(t, "/a", r.Ops[0].String)
+	assert.Equal(t, zk.ErrCode(-101), r.Err())
+
+	// A response cut short by the capture snapshot length fails without reading past its end
+	for i := 0; i < n; i++ {
+		_, err := (&MultiResponse{}).Decode(buf[:i:i])
+		assert.Equal(t, zk.ErrShortBuffer, err, "cut at %v", i)
+	}
+}
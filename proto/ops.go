@@ -1,5 +1,7 @@
 package proto
 
+import "strings"
+
 // Based on ZK 3.5 https://github.com/apache/zookeeper/blob/branch-3.5/src/java/main/org/apache/zookeeper/ZooDefs.java
 
 // OpType is the type of ZK operation. Used to track operation metrics
@@ -55,3 +57,22 @@ const (
 	// OpError is for specifying errors
 	OpError OpType = -1
 )
+
+var opTypes = []OpType{
+	OpNotify, OpCreate, OpDelete, OpExists, OpGetData, OpSetData, OpGetACL, OpSetACL, OpGetChildren, OpSync,
+	OpPing, OpGetChildren2, OpCheck, OpMulti, OpCreate2, OpReconfig, OpCheckWatches, OpRemoveWatches,
+	OpCreateContainer, OpDeleteContainer, OpCreateTTL, OpCreateSession, OpClose, OpSetAuth, OpSetWatches,
+	OpSasl, OpError,
+}
+
+// OpTypeFromName looks up an operation by name with or without the "Op" prefix, ignoring case.
+// Both "OpSetData" and "setdata" resolve to OpSetData.
+func OpTypeFromName(name string) (OpType, bool) {
+	name = strings.TrimPrefix(strings.ToLower(name), "op")
+	for _, op := range opTypes {
+		if strings.ToLower(op.String()[2:]) == name {
+			return op, true
+		}
+	}
+	return 0, false
+}
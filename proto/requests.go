@@ -21,11 +21,15 @@ type GetChildren2Request pathWatchRequest
 
 type ExistsRequest pathWatchRequest
 
-type multiRequestOp struct {
+// MultiRequest is the body of a multi request. The operations are zk.CreateRequest, zk.DeleteRequest,
+// zk.SetDataRequest and zk.CheckVersionRequest.
+type MultiRequest struct {
+	Ops        []MultiRequestOp
+	DoneHeader multiHeader
+}
+
+// MultiRequestOp is an operation of a multi request.
+type MultiRequestOp struct {
 	Header multiHeader
 	Op     interface{}
 }
-type multiRequest struct {
-	Ops        []multiRequestOp
-	DoneHeader multiHeader
-}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+)
+
+var (
+	// proxyListen is the address the proxy accepts ZooKeeper clients on
+	proxyListen = ":2181"
+	// proxyUpstream is the ZooKeeper server the proxy forwards clients to
+	proxyUpstream string
+)
+
+func proxyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&proxyListen, "listen", proxyListen, "Address to accept ZooKeeper clients on.")
+	fs.StringVar(&proxyUpstream, "upstream", proxyUpstream, "ZooKeeper server to forward clients to, host:port.")
+}
+
+func runProxy(args []string) error {
+	if proxyUpstream == "" {
+		return errors.New("-upstream is required")
+	}
+	flush, err := setupPipeline()
+	if err != nil {
+		return err
+	}
+	defer flush()
+
+	l, err := net.Listen("tcp", proxyListen)
+	if err != nil {
+		return err
+	}
+	pool := newPool(sniffer.WithUpstream(proxyUpstream))
+	defer pool.Close()
+	health.watch(nil, pool)
+	serveHTTP(pool)
+
+	fmt.Fprintf(output, "Proxying %v to %v\n", l.Addr(), proxyUpstream)
+	if opFilter.String() != "" {
+		fmt.Fprintf(output, "Operation filter: %v\n", opFilter)
+	}
+	p := newProxy(proxyUpstream, pool)
+	return p.serve(l, interrupted())
+}
+
+// proxy forwards ZooKeeper connections to an upstream server byte for byte and hands the frames of both
+// directions to the pool, so it sees the same operations as a capture without pcap or reassembly.
+type proxy struct {
+	upstream string
+	pool     *sniffer.Pool
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func newProxy(upstream string, pool *sniffer.Pool) *proxy {
+	return &proxy{upstream: upstream, pool: pool, conns: make(map[net.Conn]struct{})}
+}
+
+// serve accepts clients until stop is closed, then closes their connections and waits for them so nothing
+// is handed to the pool after.
+func (p *proxy) serve(l net.Listener, stop <-chan struct{}) error {
+	go func() {
+		<-stop
+		l.Close()
+	}()
+	defer p.closeAll()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logger.Warn("failed to accept client", zap.Error(err))
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		p.wg.Add(1)
+		go p.handle(conn)
+	}
+}
+
+func (p *proxy) handle(conn net.Conn) {
+	defer p.wg.Done()
+	upstream, err := net.DialTimeout("tcp", p.upstream, 10*time.Second)
+	if err != nil {
+		logger.Error("failed to connect upstream", zap.String("upstream", p.upstream), zap.Error(err))
+		conn.Close()
+		return
+	}
+	p.track(conn, upstream)
+	defer p.untrack(conn, upstream)
+
+	client := sniffer.Client{}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client = sniffer.Client{Host: addr.IP, Port: layers.TCPPort(addr.Port)}
+	}
+	done := make(chan struct{})
+	go func() {
+		p.forward(upstream, conn, client, true)
+		close(done)
+	}()
+	p.forward(conn, upstream, client, false)
+	// Either side closing ends the connection
+	conn.Close()
+	upstream.Close()
+	<-done
+	p.pool.HandleClose(client, time.Now())
+}
+
+// forward copies src to dst and decodes the frames. The frames are handed to the pool before they are sent
+// on, so a request is always queued before the server can answer it.
+func (p *proxy) forward(dst, src net.Conn, client sniffer.Client, toServer bool) {
+	var frames frameSplitter
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			at := time.Now()
+			if err := frames.write(buf[:n], func(frame []byte) { p.pool.HandleFrame(client, toServer, at, frame) }); err != nil {
+				logger.Warn("lost the framing of the connection, no longer decoding it", zap.Stringer("client", client), zap.Error(err))
+				countDecodeError(&sniffer.DecodeError{Reason: sniffer.ReasonFrame, Err: err})
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *proxy) track(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+}
+
+func (p *proxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
+
+func (p *proxy) closeAll() {
+	p.mu.Lock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// frameSplitter cuts a stream into length prefixed ZooKeeper frames.
+type frameSplitter struct {
+	buf    []byte
+	broken bool
+}
+
+// write adds data read from the stream and calls frame with every frame it completes, without its length
+// prefix. Once a length is out of range the rest of the stream is ignored.
+func (s *frameSplitter) write(data []byte, frame func([]byte)) error {
+	if s.broken {
+		return nil
+	}
+	s.buf = append(s.buf, data...)
+	for len(s.buf) >= 4 {
+		n := binary.BigEndian.Uint32(s.buf)
+		if n > sniffer.MaxFrameSize {
+			s.broken, s.buf = true, nil
+			return fmt.Errorf("frame length %v is over %v", n, sniffer.MaxFrameSize)
+		}
+		if len(s.buf) < 4+int(n) {
+			break
+		}
+		// The frame outlives the buffer, it is decoded by a worker later
+		f := make([]byte, n)
+		copy(f, s.buf[4:])
+		frame(f)
+		s.buf = s.buf[4+int(n):]
+	}
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/sniffer"
+	"github.com/jeffbean/zkpacket/zktest"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeFrame encodes the structs as a length prefixed ZooKeeper frame.
+func encodeFrame(t *testing.T, parts ...interface{}) []byte {
+	buf := make([]byte, 512)
+	n := 4
+	for _, p := range parts {
+		m, err := zk.EncodePacket(buf[n:], p)
+		require.NoError(t, err)
+		n += m
+	}
+	binary.BigEndian.PutUint32(buf, uint32(n-4))
+	return buf[:n]
+}
+
+// standIn answers a connect and GetData requests like a ZooKeeper server and keeps what it received.
+type standIn struct {
+	t        *testing.T
+	mu       sync.Mutex
+	received bytes.Buffer
+}
+
+func (s *standIn) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *standIn) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(size))
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received.Write(size)
+		s.received.Write(frame)
+		s.mu.Unlock()
+
+		header := &proto.RequestHeader{}
+		if _, err := zk.DecodePacket(frame[:proto.RequestHeaderByteLength], header); err != nil {
+			return
+		}
+		var response []byte
+		switch {
+		case header.Xid == 0 && header.Opcode == proto.OpNotify:
+			response = encodeFrame(s.t, &proto.ConnectResponse{TimeOut: 10000, SessionID: 0x1234, Passwd: make([]byte, 16)})
+		case header.Opcode == proto.OpGetData:
+			response = encodeFrame(s.t, &proto.ResponseHeader{Xid: header.Xid, Zxid: 7}, zk.ResponseStructForOp(int32(proto.OpGetData)))
+		default:
+			response = encodeFrame(s.t, &proto.ResponseHeader{Xid: header.Xid, Zxid: 7, Err: zk.ErrCode(-6)})
+		}
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+// proxyRecorder keeps what the pool observes.
+type proxyRecorder struct {
+	sniffer.NopObserver
+	sessions  []*sniffer.Session
+	responses []*sniffer.Response
+	events    []*sniffer.WatchEvent
+	closed    []sniffer.Client
+}
+
+func (r *proxyRecorder) Session(s *sniffer.Session)            { r.sessions = append(r.sessions, s) }
+func (r *proxyRecorder) Response(resp *sniffer.Response)       { r.responses = append(r.responses, resp) }
+func (r *proxyRecorder) WatchEvent(e *sniffer.WatchEvent)      { r.events = append(r.events, e) }
+func (r *proxyRecorder) Closed(c sniffer.Client, at time.Time) { r.closed = append(r.closed, c) }
+
+func TestProxy(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+	server := &standIn{t: t}
+	go server.serve(upstream)
+
+	rec := &proxyRecorder{}
+	pool := sniffer.NewPool(1, func(int) sniffer.Observer { return rec })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	stop := make(chan struct{})
+	served := make(chan error)
+	go func() { served <- newProxy(upstream.Addr().String(), pool).serve(l, stop) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	connect := encodeFrame(t, &proto.ConnectRequest{TimeOut: 10000, Passwd: make([]byte, 16)})
+	getData := encodeFrame(t, &proto.RequestHeader{Xid: 1, Opcode: proto.OpGetData}, &proto.GetDataRequest{Path: "/a"})
+	exists := encodeFrame(t, &proto.RequestHeader{Xid: 2, Opcode: proto.OpExists}, &proto.ExistsRequest{Path: "/missing"})
+
+	_, err = conn.Write(connect)
+	require.NoError(t, err)
+	readFrame(t, conn)
+	// A request split over writes is put back together
+	_, err = conn.Write(getData[:7])
+	require.NoError(t, err)
+	_, err = conn.Write(append(getData[7:], exists...))
+	require.NoError(t, err)
+	readFrame(t, conn)
+	readFrame(t, conn)
+
+	close(stop)
+	require.NoError(t, <-served)
+	pool.Close()
+
+	server.mu.Lock()
+	assert.Equal(t, append(append(connect, getData...), exists...), server.received.Bytes(), "forwarded byte for byte")
+	server.mu.Unlock()
+
+	require.Len(t, rec.sessions, 1)
+	assert.Equal(t, int64(0x1234), rec.sessions[0].ID)
+	require.Len(t, rec.responses, 2)
+	assert.Equal(t, "/a", rec.responses[0].Request.Path)
+	assert.NotNil(t, rec.responses[0].Body)
+	assert.Equal(t, int64(0x1234), rec.responses[0].Session)
+	assert.Equal(t, zk.ErrCode(-6), rec.responses[1].Err)
+	assert.Equal(t, conn.LocalAddr().String(), rec.responses[1].Request.Client.String())
+	require.Len(t, rec.closed, 1, "the end of the connection is observed")
+	assert.Equal(t, conn.LocalAddr().String(), rec.closed[0].String())
+}
+
+func TestProxyClient(t *testing.T) {
+	server, err := zktest.NewServer()
+	require.NoError(t, err)
+	defer server.Close()
+
+	rec := &proxyRecorder{}
+	pool := sniffer.NewPool(1, func(int) sniffer.Observer { return rec })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	stop := make(chan struct{})
+	served := make(chan error)
+	go func() { served <- newProxy(server.Addr, pool).serve(l, stop) }()
+
+	conn, _, err := zk.Connect([]string{l.Addr().String()}, 5*time.Second)
+	require.NoError(t, err)
+	_, err = conn.Create("/a", []byte("one"), 0, zk.WorldACL(zk.PermAll))
+	require.NoError(t, err)
+	_, _, changed, err := conn.GetW("/a")
+	require.NoError(t, err)
+	_, err = conn.Set("/a", []byte("two"), -1)
+	require.NoError(t, err)
+	<-changed
+	session := conn.SessionID()
+	conn.Close()
+
+	close(stop)
+	require.NoError(t, <-served)
+	pool.Close()
+
+	require.NotEmpty(t, rec.sessions)
+	assert.Equal(t, session, rec.sessions[0].ID)
+	var ops []proto.OpType
+	for _, resp := range rec.responses {
+		// The close may race the proxy shutting down
+		if resp.Request.Op != proto.OpClose {
+			ops = append(ops, resp.Request.Op)
+			assert.Equal(t, "/a", resp.Request.Path)
+		}
+	}
+	assert.Equal(t, []proto.OpType{proto.OpCreate, proto.OpGetData, proto.OpSetData}, ops)
+	require.Len(t, rec.events, 1)
+	assert.Equal(t, zk.EventNodeDataChanged, rec.events[0].Type)
+	assert.Equal(t, "/a", rec.events[0].Path)
+}
+
+func readFrame(t *testing.T, r io.Reader) []byte {
+	size := make([]byte, 4)
+	_, err := io.ReadFull(r, size)
+	require.NoError(t, err)
+	frame := make([]byte, binary.BigEndian.Uint32(size))
+	_, err = io.ReadFull(r, frame)
+	require.NoError(t, err)
+	return frame
+}
+
+func TestFrameSplitter(t *testing.T) {
+	var frames [][]byte
+	collect := func(f []byte) { frames = append(frames, f) }
+	s := &frameSplitter{}
+
+	require.NoError(t, s.write([]byte{0, 0, 0, 2, 'a'}, collect))
+	assert.Empty(t, frames)
+	require.NoError(t, s.write([]byte{'b', 0, 0, 0, 1, 'c'}, collect))
+	assert.Equal(t, [][]byte{[]byte("ab"), []byte("c")}, frames)
+
+	assert.Error(t, s.write([]byte{0xff, 0xff, 0xff, 0xff}, collect))
+	require.NoError(t, s.write([]byte{0, 0, 0, 1, 'd'}, collect), "the stream is no longer decoded")
+	assert.Len(t, frames, 2)
+}
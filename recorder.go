@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/sniffer"
+	"github.com/jeffbean/zkpacket/workload"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/jeffbean/go-zookeeper/zk"
+	"go.uber.org/zap"
+)
+
+var (
+	// recorder is the pcap writer of the record command, nil otherwise.
+	recorder *packetRecorder
+	// workloadRec collects the workload of the record command, nil otherwise.
+	workloadRec *workloadRecorder
+)
+
+// packetRecorder writes ZooKeeper packets to a pcap file. Without an operation filter every packet is kept,
+// with one the request packet of each operation is held until its response shows whether it matches. Its
+// filter is its own, it has a lock of its own rather than stateMu.
+type packetRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *pcapgo.Writer
+	filter  *filter.Filter
+	pending map[string]*recordedPacket
+	written int
+}
+
+// recordedPacket is a packet kept for the operations whose frames it carries. Pipelined frames share their
+// packet, and it is written once for all of them.
+type recordedPacket struct {
+	capturedPacket
+	written bool
+}
+
+func newRecordedPacket(p *sniffer.Packet) *recordedPacket {
+	return &recordedPacket{capturedPacket: capturedPacket{ci: p.CaptureInfo, data: p.Data}}
+}
+
+func newPacketRecorder(fileName string, f *filter.Filter, linkType layers.LinkType, snapLen uint32) (*packetRecorder, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	w := pcapgo.NewWriter(file)
+	if err := w.WriteFileHeader(snapLen, linkType); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &packetRecorder{f: file, w: w, filter: f, pending: make(map[string]*recordedPacket)}, nil
+}
+
+// packet is called for every captured packet before it is decoded.
+func (r *packetRecorder) packet(p *sniffer.Packet) {
+	if r == nil || r.filter.String() != "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(newRecordedPacket(p))
+}
+
+// request holds the packet of the request until its response arrives.
+func (r *packetRecorder) request(req *sniffer.Request, p *recordedPacket) {
+	if r == nil || r.filter.String() == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[xidKey(req)] = p
+}
+
+// complete writes the request and the response packet when the operation matches the filter, unless an
+// operation pipelined in the same packets wrote them already.
+func (r *packetRecorder) complete(resp *sniffer.Response, msg *filter.Message, p *recordedPacket) {
+	if r == nil || r.filter.String() == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := xidKey(resp.Request)
+	req, ok := r.pending[key]
+	delete(r.pending, key)
+	if !ok || !r.filter.Match(msg) {
+		return
+	}
+	r.write(req)
+	r.write(p)
+}
+
+func (r *packetRecorder) write(p *recordedPacket) {
+	if p.written {
+		return
+	}
+	if err := r.w.WritePacket(p.ci, p.data); err != nil {
+		logger.Error("failed to record packet", zap.String("file", r.f.Name()), zap.Error(err))
+		return
+	}
+	p.written = true
+	r.written++
+}
+
+func xidKey(req *sniffer.Request) string {
+	return fmt.Sprintf("%v:%v", req.Client, req.Xid)
+}
+
+func (r *packetRecorder) Close() error {
+	return r.f.Close()
+}
+
+// workloadRecorder collects the operations of each session for a workload file. Without an operation filter
+// every operation is kept, with one only those whose response matches. It has a lock of its own.
+type workloadRecorder struct {
+	mu     sync.Mutex
+	filter *filter.Filter
+	// data keeps the data sent with creates and setDatas
+	data bool
+	// sessions are keyed by session id, conns by client address
+	sessions map[int64]*recordedSession
+	conns    map[string]*recordedSession
+	all      []*recordedSession
+	pending  map[string]*recordedOp
+}
+
+type recordedSession struct {
+	session workload.Session
+	ops     []*recordedOp
+}
+
+type recordedOp struct {
+	time time.Time
+	op   workload.Op
+	keep bool
+}
+
+func newWorkloadRecorder(f *filter.Filter, data bool) *workloadRecorder {
+	return &workloadRecorder{
+		filter:   f,
+		data:     data,
+		sessions: make(map[int64]*recordedSession),
+		conns:    make(map[string]*recordedSession),
+		pending:  make(map[string]*recordedOp),
+	}
+}
+
+// session starts a session, or continues it when the client resumes it on another connection.
+func (r *workloadRecorder) session(s *sniffer.Session) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := s.Client.String()
+	if s.Expired {
+		delete(r.conns, key)
+		return
+	}
+	if sess, ok := r.sessions[s.ID]; ok {
+		r.conns[key] = sess
+		return
+	}
+	sess := &recordedSession{session: workload.Session{ID: s.ID, Client: key, Timeout: s.Timeout}}
+	r.sessions[s.ID] = sess
+	r.conns[key] = sess
+	r.all = append(r.all, sess)
+}
+
+// request adds the operation to the session of the connection. The handshake, authentication and watch
+// resets are left to the client replaying the workload.
+func (r *workloadRecorder) request(req *sniffer.Request) {
+	if r == nil {
+		return
+	}
+	switch req.Op {
+	case proto.OpNotify, proto.OpPing, proto.OpSetAuth, proto.OpSetWatches, proto.OpSasl:
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := req.Client.String()
+	sess, ok := r.conns[key]
+	if !ok {
+		// The connect of the session was not captured
+		sess = &recordedSession{session: workload.Session{Client: key}}
+		r.conns[key] = sess
+		r.all = append(r.all, sess)
+	}
+	op := &recordedOp{time: req.Time, op: r.op(req.Op, req.Body), keep: r.filter.String() == ""}
+	op.op.Path = req.Path
+	op.op.Watch = req.Watch
+	op.op.NoResponse = true
+	sess.ops = append(sess.ops, op)
+	r.pending[xidKey(req)] = op
+}
+
+// complete records the answer to the operation and whether it matches the filter.
+func (r *workloadRecorder) complete(resp *sniffer.Response, msg *filter.Message) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := xidKey(resp.Request)
+	op, ok := r.pending[key]
+	if !ok {
+		return
+	}
+	delete(r.pending, key)
+	op.op.Err = resp.Err
+	op.op.NoResponse = false
+	op.keep = r.filter.Match(msg)
+}
+
+// op is the workload operation of a decoded request body.
+func (r *workloadRecorder) op(typ proto.OpType, body interface{}) workload.Op {
+	op := workload.Op{Op: typ.String()}
+	switch b := body.(type) {
+	case *zk.CreateRequest:
+		op.Path, op.Flags = b.Path, b.Flags
+		r.setData(&op, b.Data)
+	case *zk.SetDataRequest:
+		op.Path, op.Version = b.Path, b.Version
+		r.setData(&op, b.Data)
+	case *zk.DeleteRequest:
+		op.Path, op.Version = b.Path, b.Version
+	case *zk.CheckVersionRequest:
+		op.Path, op.Version = b.Path, b.Version
+	case *proto.MultiRequest:
+		for _, o := range b.Ops {
+			op.Ops = append(op.Ops, r.op(o.Header.Type, o.Op))
+		}
+	}
+	return op
+}
+
+func (r *workloadRecorder) setData(op *workload.Op, data []byte) {
+	op.Size = len(data)
+	if r.data {
+		op.Data = string(data)
+	}
+}
+
+// workload is the kept operations of every session in the order they were sent, timed from the first one.
+func (r *workloadRecorder) workload() *workload.Workload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w := &workload.Workload{}
+	for _, sess := range r.all {
+		for _, op := range sess.ops {
+			if op.keep && (w.Start.IsZero() || op.time.Before(w.Start)) {
+				w.Start = op.time
+			}
+		}
+	}
+	for _, sess := range r.all {
+		// A resumed session's operations come from more than one connection
+		sort.SliceStable(sess.ops, func(i, j int) bool { return sess.ops[i].time.Before(sess.ops[j].time) })
+		s := sess.session
+		for _, op := range sess.ops {
+			if !op.keep {
+				continue
+			}
+			op.op.At = op.time.Sub(w.Start)
+			s.Ops = append(s.Ops, op.op)
+		}
+		if len(s.Ops) > 0 {
+			w.Sessions = append(w.Sessions, &s)
+		}
+	}
+	sort.SliceStable(w.Sessions, func(i, j int) bool { return w.Sessions[i].Ops[0].At < w.Sessions[j].Ops[0].At })
+	return w
+}
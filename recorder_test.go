@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/workload"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// recordWorkload runs the testdata pcap through the pipeline like `zkpacket record -format workload`.
+func recordWorkload(t *testing.T, name string, f *filter.Filter, data bool) *workload.Workload {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	resetTrackingState()
+	workloadRec = newWorkloadRecorder(f, data)
+	defer func() { workloadRec = nil }()
+
+	file, err := os.Open("testdata/" + name + ".pcap")
+	require.NoError(t, err)
+	r, err := pcapgo.NewReader(file)
+	require.NoError(t, err)
+	source := fileSource{Reader: r, f: file}
+	defer source.Close()
+	capturePackets(source, newPool(), 0, nil)
+	return workloadRec.workload()
+}
+
+func TestRecordWorkload(t *testing.T) {
+	w := recordWorkload(t, "basic", nil, false)
+	assert.Equal(t, time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC), w.Start.Truncate(10*time.Millisecond))
+	require.Len(t, w.Sessions, 1)
+	s := w.Sessions[0]
+	assert.Equal(t, int64(0x15d3f0e0a1b0000), s.ID)
+	assert.Equal(t, "10.0.0.1:50000", s.Client)
+	assert.Equal(t, 10*time.Second, s.Timeout)
+
+	var names []string
+	for _, op := range s.Ops {
+		names = append(names, op.Op)
+		assert.False(t, op.NoResponse)
+	}
+	assert.Equal(t, []string{"OpCreate", "OpGetData", "OpSetData", "OpGetChildren2", "OpDelete", "OpClose"}, names)
+	assert.Equal(t, workload.Op{Op: "OpCreate", Path: "/app", Size: 5}, s.Ops[0])
+	assert.True(t, s.Ops[1].Watch)
+	assert.Equal(t, int32(1), s.Ops[4].Version)
+	// The ping in between is left out, the delete is sent 3s after the getChildren2
+	assert.True(t, s.Ops[4].At-s.Ops[3].At > 3*time.Second)
+
+	w = recordWorkload(t, "basic", nil, true)
+	assert.Equal(t, "world", w.Sessions[0].Ops[2].Data)
+
+	f, err := filter.Parse("op == SetData")
+	require.NoError(t, err)
+	w = recordWorkload(t, "basic", f, false)
+	require.Len(t, w.Sessions, 1)
+	require.Len(t, w.Sessions[0].Ops, 1)
+	assert.Equal(t, "OpSetData", w.Sessions[0].Ops[0].Op)
+	assert.Equal(t, time.Duration(0), w.Sessions[0].Ops[0].At, "the workload starts at the first kept operation")
+}
+
+func TestRecordPacketsPipelined(t *testing.T) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	resetTrackingState()
+	f, err := filter.Parse(`path == "/config"`)
+	require.NoError(t, err)
+	out, err := ioutil.TempFile("", "zkpacket-record")
+	require.NoError(t, err)
+	out.Close()
+	defer os.Remove(out.Name())
+	recorder, err = newPacketRecorder(out.Name(), f, layers.LinkTypeEthernet, 65536)
+	require.NoError(t, err)
+	defer func() { recorder = nil }()
+
+	file, err := os.Open("testdata/pipelined.pcap")
+	require.NoError(t, err)
+	r, err := pcapgo.NewReader(file)
+	require.NoError(t, err)
+	source := fileSource{Reader: r, f: file}
+	defer source.Close()
+	capturePackets(source, newPool(), 0, nil)
+	require.NoError(t, recorder.Close())
+
+	// The four requests share a segment and so do their responses, each is written once
+	assert.Equal(t, 2, recorder.written)
+	recorded, err := os.Open(out.Name())
+	require.NoError(t, err)
+	defer recorded.Close()
+	rr, err := pcapgo.NewReader(recorded)
+	require.NoError(t, err)
+	var packets int
+	for {
+		if _, _, err := rr.ReadPacketData(); err != nil {
+			break
+		}
+		packets++
+	}
+	assert.Equal(t, 2, packets)
+}
+
+func TestRecordWorkloadMulti(t *testing.T) {
+	w := recordWorkload(t, "multi", nil, false)
+	require.Len(t, w.Sessions, 1)
+	ops := w.Sessions[0].Ops
+	require.Len(t, ops, 2)
+	assert.Equal(t, []workload.Op{
+		{Op: "OpCreate", Path: "/jobs/1", Size: 6},
+		{Op: "OpSetData", Path: "/jobs", Size: 1, Version: -1},
+	}, ops[0].Ops)
+	assert.Equal(t, zk.ErrCode(0), ops[0].Err)
+	// The failed multi fails with its first failed operation
+	assert.False(t, ops[1].NoResponse)
+	assert.Equal(t, zk.ErrCode(-103), ops[1].Err)
+	assert.Equal(t, int32(7), ops[1].Ops[0].Version)
+}
+
+func TestRecordWorkloadSessions(t *testing.T) {
+	w := recordWorkload(t, "sessions", nil, false)
+	require.Len(t, w.Sessions, 1, "only one session ran an operation")
+	assert.Equal(t, workload.Op{Op: "OpCreate", Path: "/members/a", Flags: zk.FlagEphemeral}, w.Sessions[0].Ops[0])
+}
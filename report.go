@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jeffbean/zkpacket/workload"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// duration stops a live report or recording, zero runs until interrupted
+	duration time.Duration
+	// recordFile is the pcap or workload file the record command writes
+	recordFile string
+	// recordFormat is pcap or workload
+	recordFormat = "pcap"
+	// recordData keeps the data of creates and setDatas in a workload
+	recordData bool
+)
+
+func durationFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&duration, "duration", 0, "Stop a live capture after this long, zero runs until interrupted.")
+}
+
+func reportFlags(fs *flag.FlagSet) {
+	durationFlags(fs)
+}
+
+func recordFlags(fs *flag.FlagSet) {
+	durationFlags(fs)
+	fs.StringVar(&recordFile, "o", "zkpacket.pcap", "The pcap or workload file to write.")
+	fs.StringVar(&recordFormat, "format", recordFormat, "What to write, pcap for the packets or workload for the operations of each session that zkload -replay runs.")
+	fs.BoolVar(&recordData, "data", false, "Keep the data of creates and setDatas in a workload, only their size is kept otherwise.")
+}
+
+// stopAfter is closed when the capture is interrupted or, for a positive duration, when it runs out.
+func stopAfter(d time.Duration) <-chan struct{} {
+	if d <= 0 {
+		return interrupted()
+	}
+	stop := make(chan struct{})
+	signals := interrupted()
+	go func() {
+		select {
+		case <-signals:
+		case <-time.After(d):
+		}
+		close(stop)
+	}()
+	return stop
+}
+
+// runReport decodes the capture without any other output and prints what it saw at the end.
+func runReport(args []string) error {
+	if err := setupFilter(); err != nil {
+		return err
+	}
+	handle, err := openSource(device, readFile)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	output = ioutil.Discard
+	topStats = newTopAggregator(time.Time{})
+	pool := newPool()
+	capturePackets(handle, pool, 0, stopAfter(duration))
+
+	first, last := clock.times()
+	topStats.start = first
+	writeReport(os.Stdout, topStats.snapshot(last, len(pool.Pending())), last.Sub(first))
+	return nil
+}
+
+func writeReport(w io.Writer, s *topSnapshot, elapsed time.Duration) {
+	var total int
+	for _, r := range s.ops {
+		total += r.count
+	}
+	fmt.Fprintf(w, "%v operations over %v, %v sessions, %v requests without a response\n",
+		total, elapsed, s.sessions, s.pending)
+	for _, table := range []struct {
+		title string
+		rows  []topRow
+	}{{"OPERATION", s.ops}, {"CLIENT", s.clients}, {"PATH", s.paths}} {
+		sort.Slice(table.rows, func(i, j int) bool {
+			if table.rows[i].count != table.rows[j].count {
+				return table.rows[i].count > table.rows[j].count
+			}
+			return table.rows[i].name < table.rows[j].name
+		})
+		fmt.Fprintln(w)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(tw, "%v\tOPS\tOPS/S\tERR%%\tP50\tP99\t\n", table.title)
+		for _, r := range table.rows {
+			fmt.Fprintf(tw, "%v\t%v\t%.1f\t%.1f\t%v\t%v\t\n", r.name, r.count, r.perSecond, r.errorRate, r.p50, r.p99)
+		}
+		tw.Flush()
+	}
+}
+
+// runRecord writes the capture, or the packets of the operations matching -filter, to a pcap file.
+func runRecord(args []string) error {
+	if len(args) > 0 {
+		return errors.New("record takes no arguments, use -o for the output file")
+	}
+	if err := setupFilter(); err != nil {
+		return err
+	}
+	handle, err := openSource(device, readFile)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	switch recordFormat {
+	case "pcap":
+		if recorder, err = newPacketRecorder(recordFile, opFilter, handle.LinkType(), uint32(snapshotLen)); err != nil {
+			return err
+		}
+	case "workload":
+		workloadRec = newWorkloadRecorder(opFilter, recordData)
+	default:
+		return fmt.Errorf("unknown record format %q, use pcap or workload", recordFormat)
+	}
+	output = ioutil.Discard
+	capturePackets(handle, newPool(), 0, stopAfter(duration))
+
+	if workloadRec != nil {
+		w := workloadRec.workload()
+		if err := writeWorkload(recordFile, w); err != nil {
+			return err
+		}
+		logger.Info("recorded workload", zap.String("file", recordFile), zap.Int("sessions", len(w.Sessions)), zap.Int("ops", w.Len()))
+		return nil
+	}
+	if err := recorder.Close(); err != nil {
+		return err
+	}
+	logger.Info("recorded packets", zap.String("file", recordFile), zap.Int("packets", recorder.written))
+	return nil
+}
+
+func writeWorkload(fileName string, w *workload.Workload) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := w.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/sniffer"
+	"github.com/jeffbean/zkpacket/zkerrors"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+)
+
+// nearExpiryRatio is the share of its timeout a session can go without a heartbeat before it is flagged.
+// Clients give up on a connection that was silent for 2/3 of the timeout, so a healthy one pings well before.
+const nearExpiryRatio = 2.0 / 3
+
+// maxTrackedPaths bounds the per path statistics so random znode names can't grow them forever.
+const maxTrackedPaths = 10000
+
+var errNoNode, _ = zkerrors.ZKErrCodeFromName("NoNode")
+
+var (
+	// stateMu guards the tracking state below, the runtime config and the packet dumper while packets are
+	// processed, so the debug API can read them from the HTTP goroutines. The recorders, the zxids and the
+	// event stream have locks of their own.
+	stateMu sync.Mutex
+
+	// connSessions tracks the session negotiated on each client connection, keyed by the client host and port.
+	connSessions = map[string]*session{}
+	// watches tracks the watches registered per path
+	watches = watchTable{}
+	// pathStats and clientStats count completed operations per znode path and client host
+	pathStats   = map[string]*opStats{}
+	clientStats = map[string]*opStats{}
+)
+
+type session struct {
+	id      int64
+	timeout time.Duration
+	// requested is the timeout the client asked for, zero when the connect request was not captured
+	requested time.Duration
+	connected time.Time
+	lastSeen  time.Time
+	// heartbeat is when the client last sent a request or a ping, which resets the session timeout
+	heartbeat   time.Time
+	ops         int
+	fingerprint clientFingerprint
+}
+
+// heartbeatAge is how long the client had been silent at now.
+func (s *session) heartbeatAge(now time.Time) time.Duration {
+	if now.Before(s.heartbeat) {
+		return 0
+	}
+	return now.Sub(s.heartbeat)
+}
+
+// nearExpiry tells if the session went without a heartbeat long enough to be at risk of expiring.
+func (s *session) nearExpiry(now time.Time) bool {
+	return s.timeout > 0 && float64(s.heartbeatAge(now)) >= nearExpiryRatio*float64(s.timeout)
+}
+
+// clock is the capture time of the packets.
+var clock = &captureClock{}
+
+// captureClock is the capture time of the first and the newest packet, used to age pending requests and
+// sessions the same way for live and offline captures. The capture loop sets it for every packet, so it has a
+// lock of its own rather than stateMu.
+type captureClock struct {
+	mu          sync.Mutex
+	first, last time.Time
+	// offline is set when the packets are read from a file, whose capture times can be long gone
+	offline bool
+}
+
+// setOffline tells if the packets are read from a file.
+func (c *captureClock) setOffline(offline bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offline = offline
+}
+
+// tick moves the clock to the time of a packet.
+func (c *captureClock) tick(ts time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = ts
+	if c.first.IsZero() {
+		c.first = ts
+	}
+}
+
+// times returns the capture time of the first and the newest packet.
+func (c *captureClock) times() (first, last time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.first, c.last
+}
+
+// now is the time of the newest packet.
+func (c *captureClock) now() time.Time {
+	_, last := c.times()
+	return last
+}
+
+// captureNow is the current time of the capture, the time of the newest packet when reading a file.
+func captureNow() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	if clock.offline {
+		return clock.last
+	}
+	return time.Now()
+}
+
+// trackHeartbeat records a request or ping the client sent.
+func trackHeartbeat(conn string, at time.Time) {
+	if s, ok := connSessions[conn]; ok && at.After(s.heartbeat) {
+		s.heartbeat = at
+	}
+}
+
+// trackRequest records a request the client sent on its session.
+func trackRequest(r *sniffer.Request) {
+	key := r.Client.String()
+	trackHeartbeat(key, r.Time)
+	if s, ok := connSessions[key]; ok {
+		s.fingerprint.observe(r.Op)
+	}
+}
+
+// opStats are the running totals of completed operations.
+type opStats struct {
+	ops     int
+	errors  int
+	latency time.Duration
+	bytes   int
+}
+
+func (s *opStats) add(msg *filter.Message) {
+	s.ops++
+	if msg.Err != 0 {
+		s.errors++
+	}
+	s.latency += msg.Latency
+	s.bytes += msg.Size
+}
+
+type watchKind string
+
+const (
+	dataWatch  watchKind = "data"
+	childWatch watchKind = "child"
+)
+
+type watcher struct {
+	conn string
+	kind watchKind
+}
+
+// watchTable maps a path to the watches registered on it.
+type watchTable map[string]map[watcher]bool
+
+// register records the watch a successful operation left on its path.
+func (w watchTable) register(conn string, msg *filter.Message) {
+	if !msg.Watch {
+		return
+	}
+	// Exists on a missing node still leaves a watch for the node being created.
+	if msg.Err != 0 && !(msg.Op == proto.OpExists && msg.Err == errNoNode) {
+		return
+	}
+	kind := dataWatch
+	if msg.Op == proto.OpGetChildren || msg.Op == proto.OpGetChildren2 {
+		kind = childWatch
+	}
+	watchers, ok := w[msg.Path]
+	if !ok {
+		watchers = make(map[watcher]bool)
+		w[msg.Path] = watchers
+	}
+	watchers[watcher{conn, kind}] = true
+}
+
+// fire removes the watches a notification consumed, since ZooKeeper watches are one shot.
+func (w watchTable) fire(conn string, event *sniffer.WatchEvent) {
+	watchers, ok := w[event.Path]
+	if !ok {
+		return
+	}
+	switch event.Type {
+	case zk.EventNodeCreated, zk.EventNodeDataChanged:
+		delete(watchers, watcher{conn, dataWatch})
+	case zk.EventNodeChildrenChanged:
+		delete(watchers, watcher{conn, childWatch})
+	case zk.EventNodeDeleted:
+		delete(watchers, watcher{conn, dataWatch})
+		delete(watchers, watcher{conn, childWatch})
+	}
+	if len(watchers) == 0 {
+		delete(w, event.Path)
+	}
+}
+
+// forget drops every watch of a closed connection.
+func (w watchTable) forget(conn string) {
+	for path, watchers := range w {
+		for wt := range watchers {
+			if wt.conn == conn {
+				delete(watchers, wt)
+			}
+		}
+		if len(watchers) == 0 {
+			delete(w, path)
+		}
+	}
+}
+
+// trackOperation updates the session, watch and per path and client state with a completed operation.
+func trackOperation(r *sniffer.Response, msg *filter.Message) {
+	key := r.Request.Client.String()
+	if s, ok := connSessions[key]; ok {
+		s.lastSeen = r.Time
+		s.ops++
+	}
+	watches.register(key, msg)
+
+	if msg.Path != "" {
+		p := templatePath(msg.Path)
+		stats, ok := pathStats[p]
+		if !ok && len(pathStats) < maxTrackedPaths {
+			stats = &opStats{}
+			pathStats[p] = stats
+		}
+		if stats != nil {
+			stats.add(msg)
+		}
+	}
+	host := r.Request.Client.Host.String()
+	stats, ok := clientStats[host]
+	if !ok {
+		stats = &opStats{}
+		clientStats[host] = stats
+	}
+	stats.add(msg)
+
+	if msg.Op == proto.OpClose {
+		forgetConnection(key)
+	}
+}
+
+// forgetConnection drops the session and the watches of a connection that was closed.
+func forgetConnection(conn string) {
+	delete(connSessions, conn)
+	watches.forget(conn)
+}
+
+// sessionSweepInterval is how often new sessions sweep the expired ones, so a capture nobody reads the
+// sessions of doesn't keep them all.
+const sessionSweepInterval = time.Minute
+
+// sessionsSwept is when the sessions were last swept.
+var sessionsSwept time.Time
+
+// expireSessions drops the sessions that went without a heartbeat for longer than their timeout. The server
+// expired them even when the end of their connection was not captured.
+func expireSessions(now time.Time) {
+	sessionsSwept = now
+	for conn, s := range connSessions {
+		if s.timeout > 0 && s.heartbeatAge(now) > s.timeout {
+			forgetConnection(conn)
+		}
+	}
+}
+
+// sweepSessions expires the sessions when the last sweep is sessionSweepInterval old.
+func sweepSessions(now time.Time) {
+	if now.Sub(sessionsSwept) >= sessionSweepInterval {
+		expireSessions(now)
+	}
+}
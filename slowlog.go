@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// slowThreshold is the latency above which a matching operation is logged as slow.
+// An empty op or path template matches any operation.
+type slowThreshold struct {
+	op        proto.OpType
+	anyOp     bool
+	template  string
+	threshold time.Duration
+}
+
+// specificity ranks rules so an op and path rule wins over a path rule, over an op rule, over the global rule.
+func (t *slowThreshold) specificity() int {
+	s := 0
+	if t.template != "" {
+		s += 2
+	}
+	if !t.anyOp {
+		s++
+	}
+	return s
+}
+
+func (t *slowThreshold) matches(op proto.OpType, p string) bool {
+	if !t.anyOp && t.op != op {
+		return false
+	}
+	if t.template == "" {
+		return true
+	}
+	ok, _ := path.Match(t.template, p)
+	return ok
+}
+
+func (t *slowThreshold) String() string {
+	var rule string
+	if !t.anyOp {
+		rule = strings.TrimPrefix(t.op.String(), "Op")
+	}
+	if t.template != "" && rule != "" {
+		rule += ":"
+	}
+	rule += t.template
+	if rule == "" {
+		return t.threshold.String()
+	}
+	return rule + "=" + t.threshold.String()
+}
+
+// parseSlowThreshold reads a rule in the form [op][:path-template]=duration, path-template=duration,
+// or a bare duration for the global threshold.
+// Path templates use path.Match syntax so /kafka/brokers/ids/* matches each broker znode.
+func parseSlowThreshold(s string) (*slowThreshold, error) {
+	t := &slowThreshold{anyOp: true}
+	rule, value := "", s
+	if i := strings.LastIndex(s, "="); i >= 0 {
+		rule, value = s[:i], s[i+1:]
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid slow threshold %q: %v", s, err)
+	}
+	t.threshold = d
+
+	op := rule
+	if strings.HasPrefix(rule, "/") {
+		op, t.template = "", rule
+	} else if i := strings.Index(rule, ":"); i >= 0 {
+		op, t.template = rule[:i], rule[i+1:]
+	}
+	if _, err := path.Match(t.template, ""); err != nil {
+		return nil, fmt.Errorf("invalid path template in slow threshold %q: %v", s, err)
+	}
+	if op != "" {
+		opType, ok := proto.OpTypeFromName(op)
+		if !ok {
+			return nil, fmt.Errorf("unknown operation in slow threshold %q", s)
+		}
+		t.op, t.anyOp = opType, false
+	}
+	return t, nil
+}
+
+// slowThresholds is the set of configured rules. It implements flag.Value so the flag can be repeated.
+type slowThresholds []*slowThreshold
+
+func (s *slowThresholds) String() string {
+	rules := make([]string, len(*s))
+	for i, t := range *s {
+		rules[i] = t.String()
+	}
+	return strings.Join(rules, ",")
+}
+
+func (s *slowThresholds) Set(value string) error {
+	t, err := parseSlowThreshold(value)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, t)
+	return nil
+}
+
+// thresholdFor returns the threshold of the most specific matching rule. Rules given later win ties.
+func (s slowThresholds) thresholdFor(op proto.OpType, p string) (time.Duration, bool) {
+	var best *slowThreshold
+	for _, t := range s {
+		if t.matches(op, p) && (best == nil || t.specificity() >= best.specificity()) {
+			best = t
+		}
+	}
+	if best == nil {
+		return 0, false
+	}
+	return best.threshold, true
+}
+
+var (
+	// slowLogOpen is set once the slow operation log file is open
+	slowLogOpen bool
+	// slowLogOnReload opens the log when a config reload brings the first thresholds
+	slowLogOnReload bool
+)
+
+// openSlowLog opens the slow operation log file once there are thresholds to log operations with. It is
+// called with stateMu held once packets are processed.
+func openSlowLog() error {
+	if slowLogOpen || len(thresholds) == 0 {
+		return nil
+	}
+	slowConfig := zap.NewProductionConfig()
+	slowConfig.OutputPaths = []string{slowLogPath}
+	slowConfig.Sampling = nil
+	l, err := slowConfig.Build()
+	if err != nil {
+		return fmt.Errorf("failed to open slow operation log: %v", err)
+	}
+	slowLogger, slowLogOpen = l, true
+	return nil
+}
+
+// slowOperation is what the slow log needs of an operation that took longer than its threshold, read while
+// stateMu is held so the log can be written after.
+type slowOperation struct {
+	logger    *zap.Logger
+	label     string
+	threshold time.Duration
+}
+
+// slowOperationFor returns the slow log entry of the operation, nil when it was fast enough. It is called
+// with stateMu held.
+func slowOperationFor(r *sniffer.Response, msg *filter.Message) *slowOperation {
+	threshold, ok := thresholds.thresholdFor(msg.Op, msg.Path)
+	if !ok || msg.Latency <= threshold {
+		return nil
+	}
+	return &slowOperation{logger: slowLogger, label: labelFor(r.Request.Client.Host), threshold: threshold}
+}
+
+// log writes the operation to the slow log, nothing is written for a nil entry.
+func (s *slowOperation) log(r *sniffer.Response, msg *filter.Message) {
+	if s == nil {
+		return
+	}
+	slowOperationCounter.With(prometheus.Labels{"operation": msg.Op.String()}).Inc()
+	s.logger.Warn("slow operation",
+		zap.Stringer("operation", msg.Op),
+		zap.String("path", msg.Path),
+		zap.Int("size", msg.Size),
+		zap.Bool("watch", msg.Watch),
+		zap.Stringer("client", r.Request.Client),
+		zap.String("label", s.label),
+		zap.String("session", fmt.Sprintf("%#x", msg.Session)),
+		zap.Int32("xid", msg.Xid),
+		zap.Int32("err", int32(msg.Err)),
+		zap.Time("requestTime", r.Request.Time),
+		zap.Duration("latency", msg.Latency),
+		zap.Duration("threshold", s.threshold),
+	)
+}
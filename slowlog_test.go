@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSlowThresholds(t *testing.T) {
+	var s slowThresholds
+	for _, rule := range []string{"100ms", "GetData=20ms", "/kafka/*=50ms", "SetData:/kafka/*=200ms"} {
+		assert.NoError(t, s.Set(rule))
+	}
+	tests := []struct {
+		op   proto.OpType
+		path string
+		want time.Duration
+	}{
+		{proto.OpCreate, "/other", 100 * time.Millisecond},
+		{proto.OpGetData, "/other", 20 * time.Millisecond},
+		{proto.OpGetData, "/kafka/brokers", 50 * time.Millisecond},
+		{proto.OpSetData, "/kafka/brokers", 200 * time.Millisecond},
+		{proto.OpSetData, "/kafka/brokers/ids", 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		got, ok := s.thresholdFor(tt.op, tt.path)
+		assert.True(t, ok)
+		assert.Equal(t, tt.want, got, "%v %v", tt.op, tt.path)
+	}
+	assert.Equal(t, "100ms,GetData=20ms,/kafka/*=50ms,SetData:/kafka/*=200ms", s.String())
+}
+
+func TestSlowThresholdsInvalid(t *testing.T) {
+	var s slowThresholds
+	assert.Error(t, s.Set("fast"))
+	assert.Error(t, s.Set("NotAnOp=1s"))
+	assert.Error(t, s.Set("GetData:[=1s"))
+	_, ok := s.thresholdFor(proto.OpGetData, "/")
+	assert.False(t, ok)
+}
+
+func TestOpenSlowLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slowlog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(path, config string, rules slowThresholds, l *zap.Logger) {
+		slowLogPath, configPath, thresholds, slowLogger = path, config, rules, l
+		slowLogOpen, slowLogOnReload = false, false
+	}(slowLogPath, configPath, thresholds, slowLogger)
+
+	slowLogPath, configPath, thresholds = filepath.Join(dir, "slow-ops.log"), "zkpacket.yaml", nil
+	flush, err := setupPipeline()
+	require.NoError(t, err)
+	flush()
+	_, err = os.Stat(slowLogPath)
+	assert.True(t, os.IsNotExist(err), "no thresholds, no log")
+	assert.True(t, slowLogOnReload)
+
+	// A reload brings the first threshold
+	require.NoError(t, thresholds.Set("10ms"))
+	require.NoError(t, openSlowLog())
+	_, err = os.Stat(slowLogPath)
+	assert.NoError(t, err)
+}
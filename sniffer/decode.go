@@ -0,0 +1,321 @@
+package sniffer
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"go.uber.org/zap"
+)
+
+var errBufferTooShort = errors.New("buffer too short for a request ZK packet")
+
+func (s *Sniffer) handleIncoming(client Client, buf []byte, at time.Time) error {
+	if len(buf) < proto.RequestHeaderByteLength {
+		return &DecodeError{Reason: ReasonRequestHeader, Err: errBufferTooShort}
+	}
+	// The incoming packets all have headers. the only relaible part that we can then determine how to decode the packet payload
+	header := &proto.RequestHeader{}
+	if _, err := zk.DecodePacket(buf[:proto.RequestHeaderByteLength], header); err != nil {
+		s.logger.Error("--> failed to decode header", zap.Error(err), zap.Binary("first-eight-bytes", buf[:proto.RequestHeaderByteLength]))
+		return &DecodeError{Reason: ReasonRequestHeader, Err: err}
+	}
+
+	// Pings are matched to their answer on their own, a client has at most one in flight
+	if header.Opcode == proto.OpPing && header.Xid != 0 {
+		s.pings[client.String()] = at
+		return nil
+	}
+
+	var req *Request
+	var err error
+	// A connect has no request header, its protocol version is read as the xid and the last zxid the client
+	// saw as the operation. Clients number their requests from 1.
+	if header.Xid == 0 {
+		req, err = s.decodeConnect(client, buf)
+	} else {
+		req, err = s.decodeRequest(header, buf)
+	}
+	if err != nil {
+		s.logger.Error("failed to process incoming operation", zap.Error(err))
+		if req == nil {
+			return &DecodeError{Reason: ReasonRequestBody, Op: header.Opcode, Err: err}
+		}
+	}
+	req.Client = client
+	req.Time = at
+
+	s.pending[pendingKey{client.String(), header.Xid}] = req
+	s.stats.Requests++
+	for _, o := range s.observers {
+		o.Request(req)
+	}
+	if err != nil {
+		// The request is kept so its response is matched, the body is still a decode error
+		return &DecodeError{Reason: ReasonRequestBody, Op: header.Opcode, Err: err}
+	}
+	return nil
+}
+
+// decodeRequest decodes the request body the header announces. A request whose body fails to decode is
+// still returned for some operations so its response can be matched.
+func (s *Sniffer) decodeRequest(header *proto.RequestHeader, buf []byte) (*Request, error) {
+	// This section is breaking up how to process different request types all based on the header operation
+	// We have a few special cases where we want to see metrics for watchs and multi operations
+	req := &Request{Xid: header.Xid, Op: header.Opcode}
+	if len(buf) < proto.RequestHeaderByteLength {
+		return nil, errBufferTooShort
+	}
+	l := s.logger.With(zap.Any("header", header))
+
+	var res interface{}
+	var err error
+
+	switch header.Opcode {
+	case proto.OpPing:
+	case proto.OpNotify:
+		res, err = s.processOperation(proto.OpNotify, buf[proto.RequestHeaderByteLength:], zk.RequestStructForOp)
+		if err != nil {
+			return req, err
+		}
+	case proto.OpMulti:
+		r := &proto.MultiRequest{}
+		res = r
+		if _, err := r.Decode(buf[proto.RequestHeaderByteLength:]); err != nil {
+			return req, err
+		}
+	case proto.OpGetData:
+		r := &proto.GetDataRequest{}
+		res = r
+		if _, err := zk.DecodePacket(buf[proto.RequestHeaderByteLength:], r); err != nil {
+			return req, err
+		}
+		req.Watch = r.Watch
+	case proto.OpGetChildren2:
+		r := &proto.GetChildren2Request{}
+		res = r
+		if _, err := zk.DecodePacket(buf[proto.RequestHeaderByteLength:], r); err != nil {
+			return nil, err
+		}
+		req.Watch = r.Watch
+	case proto.OpExists:
+		r := &proto.ExistsRequest{}
+		res = r
+		if _, err := zk.DecodePacket(buf[proto.RequestHeaderByteLength:], r); err != nil {
+			return nil, err
+		}
+		req.Watch = r.Watch
+	default:
+		res, err = s.processOperation(header.Opcode, buf[proto.RequestHeaderByteLength:], zk.RequestStructForOp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.Debug("--> processed incoming result", zap.Any("result", res))
+	req.Body = res
+	req.Path, req.Size = requestDetails(res)
+
+	return req, nil
+}
+
+// decodeConnect decodes the connect request opening a connection and keeps its handshake for the session.
+func (s *Sniffer) decodeConnect(client Client, buf []byte) (*Request, error) {
+	req := &Request{Op: proto.OpNotify}
+	c := &proto.ConnectRequest{}
+	n, err := zk.DecodePacket(buf, c)
+	if err != nil {
+		return req, err
+	}
+	req.Body = c
+	h := &Handshake{
+		ProtocolVersion: c.ProtocolVersion,
+		LastZxidSeen:    c.LastZxidSeen,
+		Timeout:         time.Duration(c.TimeOut) * time.Millisecond,
+		SessionID:       c.SessionID,
+	}
+	// Clients since ZooKeeper 3.4 follow the password with a flag telling if they accept a read-only server
+	if len(buf) == n+1 {
+		readOnly := buf[n] != 0
+		h.ReadOnly = &readOnly
+	}
+	s.handshakes[client.String()] = h
+	return req, nil
+}
+
+// requestDetails pulls the path and data size out of a decoded request struct.
+// The request structs differ per operation so we look the fields up by name.
+func requestDetails(req interface{}) (path string, size int) {
+	v := reflect.ValueOf(req)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return "", 0
+	}
+	if f := v.FieldByName("Path"); f.IsValid() && f.Kind() == reflect.String {
+		path = f.String()
+	}
+	if f := v.FieldByName("Data"); f.IsValid() && f.Kind() == reflect.Slice {
+		size = f.Len()
+	}
+	return path, size
+}
+
+func (s *Sniffer) handleOutgoing(client Client, buf []byte, at time.Time) error {
+	if len(buf) < proto.ResponseHeaderByteLength {
+		return &DecodeError{Reason: ReasonResponseHeader, Err: errors.New("length of zk payload does not allow for response header")}
+	}
+	header := &proto.ResponseHeader{}
+	if _, err := zk.DecodePacket(buf[:proto.ResponseHeaderByteLength], header); err != nil {
+		return &DecodeError{Reason: ReasonResponseHeader, Err: err}
+	}
+	l := s.logger.With(zap.Any("header", header), zap.Stringer("client", client))
+
+	switch header.Xid {
+	case -2:
+		sent, ok := s.pings[client.String()]
+		if !ok {
+			// The capture started after the ping was sent
+			return nil
+		}
+		delete(s.pings, client.String())
+		ping := &Ping{
+			Client:  client,
+			Time:    sent,
+			Latency: at.Sub(sent),
+			Session: s.sessions[client.String()],
+			Server:  s.server(client),
+			Zxid:    header.Zxid,
+		}
+		s.stats.Pings++
+		for _, o := range s.observers {
+			o.Ping(ping)
+		}
+		return nil
+	case 0:
+		res := &proto.ConnectResponse{}
+		if _, err := zk.DecodePacket(buf, res); err != nil {
+			return &DecodeError{Reason: ReasonConnect, Err: err}
+		}
+		l.Debug("<-- connect", zap.Any("response", res))
+		session := &Session{
+			Client:  client,
+			Time:    at,
+			ID:      res.SessionID,
+			Timeout: time.Duration(res.TimeOut) * time.Millisecond,
+			// The server answers a reconnect to an expired session with an empty session
+			Expired:   res.SessionID == 0 || res.TimeOut <= 0,
+			Handshake: s.handshakes[client.String()],
+		}
+		if session.Expired {
+			l.Warn("<-- session expired", zap.Any("response", res))
+		}
+		delete(s.pending, pendingKey{client.String(), 0})
+		delete(s.handshakes, client.String())
+		s.sessions[client.String()] = res.SessionID
+		for _, o := range s.observers {
+			o.Session(session)
+		}
+		return nil
+	case -1:
+		// Watch event
+		// {"h": {"xid": -1, "zxid": -1, "errorCode": 0, "errorMsg": ""}, "res": {"type": 3, "path": "/node-299352457"}}
+		res := &proto.WatcherEvent{}
+		if _, err := zk.DecodePacket(buf[proto.ResponseHeaderByteLength:], res); err != nil {
+			return &DecodeError{Reason: ReasonWatchEvent, Err: err}
+		}
+		l.Info("<-- watcher event notification", zap.Any("result", res))
+		event := &WatchEvent{
+			Client: client,
+			Time:   at,
+			Zxid:   header.Zxid,
+			Type:   res.Type,
+			State:  res.State,
+			Path:   res.Path,
+		}
+		s.stats.WatchEvents++
+		for _, o := range s.observers {
+			o.WatchEvent(event)
+		}
+		return nil
+	}
+
+	// see if we have a client request for this server reply
+	key := pendingKey{client.String(), header.Xid}
+	req, found := s.pending[key]
+	if !found || req.Op == 0 {
+		l.Warn("detected server packet with no tracked request, unable to decode.")
+		s.stats.Unmatched++
+		return nil
+	}
+	delete(s.pending, key)
+
+	resp := &Response{
+		Request: req,
+		Time:    at,
+		Latency: at.Sub(req.Time),
+		Session: s.sessions[client.String()],
+		Server:  s.server(client),
+		Zxid:    header.Zxid,
+		Err:     header.Err,
+	}
+	// Thoery: This means the rest of the packet is blank
+	// Have not proven it with tests just yet
+	if header.Err < 0 {
+		l.Warn("<-- responce error")
+	} else {
+		l.Debug("<-- outgoing operation found")
+		res, err := s.processOperation(req.Op, buf[proto.ResponseHeaderByteLength:], zk.ResponseStructForOp)
+		if err != nil {
+			return &DecodeError{Reason: ReasonResponseBody, Op: req.Op, Err: err}
+		}
+		l.Debug("<-- outgoing responce", zap.Any("struct", res))
+		resp.Body = res
+		if multi, ok := res.(*proto.MultiResponse); ok {
+			// A failed multi has an ok header, it fails with its first failed operation
+			resp.Err = multi.Err()
+		}
+	}
+	if req.Op == proto.OpClose {
+		delete(s.sessions, client.String())
+		delete(s.pings, client.String())
+	}
+	s.stats.Responses++
+	for _, o := range s.observers {
+		o.Response(resp)
+	}
+	return nil
+}
+
+func (s *Sniffer) processOperation(op proto.OpType, buf []byte, cb func(int32) interface{}) (interface{}, error) {
+	rStruct := cb(int32(op))
+	var err error
+
+	switch op {
+	case proto.OpMulti:
+		rStruct, err = s.processMultiOperation(buf)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		if _, err = zk.DecodePacket(buf, rStruct); err != nil {
+			s.logger.Error("failed to decode struct", zap.Error(err), zap.Any("op", op), zap.Binary("payload", buf))
+			return nil, err
+		}
+	}
+	return rStruct, nil
+}
+
+func (s *Sniffer) processMultiOperation(buf []byte) (*proto.MultiResponse, error) {
+	mHeader := &proto.MultiResponse{}
+
+	_, err := mHeader.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Debug("process multi operation", zap.Any("multiResponse", mHeader))
+	return mHeader, nil
+}
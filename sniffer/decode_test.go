@@ -1,7 +1,6 @@
-package main
+package sniffer
 
 import (
-	"net"
 	"testing"
 
 	"github.com/jeffbean/zkpacket/proto"
@@ -43,13 +42,12 @@ func TestPassingTest(t *testing.T) {
 // }
 
 func TestProcessIncomingOperationNoPayload(t *testing.T) {
-	logger = zap.NewNop()
-	fakeClient := &client{host: net.ParseIP("127.0.0.5"), port: 10, xid: 10}
+	s := New(WithLogger(zap.NewNop()))
 	fakeRequestHeader := &proto.RequestHeader{
 		Xid:    10,
 		Opcode: proto.OpCreate,
 	}
 	fakeBuffer := []byte{}
-	_, err := processIncomingOperation(fakeClient, fakeRequestHeader, fakeBuffer)
+	_, err := s.decodeRequest(fakeRequestHeader, fakeBuffer)
 	assert.Error(t, err, errBufferTooShort)
 }
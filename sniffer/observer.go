@@ -0,0 +1,171 @@
+package sniffer
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jeffbean/go-zookeeper/zk"
+)
+
+// Client is the client side of a connection to a ZooKeeper server.
+type Client struct {
+	Host net.IP
+	Port layers.TCPPort
+}
+
+func (c Client) String() string {
+	return net.JoinHostPort(c.Host.String(), strconv.Itoa(int(c.Port)))
+}
+
+// Packet is a raw TCP packet of a ZooKeeper connection.
+type Packet struct {
+	Client      Client
+	CaptureInfo gopacket.CaptureInfo
+	Data        []byte
+}
+
+// Request is a decoded client request.
+type Request struct {
+	Client Client
+	Time   time.Time
+	Xid    int32
+	Op     proto.OpType
+	Watch  bool
+	Path   string
+	// Size is the length of the data sent with the request
+	Size int
+	// Body is the decoded request struct
+	Body interface{}
+}
+
+// Response is a server response matched to its request.
+type Response struct {
+	Request *Request
+	Time    time.Time
+	Latency time.Duration
+	// Session is the session of the connection, zero when the connect was not captured
+	Session int64
+	// Server is the address of the server that answered
+	Server string
+	Zxid   int64
+	Err    zk.ErrCode
+	// Body is the decoded response struct, nil for error responses
+	Body interface{}
+}
+
+// WatchEvent is a watch notification sent by the server.
+type WatchEvent struct {
+	Client Client
+	Time   time.Time
+	Zxid   int64
+	Type   zk.EventType
+	State  zk.State
+	Path   string
+}
+
+// Ping is a client heartbeat matched to the server's answer.
+type Ping struct {
+	Client Client
+	// Time is when the client sent the ping
+	Time    time.Time
+	Latency time.Duration
+	// Session is the session of the connection, zero when the connect was not captured
+	Session int64
+	// Server is the address of the server that answered
+	Server string
+	// Zxid is the last transaction the server had seen when it answered
+	Zxid int64
+}
+
+// Handshake is the connect request of a client.
+type Handshake struct {
+	ProtocolVersion int32
+	// LastZxidSeen is the newest transaction a reconnecting client had seen, zero for a new client
+	LastZxidSeen int64
+	// Timeout is the session timeout the client asked for
+	Timeout time.Duration
+	// SessionID is the session the client reconnects to, zero for a new session
+	SessionID int64
+	// ReadOnly tells if the client accepts a read-only server, nil for clients that don't send the flag
+	ReadOnly *bool
+}
+
+// Session is the outcome of a connect handshake.
+type Session struct {
+	Client Client
+	Time   time.Time
+	ID     int64
+	// Timeout is the session timeout the server negotiated
+	Timeout time.Duration
+	// Expired is set when the server answered a reconnect to an expired session
+	Expired bool
+	// Handshake is the connect request, nil when it was not captured
+	Handshake *Handshake
+}
+
+// Reasons a packet fails to decode.
+const (
+	// ReasonLayers is a packet gopacket could not decode to TCP over IPv4
+	ReasonLayers = "layers"
+	// ReasonFrame is a payload shorter than the frame length prefix
+	ReasonFrame          = "frame"
+	ReasonRequestHeader  = "request_header"
+	ReasonRequestBody    = "request_body"
+	ReasonResponseHeader = "response_header"
+	ReasonResponseBody   = "response_body"
+	ReasonConnect        = "connect"
+	ReasonWatchEvent     = "watch_event"
+)
+
+// DecodeError is the error observers get for a packet that failed to decode.
+type DecodeError struct {
+	Reason string
+	// Op is the operation whose body failed to decode, only set for ReasonRequestBody and ReasonResponseBody
+	Op  proto.OpType
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Reason == ReasonRequestBody || e.Reason == ReasonResponseBody {
+		return fmt.Sprintf("%v %v: %v", e.Reason, e.Op, e.Err)
+	}
+	return fmt.Sprintf("%v: %v", e.Reason, e.Err)
+}
+
+// Observer receives what the sniffer decodes. Callbacks run on the goroutine handling the packet and
+// must not hold on to a Packet's Data past the call unless the packet source gives up its buffers.
+type Observer interface {
+	// Packet is called for every TCP packet of a ZooKeeper connection before it is decoded.
+	Packet(p *Packet)
+	Request(r *Request)
+	Response(r *Response)
+	WatchEvent(e *WatchEvent)
+	// Ping is called when the server answers a ping of the client.
+	Ping(p *Ping)
+	Session(s *Session)
+	// Closed is called when the connection of the client ends, for each of its FIN or RST packets or once
+	// when a stream source closes it. Its requests waiting for an answer are dropped, they can't be answered
+	// anymore.
+	Closed(c Client, at time.Time)
+	// DecodeError is called with a *DecodeError when a packet of the connection could not be decoded. The
+	// client is zero when the packet has no TCP or IP layer.
+	DecodeError(c Client, err error)
+}
+
+// NopObserver ignores everything. Embed it to implement only some of the callbacks.
+type NopObserver struct{}
+
+func (NopObserver) Packet(*Packet)            {}
+func (NopObserver) Request(*Request)          {}
+func (NopObserver) Response(*Response)        {}
+func (NopObserver) WatchEvent(*WatchEvent)    {}
+func (NopObserver) Ping(*Ping)                {}
+func (NopObserver) Session(*Session)          {}
+func (NopObserver) Closed(Client, time.Time)  {}
+func (NopObserver) DecodeError(Client, error) {}
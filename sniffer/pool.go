@@ -0,0 +1,170 @@
+package sniffer
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// shardQueueSize is how many packets a worker can fall behind before the dispatcher waits for it.
+const shardQueueSize = 1024
+
+// Pool spreads packets over worker goroutines, each with its own Sniffer. Packets are assigned by their
+// connection so both directions of a connection go to the same worker, in the order they were handed in,
+// and each worker keeps the correlation state of its connections without sharing it. A Pool is safe for
+// concurrent use.
+type Pool struct {
+	shards []*shard
+	wg     sync.WaitGroup
+}
+
+type shard struct {
+	// mu is held while the worker handles a packet so the state can be read in between
+	mu      sync.Mutex
+	sniffer *Sniffer
+	work    chan work
+}
+
+// work is a captured packet, or a frame of a stream when packet is nil, or the end of a stream.
+type work struct {
+	packet   gopacket.Packet
+	client   Client
+	toServer bool
+	at       time.Time
+	frame    []byte
+	closed   bool
+}
+
+// NewPool starts workers sniffers built from the options. newObserver is called once per worker and its
+// observer only sees the connections of that worker, so it can keep per worker state without locking.
+// Observers added with WithObserver are shared by every worker and must be safe for concurrent use.
+func NewPool(workers int, newObserver func(worker int) Observer, opts ...Option) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Pool{shards: make([]*shard, workers)}
+	for i := range p.shards {
+		workerOpts := opts
+		if newObserver != nil {
+			workerOpts = append(append([]Option{}, opts...), WithObserver(newObserver(i)))
+		}
+		s := &shard{sniffer: New(workerOpts...), work: make(chan work, shardQueueSize)}
+		p.shards[i] = s
+		p.wg.Add(1)
+		go p.work(s)
+	}
+	return p
+}
+
+func (p *Pool) work(s *shard) {
+	defer p.wg.Done()
+	for w := range s.work {
+		s.mu.Lock()
+		switch {
+		case w.packet != nil:
+			s.sniffer.HandlePacket(w.packet)
+		case w.closed:
+			s.sniffer.HandleClose(w.client, w.at)
+		default:
+			s.sniffer.HandleFrame(w.client, w.toServer, w.at, w.frame)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// HandlePacket queues the packet on the worker of its connection.
+func (p *Pool) HandlePacket(packet gopacket.Packet) {
+	p.shards[connectionHash(packet)%uint64(len(p.shards))].work <- work{packet: packet}
+}
+
+// HandleFrame queues a frame of a stream on the worker of the client's connection, see Sniffer.HandleFrame.
+// The frame must not be modified after.
+func (p *Pool) HandleFrame(client Client, toServer bool, at time.Time, frame []byte) {
+	w := work{client: client, toServer: toServer, at: at, frame: frame}
+	p.shards[clientHash(client)%uint64(len(p.shards))].work <- w
+}
+
+// HandleClose queues the end of the client's stream on the worker of its connection, after its frames.
+func (p *Pool) HandleClose(client Client, at time.Time) {
+	p.shards[clientHash(client)%uint64(len(p.shards))].work <- work{client: client, at: at, closed: true}
+}
+
+// Run queues every packet of the source until it is exhausted or stop is closed. Call Close to wait for
+// the workers to finish them.
+func (p *Pool) Run(source *gopacket.PacketSource, stop <-chan struct{}) {
+	packets := source.Packets()
+	for {
+		select {
+		case <-stop:
+			return
+		case packet, ok := <-packets:
+			if !ok {
+				return
+			}
+			p.HandlePacket(packet)
+		}
+	}
+}
+
+// Close waits for the workers to handle the queued packets and stops them. No packet may be handed in after.
+func (p *Pool) Close() {
+	for _, s := range p.shards {
+		close(s.work)
+	}
+	p.wg.Wait()
+}
+
+// Pending returns the requests still waiting for their response on every worker, oldest first.
+func (p *Pool) Pending() []*Request {
+	var pending []*Request
+	for _, s := range p.shards {
+		s.mu.Lock()
+		pending = append(pending, s.sniffer.Pending()...)
+		s.mu.Unlock()
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Time.Before(pending[j].Time) })
+	return pending
+}
+
+// Stats adds up the counters of every worker.
+func (p *Pool) Stats() Stats {
+	var total Stats
+	for _, s := range p.shards {
+		s.mu.Lock()
+		total.add(s.sniffer.Stats())
+		s.mu.Unlock()
+	}
+	return total
+}
+
+// connectionHash is the same for both directions of a TCP connection.
+func connectionHash(packet gopacket.Packet) uint64 {
+	var h uint64
+	if n := packet.NetworkLayer(); n != nil {
+		h = n.NetworkFlow().FastHash()
+	}
+	if t := packet.TransportLayer(); t != nil {
+		h = h*31 + t.TransportFlow().FastHash()
+	}
+	return mix(h)
+}
+
+// clientHash spreads the connections of streams over the workers.
+func clientHash(c Client) uint64 {
+	h := fnv.New64a()
+	h.Write(c.Host)
+	h.Write([]byte{byte(c.Port >> 8), byte(c.Port)})
+	return mix(h.Sum64())
+}
+
+// mix spreads the bits of the hash. The low bits of FastHash barely change between neighbouring addresses
+// and ports, mixing the high bits in lets a modulo spread the connections.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
+}
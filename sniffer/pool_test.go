@@ -0,0 +1,158 @@
+package sniffer
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exchange is a GetData request and its response on the connection of the client, as raw IPv4 packets.
+func exchange(t testing.TB, c Client, xid int32) [][]byte {
+	return [][]byte{
+		tcpData(t, c, true, frame(t, &proto.RequestHeader{Xid: xid, Opcode: proto.OpGetData}, &proto.GetDataRequest{Path: "/a"})),
+		tcpData(t, c, false, frame(t, &proto.ResponseHeader{Xid: xid, Zxid: 1}, zk.ResponseStructForOp(int32(proto.OpGetData)))),
+	}
+}
+
+// lazyPacket decodes the data the way a capture does, leaving the payload to the worker.
+func lazyPacket(data []byte, at time.Duration) gopacket.Packet {
+	packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Lazy)
+	packet.Metadata().Timestamp = testStart.Add(at)
+	packet.Metadata().CaptureLength = len(data)
+	packet.Metadata().Length = len(data)
+	return packet
+}
+
+func testClients(n int) []Client {
+	clients := make([]Client, n)
+	for i := range clients {
+		clients[i] = Client{Host: net.IPv4(10, 0, byte(i>>8), byte(i)).To4(), Port: layers.TCPPort(5000 + i)}
+	}
+	return clients
+}
+
+// workerRecorder records what each worker observes.
+type workerRecorder struct {
+	mu      sync.Mutex
+	workers map[string]int
+	r       []*recorder
+}
+
+func (w *workerRecorder) observer(worker int) Observer {
+	r := &recorder{}
+	w.r[worker] = r
+	return &workerObserver{recorder: r, worker: worker, seen: w}
+}
+
+type workerObserver struct {
+	*recorder
+	worker int
+	seen   *workerRecorder
+}
+
+func (o *workerObserver) Packet(p *Packet) {
+	o.recorder.Packet(p)
+	o.seen.mu.Lock()
+	defer o.seen.mu.Unlock()
+	if w, ok := o.seen.workers[p.Client.String()]; ok && w != o.worker {
+		panic(fmt.Sprintf("%v moved from worker %v to %v", p.Client, w, o.worker))
+	}
+	o.seen.workers[p.Client.String()] = o.worker
+}
+
+func TestPoolKeepsConnectionsOnOneWorker(t *testing.T) {
+	const workers = 4
+	seen := &workerRecorder{workers: make(map[string]int), r: make([]*recorder, workers)}
+	pool := NewPool(workers, seen.observer)
+
+	clients := testClients(32)
+	for xid := int32(1); xid <= 10; xid++ {
+		for _, c := range clients {
+			for _, data := range exchange(t, c, xid) {
+				pool.HandlePacket(lazyPacket(data, time.Duration(xid)*time.Second))
+			}
+		}
+	}
+	pool.Close()
+
+	responses := 0
+	used := 0
+	for _, r := range seen.r {
+		if r.packets > 0 {
+			used++
+		}
+		assert.Empty(t, r.errors)
+		// Every response is matched and a connection's responses come in xid order
+		last := make(map[string]int32)
+		for _, resp := range r.responses {
+			c := resp.Request.Client.String()
+			assert.Equal(t, last[c]+1, resp.Request.Xid, c)
+			last[c] = resp.Request.Xid
+		}
+		responses += len(r.responses)
+	}
+	assert.Equal(t, len(clients)*10, responses)
+	assert.True(t, used > 1, "connections should spread over the workers")
+	assert.Len(t, seen.workers, len(clients))
+
+	stats := pool.Stats()
+	assert.Equal(t, uint64(len(clients)*20), stats.Packets)
+	assert.Equal(t, uint64(len(clients)*10), stats.Responses)
+	assert.Empty(t, pool.Pending())
+}
+
+func TestPoolPending(t *testing.T) {
+	pool := NewPool(2, nil)
+	clients := testClients(3)
+	for i, c := range clients {
+		pool.HandlePacket(lazyPacket(exchange(t, c, 1)[0], time.Duration(len(clients)-i)*time.Second))
+	}
+	pool.Close()
+	pending := pool.Pending()
+	require.Len(t, pending, 3)
+	assert.Equal(t, clients[2].String(), pending[0].Client.String(), "oldest first")
+	assert.Equal(t, 3, pool.Stats().Pending)
+}
+
+// latencyObserver does a little work per response like a real pipeline would.
+type latencyObserver struct {
+	NopObserver
+	count int
+	sum   time.Duration
+}
+
+func (o *latencyObserver) Response(r *Response) {
+	o.count++
+	o.sum += r.Latency
+}
+
+func BenchmarkPool(b *testing.B) {
+	// Many connections with a few exchanges each, decoded per iteration like a capture would
+	var packets [][]byte
+	for xid := int32(1); xid <= 4; xid++ {
+		for _, c := range testClients(256) {
+			packets = append(packets, exchange(b, c, xid)...)
+		}
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			pool := NewPool(workers, func(int) Observer { return &latencyObserver{} })
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pool.HandlePacket(lazyPacket(packets[i%len(packets)], time.Duration(i)))
+			}
+			pool.Close()
+		})
+	}
+}
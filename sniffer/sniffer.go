@@ -0,0 +1,399 @@
+// Package sniffer decodes ZooKeeper client traffic from captured packets. A Sniffer matches responses
+// to their requests and hands requests, responses, watch events and sessions to its observers.
+package sniffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+)
+
+// DefaultPort is the ZooKeeper client port.
+const DefaultPort = 2181
+
+// MaxFrameSize is the largest frame length accepted, a longer one means the framing was lost. ZooKeeper's
+// jute.maxbuffer defaults to 1MB, the limit leaves room for servers that raise it.
+const MaxFrameSize = 16 << 20
+
+// pendingKey identifies a request awaiting its response.
+type pendingKey struct {
+	client string
+	xid    int32
+}
+
+// streamKey is one direction of the connection of a client.
+type streamKey struct {
+	client   string
+	toServer bool
+}
+
+// stream is the start of a frame whose rest is in the next segments of its direction.
+type stream struct {
+	// next is the sequence number of the segment that continues the frame
+	next uint32
+	buf  []byte
+}
+
+// Sniffer decodes ZooKeeper packets. It keeps the requests awaiting a response and the session of each
+// connection, so every packet of a connection must go through the same Sniffer. A Sniffer is not safe
+// for concurrent use.
+type Sniffer struct {
+	logger    *zap.Logger
+	ports     []layers.TCPPort
+	observers []Observer
+	timer     func(time.Duration)
+	upstream  string
+
+	pending  map[pendingKey]*Request
+	sessions map[string]int64
+	// pings is when the unanswered ping of each connection was sent
+	pings map[string]time.Time
+	// handshakes are the connect requests waiting for their answer
+	handshakes map[string]*Handshake
+	// streams are the frames split over segments waiting for their rest
+	streams map[streamKey]*stream
+	// servers is the address of the server of each connection
+	servers map[string]string
+	stats   Stats
+}
+
+// Stats are the running counters of a Sniffer.
+type Stats struct {
+	Packets     uint64
+	Requests    uint64
+	Responses   uint64
+	WatchEvents uint64
+	// Pings is the number of pings answered by the server
+	Pings        uint64
+	DecodeErrors uint64
+	// Unmatched is the number of responses whose request was not seen
+	Unmatched uint64
+	// Unanswered is the number of requests whose connection ended before they were answered
+	Unanswered uint64
+	// Truncated is the number of packets cut short by the capture snapshot length
+	Truncated uint64
+	// Pending is the number of requests waiting for their response
+	Pending int
+}
+
+func (s *Stats) add(o Stats) {
+	s.Packets += o.Packets
+	s.Requests += o.Requests
+	s.Responses += o.Responses
+	s.WatchEvents += o.WatchEvents
+	s.Pings += o.Pings
+	s.DecodeErrors += o.DecodeErrors
+	s.Unmatched += o.Unmatched
+	s.Unanswered += o.Unanswered
+	s.Truncated += o.Truncated
+	s.Pending += o.Pending
+}
+
+// Option configures a Sniffer.
+type Option func(*Sniffer)
+
+// WithLogger logs decode problems to l, nothing is logged by default.
+func WithLogger(l *zap.Logger) Option {
+	return func(s *Sniffer) { s.logger = l }
+}
+
+// WithServerPorts sets the ports ZooKeeper servers listen on, DefaultPort by default. A packet from one of
+// them is a response and a packet to one of them is a request.
+func WithServerPorts(ports ...layers.TCPPort) Option {
+	return func(s *Sniffer) { s.ports = ports }
+}
+
+// WithObserver adds an observer. Observers are called in the order they were added.
+func WithObserver(o Observer) Option {
+	return func(s *Sniffer) { s.observers = append(s.observers, o) }
+}
+
+// WithPacketTimer calls timer with the time each packet took to decode, observers included.
+func WithPacketTimer(timer func(time.Duration)) Option {
+	return func(s *Sniffer) { s.timer = timer }
+}
+
+// WithUpstream sets the address of the server of the connections whose frames go through HandleFrame, like
+// the upstream of a proxy.
+func WithUpstream(addr string) Option {
+	return func(s *Sniffer) { s.upstream = addr }
+}
+
+// New creates a Sniffer.
+func New(opts ...Option) *Sniffer {
+	s := &Sniffer{
+		logger:     zap.NewNop(),
+		ports:      []layers.TCPPort{DefaultPort},
+		pending:    make(map[pendingKey]*Request),
+		sessions:   make(map[string]int64),
+		pings:      make(map[string]time.Time),
+		handshakes: make(map[string]*Handshake),
+		streams:    make(map[streamKey]*stream),
+		servers:    make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Run handles every packet of the source until it is exhausted or stop is closed.
+func (s *Sniffer) Run(source *gopacket.PacketSource, stop <-chan struct{}) {
+	packets := source.Packets()
+	for {
+		select {
+		case <-stop:
+			return
+		case packet, ok := <-packets:
+			if !ok {
+				return
+			}
+			s.HandlePacket(packet)
+		}
+	}
+}
+
+// RunFrames decodes the raw frames of the source with the decoder, usually the link type of the capture,
+// and handles them until the source is exhausted or stop is closed.
+func (s *Sniffer) RunFrames(source gopacket.PacketDataSource, decoder gopacket.Decoder, stop <-chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		data, ci, err := source.ReadPacketData()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		packet := gopacket.NewPacket(data, decoder, gopacket.Default)
+		m := packet.Metadata()
+		m.CaptureInfo = ci
+		m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+		s.HandlePacket(packet)
+	}
+}
+
+// Pending returns the requests still waiting for their response, oldest first.
+func (s *Sniffer) Pending() []*Request {
+	pending := make([]*Request, 0, len(s.pending))
+	for _, req := range s.pending {
+		pending = append(pending, req)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Time.Before(pending[j].Time) })
+	return pending
+}
+
+// Stats returns the counters of the packets handled so far.
+func (s *Sniffer) Stats() Stats {
+	stats := s.stats
+	stats.Pending = len(s.pending)
+	return stats
+}
+
+// HandlePacket decodes a single packet and calls the observers with what it contains.
+func (s *Sniffer) HandlePacket(packet gopacket.Packet) {
+	if s.timer != nil {
+		defer func(start time.Time) { s.timer(time.Since(start)) }(time.Now())
+	}
+	// In this hot path we want to return as soon as we know anything is not going through
+	s.stats.Packets++
+	if packet.Metadata().Truncated {
+		s.stats.Truncated++
+	}
+
+	// Check for errors
+	if err := packet.ErrorLayer(); err != nil {
+		s.logger.Error("error layer found in packet", zap.Error(err.Error()))
+		s.decodeFailed(Client{}, &DecodeError{Reason: ReasonLayers, Err: err.Error()})
+		return
+	}
+
+	tcp, src, dst, err := castLayers(packet)
+	if err != nil {
+		s.logger.Error("failed casting required packet layers", zap.Error(err))
+		s.decodeFailed(Client{}, &DecodeError{Reason: ReasonLayers, Err: err})
+		return
+	}
+
+	// The connection is always keyed by the client side
+	client := Client{Host: src, Port: tcp.SrcPort}
+	serverHost, serverPort := dst, tcp.DstPort
+	if s.isServerPort(tcp.SrcPort) {
+		client = Client{Host: dst, Port: tcp.DstPort}
+		serverHost, serverPort = src, tcp.SrcPort
+	}
+	p := &Packet{Client: client, CaptureInfo: packet.Metadata().CaptureInfo, Data: packet.Data()}
+	for _, o := range s.observers {
+		o.Packet(p)
+	}
+
+	if tcp.FIN || tcp.RST {
+		defer s.closed(client, packet.Metadata().Timestamp)
+	}
+	applicationLayer := packet.ApplicationLayer()
+	if applicationLayer == nil {
+		// We dont log here since this can be a multitide of packets
+		return
+	}
+	if key := client.String(); s.servers[key] == "" {
+		s.servers[key] = net.JoinHostPort(serverHost.String(), strconv.Itoa(int(serverPort)))
+	}
+	appPayload := applicationLayer.Payload()
+	// TODO: add the ablity to swap this logic if you want to sniff on a client
+	// if the source port is ZK port, we treat everything as a server request
+	if s.isServerPort(tcp.SrcPort) {
+		s.handleSegment(client, false, tcp.Seq, packet.Metadata(), appPayload)
+	}
+	// If we detect the destination is the ZK port we treat this as an incoming client call.
+	if s.isServerPort(tcp.DstPort) {
+		s.handleSegment(client, true, tcp.Seq, packet.Metadata(), appPayload)
+	}
+}
+
+// handleSegment decodes the frames of a TCP segment. A frame split over segments is kept until the rest of it
+// arrives, several frames in one segment are decoded one after the other.
+func (s *Sniffer) handleSegment(client Client, toServer bool, seq uint32, md *gopacket.PacketMetadata, payload []byte) {
+	key := streamKey{client.String(), toServer}
+	data := payload
+	if st, ok := s.streams[key]; ok {
+		delete(s.streams, key)
+		if st.next == seq {
+			data = append(st.buf, payload...)
+		} else {
+			// A segment was lost or is out of order, the start of the frame is dropped
+			s.decodeFailed(client, &DecodeError{Reason: ReasonFrame, Err: errors.New("the rest of a frame split over segments is missing")})
+		}
+	}
+	if md.Truncated {
+		// The rest of the frame was not captured, what was is decoded on its own
+		if len(data) < 4 {
+			s.decodeFailed(client, &DecodeError{Reason: ReasonFrame, Err: errors.New("payload shorter than the frame length")})
+			return
+		}
+		s.handleFrame(client, toServer, md.Timestamp, data[4:])
+		return
+	}
+	for len(data) >= 4 {
+		n := binary.BigEndian.Uint32(data)
+		if n > MaxFrameSize {
+			s.logger.Error("frame length is too long, skipping the segment", zap.Uint32("length", n))
+			s.decodeFailed(client, &DecodeError{Reason: ReasonFrame, Err: fmt.Errorf("frame length %v is over %v", n, MaxFrameSize)})
+			return
+		}
+		if len(data) < 4+int(n) {
+			break
+		}
+		s.handleFrame(client, toServer, md.Timestamp, data[4:4+n])
+		data = data[4+n:]
+	}
+	if len(data) > 0 {
+		s.streams[key] = &stream{next: seq + uint32(len(payload)), buf: append([]byte(nil), data...)}
+	}
+}
+
+// HandleClose ends the connection of the client, for sources that read the TCP stream itself like
+// HandleFrame.
+func (s *Sniffer) HandleClose(client Client, at time.Time) {
+	s.closed(client, at)
+}
+
+// closed drops the state of a connection that ended and tells the observers.
+func (s *Sniffer) closed(client Client, at time.Time) {
+	key := client.String()
+	delete(s.sessions, key)
+	delete(s.pings, key)
+	delete(s.handshakes, key)
+	delete(s.servers, key)
+	for k := range s.pending {
+		if k.client == key {
+			delete(s.pending, k)
+			s.stats.Unanswered++
+		}
+	}
+	delete(s.streams, streamKey{key, true})
+	delete(s.streams, streamKey{key, false})
+	for _, o := range s.observers {
+		o.Closed(client, at)
+	}
+}
+
+// HandleFrame decodes a ZooKeeper frame, without its length prefix, sent to or by the server on the
+// connection of the client. It is for sources that read the TCP stream itself, like a proxy, and counts as
+// a packet in the stats. Observers get no Packet callback.
+func (s *Sniffer) HandleFrame(client Client, toServer bool, at time.Time, frame []byte) {
+	if s.timer != nil {
+		defer func(start time.Time) { s.timer(time.Since(start)) }(time.Now())
+	}
+	s.stats.Packets++
+	s.handleFrame(client, toServer, at, frame)
+}
+
+func (s *Sniffer) handleFrame(client Client, toServer bool, at time.Time, buf []byte) {
+	var err error
+	if toServer {
+		err = s.handleIncoming(client, buf, at)
+	} else {
+		err = s.handleOutgoing(client, buf, at)
+	}
+	if err != nil {
+		s.logger.Error("error processing packet", zap.Error(err))
+		s.decodeFailed(client, err)
+	}
+}
+
+func (s *Sniffer) decodeFailed(client Client, err error) {
+	s.stats.DecodeErrors++
+	for _, o := range s.observers {
+		o.DecodeError(client, err)
+	}
+}
+
+// server is the address of the server of the client's connection.
+func (s *Sniffer) server(client Client) string {
+	if addr, ok := s.servers[client.String()]; ok {
+		return addr
+	}
+	return s.upstream
+}
+
+func (s *Sniffer) isServerPort(port layers.TCPPort) bool {
+	for _, p := range s.ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// castLayers returns the TCP layer and the source and destination addresses of an IPv4 or IPv6 packet.
+func castLayers(packet gopacket.Packet) (*layers.TCP, net.IP, net.IP, error) {
+	// Need TCP to use the source and destination ports to see the driection of the packets
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if tcp == nil {
+		return nil, nil, nil, errors.New("required layers not found")
+	}
+	// Need Network info to track and inspect the IP info of the client and servers.
+	switch ip := packet.LayerClass(layers.LayerClassIPNetwork).(type) {
+	case *layers.IPv4:
+		return tcp, ip.SrcIP, ip.DstIP, nil
+	case *layers.IPv6:
+		return tcp, ip.SrcIP, ip.DstIP, nil
+	case nil:
+		return nil, nil, nil, errors.New("required layers not found")
+	default:
+		return nil, nil, nil, errors.New("failed to cast required layers TCP or IP")
+	}
+}
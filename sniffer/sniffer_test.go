@@ -0,0 +1,359 @@
+package sniffer
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testClient = Client{Host: net.IPv4(10, 0, 0, 1).To4(), Port: 5000}
+	testServer = net.IPv4(10, 0, 0, 100).To4()
+	testStart  = time.Unix(1500000000, 0)
+)
+
+// recorder keeps everything it observes.
+type recorder struct {
+	packets   int
+	requests  []*Request
+	responses []*Response
+	events    []*WatchEvent
+	pings     []*Ping
+	sessions  []*Session
+	closed    []Client
+	errors    []error
+}
+
+func (r *recorder) Packet(*Packet)                  { r.packets++ }
+func (r *recorder) Request(req *Request)            { r.requests = append(r.requests, req) }
+func (r *recorder) Response(resp *Response)         { r.responses = append(r.responses, resp) }
+func (r *recorder) WatchEvent(e *WatchEvent)        { r.events = append(r.events, e) }
+func (r *recorder) Ping(p *Ping)                    { r.pings = append(r.pings, p) }
+func (r *recorder) Session(s *Session)              { r.sessions = append(r.sessions, s) }
+func (r *recorder) Closed(c Client, at time.Time)   { r.closed = append(r.closed, c) }
+func (r *recorder) DecodeError(c Client, err error) { r.errors = append(r.errors, err) }
+
+// frame encodes the structs as a length prefixed ZooKeeper frame.
+func frame(t testing.TB, parts ...interface{}) []byte {
+	buf := make([]byte, 512)
+	n := 4
+	for _, p := range parts {
+		m, err := zk.EncodePacket(buf[n:], p)
+		require.NoError(t, err)
+		n += m
+	}
+	binary.BigEndian.PutUint32(buf, uint32(n-4))
+	return buf[:n]
+}
+
+// tcpPacket builds a packet between the test client and server carrying the payload.
+func tcpPacket(t testing.TB, toServer bool, at time.Duration, payload []byte) gopacket.Packet {
+	data := tcpData(t, testClient, toServer, payload)
+	packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+	packet.Metadata().Timestamp = testStart.Add(at)
+	packet.Metadata().CaptureLength = len(data)
+	packet.Metadata().Length = len(data)
+	return packet
+}
+
+// tcpData serializes an IPv4 packet between the client and the test server carrying the payload.
+func tcpData(t testing.TB, c Client, toServer bool, payload []byte) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: c.Host, DstIP: testServer}
+	tcp := &layers.TCP{SrcPort: c.Port, DstPort: DefaultPort, PSH: true, ACK: true}
+	if !toServer {
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)))
+	return buf.Bytes()
+}
+
+func TestSnifferMatchesResponses(t *testing.T) {
+	r := &recorder{}
+	s := New(WithObserver(r))
+
+	s.HandlePacket(tcpPacket(t, true, 0, frame(t, &proto.ConnectRequest{TimeOut: 10000})))
+	s.HandlePacket(tcpPacket(t, false, time.Millisecond, frame(t, &proto.ConnectResponse{TimeOut: 10000, SessionID: 0x1234, Passwd: make([]byte, 16)})))
+	require.Len(t, r.requests, 1)
+	assert.IsType(t, &proto.ConnectRequest{}, r.requests[0].Body)
+	require.Len(t, r.sessions, 1)
+	assert.Equal(t, &Session{Client: testClient, Time: testStart.Add(time.Millisecond), ID: 0x1234, Timeout: 10 * time.Second,
+		Handshake: &Handshake{Timeout: 10 * time.Second}}, r.sessions[0])
+
+	s.HandlePacket(tcpPacket(t, true, 10*time.Millisecond, frame(t,
+		&proto.RequestHeader{Xid: 1, Opcode: proto.OpGetData}, &proto.GetDataRequest{Path: "/a", Watch: true})))
+	s.HandlePacket(tcpPacket(t, true, 11*time.Millisecond, frame(t,
+		&proto.RequestHeader{Xid: 2, Opcode: proto.OpGetData}, &proto.GetDataRequest{Path: "/missing"})))
+	require.Len(t, r.requests, 3)
+	assert.Equal(t, "/a", r.requests[1].Path)
+	assert.True(t, r.requests[1].Watch)
+	assert.Len(t, s.Pending(), 2)
+
+	s.HandlePacket(tcpPacket(t, false, 13*time.Millisecond, frame(t,
+		&proto.ResponseHeader{Xid: 2, Zxid: 5, Err: zk.ErrCode(-101)})))
+	s.HandlePacket(tcpPacket(t, false, 14*time.Millisecond, frame(t,
+		&proto.ResponseHeader{Xid: 1, Zxid: 5}, zk.ResponseStructForOp(int32(proto.OpGetData)))))
+	require.Len(t, r.responses, 2)
+	assert.Equal(t, r.requests[2], r.responses[0].Request)
+	assert.Equal(t, zk.ErrCode(-101), r.responses[0].Err)
+	assert.Nil(t, r.responses[0].Body)
+	assert.Equal(t, r.requests[1], r.responses[1].Request)
+	assert.Equal(t, 4*time.Millisecond, r.responses[1].Latency)
+	assert.Equal(t, int64(0x1234), r.responses[1].Session)
+	assert.NotNil(t, r.responses[1].Body)
+	assert.Empty(t, s.Pending())
+
+	s.HandlePacket(tcpPacket(t, false, 20*time.Millisecond, frame(t,
+		&proto.ResponseHeader{Xid: -1, Zxid: -1}, &proto.WatcherEvent{Type: zk.EventNodeDataChanged, State: 3, Path: "/a"})))
+	require.Len(t, r.events, 1)
+	assert.Equal(t, &WatchEvent{Client: testClient, Time: testStart.Add(20 * time.Millisecond), Zxid: -1, Type: zk.EventNodeDataChanged, State: 3, Path: "/a"}, r.events[0])
+
+	assert.Equal(t, 7, r.packets)
+	assert.Empty(t, r.errors)
+}
+
+func TestSnifferHandshake(t *testing.T) {
+	type readOnlyFlag struct{ ReadOnly bool }
+	connected := frame(t, &proto.ConnectResponse{TimeOut: 6000, SessionID: 0x1234, Passwd: make([]byte, 16)})
+	readOnly := true
+
+	for _, tt := range []struct {
+		name    string
+		connect []byte
+		want    *Handshake
+	}{
+		{
+			name:    "without the read-only flag",
+			connect: frame(t, &proto.ConnectRequest{TimeOut: 10000, Passwd: make([]byte, 16)}),
+			want:    &Handshake{Timeout: 10 * time.Second},
+		},
+		{
+			name:    "with the read-only flag",
+			connect: frame(t, &proto.ConnectRequest{TimeOut: 10000, Passwd: make([]byte, 16)}, &readOnlyFlag{true}),
+			want:    &Handshake{Timeout: 10 * time.Second, ReadOnly: &readOnly},
+		},
+		{
+			// The epoch of the zxid is where a request has its operation, 11 is a ping
+			name: "reconnect",
+			connect: frame(t, &proto.ConnectRequest{LastZxidSeen: 0xb00000003, TimeOut: 10000, SessionID: 0x1234,
+				Passwd: make([]byte, 16)}),
+			want: &Handshake{LastZxidSeen: 0xb00000003, Timeout: 10 * time.Second, SessionID: 0x1234},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{}
+			s := New(WithObserver(r))
+			s.HandlePacket(tcpPacket(t, true, 0, tt.connect))
+			s.HandlePacket(tcpPacket(t, false, time.Millisecond, connected))
+			require.Len(t, r.requests, 1)
+			assert.Equal(t, proto.OpNotify, r.requests[0].Op)
+			require.Len(t, r.sessions, 1)
+			assert.Equal(t, 6*time.Second, r.sessions[0].Timeout)
+			assert.Equal(t, tt.want, r.sessions[0].Handshake)
+			assert.Empty(t, r.errors)
+			assert.Empty(t, s.Pending())
+		})
+	}
+}
+
+func TestSnifferPings(t *testing.T) {
+	r := &recorder{}
+	s := New(WithObserver(r))
+	ping := frame(t, &proto.RequestHeader{Xid: -2, Opcode: proto.OpPing})
+	pong := frame(t, &proto.ResponseHeader{Xid: -2, Zxid: 5})
+
+	s.HandlePacket(tcpPacket(t, false, 0, pong))
+	assert.Empty(t, r.pings, "the ping was sent before the capture started")
+
+	s.HandlePacket(tcpPacket(t, true, 0, frame(t, &proto.ConnectRequest{TimeOut: 10000})))
+	s.HandlePacket(tcpPacket(t, false, time.Millisecond, frame(t, &proto.ConnectResponse{TimeOut: 10000, SessionID: 0x1234, Passwd: make([]byte, 16)})))
+	s.HandlePacket(tcpPacket(t, true, 10*time.Millisecond, ping))
+	s.HandlePacket(tcpPacket(t, false, 13*time.Millisecond, pong))
+	s.HandlePacket(tcpPacket(t, false, 14*time.Millisecond, pong))
+	require.Len(t, r.pings, 1)
+	assert.Equal(t, &Ping{Client: testClient, Time: testStart.Add(10 * time.Millisecond), Latency: 3 * time.Millisecond, Session: 0x1234, Server: "10.0.0.100:2181", Zxid: 5}, r.pings[0])
+	assert.Len(t, r.requests, 1, "pings are not requests")
+	assert.Empty(t, r.responses)
+	assert.Empty(t, s.Pending())
+	assert.Equal(t, uint64(1), s.Stats().Pings)
+	assert.Equal(t, uint64(0), s.Stats().Unmatched)
+}
+
+func TestSnifferClose(t *testing.T) {
+	r := &recorder{}
+	s := New(WithObserver(r))
+	s.HandlePacket(tcpPacket(t, true, 0, frame(t, &proto.ConnectRequest{TimeOut: 10000})))
+	s.HandlePacket(tcpPacket(t, false, time.Millisecond, frame(t, &proto.ConnectResponse{TimeOut: 10000, SessionID: 0x1234, Passwd: make([]byte, 16)})))
+	s.HandlePacket(tcpPacket(t, true, 2*time.Millisecond, frame(t, &proto.RequestHeader{Xid: -2, Opcode: proto.OpPing})))
+	s.HandlePacket(tcpPacket(t, true, 3*time.Millisecond, frame(t, &proto.RequestHeader{Xid: 1, Opcode: proto.OpGetData}, &proto.GetDataRequest{Path: "/a"})))
+
+	fin := tcpPacket(t, true, 4*time.Millisecond, nil)
+	fin.Layer(layers.LayerTypeTCP).(*layers.TCP).FIN = true
+	s.HandlePacket(fin)
+	assert.Equal(t, []Client{testClient}, r.closed)
+	assert.Empty(t, s.sessions)
+	assert.Empty(t, s.pings)
+	assert.Empty(t, s.Pending(), "the requests of the connection can't be answered anymore")
+	assert.Equal(t, uint64(1), s.Stats().Unanswered)
+
+	s.HandlePacket(tcpPacket(t, false, 5*time.Millisecond, frame(t, &proto.ResponseHeader{Xid: -2})))
+	assert.Empty(t, r.pings)
+
+	s.HandleClose(testClient, testStart.Add(6*time.Millisecond))
+	assert.Len(t, r.closed, 2)
+}
+
+func TestSnifferServerPorts(t *testing.T) {
+	r := &recorder{}
+	s := New(WithObserver(r), WithServerPorts(2182))
+	s.HandlePacket(tcpPacket(t, true, 0, frame(t, &proto.RequestHeader{Xid: 1, Opcode: proto.OpGetData}, &proto.GetDataRequest{Path: "/a"})))
+	assert.Empty(t, r.requests, "2181 is not a server port")
+}
+
+func TestSnifferDecodeError(t *testing.T) {
+	r := &recorder{}
+	s := New(WithObserver(r))
+	s.HandlePacket(tcpPacket(t, false, 0, []byte{0, 0, 0, 4, 1, 2, 3, 4}))
+	require.Len(t, r.errors, 1)
+	assert.Equal(t, 1, r.packets)
+	assert.Equal(t, &DecodeError{Reason: ReasonResponseHeader, Err: r.errors[0].(*DecodeError).Err}, r.errors[0])
+
+	// A response body that does not decode is counted against the operation of its request
+	s.HandlePacket(tcpPacket(t, true, 0, frame(t, &proto.RequestHeader{Xid: 1, Opcode: proto.OpGetData}, &proto.GetDataRequest{Path: "/a"})))
+	s.HandlePacket(tcpPacket(t, false, time.Millisecond, frame(t, &proto.ResponseHeader{Xid: 1})))
+	require.Len(t, r.errors, 2)
+	e, ok := r.errors[1].(*DecodeError)
+	require.True(t, ok)
+	assert.Equal(t, ReasonResponseBody, e.Reason)
+	assert.Equal(t, proto.OpGetData, e.Op)
+
+	s.HandlePacket(tcpPacket(t, true, 0, []byte{0xff, 0xff, 0xff, 0xff}))
+	require.Len(t, r.errors, 3)
+	assert.Equal(t, ReasonFrame, r.errors[2].(*DecodeError).Reason)
+	assert.Equal(t, uint64(3), s.Stats().DecodeErrors)
+
+	// A request body that does not decode is an error, the request is still matched to its response
+	s.HandlePacket(tcpPacket(t, true, 0, frame(t, &proto.RequestHeader{Xid: 2, Opcode: proto.OpGetData}, &struct{ Length int32 }{100})))
+	require.Len(t, r.errors, 4)
+	assert.Equal(t, &DecodeError{Reason: ReasonRequestBody, Op: proto.OpGetData, Err: zk.ErrShortBuffer}, r.errors[3])
+	require.Len(t, r.requests, 2)
+	s.HandlePacket(tcpPacket(t, false, time.Millisecond, frame(t, &proto.ResponseHeader{Xid: 2, Err: zk.ErrCode(-101)})))
+	require.Len(t, r.responses, 1)
+	assert.Equal(t, int32(2), r.responses[0].Request.Xid)
+}
+
+// segment is a packet of the connection starting at the sequence number.
+func segment(t *testing.T, toServer bool, at time.Duration, seq uint32, payload []byte) gopacket.Packet {
+	packet := tcpPacket(t, toServer, at, payload)
+	packet.Layer(layers.LayerTypeTCP).(*layers.TCP).Seq = seq
+	return packet
+}
+
+func TestSnifferReassembles(t *testing.T) {
+	r := &recorder{}
+	s := New(WithObserver(r))
+	getData := frame(t, &proto.RequestHeader{Xid: 1, Opcode: proto.OpGetData}, &proto.GetDataRequest{Path: "/a"})
+	exists := frame(t, &proto.RequestHeader{Xid: 2, Opcode: proto.OpExists}, &proto.ExistsRequest{Path: "/b"})
+
+	// A frame split over segments is decoded once its last segment arrives
+	s.HandlePacket(segment(t, true, 0, 100, getData[:3]))
+	s.HandlePacket(segment(t, true, time.Millisecond, 103, getData[3:10]))
+	assert.Empty(t, r.requests)
+	// The segment with the rest of the frame starts the next one
+	s.HandlePacket(segment(t, true, 2*time.Millisecond, 110, append(append([]byte{}, getData[10:]...), exists[:5]...)))
+	require.Len(t, r.requests, 1)
+	assert.Equal(t, "/a", r.requests[0].Path)
+	assert.Equal(t, testStart.Add(2*time.Millisecond), r.requests[0].Time)
+	s.HandlePacket(segment(t, true, 3*time.Millisecond, uint32(110+len(getData)-10+5), exists[5:]))
+	require.Len(t, r.requests, 2)
+	assert.Equal(t, "/b", r.requests[1].Path)
+
+	// Pipelined frames in one segment are all decoded
+	pipelined := append(frame(t, &proto.ResponseHeader{Xid: 1}, zk.ResponseStructForOp(int32(proto.OpGetData))),
+		frame(t, &proto.ResponseHeader{Xid: 2}, zk.ResponseStructForOp(int32(proto.OpExists)))...)
+	s.HandlePacket(segment(t, false, 4*time.Millisecond, 500, pipelined))
+	assert.Len(t, r.responses, 2)
+
+	// The start of a frame whose next segment is missing is dropped
+	s.HandlePacket(segment(t, true, 5*time.Millisecond, 200, getData[:10]))
+	s.HandlePacket(segment(t, true, 6*time.Millisecond, 300, exists))
+	require.Len(t, r.errors, 1)
+	assert.Equal(t, ReasonFrame, r.errors[0].(*DecodeError).Reason)
+	require.Len(t, r.requests, 3)
+	assert.Equal(t, proto.OpExists, r.requests[2].Op)
+	assert.Empty(t, s.streams)
+}
+
+func TestSnifferTruncatedMulti(t *testing.T) {
+	type multiHeader struct {
+		Type proto.OpType
+		Done bool
+		Err  zk.ErrCode
+	}
+	r := &recorder{}
+	s := New(WithObserver(r))
+	s.HandlePacket(tcpPacket(t, true, 0, frame(t, &proto.RequestHeader{Xid: 1, Opcode: proto.OpMulti},
+		&multiHeader{Type: proto.OpCreate, Err: -1}, &zk.CreateRequest{Path: "/a", Acl: zk.WorldACL(zk.PermAll)},
+		&multiHeader{Type: -1, Done: true, Err: -1})))
+	resp := frame(t, &proto.ResponseHeader{Xid: 1, Zxid: 3}, &multiHeader{Type: proto.OpCreate},
+		&struct{ Path string }{"/a/very/long/path"}, &multiHeader{Type: -1, Done: true, Err: -1})
+	truncated := tcpPacket(t, false, time.Millisecond, resp[:len(resp)-20])
+	truncated.Metadata().Truncated = true
+	s.HandlePacket(truncated)
+
+	require.Len(t, r.errors, 1)
+	assert.Equal(t, ReasonResponseBody, r.errors[0].(*DecodeError).Reason)
+	assert.Empty(t, r.responses)
+}
+
+func TestSnifferStats(t *testing.T) {
+	var timed int
+	s := New(WithPacketTimer(func(time.Duration) { timed++ }))
+	s.HandlePacket(tcpPacket(t, true, 0, frame(t, &proto.RequestHeader{Xid: 1, Opcode: proto.OpGetData}, &proto.GetDataRequest{Path: "/a"})))
+	s.HandlePacket(tcpPacket(t, false, time.Millisecond, frame(t, &proto.ResponseHeader{Xid: 9}, zk.ResponseStructForOp(int32(proto.OpGetData)))))
+	truncated := tcpPacket(t, true, 2*time.Millisecond, frame(t, &proto.RequestHeader{Xid: 2, Opcode: proto.OpExists}, &proto.ExistsRequest{Path: "/b"}))
+	truncated.Metadata().Truncated = true
+	s.HandlePacket(truncated)
+
+	assert.Equal(t, Stats{Packets: 3, Requests: 2, Unmatched: 1, Truncated: 1, Pending: 2}, s.Stats())
+	assert.Equal(t, 3, timed)
+}
+
+func TestRunFrames(t *testing.T) {
+	r := &recorder{}
+	s := New(WithObserver(r))
+	source := &frameSource{packets: []gopacket.Packet{
+		tcpPacket(t, true, 0, frame(t, &proto.RequestHeader{Xid: 1, Opcode: proto.OpExists}, &proto.ExistsRequest{Path: "/a"})),
+		tcpPacket(t, false, time.Millisecond, frame(t, &proto.ResponseHeader{Xid: 1}, zk.ResponseStructForOp(int32(proto.OpExists)))),
+	}}
+	require.NoError(t, s.RunFrames(source, layers.LayerTypeIPv4, nil))
+	require.Len(t, r.responses, 1)
+	assert.Equal(t, time.Millisecond, r.responses[0].Latency)
+}
+
+// frameSource replays the raw data of packets.
+type frameSource struct {
+	packets []gopacket.Packet
+}
+
+func (f *frameSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(f.packets) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	p := f.packets[0]
+	f.packets = f.packets[1:]
+	return p.Data(), p.Metadata().CaptureInfo, nil
+}
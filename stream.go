@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/sniffer"
+)
+
+// streamBufferSize is how many events a slow subscriber can fall behind before events are dropped for it.
+const streamBufferSize = 256
+
+// operationEvent is a completed operation as sent to event stream subscribers.
+type operationEvent struct {
+	Time           time.Time `json:"time"`
+	Client         string    `json:"client"`
+	Label          string    `json:"label,omitempty"`
+	Session        string    `json:"session"`
+	Xid            int32     `json:"xid"`
+	Op             string    `json:"op"`
+	Path           string    `json:"path,omitempty"`
+	Watch          bool      `json:"watch"`
+	Size           int       `json:"size"`
+	Err            int32     `json:"err"`
+	LatencySeconds float64   `json:"latency_seconds"`
+}
+
+func newOperationEvent(r *sniffer.Response, msg *filter.Message, label string) operationEvent {
+	return operationEvent{
+		Time:           r.Request.Time,
+		Client:         r.Request.Client.String(),
+		Label:          label,
+		Session:        sessionString(msg.Session),
+		Xid:            msg.Xid,
+		Op:             msg.Op.String(),
+		Path:           msg.Path,
+		Watch:          msg.Watch,
+		Size:           msg.Size,
+		Err:            int32(msg.Err),
+		LatencySeconds: msg.Latency.Seconds(),
+	}
+}
+
+func sessionString(id int64) string {
+	return "0x" + strconv.FormatInt(id, 16)
+}
+
+type subscriber struct {
+	filter *filter.Filter
+	events chan operationEvent
+	epochs chan epochEvent
+}
+
+// eventStream fans completed operations out to the live stream subscribers.
+type eventStream struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{subscribers: make(map[*subscriber]struct{})}
+}
+
+func (s *eventStream) subscribe(f *filter.Filter) *subscriber {
+	sub := &subscriber{
+		filter: f,
+		events: make(chan operationEvent, streamBufferSize),
+		epochs: make(chan epochEvent, streamBufferSize),
+	}
+	s.mu.Lock()
+	s.subscribers[sub] = struct{}{}
+	s.mu.Unlock()
+	return sub
+}
+
+func (s *eventStream) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	delete(s.subscribers, sub)
+	s.mu.Unlock()
+}
+
+// publish sends the operation to every subscriber whose filter matches. It never blocks the packet loop,
+// a subscriber that is not keeping up misses events instead.
+func (s *eventStream) publish(r *sniffer.Response, msg *filter.Message, label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subscribers) == 0 {
+		return
+	}
+	ev := newOperationEvent(r, msg, label)
+	for sub := range s.subscribers {
+		if !sub.filter.Match(msg) {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		default:
+			streamDroppedCounter.Inc()
+		}
+	}
+}
+
+// publishEpoch sends a new leader epoch to every subscriber, whatever their filter.
+func (s *eventStream) publishEpoch(ev epochEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subscribers {
+		select {
+		case sub.epochs <- ev:
+		default:
+			streamDroppedCounter.Inc()
+		}
+	}
+}
+
+// streamFilterExpr builds a filter expression from the stream query parameters. The filter parameter takes
+// a full expression and op, path, client, err and min_latency are shortcuts that are and-ed with it.
+func streamFilterExpr(query map[string][]string) string {
+	var parts []string
+	get := func(name string) string {
+		if v := query[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	if expr := get("filter"); expr != "" {
+		parts = append(parts, "("+expr+")")
+	}
+	if ops := get("op"); ops != "" {
+		var quoted []string
+		for _, op := range strings.Split(ops, ",") {
+			quoted = append(quoted, strconv.Quote(strings.TrimSpace(op)))
+		}
+		parts = append(parts, "op in ("+strings.Join(quoted, ", ")+")")
+	}
+	if path := get("path"); path != "" {
+		parts = append(parts, "path ^= "+strconv.Quote(path))
+	}
+	if client := get("client"); client != "" {
+		parts = append(parts, "client in "+strconv.Quote(client))
+	}
+	if ec := get("err"); ec != "" {
+		parts = append(parts, "err == "+strconv.Quote(ec))
+	}
+	if latency := get("min_latency"); latency != "" {
+		parts = append(parts, "latency >= "+strconv.Quote(latency))
+	}
+	return strings.Join(parts, " and ")
+}
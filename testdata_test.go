@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/pcapgen"
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The pcaps in testdata are written by zkpcapgen from the script next to them:
+//
+//	go run ./zkpcapgen testdata/*.yaml
+
+// decoded is everything the sniffer made of a testdata pcap.
+type decoded struct {
+	sniffer.NopObserver
+	sessions  []*sniffer.Session
+	responses []*sniffer.Response
+	events    []*sniffer.WatchEvent
+	errors    []error
+	stats     sniffer.Stats
+}
+
+func (d *decoded) Session(s *sniffer.Session)              { d.sessions = append(d.sessions, s) }
+func (d *decoded) Response(r *sniffer.Response)            { d.responses = append(d.responses, r) }
+func (d *decoded) WatchEvent(e *sniffer.WatchEvent)        { d.events = append(d.events, e) }
+func (d *decoded) DecodeError(c sniffer.Client, err error) { d.errors = append(d.errors, err) }
+func (d *decoded) ops() (ops []proto.OpType) {
+	for _, r := range d.responses {
+		ops = append(ops, r.Request.Op)
+	}
+	return ops
+}
+
+func decodeTestdata(t *testing.T, name string) *decoded {
+	f, err := os.Open(filepath.Join("testdata", name+".pcap"))
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	require.NoError(t, err)
+
+	d := &decoded{}
+	s := sniffer.New(sniffer.WithObserver(d))
+	require.NoError(t, s.RunFrames(r, r.LinkType(), nil))
+	d.stats = s.Stats()
+	return d
+}
+
+func TestTestdataUpToDate(t *testing.T) {
+	scripts, err := filepath.Glob("testdata/*.yaml")
+	require.NoError(t, err)
+	require.NotEmpty(t, scripts)
+	for _, name := range scripts {
+		script, err := pcapgen.LoadScript(name)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, script.Write(&buf))
+		want, err := ioutil.ReadFile(strings.TrimSuffix(name, ".yaml") + ".pcap")
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(want, buf.Bytes()), "%v is out of date, run go run ./zkpcapgen %v", name, name)
+	}
+}
+
+func TestTestdataBasic(t *testing.T) {
+	for _, name := range []string{"basic", "ipv6"} {
+		d := decodeTestdata(t, name)
+		require.Len(t, d.sessions, 1, name)
+		assert.Equal(t, int64(0x15d3f0e0a1b0000), d.sessions[0].ID)
+		assert.Equal(t, 10*time.Second, d.sessions[0].Timeout)
+		assert.Equal(t, []proto.OpType{
+			proto.OpCreate, proto.OpGetData, proto.OpSetData, proto.OpGetChildren2, proto.OpDelete, proto.OpClose,
+		}, d.ops(), name)
+		for _, r := range d.responses {
+			assert.Equal(t, int64(0x15d3f0e0a1b0000), r.Session)
+			assert.Equal(t, zk.ErrCode(0), r.Err)
+		}
+		// The latency is the script's plus the gap between packets
+		assert.Equal(t, 2040*time.Microsecond, d.responses[0].Latency)
+		assert.True(t, d.responses[1].Request.Watch)
+		assert.Equal(t, int64(3), d.responses[4].Zxid)
+		require.Len(t, d.events, 1)
+		assert.Equal(t, zk.EventNodeDataChanged, d.events[0].Type)
+		assert.Equal(t, "/app", d.events[0].Path)
+		assert.Empty(t, d.errors)
+		assert.Equal(t, sniffer.Stats{Packets: 40, Requests: 7, Responses: 6, WatchEvents: 1, Pings: 1}, d.stats, name)
+	}
+	assert.Equal(t, "[fd00::1]:50000", decodeTestdata(t, "ipv6").sessions[0].Client.String())
+}
+
+func TestTestdataErrors(t *testing.T) {
+	d := decodeTestdata(t, "errors")
+	var errs []zk.ErrCode
+	for _, r := range d.responses {
+		errs = append(errs, r.Err)
+		if r.Err != 0 {
+			assert.Nil(t, r.Body)
+		}
+	}
+	assert.Equal(t, []zk.ErrCode{-110, -101, -103, -111, 0}, errs)
+	assert.Equal(t, sniffer.Stats{Packets: 29, Requests: 7, Responses: 5, Pending: 1}, d.stats)
+}
+
+func TestTestdataPipelined(t *testing.T) {
+	d := decodeTestdata(t, "pipelined")
+	// Every frame of a segment is decoded
+	assert.Equal(t, []proto.OpType{proto.OpExists, proto.OpGetData, proto.OpGetChildren, proto.OpGetACL}, d.ops())
+	assert.Empty(t, d.errors)
+	assert.Equal(t, sniffer.Stats{Packets: 11, Requests: 5, Responses: 4}, d.stats)
+}
+
+func TestTestdataFragmented(t *testing.T) {
+	d := decodeTestdata(t, "fragmented")
+	// The frames split over segments are put back together
+	assert.Empty(t, d.errors)
+	assert.Equal(t, []proto.OpType{proto.OpSetData, proto.OpExists}, d.ops())
+	require.Len(t, d.responses, 2)
+	assert.Equal(t, 128, d.responses[0].Request.Size)
+}
+
+func TestTestdataMulti(t *testing.T) {
+	d := decodeTestdata(t, "multi")
+	require.Len(t, d.responses, 2)
+	assert.Empty(t, d.errors)
+	for _, r := range d.responses {
+		assert.Equal(t, proto.OpMulti, r.Request.Op)
+		multi, ok := r.Body.(*proto.MultiResponse)
+		require.True(t, ok)
+		assert.Len(t, multi.Ops, 2)
+	}
+	assert.Equal(t, zk.ErrCode(0), d.responses[0].Err)
+	// A failed multi is answered without an error in the header, it fails with its first failed operation
+	assert.Equal(t, zk.ErrCode(-103), d.responses[1].Err)
+}
+
+func TestTestdataSessions(t *testing.T) {
+	d := decodeTestdata(t, "sessions")
+	require.Len(t, d.sessions, 4)
+	assert.Equal(t, d.sessions[0].ID, d.sessions[2].ID, "the session is resumed on a new connection")
+	assert.NotEqual(t, d.sessions[0].Client, d.sessions[2].Client)
+	assert.Equal(t, 40*time.Second, d.sessions[1].Timeout)
+	assert.True(t, d.sessions[3].Expired)
+	assert.Equal(t, time.Date(2017, 7, 14, 2, 41, 2, int(10720*time.Microsecond), time.UTC), d.sessions[3].Time)
+}
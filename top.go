@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/sniffer"
+
+	"github.com/nsf/termbox-go"
+	"go.uber.org/zap"
+)
+
+const topRefresh = time.Second
+
+// topStats collects the operations of the current refresh window while the top view runs, nil otherwise.
+var topStats *topAggregator
+
+// opWindow is the operations seen for one row of the top view during a refresh window.
+type opWindow struct {
+	count     int
+	errors    int
+	latencies []time.Duration
+}
+
+func (w *opWindow) add(msg *filter.Message) {
+	w.count++
+	if msg.Err != 0 {
+		w.errors++
+	}
+	w.latencies = append(w.latencies, msg.Latency)
+}
+
+type topAggregator struct {
+	start   time.Time
+	ops     map[string]*opWindow
+	clients map[string]*opWindow
+	paths   map[string]*opWindow
+}
+
+func newTopAggregator(start time.Time) *topAggregator {
+	return &topAggregator{
+		start:   start,
+		ops:     make(map[string]*opWindow),
+		clients: make(map[string]*opWindow),
+		paths:   make(map[string]*opWindow),
+	}
+}
+
+// add counts a completed operation. A nil aggregator ignores it.
+func (a *topAggregator) add(r *sniffer.Response, msg *filter.Message) {
+	if a == nil {
+		return
+	}
+	addWindow(a.ops, msg.Op.String(), msg)
+	addWindow(a.clients, r.Request.Client.Host.String(), msg)
+	if msg.Path != "" {
+		addWindow(a.paths, templatePath(msg.Path), msg)
+	}
+}
+
+func addWindow(windows map[string]*opWindow, key string, msg *filter.Message) {
+	w, ok := windows[key]
+	if !ok {
+		w = &opWindow{}
+		windows[key] = w
+	}
+	w.add(msg)
+}
+
+// topRow is a summarised line of the top view.
+type topRow struct {
+	name      string
+	count     int
+	perSecond float64
+	errorRate float64
+	p50       time.Duration
+	p99       time.Duration
+}
+
+type topColumn struct {
+	title string
+	width int
+	less  func(a, b topRow) bool
+}
+
+var topColumns = []topColumn{
+	{"NAME", 0, func(a, b topRow) bool { return a.name < b.name }},
+	{"OPS/S", 10, func(a, b topRow) bool { return a.perSecond < b.perSecond }},
+	{"ERR%", 8, func(a, b topRow) bool { return a.errorRate < b.errorRate }},
+	{"P50", 12, func(a, b topRow) bool { return a.p50 < b.p50 }},
+	{"P99", 12, func(a, b topRow) bool { return a.p99 < b.p99 }},
+}
+
+func summarise(windows map[string]*opWindow, seconds float64) []topRow {
+	rows := make([]topRow, 0, len(windows))
+	for name, w := range windows {
+		sort.Slice(w.latencies, func(i, j int) bool { return w.latencies[i] < w.latencies[j] })
+		rows = append(rows, topRow{
+			name:      name,
+			count:     w.count,
+			perSecond: float64(w.count) / seconds,
+			errorRate: 100 * float64(w.errors) / float64(w.count),
+			p50:       percentile(w.latencies, 0.50),
+			p99:       percentile(w.latencies, 0.99),
+		})
+	}
+	return rows
+}
+
+// percentile returns the nearest rank percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// topSnapshot is everything drawn for one refresh.
+type topSnapshot struct {
+	ops, clients, paths []topRow
+	sessions            int
+	pending             int
+}
+
+// snapshot summarises the window since the last call and starts a new one. The window is measured on the
+// capture clock so offline replays at any speed show the rates of the original traffic.
+func (a *topAggregator) snapshot(now time.Time, pending int) *topSnapshot {
+	seconds := now.Sub(a.start).Seconds()
+	if seconds <= 0 {
+		seconds = topRefresh.Seconds()
+	}
+	expireSessions(now)
+	s := &topSnapshot{
+		ops:      summarise(a.ops, seconds),
+		clients:  summarise(a.clients, seconds),
+		paths:    summarise(a.paths, seconds),
+		sessions: len(connSessions),
+		pending:  pending,
+	}
+	*a = *newTopAggregator(now)
+	return s
+}
+
+// topView is the terminal state of the top view, the sort order and the last snapshot.
+type topView struct {
+	source  string
+	sortBy  int
+	reverse bool
+	last    *topSnapshot
+	done    bool
+}
+
+func (v *topView) sortRows(rows []topRow) {
+	less := topColumns[v.sortBy].less
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		// Names sort ascending and the numbers descending unless reversed
+		if v.sortBy != 0 {
+			a, b = b, a
+		}
+		if v.reverse {
+			a, b = b, a
+		}
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		return rows[i].name < rows[j].name
+	})
+}
+
+func (v *topView) draw() {
+	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+	width, height := termbox.Size()
+	s := v.last
+	if s == nil {
+		s = &topSnapshot{}
+	}
+	var total float64
+	for _, r := range s.ops {
+		total += r.perSecond
+	}
+	status := "live"
+	if v.done {
+		status = "finished"
+	}
+	y := 0
+	printLine(0, y, termbox.AttrBold, fmt.Sprintf("zkpacket top - %v (%v)  ops/s: %.1f  sessions: %v  pending: %v",
+		v.source, status, total, s.sessions, s.pending))
+	y++
+	printLine(0, y, termbox.ColorDefault, fmt.Sprintf("sort: %v (left/right to change, r to reverse, q to quit)", topColumns[v.sortBy].title))
+	y += 2
+
+	// Split what is left of the screen between the three tables
+	rowsEach := (height - y - 6) / 3
+	for _, table := range []struct {
+		title string
+		rows  []topRow
+	}{{"OPERATION", s.ops}, {"CLIENT", s.clients}, {"PATH", s.paths}} {
+		v.sortRows(table.rows)
+		y = v.drawTable(y, width, table.title, table.rows, rowsEach)
+		y++
+	}
+	termbox.Flush()
+}
+
+func (v *topView) drawTable(y, width int, title string, rows []topRow, limit int) int {
+	nameWidth := width
+	for _, c := range topColumns[1:] {
+		nameWidth -= c.width
+	}
+	var header []string
+	for i, c := range topColumns {
+		name := c.title
+		if i == 0 {
+			name = title
+		}
+		if i == v.sortBy {
+			name += "*"
+		}
+		header = append(header, pad(name, columnWidth(c, nameWidth), i == 0))
+	}
+	printLine(0, y, termbox.AttrReverse, pad(strings.Join(header, ""), width, true))
+	y++
+	for i, r := range rows {
+		if i >= limit {
+			break
+		}
+		printLine(0, y, termbox.ColorDefault, pad(r.name, nameWidth, true)+
+			pad(fmt.Sprintf("%.1f", r.perSecond), topColumns[1].width, false)+
+			pad(fmt.Sprintf("%.1f", r.errorRate), topColumns[2].width, false)+
+			pad(r.p50.String(), topColumns[3].width, false)+
+			pad(r.p99.String(), topColumns[4].width, false))
+		y++
+	}
+	return y
+}
+
+func columnWidth(c topColumn, nameWidth int) int {
+	if c.width == 0 {
+		return nameWidth
+	}
+	return c.width
+}
+
+// pad fits the text into width cells, left aligned for names and right aligned for numbers.
+func pad(text string, width int, left bool) string {
+	if width <= 0 {
+		return ""
+	}
+	if len(text) >= width {
+		return text[:width]
+	}
+	if left {
+		return text + strings.Repeat(" ", width-len(text))
+	}
+	return strings.Repeat(" ", width-len(text)) + text
+}
+
+func printLine(x, y int, attr termbox.Attribute, text string) {
+	for _, r := range text {
+		termbox.SetCell(x, y, r, termbox.ColorDefault|attr, termbox.ColorDefault)
+		x++
+	}
+}
+
+// runTop shows a live summary of the traffic, refreshed every second, until the user quits.
+func runTop(args []string) error {
+	// The terminal belongs to the view so nothing else may write to it
+	logger = zap.NewNop()
+	output = ioutil.Discard
+
+	if err := setupFilter(); err != nil {
+		return err
+	}
+	handle, err := openSource(device, readFile)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	view := &topView{source: device, sortBy: 1}
+	if readFile != "" {
+		view.source = readFile
+	} else {
+		speed = 0
+	}
+
+	pool := newPool()
+	topStats = newTopAggregator(time.Time{})
+	captureDone := make(chan struct{})
+	go func() {
+		capturePackets(handle, pool, speed, nil)
+		close(captureDone)
+	}()
+
+	if err := termbox.Init(); err != nil {
+		return err
+	}
+	defer termbox.Close()
+
+	keys := make(chan termbox.Event)
+	go func() {
+		for {
+			keys <- termbox.PollEvent()
+		}
+	}()
+
+	refresh := func() {
+		// The workers lock stateMu while they hold their own lock, so the pool is read first
+		pending := len(pool.Pending())
+		now := clock.now()
+		stateMu.Lock()
+		if topStats.start.IsZero() {
+			topStats.start = now
+		}
+		view.last = topStats.snapshot(now, pending)
+		stateMu.Unlock()
+		view.draw()
+	}
+	ticker := time.NewTicker(topRefresh)
+	defer ticker.Stop()
+	view.draw()
+	for {
+		select {
+		case <-ticker.C:
+			// A finished replay keeps showing its last window
+			if !view.done {
+				refresh()
+			}
+		case <-captureDone:
+			captureDone = nil
+			view.done = true
+			refresh()
+		case ev := <-keys:
+			if ev.Type == termbox.EventResize {
+				view.draw()
+				continue
+			}
+			if ev.Type != termbox.EventKey {
+				continue
+			}
+			switch {
+			case ev.Ch == 'q' || ev.Key == termbox.KeyEsc || ev.Key == termbox.KeyCtrlC:
+				return nil
+			case ev.Key == termbox.KeyArrowRight:
+				view.sortBy = (view.sortBy + 1) % len(topColumns)
+			case ev.Key == termbox.KeyArrowLeft:
+				view.sortBy = (view.sortBy + len(topColumns) - 1) % len(topColumns)
+			case ev.Ch == 'r':
+				view.reverse = !view.reverse
+			}
+			view.draw()
+		}
+	}
+}
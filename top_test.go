@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/proto"
+	"github.com/jeffbean/zkpacket/sniffer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, percentile(latencies, 0.50))
+	assert.Equal(t, 99*time.Millisecond, percentile(latencies, 0.99))
+	assert.Equal(t, time.Duration(0), percentile(nil, 0.99))
+}
+
+func TestTopAggregatorSnapshot(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	a := newTopAggregator(start)
+	c := &sniffer.Response{Request: &sniffer.Request{Client: sniffer.Client{Host: net.ParseIP("10.0.0.1"), Port: 5000}}}
+	a.add(c, &filter.Message{Op: proto.OpGetData, Path: "/a", Latency: time.Millisecond})
+	a.add(c, &filter.Message{Op: proto.OpGetData, Path: "/a", Latency: 3 * time.Millisecond, Err: errNoNode})
+	a.add(c, &filter.Message{Op: proto.OpSetData, Path: "/b", Latency: 2 * time.Millisecond})
+
+	s := a.snapshot(start.Add(2*time.Second), 0)
+	view := &topView{sortBy: 1}
+	view.sortRows(s.ops)
+	assert.Equal(t, []topRow{
+		{name: "OpGetData", count: 2, perSecond: 1, errorRate: 50, p50: time.Millisecond, p99: 3 * time.Millisecond},
+		{name: "OpSetData", count: 1, perSecond: 0.5, p50: 2 * time.Millisecond, p99: 2 * time.Millisecond},
+	}, s.ops)
+	assert.Equal(t, []topRow{{name: "10.0.0.1", count: 3, perSecond: 1.5, errorRate: 100.0 / 3, p50: 2 * time.Millisecond, p99: 3 * time.Millisecond}}, s.clients)
+
+	view.reverse = true
+	view.sortRows(s.paths)
+	assert.Equal(t, "/b", s.paths[0].name)
+
+	// The next window starts empty
+	assert.Empty(t, a.snapshot(start.Add(3*time.Second), 0).ops)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/sniffer"
+)
+
+// outputMu keeps the traces of the workers from interleaving.
+var outputMu sync.Mutex
+
+// traceOperation writes a completed request and response pair to the output.
+func traceOperation(r *sniffer.Response, msg *filter.Message) {
+	line := fmt.Sprintf("%v %v session=%#x xid=%v %v %q watch=%v size=%v err=%v latency=%v\n",
+		r.Request.Time.Format(time.RFC3339Nano), r.Request.Client, msg.Session, msg.Xid, msg.Op, msg.Path, msg.Watch, msg.Size, msg.Err, msg.Latency)
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	io.WriteString(output, line)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/zkerrors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	triggerLatency        = "latency"
+	triggerDecodeError    = "decode-error"
+	triggerSessionExpired = "session-expired"
+	triggerErrPrefix      = "err="
+)
+
+// ringIdleTimeout is how long a connection can go without a packet before its ring is dropped. Connected
+// clients ping well within it, so the connection ended without a close request.
+const ringIdleTimeout = time.Minute
+
+var errSessionExpired, _ = zkerrors.ZKErrCodeFromName("SessionExpired")
+
+// triggerRules are the conditions that dump a connection's recent packets. It implements flag.Value.
+type triggerRules struct {
+	// latency is an explicit latency trigger. When zero the slow operation thresholds are used.
+	latency        time.Duration
+	onLatency      bool
+	onDecodeError  bool
+	onSessionEnded bool
+	errCodes       map[zk.ErrCode]bool
+}
+
+func (t *triggerRules) String() string {
+	var rules []string
+	if t.onLatency {
+		if t.latency > 0 {
+			rules = append(rules, fmt.Sprintf("%v=%v", triggerLatency, t.latency))
+		} else {
+			rules = append(rules, triggerLatency)
+		}
+	}
+	if t.onDecodeError {
+		rules = append(rules, triggerDecodeError)
+	}
+	if t.onSessionEnded {
+		rules = append(rules, triggerSessionExpired)
+	}
+	for ec := range t.errCodes {
+		rules = append(rules, fmt.Sprintf("%v%v", triggerErrPrefix, ec))
+	}
+	return strings.Join(rules, ",")
+}
+
+// Set parses one of latency, latency=<duration>, err=<code or name>, decode-error or session-expired.
+func (t *triggerRules) Set(value string) error {
+	switch {
+	case value == triggerLatency:
+		t.onLatency = true
+	case strings.HasPrefix(value, triggerLatency+"="):
+		d, err := time.ParseDuration(strings.TrimPrefix(value, triggerLatency+"="))
+		if err != nil {
+			return fmt.Errorf("invalid latency trigger %q: %v", value, err)
+		}
+		t.onLatency, t.latency = true, d
+	case strings.HasPrefix(value, triggerErrPrefix):
+		name := strings.TrimPrefix(value, triggerErrPrefix)
+		ec, ok := zkerrors.ZKErrCodeFromName(name)
+		if !ok {
+			var code int32
+			if _, err := fmt.Sscanf(name, "%d", &code); err != nil {
+				return fmt.Errorf("unknown error code in trigger %q", value)
+			}
+			ec = zk.ErrCode(code)
+		}
+		if t.errCodes == nil {
+			t.errCodes = make(map[zk.ErrCode]bool)
+		}
+		t.errCodes[ec] = true
+	case value == triggerDecodeError:
+		t.onDecodeError = true
+	case value == triggerSessionExpired:
+		t.onSessionEnded = true
+	default:
+		return fmt.Errorf("unknown trigger %q", value)
+	}
+	return nil
+}
+
+// triggerReason returns why a completed operation should dump its connection, if it should.
+func (t *triggerRules) triggerReason(msg *filter.Message) (string, bool) {
+	if t.onSessionEnded && msg.Err == errSessionExpired {
+		return triggerSessionExpired, true
+	}
+	if t.errCodes[msg.Err] {
+		return fmt.Sprintf("err%d", -msg.Err), true
+	}
+	if t.onLatency {
+		threshold, ok := t.latency, t.latency > 0
+		if !ok {
+			threshold, ok = thresholds.thresholdFor(msg.Op, msg.Path)
+		}
+		if ok && msg.Latency > threshold {
+			return triggerLatency, true
+		}
+	}
+	return "", false
+}
+
+type capturedPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// packetRing holds the most recent packets of a single connection.
+type packetRing struct {
+	packets []capturedPacket
+	next    int
+	// last is the capture time of the newest packet
+	last time.Time
+	// lastDump rate limits how often the same connection is written out
+	lastDump time.Time
+}
+
+func (r *packetRing) add(p capturedPacket) {
+	if len(r.packets) < cap(r.packets) {
+		r.packets = append(r.packets, p)
+		return
+	}
+	r.packets[r.next] = p
+	r.next = (r.next + 1) % len(r.packets)
+}
+
+// ordered returns the packets oldest first.
+func (r *packetRing) ordered() []capturedPacket {
+	return append(append([]capturedPacket{}, r.packets[r.next:]...), r.packets[:r.next]...)
+}
+
+// packetDumper keeps a ring of recent raw packets per connection and writes them to a pcap file when a trigger fires.
+// A nil packetDumper records and dumps nothing.
+type packetDumper struct {
+	dir      string
+	size     int
+	cooldown time.Duration
+	linkType layers.LinkType
+	snapLen  uint32
+	rules    *triggerRules
+	rings    map[string]*packetRing
+	// swept is the capture time idle rings were last dropped at
+	swept time.Time
+	// writes are the dumps being written, the files are written outside stateMu
+	writes sync.WaitGroup
+}
+
+func newPacketDumper(dir string, size int, cooldown time.Duration, rules *triggerRules, linkType layers.LinkType, snapLen uint32) (*packetDumper, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("the trigger ring size must be at least 1, got %v", size)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &packetDumper{
+		dir:      dir,
+		size:     size,
+		cooldown: cooldown,
+		linkType: linkType,
+		snapLen:  snapLen,
+		rules:    rules,
+		rings:    make(map[string]*packetRing),
+	}, nil
+}
+
+// record adds the raw packet to the ring of the connection it belongs to.
+func (d *packetDumper) record(conn string, ci gopacket.CaptureInfo, data []byte) {
+	if d == nil {
+		return
+	}
+	ring, ok := d.rings[conn]
+	if !ok {
+		ring = &packetRing{packets: make([]capturedPacket, 0, d.size)}
+		d.rings[conn] = ring
+	}
+	ring.add(capturedPacket{ci: ci, data: data})
+	ring.last = ci.Timestamp
+	if ci.Timestamp.Sub(d.swept) >= ringIdleTimeout {
+		d.sweep(ci.Timestamp)
+	}
+}
+
+// sweep drops the rings of connections that ended without a close request, idle since before now.
+func (d *packetDumper) sweep(now time.Time) {
+	d.swept = now
+	for conn, ring := range d.rings {
+		if now.Sub(ring.last) >= ringIdleTimeout {
+			delete(d.rings, conn)
+		}
+	}
+}
+
+// forget drops the ring of a closed connection.
+func (d *packetDumper) forget(conn string) {
+	if d == nil {
+		return
+	}
+	delete(d.rings, conn)
+}
+
+// checkOperation dumps the connection when the completed operation matches the filter and a trigger.
+func (d *packetDumper) checkOperation(conn string, msg *filter.Message) {
+	if d == nil || !opFilter.Match(msg) {
+		return
+	}
+	if reason, ok := d.rules.triggerReason(msg); ok {
+		d.dump(conn, reason)
+	}
+}
+
+// decodeFailed dumps the connection if decode errors are a trigger.
+func (d *packetDumper) decodeFailed(conn string) {
+	if d == nil || !d.rules.onDecodeError {
+		return
+	}
+	d.dump(conn, triggerDecodeError)
+}
+
+// sessionExpired dumps the connection if session expiry is a trigger.
+func (d *packetDumper) sessionExpired(conn string) {
+	if d == nil || !d.rules.onSessionEnded {
+		return
+	}
+	d.dump(conn, triggerSessionExpired)
+}
+
+func (d *packetDumper) dump(conn, reason string) {
+	ring, ok := d.rings[conn]
+	if !ok || len(ring.packets) == 0 {
+		return
+	}
+	packets := ring.ordered()
+	last := packets[len(packets)-1].ci.Timestamp
+	if !ring.lastDump.IsZero() && last.Sub(ring.lastDump) < d.cooldown {
+		return
+	}
+	ring.lastDump = last
+
+	name := fmt.Sprintf("zkpacket-%v-%v-%v.pcap", last.UTC().Format("20060102T150405.000"), strings.Replace(conn, ":", "_", -1), reason)
+	d.writes.Add(1)
+	go func() {
+		defer d.writes.Done()
+		d.write(filepath.Join(d.dir, name), conn, reason, packets)
+	}()
+}
+
+// write writes a dump of the packets, a copy of the ring taken when the trigger fired.
+func (d *packetDumper) write(fileName, conn, reason string, packets []capturedPacket) {
+	if err := d.writeFile(fileName, packets); err != nil {
+		logger.Error("failed to write triggered capture", zap.String("file", fileName), zap.Error(err))
+		return
+	}
+	triggeredCaptureCounter.With(prometheus.Labels{"reason": reason}).Inc()
+	logger.Info("wrote triggered capture",
+		zap.String("file", fileName),
+		zap.String("reason", reason),
+		zap.String("client", conn),
+		zap.Int("packets", len(packets)),
+	)
+}
+
+// wait blocks until the dumps already triggered are written.
+func (d *packetDumper) wait() {
+	if d == nil {
+		return
+	}
+	d.writes.Wait()
+}
+
+func (d *packetDumper) writeFile(fileName string, packets []capturedPacket) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(d.snapLen, d.linkType); err != nil {
+		return err
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p.ci, p.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffbean/zkpacket/filter"
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPacketRingKeepsNewest(t *testing.T) {
+	r := &packetRing{packets: make([]capturedPacket, 0, 3)}
+	for i := 0; i < 5; i++ {
+		r.add(capturedPacket{data: []byte{byte(i)}})
+	}
+	var got []byte
+	for _, p := range r.ordered() {
+		got = append(got, p.data...)
+	}
+	assert.Equal(t, []byte{2, 3, 4}, got)
+}
+
+func TestTriggerRules(t *testing.T) {
+	var rules triggerRules
+	require.NoError(t, rules.Set("latency=100ms"))
+	require.NoError(t, rules.Set("err=NoNode"))
+	require.NoError(t, rules.Set("session-expired"))
+	assert.Error(t, rules.Set("err=bogus"))
+	assert.Error(t, rules.Set("sometimes"))
+
+	reason, ok := rules.triggerReason(&filter.Message{Op: proto.OpGetData, Latency: 200 * time.Millisecond})
+	assert.True(t, ok)
+	assert.Equal(t, triggerLatency, reason)
+
+	reason, ok = rules.triggerReason(&filter.Message{Op: proto.OpGetData, Err: -101})
+	assert.True(t, ok)
+	assert.Equal(t, "err101", reason)
+
+	reason, ok = rules.triggerReason(&filter.Message{Op: proto.OpGetData, Err: errSessionExpired})
+	assert.True(t, ok)
+	assert.Equal(t, triggerSessionExpired, reason)
+
+	_, ok = rules.triggerReason(&filter.Message{Op: proto.OpGetData, Latency: time.Millisecond})
+	assert.False(t, ok)
+}
+
+func TestPacketDumperWritesPcap(t *testing.T) {
+	logger = zap.NewNop()
+	dir, err := ioutil.TempDir("", "zkpacket-trigger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rules := &triggerRules{onDecodeError: true}
+	d, err := newPacketDumper(dir, 2, time.Minute, rules, layers.LinkTypeEthernet, 1024)
+	require.NoError(t, err)
+
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 3; i++ {
+		data := []byte{byte(i), 0xff}
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Second), CaptureLength: len(data), Length: len(data)}
+		d.record("10.0.0.1:5000", ci, data)
+	}
+	d.decodeFailed("10.0.0.1:5000")
+	// The cooldown stops a second dump of the same connection
+	d.decodeFailed("10.0.0.1:5000")
+	// The dump is a copy of the ring when it fired, later packets aren't in it
+	d.record("10.0.0.1:5000", gopacket.CaptureInfo{Timestamp: start.Add(3 * time.Second), CaptureLength: 2, Length: 2}, []byte{3, 0xff})
+	d.wait()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pcap"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Contains(t, files[0], "10.0.0.1_5000-decode-error")
+
+	f, err := os.Open(files[0])
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	require.NoError(t, err)
+	var got []byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		got = append(got, data[0])
+	}
+	assert.Equal(t, []byte{1, 2}, got)
+}
+
+func TestPacketDumperRings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkpacket-trigger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, size := range []int{0, -1} {
+		_, err := newPacketDumper(dir, size, time.Minute, &triggerRules{}, layers.LinkTypeEthernet, 1024)
+		assert.Error(t, err, "ring size %v", size)
+	}
+
+	d, err := newPacketDumper(dir, 1, time.Minute, &triggerRules{}, layers.LinkTypeEthernet, 1024)
+	require.NoError(t, err)
+	start := time.Unix(1500000000, 0)
+	record := func(conn string, at time.Duration) {
+		d.record(conn, gopacket.CaptureInfo{Timestamp: start.Add(at), CaptureLength: 1, Length: 1}, []byte{1})
+	}
+	record("10.0.0.1:5000", 0)
+	record("10.0.0.2:5000", 0)
+	record("10.0.0.1:5000", 2*time.Second)
+	assert.Len(t, d.rings, 2)
+
+	// The first connection keeps pinging while the second one is gone
+	for at := 10 * time.Second; at <= 2*ringIdleTimeout; at += 10 * time.Second {
+		record("10.0.0.1:5000", at)
+	}
+	assert.Len(t, d.rings, 1)
+	assert.Contains(t, d.rings, "10.0.0.1:5000")
+}
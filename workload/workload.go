@@ -0,0 +1,127 @@
+// Package workload describes the operations ZooKeeper sessions ran, in a file `zkpacket record -format workload`
+// writes from captured traffic and zkload replays against another ensemble.
+package workload
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"gopkg.in/yaml.v2"
+)
+
+// Workload is the operations of sessions, read from and written to YAML:
+//
+//	start: 2017-07-14T02:40:00Z
+//	sessions:
+//	- id: 0x15d3f0e0a1b0000
+//	  client: 10.0.0.1:50000
+//	  timeout: 10s
+//	  ops:
+//	  - {at: 0s, op: OpCreate, path: /app, size: 5, version: -1}
+//	  - {at: 5ms, op: OpGetData, path: /app, watch: true}
+//	  - {at: 9ms, op: OpExists, path: /b, err: -101}
+type Workload struct {
+	// Start is the time of the first operation
+	Start    time.Time  `yaml:"start"`
+	Sessions []*Session `yaml:"sessions"`
+}
+
+// Session is the operations of a session in the order they were sent.
+type Session struct {
+	// ID is the recorded session id, zero when the connect was not captured
+	ID      int64         `yaml:"id"`
+	Client  string        `yaml:"client"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	Ops     []Op          `yaml:"ops"`
+}
+
+// Op is a request and what the server answered.
+type Op struct {
+	// At is the time since the start of the workload the request was sent, not set for the operations of a multi
+	At time.Duration `yaml:"at,omitempty"`
+	// Op is the operation name, e.g. OpGetData
+	Op    string `yaml:"op"`
+	Path  string `yaml:"path,omitempty"`
+	Watch bool   `yaml:"watch,omitempty"`
+	// Size is the length of the data sent with a create or setData
+	Size int `yaml:"size,omitempty"`
+	// Data is the data sent, only kept when recorded with data
+	Data    string `yaml:"data,omitempty"`
+	Version int32  `yaml:"version,omitempty"`
+	// Flags are the create flags, zk.FlagEphemeral and zk.FlagSequence
+	Flags int32 `yaml:"flags,omitempty"`
+	Ops   []Op  `yaml:"ops,omitempty"`
+	// Err is the error code the server answered with
+	Err zk.ErrCode `yaml:"err,omitempty"`
+	// NoResponse is set when the response was not seen, Err is unknown then
+	NoResponse bool `yaml:"no_response,omitempty"`
+}
+
+// Type is the operation type, false for an unknown name.
+func (o *Op) Type() (proto.OpType, bool) {
+	return proto.OpTypeFromName(o.Op)
+}
+
+// Payload is the data to send with the operation, zeros of the recorded size when the data was not kept.
+func (o *Op) Payload() []byte {
+	if o.Data != "" || o.Size == 0 {
+		return []byte(o.Data)
+	}
+	return make([]byte, o.Size)
+}
+
+// Len is the number of operations of all sessions.
+func (w *Workload) Len() int {
+	var n int
+	for _, s := range w.Sessions {
+		n += len(s.Ops)
+	}
+	return n
+}
+
+// Load reads a workload file.
+func Load(fileName string) (*Workload, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	w := &Workload{}
+	if err := yaml.UnmarshalStrict(data, w); err != nil {
+		return nil, fmt.Errorf("invalid workload %v: %v", fileName, err)
+	}
+	for _, s := range w.Sessions {
+		for i := range s.Ops {
+			if err := s.Ops[i].validate(); err != nil {
+				return nil, fmt.Errorf("invalid workload %v: session %#x: %v", fileName, s.ID, err)
+			}
+		}
+	}
+	return w, nil
+}
+
+func (o *Op) validate() error {
+	if _, ok := o.Type(); !ok {
+		return fmt.Errorf("unknown operation %q", o.Op)
+	}
+	for i := range o.Ops {
+		if err := o.Ops[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes the workload as YAML.
+func (w *Workload) Write(out io.Writer) error {
+	data, err := yaml.Marshal(w)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
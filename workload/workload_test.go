@@ -0,0 +1,61 @@
+package workload
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "workload")
+	require.NoError(t, err)
+	name := filepath.Join(dir, "workload.yaml")
+	require.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+	return name
+}
+
+func TestWriteLoad(t *testing.T) {
+	w := &Workload{
+		Start: time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC),
+		Sessions: []*Session{{ID: 0x15d3f0e0a1b0000, Client: "10.0.0.1:50000", Timeout: 10 * time.Second, Ops: []Op{
+			{Op: "OpCreate", Path: "/app", Size: 3, Data: "\x00\xff\x01", Flags: 1},
+			{At: 1500 * time.Microsecond, Op: "OpMulti", Ops: []Op{{Op: "OpCheck", Path: "/app", Version: 2}}},
+			{At: time.Second, Op: "OpExists", Path: "/b", Watch: true, Err: -101, NoResponse: true},
+		}}},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, w.Write(&buf))
+	assert.Contains(t, buf.String(), "at: 1.5ms")
+
+	name := writeFile(t, buf.String())
+	defer os.RemoveAll(filepath.Dir(name))
+	got, err := Load(name)
+	require.NoError(t, err)
+	assert.Equal(t, w, got)
+	assert.Equal(t, 3, got.Len())
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, content := range []string{
+		"sessions: [{ops: [{op: fly}]}]",
+		"sessions: [{ops: [{op: OpMulti, ops: [{op: fly}]}]}]",
+		"sessions: [{ops: [{op: OpCreate, color: red}]}]",
+	} {
+		name := writeFile(t, content)
+		_, err := Load(name)
+		assert.Error(t, err, content)
+		os.RemoveAll(filepath.Dir(name))
+	}
+}
+
+func TestPayload(t *testing.T) {
+	assert.Equal(t, []byte("abc"), (&Op{Size: 3, Data: "abc"}).Payload())
+	assert.Equal(t, make([]byte, 4), (&Op{Size: 4}).Payload(), "zeros of the recorded size without data")
+	assert.Equal(t, []byte{}, (&Op{}).Payload())
+}
@@ -1,6 +1,10 @@
 package zkerrors
 
-import "github.com/jeffbean/go-zookeeper/zk"
+import (
+	"strings"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+)
 
 const (
 	// ErrOk The OK Error code from ZK packets
@@ -50,6 +54,41 @@ var errCodeToString = map[zk.ErrCode]string{
 	errSessionMoved:            "session moved to another server, so operation is ignored",
 }
 
+var errNameToCode = map[string]zk.ErrCode{
+	"ok":                      ErrOk,
+	"systemerror":             errSystemError,
+	"runtimeinconsistency":    errRuntimeInconsistency,
+	"datainconsistency":       errDataInconsistency,
+	"connectionloss":          errConnectionLoss,
+	"marshallingerror":        errMarshallingError,
+	"unimplemented":           errUnimplemented,
+	"operationtimeout":        errOperationTimeout,
+	"badarguments":            errBadArguments,
+	"invalidstate":            errInvalidState,
+	"apierror":                errAPIError,
+	"nonode":                  errNoNode,
+	"noauth":                  errNoAuth,
+	"badversion":              errBadVersion,
+	"nochildrenforephemerals": errNoChildrenForEphemerals,
+	"nodeexists":              errNodeExists,
+	"notempty":                errNotEmpty,
+	"sessionexpired":          errSessionExpired,
+	"invalidcallback":         errInvalidCallback,
+	"invalidacl":              errInvalidACL,
+	"authfailed":              errAuthFailed,
+	"closing":                 errClosing,
+	"nothing":                 errNothing,
+	"sessionmoved":            errSessionMoved,
+}
+
+// ZKErrCodeFromName looks up an error code by its ZooKeeper name, e.g. "NoNode" or "ErrNoNode".
+// The lookup ignores case.
+func ZKErrCodeFromName(name string) (zk.ErrCode, bool) {
+	name = strings.ToLower(name)
+	ec, ok := errNameToCode[strings.TrimPrefix(name, "err")]
+	return ec, ok
+}
+
 // ZKErrCodeToMessage converts the ZK error code to a message
 func ZKErrCodeToMessage(ec zk.ErrCode) string {
 	if errString, ok := errCodeToString[ec]; ok {
@@ -11,3 +11,16 @@ func TestErrors(t *testing.T) {
 	assert.Equal(t, ZKErrCodeToMessage(errAPIError), "api error")
 	assert.Equal(t, ZKErrCodeToMessage(9999), "unknown error")
 }
+
+func TestErrCodeFromName(t *testing.T) {
+	ec, ok := ZKErrCodeFromName("NoNode")
+	assert.True(t, ok)
+	assert.Equal(t, errNoNode, ec)
+
+	ec, ok = ZKErrCodeFromName("ErrSessionExpired")
+	assert.True(t, ok)
+	assert.Equal(t, errSessionExpired, ec)
+
+	_, ok = ZKErrCodeFromName("NotAnError")
+	assert.False(t, ok)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jeffbean/zkpacket/pcapgen"
+)
+
+// zkpcapgen writes the pcaps of scripted ZooKeeper conversations, see the pcapgen package for the script format.
+func main() {
+	out := flag.String("o", "", "pcap file to write, by default the script file with a .pcap extension")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: zkpcapgen [-o file.pcap] script.yaml...\n\nWrites the pcap of each scripted ZooKeeper conversation.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(flag.Args(), *out); err != nil {
+		fmt.Fprintln(os.Stderr, "zkpcapgen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(scripts []string, out string) error {
+	if len(scripts) == 0 {
+		return errors.New("no script given")
+	}
+	if out != "" && len(scripts) > 1 {
+		return errors.New("-o needs a single script")
+	}
+	for _, name := range scripts {
+		pcapName := out
+		if pcapName == "" {
+			pcapName = strings.TrimSuffix(name, ".yaml") + ".pcap"
+		}
+		if err := generate(name, pcapName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generate(scriptName, pcapName string) error {
+	script, err := pcapgen.LoadScript(scriptName)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(pcapName)
+	if err != nil {
+		return err
+	}
+	if err := script.Write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("%v: %v", scriptName, err)
+	}
+	return f.Close()
+}
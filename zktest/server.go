@@ -0,0 +1,661 @@
+// Package zktest runs an in-memory ZooKeeper server for tests. It speaks enough of the client protocol for
+// go-zookeeper, zkload and the sniffer: sessions, create, delete, get, set, exists, children, ACLs, sync,
+// watches, multi and ephemeral nodes. It is a single server without persistence, quorum or authentication
+// and ACLs are stored but not enforced.
+package zktest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jeffbean/zkpacket/proto"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+)
+
+const (
+	// tickTime is the server tick, session timeouts are negotiated between 2 and 20 ticks like ZooKeeper
+	tickTime   = 2 * time.Second
+	minTimeout = 2 * tickTime
+	maxTimeout = 20 * tickTime
+
+	// maxFrameSize is the largest request accepted, ZooKeeper's jute.maxbuffer plus room for the request
+	maxFrameSize = 1<<20 + 1<<12
+	// writeTimeout bounds a write to a client that stopped reading
+	writeTimeout = 5 * time.Second
+
+	// syncConnected is the state of watch events sent to a connected client
+	syncConnected = 3
+)
+
+var errFrameTooLarge = errors.New("frame too large")
+
+type watchKind int
+
+const (
+	dataWatch watchKind = iota
+	existWatch
+	childWatch
+)
+
+// watchKinds are the watches each event type fires.
+var watchKinds = map[zk.EventType][]watchKind{
+	zk.EventNodeCreated:         {existWatch},
+	zk.EventNodeDeleted:         {dataWatch, existWatch, childWatch},
+	zk.EventNodeDataChanged:     {dataWatch, existWatch},
+	zk.EventNodeChildrenChanged: {childWatch},
+}
+
+// Server is an in-memory ZooKeeper server listening on localhost.
+type Server struct {
+	// Addr is the address clients connect to, host:port
+	Addr string
+
+	l  net.Listener
+	wg sync.WaitGroup
+
+	mu          sync.Mutex
+	tree        *tree
+	sessions    map[int64]*session
+	nextSession int64
+	conns       map[*serverConn]bool
+	watches     map[watchKind]map[string]map[*serverConn]bool
+	closed      bool
+}
+
+type session struct {
+	id      int64
+	passwd  []byte
+	timeout time.Duration
+	conn    *serverConn
+	// expiry expires the session once it has been disconnected for its timeout
+	expiry *time.Timer
+}
+
+type serverConn struct {
+	net.Conn
+	session *session
+	buf     []byte
+}
+
+// NewServer starts a server on a free localhost port.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:        l.Addr().String(),
+		l:           l,
+		tree:        newTree(),
+		sessions:    make(map[int64]*session),
+		nextSession: 0x100000000,
+		conns:       make(map[*serverConn]bool),
+		watches: map[watchKind]map[string]map[*serverConn]bool{
+			dataWatch:  {},
+			existWatch: {},
+			childWatch: {},
+		},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Close stops the server and drops every connection and session.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.l.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	for _, sess := range s.sessions {
+		if sess.expiry != nil {
+			sess.expiry.Stop()
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// ExpireSession expires the session as if its client had been gone for the whole timeout: its connection is
+// dropped, its ephemeral nodes deleted and a reconnect is told the session expired. It returns false for an
+// unknown session.
+func (s *Server) ExpireSession(id int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if ok {
+		s.expire(sess)
+	}
+	return ok
+}
+
+// Sessions returns the ids of the live sessions.
+func (s *Server) Sessions() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]int64, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Get returns the data of the node and whether it exists.
+func (s *Server) Get(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.tree.nodes[path]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), n.data...), true
+}
+
+// Children returns the sorted children of the node and whether it exists.
+func (s *Server) Children(path string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.children(path)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		c := &serverConn{Conn: conn, buf: make([]byte, 4096)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c *serverConn) {
+	defer s.wg.Done()
+	defer s.disconnect(c)
+
+	frame, err := readFrame(c)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	ok := s.connect(c, frame)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	for {
+		frame, err := readFrame(c)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		closing := s.request(c, frame)
+		s.mu.Unlock()
+		if closing {
+			return
+		}
+	}
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// connect answers the handshake with a new session, the resumed session or an expired session.
+func (s *Server) connect(c *serverConn, frame []byte) bool {
+	req := &proto.ConnectRequest{}
+	if _, err := zk.DecodePacket(frame, req); err != nil {
+		return false
+	}
+	timeout := time.Duration(req.TimeOut) * time.Millisecond
+	if timeout < minTimeout {
+		timeout = minTimeout
+	}
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+
+	var sess *session
+	if req.SessionID != 0 {
+		sess = s.sessions[req.SessionID]
+		if sess == nil || string(sess.passwd) != string(req.Passwd) {
+			// The server answers a reconnect to an expired session with an empty session and hangs up
+			s.write(c, &proto.ConnectResponse{Passwd: make([]byte, 16)})
+			return false
+		}
+		if sess.expiry != nil {
+			sess.expiry.Stop()
+			sess.expiry = nil
+		}
+		if sess.conn != nil {
+			sess.conn.Close()
+		}
+	} else {
+		id := s.nextSession
+		s.nextSession++
+		passwd := make([]byte, 16)
+		binary.BigEndian.PutUint64(passwd, uint64(id))
+		sess = &session{id: id, passwd: passwd}
+		s.sessions[id] = sess
+	}
+	sess.timeout = timeout
+	sess.conn = c
+	c.session = sess
+	return s.write(c, &proto.ConnectResponse{
+		TimeOut:   int32(timeout / time.Millisecond),
+		SessionID: sess.id,
+		Passwd:    sess.passwd,
+	})
+}
+
+// disconnect forgets the connection's watches and starts the expiry of its session.
+func (s *Server) disconnect(c *serverConn) {
+	c.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	for _, paths := range s.watches {
+		for p, conns := range paths {
+			delete(conns, c)
+			if len(conns) == 0 {
+				delete(paths, p)
+			}
+		}
+	}
+	sess := c.session
+	if sess == nil || sess.conn != c || s.sessions[sess.id] != sess || s.closed {
+		return
+	}
+	sess.conn = nil
+	sess.expiry = time.AfterFunc(sess.timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.sessions[sess.id] == sess && sess.conn == nil {
+			s.expire(sess)
+		}
+	})
+}
+
+// expire ends the session and deletes its ephemeral nodes.
+func (s *Server) expire(sess *session) {
+	delete(s.sessions, sess.id)
+	if sess.expiry != nil {
+		sess.expiry.Stop()
+	}
+	if sess.conn != nil {
+		sess.conn.Close()
+	}
+	for _, p := range s.tree.ephemerals(sess.id) {
+		events, _ := s.tree.delete(p, -1)
+		s.fire(events)
+	}
+}
+
+// request handles a request and returns whether the connection is closing.
+func (s *Server) request(c *serverConn, frame []byte) bool {
+	header := &proto.RequestHeader{}
+	if len(frame) < proto.RequestHeaderByteLength {
+		return true
+	}
+	if _, err := zk.DecodePacket(frame[:proto.RequestHeaderByteLength], header); err != nil {
+		return true
+	}
+	body := frame[proto.RequestHeaderByteLength:]
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	t := s.tree
+
+	switch header.Opcode {
+	case proto.OpPing:
+		return !s.respond(c, header.Xid, errOk)
+	case proto.OpClose:
+		s.expire(c.session)
+		s.respond(c, header.Xid, errOk)
+		return true
+	case proto.OpCreate:
+		req := &createRequest{}
+		if !decode(body, req) {
+			return true
+		}
+		p, events, code := t.create(req.Path, req.Data, req.Acl, req.Flags, c.session.id, now)
+		s.fire(events)
+		return !s.respond(c, header.Xid, code, &pathResponse{Path: p})
+	case proto.OpDelete:
+		req := &pathVersionRequest{}
+		if !decode(body, req) {
+			return true
+		}
+		events, code := t.delete(req.Path, req.Version)
+		s.fire(events)
+		return !s.respond(c, header.Xid, code)
+	case proto.OpExists:
+		req := &pathWatchRequest{}
+		if !decode(body, req) {
+			return true
+		}
+		stat, ok := t.stat(req.Path)
+		if req.Watch {
+			// Like ZooKeeper an exists watch on a node is a data watch
+			kind := dataWatch
+			if !ok {
+				kind = existWatch
+			}
+			s.watch(kind, req.Path, c)
+		}
+		if !ok {
+			return !s.respond(c, header.Xid, errNoNode)
+		}
+		return !s.respond(c, header.Xid, errOk, &statResponse{Stat: stat})
+	case proto.OpGetData:
+		req := &pathWatchRequest{}
+		if !decode(body, req) {
+			return true
+		}
+		n, ok := t.nodes[req.Path]
+		if !ok {
+			return !s.respond(c, header.Xid, errNoNode)
+		}
+		if req.Watch {
+			s.watch(dataWatch, req.Path, c)
+		}
+		return !s.respond(c, header.Xid, errOk, &getDataResponse{Data: n.data, Stat: n.currentStat()})
+	case proto.OpSetData:
+		req := &setDataRequest{}
+		if !decode(body, req) {
+			return true
+		}
+		stat, events, code := t.setData(req.Path, req.Data, req.Version, now)
+		s.fire(events)
+		return !s.respond(c, header.Xid, code, &statResponse{Stat: stat})
+	case proto.OpGetACL:
+		req := &pathRequest{}
+		if !decode(body, req) {
+			return true
+		}
+		n, ok := t.nodes[req.Path]
+		if !ok {
+			return !s.respond(c, header.Xid, errNoNode)
+		}
+		return !s.respond(c, header.Xid, errOk, &getACLResponse{Acl: n.acl, Stat: n.currentStat()})
+	case proto.OpSetACL:
+		req := &setACLRequest{}
+		if !decode(body, req) {
+			return true
+		}
+		stat, code := t.setACL(req.Path, req.Acl, req.Version)
+		return !s.respond(c, header.Xid, code, &statResponse{Stat: stat})
+	case proto.OpGetChildren, proto.OpGetChildren2:
+		req := &pathWatchRequest{}
+		if !decode(body, req) {
+			return true
+		}
+		children, ok := t.children(req.Path)
+		if !ok {
+			return !s.respond(c, header.Xid, errNoNode)
+		}
+		if req.Watch {
+			s.watch(childWatch, req.Path, c)
+		}
+		if header.Opcode == proto.OpGetChildren {
+			return !s.respond(c, header.Xid, errOk, &getChildrenResponse{Children: children})
+		}
+		stat, _ := t.stat(req.Path)
+		return !s.respond(c, header.Xid, errOk, &getChildren2Response{Children: children, Stat: stat})
+	case proto.OpSync:
+		req := &pathRequest{}
+		if !decode(body, req) {
+			return true
+		}
+		return !s.respond(c, header.Xid, errOk, &pathResponse{Path: req.Path})
+	case proto.OpSetWatches:
+		req := &setWatchesRequest{}
+		if !decode(body, req) {
+			return true
+		}
+		s.setWatches(c, req)
+		return !s.respond(c, header.Xid, errOk)
+	case proto.OpMulti:
+		return !s.multi(c, header.Xid, body, now)
+	default:
+		return !s.respond(c, header.Xid, errUnimplemented)
+	}
+}
+
+// multiOp is an operation of a multi request.
+type multiOp struct {
+	op   proto.OpType
+	body interface{}
+}
+
+// multi runs the operations atomically. When one fails the tree is rolled back, the operations before it
+// answer ok, the failed one its error and the ones after a runtime inconsistency, like ZooKeeper.
+func (s *Server) multi(c *serverConn, xid int32, body []byte, now int64) bool {
+	var ops []multiOp
+	for {
+		header := &multiHeader{}
+		n, err := zk.DecodePacket(body, header)
+		if err != nil {
+			return false
+		}
+		body = body[n:]
+		if header.Done {
+			break
+		}
+		op := multiOp{op: proto.OpType(header.Type)}
+		switch op.op {
+		case proto.OpCreate:
+			op.body = &createRequest{}
+		case proto.OpDelete, proto.OpCheck:
+			op.body = &pathVersionRequest{}
+		case proto.OpSetData:
+			op.body = &setDataRequest{}
+		default:
+			return s.respond(c, xid, errUnimplemented)
+		}
+		n, err = zk.DecodePacket(body, op.body)
+		if err != nil {
+			return false
+		}
+		body = body[n:]
+		ops = append(ops, op)
+	}
+
+	saved := s.tree.clone()
+	var results []interface{}
+	var events []event
+	failed := -1
+	var failure zk.ErrCode
+	for i, op := range ops {
+		var code zk.ErrCode
+		switch req := op.body.(type) {
+		case *createRequest:
+			var p string
+			var evs []event
+			p, evs, code = s.tree.create(req.Path, req.Data, req.Acl, req.Flags, c.session.id, now)
+			events = append(events, evs...)
+			results = append(results, &multiHeader{Type: int32(op.op)}, &pathResponse{Path: p})
+		case *setDataRequest:
+			var stat zk.Stat
+			var evs []event
+			stat, evs, code = s.tree.setData(req.Path, req.Data, req.Version, now)
+			events = append(events, evs...)
+			results = append(results, &multiHeader{Type: int32(op.op)}, &stat)
+		case *pathVersionRequest:
+			if op.op == proto.OpDelete {
+				var evs []event
+				evs, code = s.tree.delete(req.Path, req.Version)
+				events = append(events, evs...)
+			} else {
+				code = s.tree.check(req.Path, req.Version)
+			}
+			results = append(results, &multiHeader{Type: int32(op.op)})
+		}
+		if code != errOk {
+			failed, failure = i, code
+			break
+		}
+	}
+	if failed >= 0 {
+		s.tree = saved
+		results = results[:0]
+		for i := range ops {
+			code := errOk
+			switch {
+			case i == failed:
+				code = failure
+			case i > failed:
+				code = errRuntimeInconsistency
+			}
+			results = append(results, &multiHeader{Type: int32(proto.OpError), Err: code}, &errorResponse{Err: code})
+		}
+	} else {
+		s.fire(events)
+	}
+	// Like ZooKeeper, a failed multi is answered with an ok header and the errors in the results
+	results = append(results, &multiHeader{Type: -1, Done: true, Err: -1})
+	return s.respond(c, xid, errOk, results...)
+}
+
+func decode(buf []byte, st interface{}) bool {
+	_, err := zk.DecodePacket(buf, st)
+	return err == nil
+}
+
+func (s *Server) watch(kind watchKind, path string, c *serverConn) {
+	conns, ok := s.watches[kind][path]
+	if !ok {
+		conns = make(map[*serverConn]bool)
+		s.watches[kind][path] = conns
+	}
+	conns[c] = true
+}
+
+// setWatches restores the watches of a reconnected client. Watches on nodes that changed while it was away
+// fire straight away.
+func (s *Server) setWatches(c *serverConn, req *setWatchesRequest) {
+	for _, p := range req.DataWatches {
+		n, ok := s.tree.nodes[p]
+		switch {
+		case !ok:
+			s.notify(c, event{zk.EventNodeDeleted, p})
+		case n.stat.Mzxid > req.RelativeZxid:
+			s.notify(c, event{zk.EventNodeDataChanged, p})
+		default:
+			s.watch(dataWatch, p, c)
+		}
+	}
+	for _, p := range req.ExistWatches {
+		if _, ok := s.tree.nodes[p]; ok {
+			s.notify(c, event{zk.EventNodeCreated, p})
+		} else {
+			s.watch(existWatch, p, c)
+		}
+	}
+	for _, p := range req.ChildWatches {
+		n, ok := s.tree.nodes[p]
+		switch {
+		case !ok:
+			s.notify(c, event{zk.EventNodeDeleted, p})
+		case n.stat.Pzxid > req.RelativeZxid:
+			s.notify(c, event{zk.EventNodeChildrenChanged, p})
+		default:
+			s.watch(childWatch, p, c)
+		}
+	}
+}
+
+// fire notifies and clears the watches the events trigger. A client gets one notification per event even
+// when it set several kinds of watches on the path.
+func (s *Server) fire(events []event) {
+	for _, e := range events {
+		notified := make(map[*serverConn]bool)
+		for _, kind := range watchKinds[e.typ] {
+			for c := range s.watches[kind][e.path] {
+				if !notified[c] {
+					notified[c] = true
+					s.notify(c, e)
+				}
+			}
+			delete(s.watches[kind], e.path)
+		}
+	}
+}
+
+func (s *Server) notify(c *serverConn, e event) {
+	s.write(c, &proto.ResponseHeader{Xid: -1, Zxid: -1}, &proto.WatcherEvent{Type: e.typ, State: syncConnected, Path: e.path})
+}
+
+// respond answers a request. The body is only sent when the request succeeded.
+func (s *Server) respond(c *serverConn, xid int32, code zk.ErrCode, body ...interface{}) bool {
+	parts := []interface{}{&proto.ResponseHeader{Xid: xid, Zxid: s.tree.zxid, Err: code}}
+	if code == errOk {
+		parts = append(parts, body...)
+	}
+	return s.write(c, parts...)
+}
+
+// write sends the parts as one frame, growing the connection's buffer as needed. A client that can't be
+// written to is disconnected.
+func (s *Server) write(c *serverConn, parts ...interface{}) bool {
+	for {
+		n, err := encode(c.buf[4:], parts)
+		if err == zk.ErrShortBuffer {
+			c.buf = make([]byte, 2*len(c.buf))
+			continue
+		}
+		if err != nil {
+			panic(fmt.Sprintf("zktest: failed to encode %T: %v", parts, err))
+		}
+		binary.BigEndian.PutUint32(c.buf, uint32(n))
+		c.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := c.Write(c.buf[:4+n]); err != nil {
+			c.Close()
+			return false
+		}
+		return true
+	}
+}
+
+func encode(buf []byte, parts []interface{}) (int, error) {
+	total := 0
+	for _, p := range parts {
+		n, err := zk.EncodePacket(buf[total:], p)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,221 @@
+package zktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type quietLogger struct{}
+
+func (quietLogger) Printf(string, ...interface{}) {}
+
+func newTestServer(t *testing.T) *Server {
+	s, err := NewServer()
+	require.NoError(t, err)
+	return s
+}
+
+func connect(t *testing.T, s *Server) (*zk.Conn, <-chan zk.Event) {
+	conn, events, err := zk.Connect([]string{s.Addr}, 5*time.Second, zk.WithLogger(quietLogger{}))
+	require.NoError(t, err)
+	for e := range events {
+		if e.State == zk.StateHasSession {
+			return conn, events
+		}
+	}
+	t.Fatal("session never established")
+	return nil, nil
+}
+
+func waitEvent(t *testing.T, ch <-chan zk.Event) zk.Event {
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a watch event")
+	}
+	return zk.Event{}
+}
+
+func TestServerCRUD(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	conn, _ := connect(t, s)
+	defer conn.Close()
+	acl := zk.WorldACL(zk.PermAll)
+
+	p, err := conn.Create("/a", []byte("one"), 0, acl)
+	require.NoError(t, err)
+	assert.Equal(t, "/a", p)
+	_, err = conn.Create("/a", nil, 0, acl)
+	assert.Equal(t, zk.ErrNodeExists, err)
+	_, err = conn.Create("/missing/child", nil, 0, acl)
+	assert.Equal(t, zk.ErrNoNode, err)
+
+	data, stat, err := conn.Get("/a")
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(data))
+	assert.Equal(t, int32(0), stat.Version)
+	assert.Equal(t, int32(3), stat.DataLength)
+
+	stat, err = conn.Set("/a", []byte("two"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), stat.Version)
+	_, err = conn.Set("/a", []byte("three"), 0)
+	assert.Equal(t, zk.ErrBadVersion, err)
+
+	_, err = conn.Create("/a/b", nil, 0, acl)
+	require.NoError(t, err)
+	_, err = conn.Create("/a/c", nil, 0, acl)
+	require.NoError(t, err)
+	children, stat, err := conn.Children("/a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, children)
+	assert.Equal(t, int32(2), stat.NumChildren)
+
+	assert.Equal(t, zk.ErrNotEmpty, conn.Delete("/a", -1))
+	require.NoError(t, conn.Delete("/a/b", -1))
+	ok, _, err := conn.Exists("/a/b")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	gotACL, _, err := conn.GetACL("/a")
+	require.NoError(t, err)
+	assert.Equal(t, acl, gotACL)
+	_, err = conn.Sync("/a")
+	assert.NoError(t, err)
+
+	data, ok = s.Get("/a")
+	assert.True(t, ok)
+	assert.Equal(t, "two", string(data))
+	children, ok = s.Children("/")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a", "zookeeper"}, children)
+}
+
+func TestServerSequential(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	conn, _ := connect(t, s)
+	defer conn.Close()
+	acl := zk.WorldACL(zk.PermAll)
+
+	_, err := conn.Create("/q", nil, 0, acl)
+	require.NoError(t, err)
+	first, err := conn.Create("/q/item-", nil, zk.FlagSequence, acl)
+	require.NoError(t, err)
+	second, err := conn.Create("/q/item-", nil, zk.FlagSequence, acl)
+	require.NoError(t, err)
+	assert.Equal(t, "/q/item-0000000000", first)
+	assert.Equal(t, "/q/item-0000000001", second)
+}
+
+func TestServerWatches(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	conn, _ := connect(t, s)
+	defer conn.Close()
+	other, _ := connect(t, s)
+	defer other.Close()
+	acl := zk.WorldACL(zk.PermAll)
+
+	ok, _, created, err := conn.ExistsW("/w")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	_, children, err := childrenW(conn, "/")
+	require.NoError(t, err)
+	_, err = other.Create("/w", nil, 0, acl)
+	require.NoError(t, err)
+	assert.Equal(t, zk.EventNodeCreated, waitEvent(t, created).Type)
+	assert.Equal(t, zk.EventNodeChildrenChanged, waitEvent(t, children).Type)
+
+	_, _, changed, err := conn.GetW("/w")
+	require.NoError(t, err)
+	_, err = other.Set("/w", []byte("x"), -1)
+	require.NoError(t, err)
+	e := waitEvent(t, changed)
+	assert.Equal(t, zk.EventNodeDataChanged, e.Type)
+	assert.Equal(t, "/w", e.Path)
+
+	_, _, deleted, err := conn.GetW("/w")
+	require.NoError(t, err)
+	require.NoError(t, other.Delete("/w", -1))
+	assert.Equal(t, zk.EventNodeDeleted, waitEvent(t, deleted).Type)
+}
+
+func childrenW(conn *zk.Conn, path string) ([]string, <-chan zk.Event, error) {
+	children, _, ch, err := conn.ChildrenW(path)
+	return children, ch, err
+}
+
+func TestServerMulti(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	conn, _ := connect(t, s)
+	defer conn.Close()
+	acl := zk.WorldACL(zk.PermAll)
+
+	res, err := conn.Multi(
+		&zk.CreateRequest{Path: "/m", Data: []byte("a"), Acl: acl},
+		&zk.SetDataRequest{Path: "/m", Data: []byte("b"), Version: 0},
+		&zk.CheckVersionRequest{Path: "/m", Version: 1},
+	)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	assert.Equal(t, "/m", res[0].String)
+	assert.Equal(t, int32(1), res[1].Stat.Version)
+	data, _ := s.Get("/m")
+	assert.Equal(t, "b", string(data))
+
+	// The failed check rolls back the create before it. The header is ok, the errors are in the results.
+	res, err = conn.Multi(
+		&zk.CreateRequest{Path: "/m/child", Acl: acl},
+		&zk.CheckVersionRequest{Path: "/m", Version: 7},
+		&zk.DeleteRequest{Path: "/m", Version: -1},
+	)
+	assert.Equal(t, zk.ErrBadVersion, err, "the client fails with the first failed operation")
+	require.Len(t, res, 3)
+	assert.NoError(t, res[0].Error)
+	assert.Equal(t, zk.ErrBadVersion, res[1].Error)
+	assert.Error(t, res[2].Error, "the operations after the failed one")
+	_, ok := s.Get("/m/child")
+	assert.False(t, ok)
+	_, ok = s.Get("/m")
+	assert.True(t, ok)
+}
+
+func TestServerEphemerals(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	acl := zk.WorldACL(zk.PermAll)
+
+	conn, _ := connect(t, s)
+	_, err := conn.Create("/e", nil, zk.FlagEphemeral, acl)
+	require.NoError(t, err)
+	_, err = conn.Create("/e/child", nil, 0, acl)
+	assert.Equal(t, zk.ErrNoChildrenForEphemerals, err)
+	conn.Close()
+	_, ok := s.Get("/e")
+	assert.False(t, ok, "closing the session deletes its ephemerals")
+
+	conn, events := connect(t, s)
+	defer conn.Close()
+	_, err = conn.Create("/e", nil, zk.FlagEphemeral, acl)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{conn.SessionID()}, s.Sessions())
+	assert.True(t, s.ExpireSession(conn.SessionID()))
+	assert.False(t, s.ExpireSession(conn.SessionID()))
+	_, ok = s.Get("/e")
+	assert.False(t, ok, "expiring the session deletes its ephemerals")
+
+	for e := range events {
+		if e.State == zk.StateExpired {
+			return
+		}
+	}
+	t.Fatal("client never saw its session expire")
+}
@@ -0,0 +1,232 @@
+package zktest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jeffbean/go-zookeeper/zk"
+)
+
+// Error codes the server answers with. The zk package keeps its own unexported.
+const (
+	errOk                      zk.ErrCode = 0
+	errRuntimeInconsistency    zk.ErrCode = -2
+	errUnimplemented           zk.ErrCode = -6
+	errBadArguments            zk.ErrCode = -8
+	errNoNode                  zk.ErrCode = -101
+	errBadVersion              zk.ErrCode = -103
+	errNoChildrenForEphemerals zk.ErrCode = -108
+	errNodeExists              zk.ErrCode = -110
+	errNotEmpty                zk.ErrCode = -111
+)
+
+type znode struct {
+	data     []byte
+	acl      []zk.ACL
+	stat     zk.Stat
+	children map[string]bool
+}
+
+// event is a change watches are notified of.
+type event struct {
+	typ  zk.EventType
+	path string
+}
+
+// tree is the znode tree. Every change takes the next zxid.
+type tree struct {
+	nodes map[string]*znode
+	zxid  int64
+}
+
+func newTree() *tree {
+	t := &tree{nodes: map[string]*znode{
+		"/": {children: map[string]bool{"zookeeper": true}, stat: zk.Stat{NumChildren: 1}},
+		// Real servers always have /zookeeper, clients and filters expect it
+		"/zookeeper": {children: map[string]bool{}},
+	}}
+	return t
+}
+
+// clone copies the tree so a failed multi can be rolled back.
+func (t *tree) clone() *tree {
+	c := &tree{nodes: make(map[string]*znode, len(t.nodes)), zxid: t.zxid}
+	for p, n := range t.nodes {
+		copied := *n
+		copied.children = make(map[string]bool, len(n.children))
+		for child := range n.children {
+			copied.children[child] = true
+		}
+		c.nodes[p] = &copied
+	}
+	return c
+}
+
+// validPath accepts absolute paths without empty components or a trailing slash.
+func validPath(p string) bool {
+	if p == "/" {
+		return true
+	}
+	if !strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") {
+		return false
+	}
+	for _, part := range strings.Split(p[1:], "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func splitPath(p string) (parent, name string) {
+	i := strings.LastIndex(p, "/")
+	if i == 0 {
+		return "/", p[1:]
+	}
+	return p[:i], p[i+1:]
+}
+
+func (t *tree) stat(p string) (zk.Stat, bool) {
+	n, ok := t.nodes[p]
+	if !ok {
+		return zk.Stat{}, false
+	}
+	return n.currentStat(), true
+}
+
+func (n *znode) currentStat() zk.Stat {
+	s := n.stat
+	s.DataLength = int32(len(n.data))
+	s.NumChildren = int32(len(n.children))
+	return s
+}
+
+func (t *tree) children(p string) ([]string, bool) {
+	n, ok := t.nodes[p]
+	if !ok {
+		return nil, false
+	}
+	children := make([]string, 0, len(n.children))
+	for child := range n.children {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+	return children, true
+}
+
+func (t *tree) create(p string, data []byte, acl []zk.ACL, flags int32, owner, now int64) (string, []event, zk.ErrCode) {
+	if !validPath(p) || p == "/" {
+		return "", nil, errBadArguments
+	}
+	parentPath, name := splitPath(p)
+	parent, ok := t.nodes[parentPath]
+	if !ok {
+		return "", nil, errNoNode
+	}
+	if parent.stat.EphemeralOwner != 0 {
+		return "", nil, errNoChildrenForEphemerals
+	}
+	if flags&zk.FlagSequence != 0 {
+		// Like ZooKeeper the sequence number is the number of changes to the parent's children
+		name = fmt.Sprintf("%v%010d", name, parent.stat.Cversion)
+		p = strings.TrimSuffix(parentPath, "/") + "/" + name
+	}
+	if _, ok := t.nodes[p]; ok {
+		return "", nil, errNodeExists
+	}
+
+	t.zxid++
+	n := &znode{
+		data:     data,
+		acl:      acl,
+		children: map[string]bool{},
+		stat:     zk.Stat{Czxid: t.zxid, Mzxid: t.zxid, Pzxid: t.zxid, Ctime: now, Mtime: now},
+	}
+	if flags&zk.FlagEphemeral != 0 {
+		n.stat.EphemeralOwner = owner
+	}
+	t.nodes[p] = n
+	parent.children[name] = true
+	parent.stat.Cversion++
+	parent.stat.Pzxid = t.zxid
+	return p, []event{{zk.EventNodeCreated, p}, {zk.EventNodeChildrenChanged, parentPath}}, errOk
+}
+
+func (t *tree) delete(p string, version int32) ([]event, zk.ErrCode) {
+	if !validPath(p) || p == "/" {
+		return nil, errBadArguments
+	}
+	n, ok := t.nodes[p]
+	if !ok {
+		return nil, errNoNode
+	}
+	if version != -1 && version != n.stat.Version {
+		return nil, errBadVersion
+	}
+	if len(n.children) > 0 {
+		return nil, errNotEmpty
+	}
+
+	t.zxid++
+	parentPath, name := splitPath(p)
+	parent := t.nodes[parentPath]
+	delete(parent.children, name)
+	parent.stat.Cversion++
+	parent.stat.Pzxid = t.zxid
+	delete(t.nodes, p)
+	return []event{{zk.EventNodeDeleted, p}, {zk.EventNodeChildrenChanged, parentPath}}, errOk
+}
+
+func (t *tree) setData(p string, data []byte, version int32, now int64) (zk.Stat, []event, zk.ErrCode) {
+	n, ok := t.nodes[p]
+	if !ok {
+		return zk.Stat{}, nil, errNoNode
+	}
+	if version != -1 && version != n.stat.Version {
+		return zk.Stat{}, nil, errBadVersion
+	}
+	t.zxid++
+	n.data = data
+	n.stat.Version++
+	n.stat.Mzxid = t.zxid
+	n.stat.Mtime = now
+	return n.currentStat(), []event{{zk.EventNodeDataChanged, p}}, errOk
+}
+
+func (t *tree) setACL(p string, acl []zk.ACL, version int32) (zk.Stat, zk.ErrCode) {
+	n, ok := t.nodes[p]
+	if !ok {
+		return zk.Stat{}, errNoNode
+	}
+	if version != -1 && version != n.stat.Aversion {
+		return zk.Stat{}, errBadVersion
+	}
+	t.zxid++
+	n.acl = acl
+	n.stat.Aversion++
+	return n.currentStat(), errOk
+}
+
+func (t *tree) check(p string, version int32) zk.ErrCode {
+	n, ok := t.nodes[p]
+	if !ok {
+		return errNoNode
+	}
+	if version != -1 && version != n.stat.Version {
+		return errBadVersion
+	}
+	return errOk
+}
+
+// ephemerals returns the nodes the session owns.
+func (t *tree) ephemerals(session int64) []string {
+	var paths []string
+	for p, n := range t.nodes {
+		if n.stat.EphemeralOwner == session {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
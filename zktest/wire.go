@@ -0,0 +1,82 @@
+package zktest
+
+import "github.com/jeffbean/go-zookeeper/zk"
+
+// The request and response bodies of the client protocol. The zk package keeps most of its own unexported.
+
+type pathRequest struct {
+	Path string
+}
+
+type pathWatchRequest struct {
+	Path  string
+	Watch bool
+}
+
+type pathVersionRequest struct {
+	Path    string
+	Version int32
+}
+
+type createRequest struct {
+	Path  string
+	Data  []byte
+	Acl   []zk.ACL
+	Flags int32
+}
+
+type setDataRequest struct {
+	Path    string
+	Data    []byte
+	Version int32
+}
+
+type setACLRequest struct {
+	Path    string
+	Acl     []zk.ACL
+	Version int32
+}
+
+type setWatchesRequest struct {
+	RelativeZxid int64
+	DataWatches  []string
+	ExistWatches []string
+	ChildWatches []string
+}
+
+type pathResponse struct {
+	Path string
+}
+
+type statResponse struct {
+	Stat zk.Stat
+}
+
+type getDataResponse struct {
+	Data []byte
+	Stat zk.Stat
+}
+
+type getChildrenResponse struct {
+	Children []string
+}
+
+type getChildren2Response struct {
+	Children []string
+	Stat     zk.Stat
+}
+
+type getACLResponse struct {
+	Acl  []zk.ACL
+	Stat zk.Stat
+}
+
+type multiHeader struct {
+	Type int32
+	Done bool
+	Err  zk.ErrCode
+}
+
+type errorResponse struct {
+	Err zk.ErrCode
+}
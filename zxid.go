@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// zxidRolloverWarning is the counter past which the epoch is about to roll over. A leader can't hand out
+// another zxid once the 32 bit counter is exhausted, and the ensemble is unavailable while it elects a new one.
+const zxidRolloverWarning = 0xf0000000
+
+// zxids follows the transactions of the captured servers.
+var zxids = newZxidTracker()
+
+// zxidTracker keeps the highest zxid each server answered with. A zxid is the epoch of the leader that
+// committed the transaction in its high 32 bits and a counter in the low 32 bits. Servers are kept apart by
+// address, the zxids of different ensembles can't be compared. It has a lock of its own so the workers
+// don't hold stateMu for it.
+type zxidTracker struct {
+	mu      sync.Mutex
+	servers map[string]*serverZxid
+}
+
+// serverZxid is the highest zxid of a server.
+type serverZxid struct {
+	highest int64
+	// warned is set once the counter of the current epoch passed zxidRolloverWarning
+	warned bool
+}
+
+func newZxidTracker() *zxidTracker {
+	return &zxidTracker{servers: make(map[string]*serverZxid)}
+}
+
+// epochEvent is a new leader epoch seen by a server as sent to event stream subscribers.
+type epochEvent struct {
+	Time          time.Time `json:"time"`
+	Server        string    `json:"server"`
+	Zxid          string    `json:"zxid"`
+	Epoch         uint32    `json:"epoch"`
+	PreviousEpoch uint32    `json:"previous_epoch"`
+}
+
+func zxidEpoch(zxid int64) uint32 {
+	return uint32(uint64(zxid) >> 32)
+}
+
+func zxidCounter(zxid int64) uint32 {
+	return uint32(zxid)
+}
+
+func zxidString(zxid int64) string {
+	return "0x" + strconv.FormatUint(uint64(zxid), 16)
+}
+
+// observe records the zxid of an answer of the server. A server answers with the last transaction it
+// applied, answers of other connections handled after a newer one don't move it back. The transactions
+// between two zxids of an epoch are counted; the ones before the first zxid seen, or skipped by an epoch
+// change, can't be known.
+func (z *zxidTracker) observe(server string, zxid int64, at time.Time) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	s, ok := z.servers[server]
+	if !ok {
+		s = &serverZxid{}
+		z.servers[server] = s
+	}
+	if zxid <= s.highest {
+		return
+	}
+	previous := s.highest
+	s.highest = zxid
+	epoch, counter := zxidEpoch(zxid), zxidCounter(zxid)
+	zxidEpochGauge.WithLabelValues(server).Set(float64(epoch))
+	zxidCounterGauge.WithLabelValues(server).Set(float64(counter))
+
+	switch {
+	case previous == 0:
+	case zxidEpoch(previous) != epoch:
+		epochChangeCounter.WithLabelValues(server).Inc()
+		transactionCounter.WithLabelValues(server).Add(float64(counter))
+		s.warned = false
+		logger.Warn("new leader epoch", zap.String("server", server), zap.Uint32("epoch", epoch),
+			zap.Uint32("previous_epoch", zxidEpoch(previous)), zap.String("zxid", zxidString(zxid)))
+		events.publishEpoch(epochEvent{Time: at, Server: server, Zxid: zxidString(zxid), Epoch: epoch,
+			PreviousEpoch: zxidEpoch(previous)})
+	default:
+		transactionCounter.WithLabelValues(server).Add(float64(zxid - previous))
+	}
+
+	if counter >= zxidRolloverWarning && !s.warned {
+		s.warned = true
+		logger.Warn("zxid counter is close to rolling over, the ensemble will elect a new leader when it does",
+			zap.String("server", server), zap.Uint32("epoch", epoch), zap.String("zxid", zxidString(zxid)),
+			zap.Uint32("transactions_left", ^uint32(0)-counter))
+	}
+}
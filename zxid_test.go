@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, g.Write(m))
+	return m.GetGauge().GetValue()
+}
+
+func TestZxidTracker(t *testing.T) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	defer func(s *eventStream) { events = s }(events)
+	events = newEventStream()
+	sub := events.subscribe(nil)
+	start := time.Unix(1500000000, 0)
+
+	const leader, follower = "10.0.0.100:2181", "10.0.0.101:2181"
+	z := newZxidTracker()
+	transactions := counterValue(t, transactionCounter.WithLabelValues(leader))
+	changes := counterValue(t, epochChangeCounter.WithLabelValues(leader))
+	z.observe(leader, -1, start)
+	z.observe(leader, 0x100000010, start)
+	assert.Equal(t, transactions, counterValue(t, transactionCounter.WithLabelValues(leader)), "the first zxid has nothing to count from")
+	z.observe(leader, 0x100000018, start)
+	z.observe(leader, 0x100000012, start)
+	assert.Equal(t, transactions+8, counterValue(t, transactionCounter.WithLabelValues(leader)), "an older answer doesn't count")
+	assert.Equal(t, 1.0, gaugeValue(t, zxidEpochGauge.WithLabelValues(leader)))
+	assert.Equal(t, float64(0x18), gaugeValue(t, zxidCounterGauge.WithLabelValues(leader)))
+	assert.Empty(t, sub.epochs)
+
+	// A follower lagging behind, or a server of another ensemble, is followed on its own
+	z.observe(follower, 0x100000012, start)
+	assert.Equal(t, float64(0x12), gaugeValue(t, zxidCounterGauge.WithLabelValues(follower)))
+	assert.Equal(t, float64(0x18), gaugeValue(t, zxidCounterGauge.WithLabelValues(leader)))
+
+	z.observe(leader, 0x200000003, start.Add(time.Second))
+	assert.Equal(t, transactions+11, counterValue(t, transactionCounter.WithLabelValues(leader)))
+	assert.Equal(t, changes+1, counterValue(t, epochChangeCounter.WithLabelValues(leader)))
+	assert.Equal(t, 2.0, gaugeValue(t, zxidEpochGauge.WithLabelValues(leader)))
+	assert.Equal(t, 1.0, gaugeValue(t, zxidEpochGauge.WithLabelValues(follower)))
+	require.Len(t, sub.epochs, 1)
+	assert.Equal(t, epochEvent{Time: start.Add(time.Second), Server: leader, Zxid: "0x200000003", Epoch: 2, PreviousEpoch: 1}, <-sub.epochs)
+	assert.Empty(t, sub.events)
+
+	assert.False(t, z.servers[leader].warned)
+	z.observe(leader, 0x2f0000000, start)
+	assert.True(t, z.servers[leader].warned, "close to rolling over")
+	z.observe(leader, 0x300000000, start)
+	assert.False(t, z.servers[leader].warned, "a new epoch starts a new counter")
+}